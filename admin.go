@@ -23,7 +23,7 @@ func (nbrew *Notebrew) admin(w http.ResponseWriter, r *http.Request) {
 		nbrew.static(w, r, urlPath)
 		return
 	}
-	if head == "login" || head == "logout" || head == "reset-password" {
+	if head == "login" || head == "logout" || head == "reset-password" || head == "invite" {
 		if tail != "" {
 			notFound(w, r)
 			return
@@ -35,6 +35,8 @@ func (nbrew *Notebrew) admin(w http.ResponseWriter, r *http.Request) {
 			nbrew.logout(w, r)
 		case "reset-password":
 			nbrew.resetPassword(w, r)
+		case "invite":
+			nbrew.acceptInvite(w, r)
 		}
 		return
 	}
@@ -59,7 +61,7 @@ func (nbrew *Notebrew) admin(w http.ResponseWriter, r *http.Request) {
 				" FROM authentication" +
 				" JOIN users ON users.user_id = authentication.user_id" +
 				" LEFT JOIN (" +
-				"SELECT site_user.user_id" +
+				"SELECT site_user.user_id, site_user.role" +
 				" FROM site_user" +
 				" JOIN site ON site.site_id = site_user.site_id" +
 				" WHERE site.site_name = {siteName}" +
@@ -71,13 +73,44 @@ func (nbrew *Notebrew) admin(w http.ResponseWriter, r *http.Request) {
 				sq.BytesParam("authenticationTokenHash", authenticationTokenHash),
 			},
 		}, func(row *sq.Row) (result struct {
-			Username     string
-			IsAuthorized bool
+			Username       string
+			IsAuthorized   bool
+			Role           string
+			LastActiveTime sql.NullTime
 		}) {
 			result.Username = row.String("users.username")
 			result.IsAuthorized = row.Bool("authorized_users.user_id IS NOT NULL")
+			result.Role = row.String("COALESCE(authorized_users.role, '')")
+			result.LastActiveTime = row.NullTime("authentication.last_active_time")
 			return result
 		})
+		// An expired login session is deleted and treated as if it never
+		// existed.
+		if err == nil {
+			if nbrew.isSessionExpired(authenticationTokenHash, result.LastActiveTime) {
+				err = nbrew.revokeSession(r.Context(), authenticationTokenHash)
+				if err == nil {
+					err = sql.ErrNoRows
+				}
+			} else {
+				err = nbrew.touchSession(r, authenticationTokenHash, result.LastActiveTime)
+			}
+		}
+		// If no rows, the token may be an API token instead.
+		isAPIToken := false
+		if errors.Is(err, sql.ErrNoRows) {
+			var apiTokenAuthentication apiTokenAuthentication
+			apiTokenAuthentication, err = nbrew.authenticateAPIToken(r.Context(), authenticationTokenHash, strings.TrimPrefix(sitePrefix, "@"))
+			if err == nil {
+				isAPIToken = true
+				result.Username = apiTokenAuthentication.Username
+				result.IsAuthorized = apiTokenAuthentication.IsAuthorized && apiTokenAuthentication.InScope
+				result.Role = apiTokenAuthentication.Role
+				if apiTokenAuthentication.ReadOnly {
+					result.Role = roleViewer
+				}
+			}
+		}
 		// If no rows, user is not authenticated.
 		// If row but site is null, user is not authorized
 		if err != nil {
@@ -90,20 +123,63 @@ func (nbrew *Notebrew) admin(w http.ResponseWriter, r *http.Request) {
 			internalServerError(w, r, err)
 			return
 		}
-		if !result.IsAuthorized {
-			forbidden(w, r)
-			return
-		}
 		username = result.Username
 		r = r.WithContext(context.WithValue(r.Context(), loggerKey, logger.With(
 			slog.String("username", username),
 		)))
+		// The API tokens and sessions pages belong to the user rather than to
+		// a site. API tokens cannot be used to mint more API tokens or to
+		// manage login sessions.
+		if sitePrefix == "" && (head == "api-tokens" || head == "sessions") {
+			if isAPIToken {
+				forbidden(w, r)
+				return
+			}
+			if tail != "" {
+				notFound(w, r)
+				return
+			}
+			if head == "api-tokens" {
+				nbrew.apiTokens(w, r, username)
+			} else {
+				nbrew.sessions(w, r, username)
+			}
+			return
+		}
+		if !result.IsAuthorized {
+			forbidden(w, r)
+			return
+		}
+		// Permissions are checked here once for every page instead of in
+		// each handler.
+		ok, err := nbrew.authorize(r, username, sitePrefix, result.Role, urlPath)
+		if err != nil {
+			logger.Error(err.Error())
+			internalServerError(w, r, err)
+			return
+		}
+		if !ok {
+			forbidden(w, r)
+			return
+		}
 	}
 
 	if head == "" || head == "notes" || head == "pages" || head == "posts" || head == "site" {
 		nbrew.filesystem(w, r, username, sitePrefix, urlPath)
 		return
 	}
+	if head == "tags" {
+		nbrew.tags(w, r, username, sitePrefix, tail)
+		return
+	}
+	if head == "history" {
+		nbrew.history(w, r, username, sitePrefix, tail)
+		return
+	}
+	if head == "preview" {
+		nbrew.preview(w, r, username, sitePrefix, tail)
+		return
+	}
 	if tail != "" {
 		notFound(w, r)
 		return
@@ -116,27 +192,39 @@ func (nbrew *Notebrew) admin(w http.ResponseWriter, r *http.Request) {
 	case "create-note":
 		nbrew.createNote(w, r, username, sitePrefix)
 	case "create-note-category":
-		nbrew.createNoteCategory(w, r)
+		nbrew.createCategory(w, r, username, sitePrefix, "notes")
 	case "create-post":
-		nbrew.createPost(w, r)
+		nbrew.createPost(w, r, username, sitePrefix)
 	case "create-post-category":
-		nbrew.createNoteCategory(w, r)
+		nbrew.createCategory(w, r, username, sitePrefix, "posts")
 	case "create-file":
 		nbrew.createFile(w, r)
 	case "create-folder":
 		nbrew.createFolder(w, r)
+	case "upload":
+		nbrew.upload(w, r, username, sitePrefix)
 	case "cut":
-		nbrew.cpy(w, r)
+		nbrew.cpy(w, r, username, sitePrefix, true)
 	case "copy":
-		nbrew.cpy(w, r)
+		nbrew.cpy(w, r, username, sitePrefix, false)
 	case "paste":
-		nbrew.cpy(w, r)
+		nbrew.paste(w, r, username, sitePrefix)
+	case "clear":
+		nbrew.clearClipboard(w, r, sitePrefix)
+	case "fileconflict":
+		nbrew.fileConflict(w, r, username, sitePrefix)
 	case "rename":
 		nbrew.rename(w, r)
+	case "move":
+		nbrew.move(w, r)
 	case "delete":
 		nbrew.delet(w, r, username, sitePrefix)
 	case "recycle_bin":
-		nbrew.recycleBin(w, r)
+		nbrew.recycleBin(w, r, username, sitePrefix)
+	case "search":
+		nbrew.search(w, r, username, sitePrefix)
+	case "members":
+		nbrew.members(w, r, username, sitePrefix)
 	default:
 		notFound(w, r)
 	}
@@ -0,0 +1,606 @@
+package nb6
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bokwoon95/sq"
+	"golang.org/x/exp/slog"
+)
+
+// APIToken is a long-lived authentication token that scripts and CI jobs send
+// in the "Authorization: Notebrew <token>" header instead of logging in.
+type APIToken struct {
+	// Name identifies the token among the tokens of its user.
+	Name string `json:"name"`
+
+	// Username is the user that the token acts on behalf of.
+	Username string `json:"username"`
+
+	// SiteNames restricts the token to the given sites. A token without any
+	// sites can be used on every site its user is a member of.
+	SiteNames []string `json:"site_names,omitempty"`
+
+	// ReadOnly restricts the token to reading, as if its user were a viewer
+	// of every site.
+	ReadOnly bool `json:"read_only"`
+
+	CreationTime time.Time `json:"creation_time"`
+
+	// LastUsedTime is the zero time if the token was never used.
+	LastUsedTime time.Time `json:"last_used_time,omitempty"`
+
+	// ExpiryTime is the zero time if the token never expires.
+	ExpiryTime time.Time `json:"expiry_time,omitempty"`
+}
+
+// ErrAPITokenExists is returned by CreateAPIToken if the user already has a
+// token with the same name.
+var ErrAPITokenExists = errors.New("API token with the same name already exists")
+
+// CreateAPIToken creates an API token for apiToken.Username and returns it.
+// The token itself is not stored, only its hash, so it cannot be shown again.
+func (nbrew *Notebrew) CreateAPIToken(ctx context.Context, apiToken APIToken) (string, error) {
+	if nbrew.DB == nil {
+		return "", fmt.Errorf("API tokens need a database")
+	}
+	apiToken.Name = strings.TrimSpace(apiToken.Name)
+	if apiToken.Name == "" {
+		return "", fmt.Errorf("API token name cannot be blank")
+	}
+	token, apiTokenHash, err := newToken()
+	if err != nil {
+		return "", err
+	}
+	tx, err := nbrew.DB.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+	exists, err := sq.FetchExistsContext(ctx, tx, sq.CustomQuery{
+		Dialect: nbrew.Dialect,
+		Format: "SELECT 1" +
+			" FROM api_token" +
+			" JOIN users ON users.user_id = api_token.user_id" +
+			" WHERE users.username = {username}" +
+			" AND api_token.token_name = {name}",
+		Values: []any{
+			sq.StringParam("username", apiToken.Username),
+			sq.StringParam("name", apiToken.Name),
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	if exists {
+		return "", ErrAPITokenExists
+	}
+	result, err := sq.ExecContext(ctx, tx, sq.CustomQuery{
+		Dialect: nbrew.Dialect,
+		Format: "INSERT INTO api_token (api_token_hash, user_id, token_name, read_only, creation_time, expiry_time)" +
+			" SELECT {apiTokenHash}, user_id, {name}, {readOnly}, {creationTime}, {expiryTime}" +
+			" FROM users" +
+			" WHERE username = {username}",
+		Values: []any{
+			sq.BytesParam("apiTokenHash", apiTokenHash),
+			sq.StringParam("name", apiToken.Name),
+			sq.BoolParam("readOnly", apiToken.ReadOnly),
+			sq.TimeParam("creationTime", time.Now().UTC()),
+			sq.Param("expiryTime", sql.NullTime{Time: apiToken.ExpiryTime.UTC(), Valid: !apiToken.ExpiryTime.IsZero()}),
+			sq.StringParam("username", apiToken.Username),
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	if result.RowsAffected == 0 {
+		return "", fmt.Errorf("no such user %q", apiToken.Username)
+	}
+	seen := make(map[string]bool)
+	for _, siteName := range apiToken.SiteNames {
+		if seen[siteName] {
+			continue
+		}
+		seen[siteName] = true
+		_, err = sq.ExecContext(ctx, tx, sq.CustomQuery{
+			Dialect: nbrew.Dialect,
+			Format:  "INSERT INTO api_token_site (api_token_hash, site_name) VALUES ({apiTokenHash}, {siteName})",
+			Values: []any{
+				sq.BytesParam("apiTokenHash", apiTokenHash),
+				sq.StringParam("siteName", siteName),
+			},
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// GetAPITokens returns the API tokens of a user, ordered by name.
+func (nbrew *Notebrew) GetAPITokens(ctx context.Context, username string) ([]APIToken, error) {
+	if nbrew.DB == nil {
+		return nil, nil
+	}
+	type tokenSite struct {
+		Name     string
+		SiteName string
+	}
+	apiTokens, err := sq.FetchAllContext(ctx, nbrew.DB, sq.CustomQuery{
+		Dialect: nbrew.Dialect,
+		Format: "SELECT {*}" +
+			" FROM api_token" +
+			" JOIN users ON users.user_id = api_token.user_id" +
+			" WHERE users.username = {username}" +
+			" ORDER BY api_token.token_name",
+		Values: []any{
+			sq.StringParam("username", username),
+		},
+	}, func(row *sq.Row) APIToken {
+		apiToken := APIToken{
+			Name:         row.String("api_token.token_name"),
+			Username:     row.String("users.username"),
+			ReadOnly:     row.Bool("api_token.read_only"),
+			CreationTime: row.Time("api_token.creation_time"),
+		}
+		lastUsedTime := row.NullTime("api_token.last_used_time")
+		if lastUsedTime.Valid {
+			apiToken.LastUsedTime = lastUsedTime.Time
+		}
+		expiryTime := row.NullTime("api_token.expiry_time")
+		if expiryTime.Valid {
+			apiToken.ExpiryTime = expiryTime.Time
+		}
+		return apiToken
+	})
+	if err != nil {
+		return nil, err
+	}
+	tokenSites, err := sq.FetchAllContext(ctx, nbrew.DB, sq.CustomQuery{
+		Dialect: nbrew.Dialect,
+		Format: "SELECT {*}" +
+			" FROM api_token_site" +
+			" JOIN api_token ON api_token.api_token_hash = api_token_site.api_token_hash" +
+			" JOIN users ON users.user_id = api_token.user_id" +
+			" WHERE users.username = {username}" +
+			" ORDER BY api_token_site.site_name",
+		Values: []any{
+			sq.StringParam("username", username),
+		},
+	}, func(row *sq.Row) tokenSite {
+		return tokenSite{
+			Name:     row.String("api_token.token_name"),
+			SiteName: row.String("api_token_site.site_name"),
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, tokenSite := range tokenSites {
+		for i := range apiTokens {
+			if apiTokens[i].Name == tokenSite.Name {
+				apiTokens[i].SiteNames = append(apiTokens[i].SiteNames, tokenSite.SiteName)
+				break
+			}
+		}
+	}
+	return apiTokens, nil
+}
+
+// RevokeAPIToken deletes the API token of a user with the given name. It
+// returns sql.ErrNoRows if there is no such token.
+func (nbrew *Notebrew) RevokeAPIToken(ctx context.Context, username, name string) error {
+	if nbrew.DB == nil {
+		return sql.ErrNoRows
+	}
+	tx, err := nbrew.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = sq.ExecContext(ctx, tx, sq.CustomQuery{
+		Dialect: nbrew.Dialect,
+		Format: "DELETE FROM api_token_site WHERE EXISTS (SELECT 1" +
+			" FROM api_token" +
+			" JOIN users ON users.user_id = api_token.user_id" +
+			" WHERE api_token.api_token_hash = api_token_site.api_token_hash" +
+			" AND users.username = {username}" +
+			" AND api_token.token_name = {name}" +
+			")",
+		Values: []any{
+			sq.StringParam("username", username),
+			sq.StringParam("name", name),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	result, err := sq.ExecContext(ctx, tx, sq.CustomQuery{
+		Dialect: nbrew.Dialect,
+		Format: "DELETE FROM api_token" +
+			" WHERE user_id = (SELECT user_id FROM users WHERE username = {username})" +
+			" AND token_name = {name}",
+		Values: []any{
+			sq.StringParam("username", username),
+			sq.StringParam("name", name),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected == 0 {
+		return sql.ErrNoRows
+	}
+	return tx.Commit()
+}
+
+// apiTokenAuthentication is the result of authenticating a request with an
+// API token.
+type apiTokenAuthentication struct {
+	Username     string
+	IsAuthorized bool
+	Role         string
+	ReadOnly     bool
+	InScope      bool
+}
+
+// authenticateAPIToken looks up the API token with the given hash for a
+// request to the site. It returns sql.ErrNoRows if there is no such token or
+// if the token has expired. The last used time of the token is updated.
+func (nbrew *Notebrew) authenticateAPIToken(ctx context.Context, apiTokenHash []byte, siteName string) (apiTokenAuthentication, error) {
+	type tokenRow struct {
+		apiTokenAuthentication
+		ExpiryTime sql.NullTime
+	}
+	row, err := sq.FetchOneContext(ctx, nbrew.DB, sq.CustomQuery{
+		Dialect: nbrew.Dialect,
+		Format: "SELECT {*}" +
+			" FROM api_token" +
+			" JOIN users ON users.user_id = api_token.user_id" +
+			" LEFT JOIN (" +
+			"SELECT site_user.user_id, site_user.role" +
+			" FROM site_user" +
+			" JOIN site ON site.site_id = site_user.site_id" +
+			" WHERE site.site_name = {siteName}" +
+			") AS authorized_users ON authorized_users.user_id = users.user_id" +
+			" WHERE api_token.api_token_hash = {apiTokenHash}",
+		Values: []any{
+			sq.StringParam("siteName", siteName),
+			sq.BytesParam("apiTokenHash", apiTokenHash),
+		},
+	}, func(row *sq.Row) (result tokenRow) {
+		result.Username = row.String("users.username")
+		result.IsAuthorized = row.Bool("authorized_users.user_id IS NOT NULL")
+		result.Role = row.String("COALESCE(authorized_users.role, '')")
+		result.ReadOnly = row.Bool("api_token.read_only")
+		result.ExpiryTime = row.NullTime("api_token.expiry_time")
+		return result
+	})
+	if err != nil {
+		return apiTokenAuthentication{}, err
+	}
+	if row.ExpiryTime.Valid && time.Now().After(row.ExpiryTime.Time) {
+		return apiTokenAuthentication{}, sql.ErrNoRows
+	}
+	// A token without any sites is not restricted to any site.
+	row.InScope, err = sq.FetchExistsContext(ctx, nbrew.DB, sq.CustomQuery{
+		Dialect: nbrew.Dialect,
+		Format: "SELECT 1" +
+			" FROM api_token" +
+			" WHERE api_token.api_token_hash = {apiTokenHash}" +
+			" AND (NOT EXISTS (SELECT 1 FROM api_token_site WHERE api_token_site.api_token_hash = api_token.api_token_hash)" +
+			" OR EXISTS (SELECT 1 FROM api_token_site WHERE api_token_site.api_token_hash = api_token.api_token_hash AND api_token_site.site_name = {siteName}))",
+		Values: []any{
+			sq.BytesParam("apiTokenHash", apiTokenHash),
+			sq.StringParam("siteName", siteName),
+		},
+	})
+	if err != nil {
+		return apiTokenAuthentication{}, err
+	}
+	_, err = sq.ExecContext(ctx, nbrew.DB, sq.CustomQuery{
+		Dialect: nbrew.Dialect,
+		Format:  "UPDATE api_token SET last_used_time = {lastUsedTime} WHERE api_token_hash = {apiTokenHash}",
+		Values: []any{
+			sq.TimeParam("lastUsedTime", time.Now().UTC()),
+			sq.BytesParam("apiTokenHash", apiTokenHash),
+		},
+	})
+	if err != nil {
+		return apiTokenAuthentication{}, err
+	}
+	return row.apiTokenAuthentication, nil
+}
+
+// apiTokens lists the API tokens of the user and lets them create and revoke
+// them. API tokens cannot be used to manage API tokens.
+func (nbrew *Notebrew) apiTokens(w http.ResponseWriter, r *http.Request, username string) {
+	type Request struct {
+		Action        string   `json:"action,omitempty"`
+		Name          string   `json:"name,omitempty"`
+		SiteNames     []string `json:"site_names,omitempty"`
+		ReadOnly      bool     `json:"read_only,omitempty"`
+		ExpiresInDays int      `json:"expires_in_days,omitempty"`
+	}
+	type Response struct {
+		Action   string   `json:"action,omitempty"`
+		Name     string   `json:"name,omitempty"`
+		APIToken string   `json:"api_token,omitempty"`
+		Errors   []string `json:"errors,omitempty"`
+		Success  []string `json:"success,omitempty"`
+	}
+	type TemplateData struct {
+		APIToken  string     `json:"api_token,omitempty"`
+		APITokens []APIToken `json:"api_tokens"`
+		SiteNames []string   `json:"site_names"`
+		Alerts    url.Values `json:"alerts,omitempty"`
+	}
+
+	logger, ok := r.Context().Value(loggerKey).(*slog.Logger)
+	if !ok {
+		logger = slog.Default()
+	}
+
+	if nbrew.DB == nil {
+		notFound(w, r)
+		return
+	}
+
+	getSiteNames := func() ([]string, error) {
+		return sq.FetchAllContext(r.Context(), nbrew.DB, sq.CustomQuery{
+			Dialect: nbrew.Dialect,
+			Format: "SELECT {*}" +
+				" FROM site_user" +
+				" JOIN site ON site.site_id = site_user.site_id" +
+				" JOIN users ON users.user_id = site_user.user_id" +
+				" WHERE users.username = {username}" +
+				" ORDER BY site.site_name",
+			Values: []any{
+				sq.StringParam("username", username),
+			},
+		}, func(row *sq.Row) string {
+			return row.String("site.site_name")
+		})
+	}
+
+	// render writes the API tokens page. Besides GET, it is called directly
+	// by a successful create so that the new token is shown exactly once
+	// without ever being stored in the flash session.
+	render := func(w http.ResponseWriter, r *http.Request, templateData TemplateData) {
+		var err error
+		templateData.APITokens, err = nbrew.GetAPITokens(r.Context(), username)
+		if err != nil {
+			logger.Error(err.Error())
+			internalServerError(w, r, err)
+			return
+		}
+		templateData.SiteNames, err = getSiteNames()
+		if err != nil {
+			logger.Error(err.Error())
+			internalServerError(w, r, err)
+			return
+		}
+		if templateData.APIToken != "" {
+			w.Header().Set("Cache-Control", "no-store")
+		}
+
+		accept, _, _ := mime.ParseMediaType(r.Header.Get("Accept"))
+		if accept == "application/json" {
+			w.Header().Set("Content-Type", "application/json")
+			b, err := json.Marshal(&templateData)
+			if err != nil {
+				logger.Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+			w.Write(b)
+			return
+		}
+
+		funcMap := map[string]any{
+			"join":     strings.Join,
+			"safeHTML": func(s string) template.HTML { return template.HTML(s) },
+			"username": func() string { return username },
+		}
+		tmpl, err := template.New("api_tokens.html").Funcs(funcMap).ParseFS(rootFS, "api_tokens.html")
+		if err != nil {
+			logger.Error(err.Error())
+			internalServerError(w, r, err)
+			return
+		}
+		buf := bufPool.Get().(*bytes.Buffer)
+		buf.Reset()
+		defer bufPool.Put(buf)
+		err = tmpl.Execute(buf, &templateData)
+		if err != nil {
+			logger.Error(err.Error())
+			internalServerError(w, r, err)
+			return
+		}
+		w.Header().Add("Content-Security-Policy", defaultContentSecurityPolicy)
+		buf.WriteTo(w)
+	}
+
+	switch r.Method {
+	case "GET":
+		var templateData TemplateData
+		_, err := nbrew.getSession(r, "flash", &templateData)
+		if err != nil {
+			logger.Error(err.Error())
+		}
+		nbrew.clearSession(w, r, "flash")
+		render(w, r, templateData)
+	case "POST":
+		writeResponse := func(w http.ResponseWriter, r *http.Request, response Response) {
+			accept, _, _ := mime.ParseMediaType(r.Header.Get("Accept"))
+			if accept == "application/json" {
+				w.Header().Set("Content-Type", "application/json")
+				if response.APIToken != "" {
+					w.Header().Set("Cache-Control", "no-store")
+				}
+				b, err := json.Marshal(&response)
+				if err != nil {
+					logger.Error(err.Error())
+					internalServerError(w, r, err)
+					return
+				}
+				w.Write(b)
+				return
+			}
+			alerts := make(url.Values)
+			for _, msg := range response.Success {
+				alerts.Add("success", msg)
+			}
+			for _, errmsg := range response.Errors {
+				alerts.Add("danger", template.HTMLEscapeString(errmsg))
+			}
+			if response.APIToken != "" {
+				// The token is rendered straight into the response instead of
+				// going through the flash session, so that it is never
+				// stored anywhere in plaintext.
+				render(w, r, TemplateData{
+					APIToken: response.APIToken,
+					Alerts:   alerts,
+				})
+				return
+			}
+			err := nbrew.setSession(w, r, "flash", map[string]any{
+				"alerts": alerts,
+			})
+			if err != nil {
+				logger.Error(err.Error())
+			}
+			http.Redirect(w, r, nbrew.Scheme+nbrew.AdminDomain+"/admin/api-tokens/", http.StatusFound)
+		}
+
+		var request Request
+		contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		switch contentType {
+		case "application/json":
+			err := json.NewDecoder(r.Body).Decode(&request)
+			if err != nil {
+				var syntaxErr *json.SyntaxError
+				if errors.As(err, &syntaxErr) {
+					http.Error(w, "400 Bad Request: invalid JSON", http.StatusBadRequest)
+					return
+				}
+				logger.Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+		case "application/x-www-form-urlencoded":
+			err := r.ParseForm()
+			if err != nil {
+				http.Error(w, fmt.Sprintf("400 Bad Request: %s", err), http.StatusBadRequest)
+				return
+			}
+			request.Action = r.Form.Get("action")
+			request.Name = r.Form.Get("name")
+			request.SiteNames = r.Form["site_name"]
+			request.ReadOnly, _ = strconv.ParseBool(r.Form.Get("read_only"))
+			if s := r.Form.Get("expires_in_days"); s != "" {
+				request.ExpiresInDays, err = strconv.Atoi(s)
+				if err != nil {
+					http.Error(w, fmt.Sprintf("400 Bad Request: expires_in_days: %s", err), http.StatusBadRequest)
+					return
+				}
+			}
+		default:
+			http.Error(w, "415 Unsupported Media Type", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		response := Response{
+			Action: request.Action,
+			Name:   strings.TrimSpace(request.Name),
+		}
+		switch response.Action {
+		case "create":
+			if response.Name == "" {
+				response.Errors = append(response.Errors, "name cannot be blank")
+				writeResponse(w, r, response)
+				return
+			}
+			if request.ExpiresInDays < 0 {
+				response.Errors = append(response.Errors, "expires_in_days cannot be negative")
+				writeResponse(w, r, response)
+				return
+			}
+			siteNames, err := getSiteNames()
+			if err != nil {
+				logger.Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+			isMember := make(map[string]bool)
+			for _, siteName := range siteNames {
+				isMember[siteName] = true
+			}
+			for _, siteName := range request.SiteNames {
+				if !isMember[strings.TrimPrefix(siteName, "@")] {
+					response.Errors = append(response.Errors, fmt.Sprintf("you are not a member of %s", siteName))
+				}
+			}
+			if len(response.Errors) > 0 {
+				writeResponse(w, r, response)
+				return
+			}
+			apiToken := APIToken{
+				Name:     response.Name,
+				Username: username,
+				ReadOnly: request.ReadOnly,
+			}
+			for _, siteName := range request.SiteNames {
+				apiToken.SiteNames = append(apiToken.SiteNames, strings.TrimPrefix(siteName, "@"))
+			}
+			if request.ExpiresInDays > 0 {
+				apiToken.ExpiryTime = time.Now().Add(time.Duration(request.ExpiresInDays) * 24 * time.Hour)
+			}
+			response.APIToken, err = nbrew.CreateAPIToken(r.Context(), apiToken)
+			if err != nil {
+				if errors.Is(err, ErrAPITokenExists) {
+					response.Errors = append(response.Errors, fmt.Sprintf("you already have an API token called %s", response.Name))
+					writeResponse(w, r, response)
+					return
+				}
+				logger.Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+			response.Success = append(response.Success, fmt.Sprintf("Created API token %s", template.HTMLEscapeString(response.Name)))
+		case "revoke":
+			err := nbrew.RevokeAPIToken(r.Context(), username, response.Name)
+			if err != nil {
+				if errors.Is(err, sql.ErrNoRows) {
+					response.Errors = append(response.Errors, fmt.Sprintf("no such API token %s", response.Name))
+					writeResponse(w, r, response)
+					return
+				}
+				logger.Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+			response.Success = append(response.Success, fmt.Sprintf("Revoked API token %s", template.HTMLEscapeString(response.Name)))
+		default:
+			response.Errors = append(response.Errors, fmt.Sprintf("invalid action %q (must be create or revoke)", response.Action))
+		}
+		writeResponse(w, r, response)
+	default:
+		http.Error(w, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,69 @@
+package nb6
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/bokwoon95/sq"
+)
+
+func TestCreateAPITokenShownOnce(t *testing.T) {
+	nbrew := &Notebrew{Scheme: "http://", AdminDomain: "localhost"}
+	newTestDatabase(t, nbrew)
+	addTestMember(t, nbrew, "alice", "alice", roleOwner)
+
+	r := httptest.NewRequest("POST", "/admin/api-tokens/", strings.NewReader(url.Values{
+		"action": {"create"},
+		"name":   {"ci"},
+	}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	nbrew.apiTokens(w, r, "alice")
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusOK)
+	}
+	apiTokens, err := nbrew.GetAPITokens(r.Context(), "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(apiTokens) != 1 || apiTokens[0].Name != "ci" {
+		t.Fatalf("got API tokens %v, want one token called ci", apiTokens)
+	}
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == "flash" {
+			t.Errorf("the API token was created with a flash cookie")
+		}
+	}
+	sessionCount, err := sq.FetchOne(nbrew.DB, sq.CustomQuery{
+		Dialect: nbrew.Dialect,
+		Format:  "SELECT {*} FROM session",
+	}, func(row *sq.Row) int {
+		return row.Int("COUNT(*)")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sessionCount != 0 {
+		t.Errorf("got %d sessions, want 0", sessionCount)
+	}
+
+	// The token in the page must be the one that authenticates.
+	body := w.Body.String()
+	_, after, ok := strings.Cut(body, "<code class=\"db mv2 break-all\">")
+	if !ok {
+		t.Fatalf("token not found in response:\n%s", body)
+	}
+	token, _, _ := strings.Cut(after, "</code>")
+	r = httptest.NewRequest("GET", "/admin/", nil)
+	r.Header.Set("Authorization", "Notebrew "+token)
+	authentication, err := nbrew.authenticateAPIToken(r.Context(), getAuthenticationTokenHash(r), "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if authentication.Username != "alice" {
+		t.Errorf("got username %q, want %q", authentication.Username, "alice")
+	}
+}
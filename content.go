@@ -1,16 +1,371 @@
 package nb6
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"html/template"
+	"io"
+	"io/fs"
 	"net/http"
+	"path"
+	"sort"
 	"strings"
+	"time"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/parser"
+	"golang.org/x/exp/slog"
+)
+
+// goldmarkMarkdown converts the markdown of posts into HTML.
+var goldmarkMarkdown = goldmark.New(
+	goldmark.WithParserOptions(parser.WithAttribute()),
+	goldmark.WithExtensions(extension.Table),
 )
 
+// siteFuncMap returns the funcMap made available to every page and post
+// template of a site.
+func (nbrew *Notebrew) siteFuncMap(sitePrefix string) map[string]any {
+	siteURL := nbrew.contentSiteURL(sitePrefix)
+	return map[string]any{
+		"join":       path.Join,
+		"base":       path.Base,
+		"ext":        path.Ext,
+		"dir":        path.Dir,
+		"hasPrefix":  strings.HasPrefix,
+		"hasSuffix":  strings.HasSuffix,
+		"trimPrefix": strings.TrimPrefix,
+		"trimSuffix": strings.TrimSuffix,
+		"lower":      strings.ToLower,
+		"upper":      strings.ToUpper,
+		"safeHTML":   func(s string) template.HTML { return template.HTML(s) },
+		"siteURL":    func() string { return siteURL },
+		"srcset": func(name string) (string, error) {
+			return nbrew.imageSrcset(sitePrefix, name)
+		},
+	}
+}
+
+// contentSiteURL returns the URL of the content site for a sitePrefix (always
+// ending in a slash).
+func (nbrew *Notebrew) contentSiteURL(sitePrefix string) string {
+	if strings.Contains(sitePrefix, ".") {
+		return "https://" + sitePrefix + "/"
+	}
+	if sitePrefix != "" {
+		if nbrew.MultisiteMode == "subdomain" {
+			return nbrew.Scheme + strings.TrimPrefix(sitePrefix, "@") + "." + nbrew.ContentDomain + "/"
+		}
+		if nbrew.MultisiteMode == "subdirectory" {
+			return nbrew.Scheme + nbrew.ContentDomain + "/" + sitePrefix + "/"
+		}
+	}
+	return nbrew.Scheme + nbrew.ContentDomain + "/"
+}
+
+// Post represents a post as seen by the post.html and posts.html templates.
+type Post struct {
+	Category    string        `json:"category,omitempty"`
+	Name        string        `json:"name,omitempty"`
+	Title       string        `json:"title,omitempty"`
+	Preview     string        `json:"preview,omitempty"`
+	URL         string        `json:"url,omitempty"`
+	PublishDate time.Time     `json:"publish_date,omitempty"`
+	Draft       bool          `json:"draft,omitempty"`
+	Tags        []string      `json:"tags,omitempty"`
+	ModTime     time.Time     `json:"mod_time,omitempty"`
+	Content     template.HTML `json:"content,omitempty"`
+}
+
+// isPublished reports whether the post is shown on the site at time now.
+// Drafts never are, and scheduled posts (posts with a publish date in the
+// future) are not until their publish date.
+func (post *Post) isPublished(now time.Time) bool {
+	return !post.Draft && !post.PublishDate.After(now)
+}
+
+// content serves the content site of a sitePrefix. Pages and posts are
+// generated ahead of time into the site folder (see generate), so the content
+// domain only ever serves static files.
 func (nbrew *Notebrew) content(w http.ResponseWriter, r *http.Request, sitePrefix, resourcePath string) {
-	prefix, _, _ := strings.Cut(resourcePath, "/")
-	switch prefix {
-	case "admin":
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	head, _, _ := strings.Cut(resourcePath, "/")
+	if head == "admin" {
 		notFound(w, r)
 		return
 	}
-	w.Write([]byte(sitePrefix + ": " + resourcePath))
+	// Anything without a file extension is a folder containing a generated
+	// index.html.
+	name := resourcePath
+	if path.Ext(name) == "" {
+		name = path.Join(name, "index.html")
+	}
+	nbrew.serveSiteFile(w, r, sitePrefix, name)
+}
+
+// serveSiteFile serves a file from the site folder of the given sitePrefix. If
+// an HTML file does not exist, its gzipped variant (generated when
+// CompressGeneratedHTML is set) is served instead.
+func (nbrew *Notebrew) serveSiteFile(w http.ResponseWriter, r *http.Request, sitePrefix, name string) {
+	logger, ok := r.Context().Value(loggerKey).(*slog.Logger)
+	if !ok {
+		logger = slog.Default()
+	}
+	filePath := path.Join(sitePrefix, "site", name)
+	file, err := nbrew.FS.Open(filePath)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			logger.Error(err.Error())
+			internalServerError(w, r, err)
+			return
+		}
+		if path.Ext(name) != ".html" {
+			nbrew.notFound(w, r, sitePrefix)
+			return
+		}
+		// Try again with .gz.
+		filePath += ".gz"
+		file, err = nbrew.FS.Open(filePath)
+		if err != nil {
+			if !errors.Is(err, fs.ErrNotExist) {
+				logger.Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+			nbrew.notFound(w, r, sitePrefix)
+			return
+		}
+	}
+	defer file.Close()
+	fileInfo, err := file.Stat()
+	if err != nil {
+		logger.Error(err.Error())
+		internalServerError(w, r, err)
+		return
+	}
+	if fileInfo.IsDir() {
+		nbrew.notFound(w, r, sitePrefix)
+		return
+	}
+
+	// Uploaded files are served from the content domain, which is also the
+	// admin domain unless a separate ContentDomain is configured. Those that
+	// could run scripts are sandboxed so that they cannot act on behalf of
+	// whoever opens them.
+	if head, _, _ := strings.Cut(name, "/"); (head == "images" || head == "themes") && isActiveUpload(name) {
+		w.Header().Set("Content-Security-Policy", "sandbox")
+	}
+	var reader io.Reader = file
+	if strings.HasSuffix(filePath, ".gz") {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Vary", "Accept-Encoding")
+		if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			w.Header().Set("Content-Encoding", "gzip")
+		} else {
+			gzipReader, err := gzip.NewReader(file)
+			if err != nil {
+				logger.Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+			defer gzipReader.Close()
+			reader = gzipReader
+		}
+	}
+	if fileSeeker, ok := reader.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, name, fileInfo.ModTime(), fileSeeker)
+		return
+	}
+	buf := bufPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer bufPool.Put(buf)
+	_, err = buf.ReadFrom(reader)
+	if err != nil {
+		logger.Error(err.Error())
+		internalServerError(w, r, err)
+		return
+	}
+	http.ServeContent(w, r, name, fileInfo.ModTime(), bytes.NewReader(buf.Bytes()))
+}
+
+// themeTemplate parses the named template from the site's themes folder,
+// falling back to the built-in template of the same name if the site does not
+// define one.
+func (nbrew *Notebrew) themeTemplate(sitePrefix, name string) (*template.Template, error) {
+	themesDir := path.Join(sitePrefix, "site/themes")
+	text, err := readFile(nbrew.FS, path.Join(themesDir, name))
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		text, err = readFile(rootFS, name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	themesFS, err := fs.Sub(nbrew.FS, themesDir)
+	if err != nil {
+		return nil, err
+	}
+	return ParseTemplate(themesFS, nbrew.siteFuncMap(sitePrefix), text)
+}
+
+// renderPage renders the page identified by name (relative to the pages
+// folder) into w. Pages may invoke any HTML template defined in the site's
+// themes folder.
+func (nbrew *Notebrew) renderPage(w io.Writer, sitePrefix, name string) error {
+	text, err := readFile(nbrew.FS, path.Join(sitePrefix, "pages", name))
+	if err != nil {
+		return err
+	}
+	return nbrew.renderPageText(w, sitePrefix, text)
+}
+
+// renderPageText renders the text of a page into w.
+func (nbrew *Notebrew) renderPageText(w io.Writer, sitePrefix, text string) error {
+	themesFS, err := fs.Sub(nbrew.FS, path.Join(sitePrefix, "site/themes"))
+	if err != nil {
+		return err
+	}
+	tmpl, err := ParseTemplate(themesFS, nbrew.siteFuncMap(sitePrefix), text)
+	if err != nil {
+		return err
+	}
+	return tmpl.Execute(w, nil)
+}
+
+// getPost returns the post identified by name (relative to the posts folder).
+// The title, publish date and preview of the post come from its front matter
+// if present. If the post does not specify a date, its modification time is
+// used.
+func (nbrew *Notebrew) getPost(ctx context.Context, sitePrefix, name string) (Post, error) {
+	file, err := nbrew.FS.Open(path.Join(sitePrefix, "posts", name))
+	if err != nil {
+		return Post{}, err
+	}
+	fileInfo, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return Post{}, err
+	}
+	var b bytes.Buffer
+	_, err = b.ReadFrom(file)
+	file.Close()
+	if err != nil {
+		return Post{}, err
+	}
+	return nbrew.parsePost(ctx, sitePrefix, name, b.Bytes(), fileInfo.ModTime())
+}
+
+// parsePost returns the post identified by name (relative to the posts
+// folder) given its contents and modification time.
+func (nbrew *Notebrew) parsePost(ctx context.Context, sitePrefix, name string, b []byte, modTime time.Time) (Post, error) {
+	logger, ok := ctx.Value(loggerKey).(*slog.Logger)
+	if !ok {
+		logger = slog.Default()
+	}
+	category, filename := path.Split(name)
+	post := Post{
+		Category: strings.Trim(category, "/"),
+		Name:     strings.TrimSuffix(filename, path.Ext(filename)),
+		ModTime:  modTime,
+	}
+	post.URL = nbrew.contentSiteURL(sitePrefix) + path.Join("posts", post.Category, post.Name) + "/"
+	// A malformed front matter should not take down the post list, feeds
+	// and tag pages with it, so we make do with whatever was parsed (a
+	// missing date falls back to the modification time below).
+	frontMatter, markdown, err := parseFrontMatter(b)
+	if err != nil {
+		logger.Warn(err.Error(), slog.String("name", path.Join(sitePrefix, "posts", name)))
+	}
+	post.PublishDate, post.Draft = frontMatter.Date, frontMatter.Draft
+	post.Tags = getTags(frontMatter, markdown)
+	if post.PublishDate.IsZero() {
+		post.PublishDate = post.ModTime
+	}
+	post.Title, post.Preview = getTitleAndPreview(io.NopCloser(bytes.NewReader(markdown)))
+	if frontMatter.Title != "" {
+		post.Title = frontMatter.Title
+	}
+	if frontMatter.Description != "" {
+		post.Preview = frontMatter.Description
+	}
+	var content strings.Builder
+	err = goldmarkMarkdown.Convert(markdown, &content)
+	if err != nil {
+		return Post{}, err
+	}
+	post.Content = template.HTML(content.String())
+	return post, nil
+}
+
+// renderPost renders a post into w using the site's post.html template.
+func (nbrew *Notebrew) renderPost(w io.Writer, sitePrefix string, post *Post) error {
+	tmpl, err := nbrew.themeTemplate(sitePrefix, "post.html")
+	if err != nil {
+		return err
+	}
+	return tmpl.Execute(w, post)
+}
+
+// getPosts returns the published posts in a category (an empty category
+// means the uncategorized posts in the root of the posts folder), newest
+// first. Drafts and scheduled posts are left out.
+func (nbrew *Notebrew) getPosts(ctx context.Context, sitePrefix, category string) ([]Post, error) {
+	dirEntries, err := nbrew.FS.ReadDir(path.Join(sitePrefix, "posts", category))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	posts := make([]Post, 0, len(dirEntries))
+	for _, dirEntry := range dirEntries {
+		if dirEntry.IsDir() || path.Ext(dirEntry.Name()) != ".md" {
+			continue
+		}
+		post, err := nbrew.getPost(ctx, sitePrefix, path.Join(category, dirEntry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		if !post.isPublished(now) {
+			continue
+		}
+		posts = append(posts, post)
+	}
+	sortPosts(posts)
+	return posts, nil
+}
+
+// sortPosts sorts posts newest first. Post names start with a timestamp, so
+// reverse lexicographical order breaks ties between posts with the same
+// publish date.
+func sortPosts(posts []Post) {
+	sort.SliceStable(posts, func(i, j int) bool {
+		if !posts[i].PublishDate.Equal(posts[j].PublishDate) {
+			return posts[i].PublishDate.After(posts[j].PublishDate)
+		}
+		return posts[i].Name > posts[j].Name
+	})
+}
+
+// renderPostList renders the list of posts in a category into w using the
+// site's posts.html template.
+func (nbrew *Notebrew) renderPostList(ctx context.Context, w io.Writer, sitePrefix, category string) error {
+	posts, err := nbrew.getPosts(ctx, sitePrefix, category)
+	if err != nil {
+		return err
+	}
+	tmpl, err := nbrew.themeTemplate(sitePrefix, "posts.html")
+	if err != nil {
+		return err
+	}
+	return tmpl.Execute(w, map[string]any{
+		"Category": category,
+		"Posts":    posts,
+	})
 }
@@ -0,0 +1,59 @@
+package nb6
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestServeSiteFileSandbox(t *testing.T) {
+	type TestTable struct {
+		description string
+		resource    string
+		wantCSP     string
+	}
+
+	tests := []TestTable{{
+		description: "svg image",
+		resource:    "images/a.svg",
+		wantCSP:     "sandbox",
+	}, {
+		description: "png image",
+		resource:    "images/a.png",
+		wantCSP:     "",
+	}, {
+		description: "theme template",
+		resource:    "themes/post.html",
+		wantCSP:     "sandbox",
+	}, {
+		description: "theme script",
+		resource:    "themes/a.js",
+		wantCSP:     "sandbox",
+	}, {
+		description: "generated page",
+		resource:    "about",
+		wantCSP:     "",
+	}}
+
+	nbrew, _ := newTestLocalNotebrew(t, map[string]string{
+		"root/site/images/a.svg":     `<svg xmlns="http://www.w3.org/2000/svg"><script>alert(1)</script></svg>`,
+		"root/site/images/a.png":     "\x89PNG\r\n\x1a\n",
+		"root/site/themes/post.html": "<script>alert(1)</script>",
+		"root/site/themes/a.js":      "alert(1)",
+		"root/site/about/index.html": "<p>about</p>",
+	})
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.description, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/"+tt.resource, nil)
+			w := httptest.NewRecorder()
+			nbrew.content(w, r, "", tt.resource)
+			if w.Code != http.StatusOK {
+				t.Fatalf("got status %d, want %d", w.Code, http.StatusOK)
+			}
+			if got := w.Header().Get("Content-Security-Policy"); got != tt.wantCSP {
+				t.Errorf("got Content-Security-Policy %q, want %q", got, tt.wantCSP)
+			}
+		})
+	}
+}
@@ -1,13 +1,636 @@
 package nb6
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
 	"io"
 	"io/fs"
+	"mime"
 	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"golang.org/x/exp/slog"
 )
 
-func (nbrew *Notebrew) cpy(w http.ResponseWriter, r *http.Request) {
+// clipboard holds the items that were cut or copied, waiting to be pasted. It
+// is stored with setSession under the "clipboard" name, so that the client
+// cannot tamper with it.
+type clipboard struct {
+	Cut        bool     `json:"cut,omitempty"`
+	SitePrefix string   `json:"site_prefix,omitempty"`
+	Folder     string   `json:"folder,omitempty"`
+	Names      []string `json:"names,omitempty"`
+}
+
+// getClipboard returns the clipboard of the current session. The clipboard is
+// validated again when read back, so ok is false if any of its folder or names
+// are invalid.
+func (nbrew *Notebrew) getClipboard(r *http.Request) (clip clipboard, ok bool, err error) {
+	ok, err = nbrew.getSession(r, "clipboard", &clip)
+	if err != nil || !ok {
+		return clipboard{}, false, err
+	}
+	if clip.SitePrefix != "" && !strings.HasPrefix(clip.SitePrefix, "@") && !strings.Contains(clip.SitePrefix, ".") {
+		return clipboard{}, false, nil
+	}
+	if strings.Contains(clip.SitePrefix, "/") || !isPasteableFolder(clip.Folder) || len(clip.Names) == 0 {
+		return clipboard{}, false, nil
+	}
+	for _, name := range clip.Names {
+		if !isValidClipboardName(name) {
+			return clipboard{}, false, nil
+		}
+	}
+	return clip, true, nil
+}
+
+// isValidClipboardName reports whether name can be cut, copied or pasted. It
+// has to be a single path element that passes validateName, which also rules
+// out "." and "..".
+func isValidClipboardName(name string) bool {
+	return name != "" && name != "." && name != ".." && len(validateName(name)) == 0
+}
+
+// isPasteableFolder reports whether items can be cut or copied from, or pasted
+// into, a folder.
+func isPasteableFolder(folder string) bool {
+	if folder == "" || path.Clean(folder) != folder {
+		return false
+	}
+	head, tail, _ := strings.Cut(folder, "/")
+	switch head {
+	case "notes", "pages", "posts":
+		return true
+	case "site":
+		next, _, _ := strings.Cut(tail, "/")
+		return next == "themes" || next == "images"
+	}
+	return false
+}
+
+// cpy handles both cut and copy: it puts the named items of a folder into the
+// clipboard.
+func (nbrew *Notebrew) cpy(w http.ResponseWriter, r *http.Request, username, sitePrefix string, isCut bool) {
+	type Request struct {
+		Folder string   `json:"folder,omitempty"`
+		Names  []string `json:"names,omitempty"`
+	}
+	type Response struct {
+		Cut    bool     `json:"cut,omitempty"`
+		Folder string   `json:"folder,omitempty"`
+		Names  []string `json:"names,omitempty"`
+		Errors []string `json:"errors,omitempty"`
+	}
+
+	logger, ok := r.Context().Value(loggerKey).(*slog.Logger)
+	if !ok {
+		logger = slog.Default()
+	}
+
+	if r.Method != "POST" {
+		http.Error(w, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeResponse := func(w http.ResponseWriter, r *http.Request, response Response) {
+		accept, _, _ := mime.ParseMediaType(r.Header.Get("Accept"))
+		if accept == "application/json" {
+			w.Header().Set("Content-Type", "application/json")
+			b, err := json.Marshal(&response)
+			if err != nil {
+				logger.Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+			w.Write(b)
+			return
+		}
+		alerts := make(url.Values)
+		for _, errmsg := range response.Errors {
+			alerts.Add("danger", template.HTMLEscapeString(errmsg))
+		}
+		if len(response.Names) > 0 {
+			msg := "1 item"
+			if len(response.Names) > 1 {
+				msg = fmt.Sprintf("%d items", len(response.Names))
+			}
+			if response.Cut {
+				msg += " cut"
+			} else {
+				msg += " copied"
+			}
+			alerts.Add("success", msg)
+		}
+		err := nbrew.setSession(w, r, "flash", map[string]any{
+			"alerts": alerts,
+		})
+		if err != nil {
+			logger.Error(err.Error())
+		}
+		http.Redirect(w, r, nbrew.Scheme+nbrew.AdminDomain+"/"+path.Join("admin", sitePrefix, response.Folder)+"/", http.StatusFound)
+	}
+
+	var request Request
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch contentType {
+	case "application/json":
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			var syntaxErr *json.SyntaxError
+			if errors.As(err, &syntaxErr) {
+				http.Error(w, "400 Bad Request: invalid JSON", http.StatusBadRequest)
+				return
+			}
+			logger.Error(err.Error())
+			internalServerError(w, r, err)
+			return
+		}
+	case "application/x-www-form-urlencoded":
+		err := r.ParseForm()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("400 Bad Request: %s", err), http.StatusBadRequest)
+			return
+		}
+		request.Folder = r.Form.Get("folder")
+		request.Names = r.Form["name"]
+	default:
+		http.Error(w, "415 Unsupported Media Type", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	response := Response{
+		Cut:    isCut,
+		Folder: strings.Trim(path.Clean(request.Folder), "/"),
+	}
+	if !isPasteableFolder(response.Folder) {
+		response.Errors = append(response.Errors, fmt.Sprintf("invalid folder %s", request.Folder))
+		writeResponse(w, r, response)
+		return
+	}
+	seen := make(map[string]bool)
+	for _, name := range request.Names {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		if !isValidClipboardName(name) {
+			response.Errors = append(response.Errors, fmt.Sprintf("invalid name %q", name))
+			continue
+		}
+		_, err := fs.Stat(nbrew.FS, path.Join(sitePrefix, response.Folder, name))
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			logger.Error(err.Error())
+			internalServerError(w, r, err)
+			return
+		}
+		response.Names = append(response.Names, name)
+	}
+	if len(response.Names) == 0 {
+		response.Errors = append(response.Errors, "no items selected")
+		writeResponse(w, r, response)
+		return
+	}
+	err := nbrew.setSession(w, r, "clipboard", &clipboard{
+		Cut:        isCut,
+		SitePrefix: sitePrefix,
+		Folder:     response.Folder,
+		Names:      response.Names,
+	})
+	if err != nil {
+		logger.Error(err.Error())
+		internalServerError(w, r, err)
+		return
+	}
+	writeResponse(w, r, response)
+}
+
+// clearClipboard empties the clipboard.
+func (nbrew *Notebrew) clearClipboard(w http.ResponseWriter, r *http.Request, sitePrefix string) {
+	if r.Method != "POST" {
+		http.Error(w, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	nbrew.clearSession(w, r, "clipboard")
+	accept, _, _ := mime.ParseMediaType(r.Header.Get("Accept"))
+	if accept == "application/json" {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("{}"))
+		return
+	}
+	redirectURL := r.Referer()
+	if redirectURL == "" {
+		redirectURL = "/" + path.Join("admin", sitePrefix) + "/"
+	}
+	http.Redirect(w, r, redirectURL, http.StatusFound)
+}
+
+// pasteConflicts returns the names in the clipboard that already exist in the
+// destination folder.
+func (nbrew *Notebrew) pasteConflicts(clip clipboard, sitePrefix, folder string) ([]string, error) {
+	var conflicts []string
+	for _, name := range clip.Names {
+		_, err := fs.Stat(nbrew.FS, path.Join(sitePrefix, folder, name))
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			return nil, err
+		}
+		conflicts = append(conflicts, name)
+	}
+	return conflicts, nil
+}
+
+// checkPasteDestination returns an error message if an item cannot be pasted
+// into folder, or an empty string if it can.
+func checkPasteDestination(folder, name string, isDir bool) string {
+	head, tail, _ := strings.Cut(folder, "/")
+	switch head {
+	case "notes", "posts":
+		if isDir {
+			if tail != "" {
+				return fmt.Sprintf("%s: cannot paste a folder into a %s category", name, strings.TrimSuffix(head, "s"))
+			}
+			return ""
+		}
+		if path.Ext(name) != ".md" {
+			return fmt.Sprintf("%s: only .md files can be pasted into %s", name, head)
+		}
+	case "pages":
+		if !isDir && path.Ext(name) != ".html" {
+			return fmt.Sprintf("%s: only .html files can be pasted into pages", name)
+		}
+	}
+	return ""
+}
+
+// nonConflictingName returns a variant of name (name-copy.ext,
+// name-copy-2.ext, etc) that does not exist in the folder.
+func (nbrew *Notebrew) nonConflictingName(folder, name string) (string, error) {
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 1; ; i++ {
+		newName := base + "-copy" + ext
+		if i > 1 {
+			newName = base + "-copy-" + strconv.Itoa(i) + ext
+		}
+		_, err := fs.Stat(nbrew.FS, path.Join(folder, newName))
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return newName, nil
+			}
+			return "", err
+		}
+	}
+}
+
+func (nbrew *Notebrew) paste(w http.ResponseWriter, r *http.Request, username, sitePrefix string) {
+	type Request struct {
+		Folder             string `json:"folder,omitempty"`
+		ConflictResolution string `json:"conflict_resolution,omitempty"`
+	}
+	type Response struct {
+		Folder             string   `json:"folder,omitempty"`
+		ConflictResolution string   `json:"conflict_resolution,omitempty"`
+		Conflicts          []string `json:"conflicts,omitempty"`
+		Pasted             []string `json:"pasted,omitempty"`
+		Errors             []string `json:"errors,omitempty"`
+	}
+
+	logger, ok := r.Context().Value(loggerKey).(*slog.Logger)
+	if !ok {
+		logger = slog.Default()
+	}
+
+	if r.Method != "POST" {
+		http.Error(w, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeResponse := func(w http.ResponseWriter, r *http.Request, response Response) {
+		accept, _, _ := mime.ParseMediaType(r.Header.Get("Accept"))
+		if accept == "application/json" {
+			w.Header().Set("Content-Type", "application/json")
+			if len(response.Conflicts) > 0 && response.ConflictResolution == "" {
+				w.WriteHeader(http.StatusConflict)
+			}
+			b, err := json.Marshal(&response)
+			if err != nil {
+				logger.Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+			w.Write(b)
+			return
+		}
+		if len(response.Conflicts) > 0 && response.ConflictResolution == "" {
+			http.Redirect(w, r, nbrew.Scheme+nbrew.AdminDomain+"/"+path.Join("admin", sitePrefix, "fileconflict")+"/?"+url.Values{"folder": []string{response.Folder}}.Encode(), http.StatusFound)
+			return
+		}
+		alerts := make(url.Values)
+		for _, errmsg := range response.Errors {
+			alerts.Add("danger", template.HTMLEscapeString(errmsg))
+		}
+		if len(response.Pasted) > 0 {
+			msg := "1 item pasted"
+			if len(response.Pasted) > 1 {
+				msg = fmt.Sprintf("%d items pasted", len(response.Pasted))
+			}
+			alerts.Add("success", msg)
+		}
+		err := nbrew.setSession(w, r, "flash", map[string]any{
+			"alerts": alerts,
+		})
+		if err != nil {
+			logger.Error(err.Error())
+		}
+		http.Redirect(w, r, nbrew.Scheme+nbrew.AdminDomain+"/"+path.Join("admin", sitePrefix, response.Folder)+"/", http.StatusFound)
+	}
+
+	var request Request
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch contentType {
+	case "application/json":
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			var syntaxErr *json.SyntaxError
+			if errors.As(err, &syntaxErr) {
+				http.Error(w, "400 Bad Request: invalid JSON", http.StatusBadRequest)
+				return
+			}
+			logger.Error(err.Error())
+			internalServerError(w, r, err)
+			return
+		}
+	case "application/x-www-form-urlencoded":
+		err := r.ParseForm()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("400 Bad Request: %s", err), http.StatusBadRequest)
+			return
+		}
+		request.Folder = r.Form.Get("folder")
+		request.ConflictResolution = r.Form.Get("conflict_resolution")
+	default:
+		http.Error(w, "415 Unsupported Media Type", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	response := Response{
+		Folder:             strings.Trim(path.Clean(request.Folder), "/"),
+		ConflictResolution: request.ConflictResolution,
+	}
+	switch response.ConflictResolution {
+	case "", "replace", "skip", "rename":
+		break
+	default:
+		response.Errors = append(response.Errors, fmt.Sprintf("invalid conflict resolution %q (must be replace, skip or rename)", response.ConflictResolution))
+		writeResponse(w, r, response)
+		return
+	}
+	if !isPasteableFolder(response.Folder) {
+		response.Errors = append(response.Errors, fmt.Sprintf("cannot paste into %s", request.Folder))
+		writeResponse(w, r, response)
+		return
+	}
+	fileInfo, err := fs.Stat(nbrew.FS, path.Join(sitePrefix, response.Folder))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		logger.Error(err.Error())
+		internalServerError(w, r, err)
+		return
+	}
+	if fileInfo == nil || !fileInfo.IsDir() {
+		response.Errors = append(response.Errors, fmt.Sprintf("folder %s does not exist", response.Folder))
+		writeResponse(w, r, response)
+		return
+	}
+
+	clip, ok, err := nbrew.getClipboard(r)
+	if err != nil {
+		logger.Error(err.Error())
+	}
+	if !ok {
+		response.Errors = append(response.Errors, "clipboard is empty")
+		writeResponse(w, r, response)
+		return
+	}
+	if clip.SitePrefix != sitePrefix && nbrew.DB != nil {
+		// Pasting from another site needs the same permissions there as
+		// taking the items out of it: any member may copy from a site, but
+		// only those who may cut from it may move its items away.
+		role, err := nbrew.getSiteRole(r.Context(), username, strings.TrimPrefix(clip.SitePrefix, "@"))
+		if err != nil {
+			logger.Error(err.Error())
+			internalServerError(w, r, err)
+			return
+		}
+		authorized := role != ""
+		if authorized && clip.Cut {
+			authorized, err = nbrew.authorize(r, username, clip.SitePrefix, role, "cut")
+			if err != nil {
+				logger.Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+		}
+		if !authorized {
+			response.Errors = append(response.Errors, "you are not authorized to take items from the site they were cut or copied from")
+			writeResponse(w, r, response)
+			return
+		}
+	}
+	if clip.Cut && clip.SitePrefix == sitePrefix && clip.Folder == response.Folder {
+		response.Errors = append(response.Errors, "cannot cut and paste into the same folder")
+		writeResponse(w, r, response)
+		return
+	}
+
+	response.Conflicts, err = nbrew.pasteConflicts(clip, sitePrefix, response.Folder)
+	if err != nil {
+		logger.Error(err.Error())
+		internalServerError(w, r, err)
+		return
+	}
+	if len(response.Conflicts) > 0 && response.ConflictResolution == "" {
+		writeResponse(w, r, response)
+		return
+	}
+	isConflict := make(map[string]bool)
+	for _, name := range response.Conflicts {
+		isConflict[name] = true
+	}
+	if response.ConflictResolution == "replace" {
+		// Like delete, the preconditions must hold for every item that would
+		// be replaced, otherwise nothing is pasted.
+		for _, name := range response.Conflicts {
+			ok, err := checkPreconditions(nbrew.FS, r, path.Join(sitePrefix, response.Folder, name))
+			if err != nil {
+				logger.Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+			if !ok {
+				http.Error(w, "412 Precondition Failed", http.StatusPreconditionFailed)
+				return
+			}
+		}
+	}
+
+	var srcNames, destNames []string
+	for _, name := range clip.Names {
+		srcPath := path.Join(clip.SitePrefix, clip.Folder, name)
+		fileInfo, err := fs.Stat(nbrew.FS, srcPath)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				response.Errors = append(response.Errors, fmt.Sprintf("%s: no longer exists", name))
+				continue
+			}
+			logger.Error(err.Error())
+			internalServerError(w, r, err)
+			return
+		}
+		if errmsg := checkPasteDestination(response.Folder, name, fileInfo.IsDir()); errmsg != "" {
+			response.Errors = append(response.Errors, errmsg)
+			continue
+		}
+		destName := name
+		if isConflict[name] {
+			switch response.ConflictResolution {
+			case "skip":
+				continue
+			case "replace":
+				if clip.SitePrefix == sitePrefix && clip.Folder == response.Folder {
+					// Replacing an item with itself is a no-op.
+					continue
+				}
+				// The replaced item goes into the recycle bin, so it can still
+				// be recovered.
+				_, err = nbrew.recycle(sitePrefix, path.Join(response.Folder, name))
+				if err != nil && !errors.Is(err, fs.ErrNotExist) {
+					logger.Error(err.Error())
+					response.Errors = append(response.Errors, fmt.Sprintf("%s: %v", name, err))
+					continue
+				}
+			case "rename":
+				destName, err = nbrew.nonConflictingName(path.Join(sitePrefix, response.Folder), name)
+				if err != nil {
+					logger.Error(err.Error())
+					internalServerError(w, r, err)
+					return
+				}
+			}
+		}
+		destPath := path.Join(sitePrefix, response.Folder, destName)
+		if fileInfo.IsDir() && strings.HasPrefix(destPath, srcPath+"/") {
+			response.Errors = append(response.Errors, fmt.Sprintf("%s: cannot paste a folder into itself", name))
+			continue
+		}
+		if clip.Cut {
+			err = nbrew.journaled(journalEntry{Op: "move", Src: srcPath, Dest: destPath}, func() error {
+				return move(nbrew.FS, srcPath, destPath)
+			})
+		} else if fileInfo.IsDir() {
+			err = nbrew.journaled(journalEntry{Op: "copy", Src: srcPath, Dest: destPath}, func() error {
+				return copyDir(r.Context(), nbrew.FS, srcPath, destPath)
+			})
+		} else {
+			err = copyFile(r.Context(), nbrew.FS, srcPath, destPath)
+		}
+		if err != nil {
+			logger.Error(err.Error())
+			response.Errors = append(response.Errors, fmt.Sprintf("%s: %v", name, err))
+			continue
+		}
+		response.Pasted = append(response.Pasted, destName)
+		srcNames = append(srcNames, path.Join(clip.Folder, name))
+		destNames = append(destNames, path.Join(response.Folder, destName))
+	}
+	if clip.Cut {
+		// Items that were cut can only be pasted once.
+		nbrew.clearSession(w, r, "clipboard")
+		err = nbrew.generate(r.Context(), clip.SitePrefix, srcNames...)
+		if err != nil {
+			logger.Error(err.Error())
+		}
+	}
+	err = nbrew.generate(r.Context(), sitePrefix, destNames...)
+	if err != nil {
+		logger.Error(err.Error())
+	}
+	writeResponse(w, r, response)
+}
+
+func (nbrew *Notebrew) fileConflict(w http.ResponseWriter, r *http.Request, username, sitePrefix string) {
+	type TemplateData struct {
+		Folder    string   `json:"folder,omitempty"`
+		Cut       bool     `json:"cut,omitempty"`
+		Conflicts []string `json:"conflicts,omitempty"`
+	}
+
+	logger, ok := r.Context().Value(loggerKey).(*slog.Logger)
+	if !ok {
+		logger = slog.Default()
+	}
+
+	if r.Method != "GET" {
+		http.Error(w, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("400 Bad Request: %s", err), http.StatusBadRequest)
+		return
+	}
+	var templateData TemplateData
+	templateData.Folder = strings.Trim(path.Clean(r.Form.Get("folder")), "/")
+	if isPasteableFolder(templateData.Folder) {
+		clip, ok, err := nbrew.getClipboard(r)
+		if err != nil {
+			logger.Error(err.Error())
+		}
+		if ok {
+			templateData.Cut = clip.Cut
+			templateData.Conflicts, err = nbrew.pasteConflicts(clip, sitePrefix, templateData.Folder)
+			if err != nil {
+				logger.Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+		}
+	}
+
+	funcMap := map[string]any{
+		"join":       path.Join,
+		"username":   func() string { return username },
+		"referer":    func() string { return r.Referer() },
+		"sitePrefix": func() string { return sitePrefix },
+	}
+	tmpl, err := template.New("fileconflict.html").Funcs(funcMap).ParseFS(rootFS, "fileconflict.html")
+	if err != nil {
+		logger.Error(err.Error())
+		internalServerError(w, r, err)
+		return
+	}
+	buf := bufPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer bufPool.Put(buf)
+	err = tmpl.Execute(buf, &templateData)
+	if err != nil {
+		logger.Error(err.Error())
+		internalServerError(w, r, err)
+		return
+	}
+	w.Header().Add("Content-Security-Policy", defaultContentSecurityPolicy)
+	buf.WriteTo(w)
 }
 
 // copyFile copies src to dst like the cp command.
@@ -19,6 +642,9 @@ func copyFile(ctx context.Context, fsys FS, srcName, destName string) error {
 	if destName == srcName {
 		return fs.ErrInvalid
 	}
+	if fsys, ok := fsys.(CopyFS); ok {
+		return fsys.Copy(srcName, destName)
+	}
 	srcFile, err := fsys.Open(srcName)
 	if err != nil {
 		return err
@@ -39,6 +665,28 @@ func copyFile(ctx context.Context, fsys FS, srcName, destName string) error {
 	return err
 }
 
+// copyDir copies the src directory to dest like the cp -r command. dest must
+// not exist.
+func copyDir(ctx context.Context, fsys FS, srcName, destName string) error {
+	if fsys, ok := fsys.(CopyFS); ok {
+		err := ctx.Err()
+		if err != nil {
+			return err
+		}
+		return fsys.Copy(srcName, destName)
+	}
+	return walkDir(fsys, srcName, func(name string, dirEntry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		destName := path.Join(destName, strings.TrimPrefix(name, srcName))
+		if dirEntry.IsDir() {
+			return fsys.Mkdir(destName, 0755)
+		}
+		return copyFile(ctx, fsys, name, destName)
+	})
+}
+
 type contextReader struct {
 	ctx context.Context
 	src io.Reader
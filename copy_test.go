@@ -0,0 +1,182 @@
+package nb6
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bokwoon95/nb6/internal/testutil"
+)
+
+// forgedClipboard returns a clipboard cookie the way a client without a
+// database-backed session would send it.
+func forgedClipboard(t *testing.T, clip clipboard) *http.Cookie {
+	t.Helper()
+	b, err := json.Marshal(&clip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &http.Cookie{Name: "clipboard", Value: base64.URLEncoding.EncodeToString(b)}
+}
+
+func TestCopyNameChecks(t *testing.T) {
+	type Response struct {
+		Names  []string `json:"names"`
+		Errors []string `json:"errors"`
+	}
+	nbrew, _ := newTestLocalNotebrew(t, map[string]string{
+		"outside/secret.md": "secret",
+		"root/notes/a.md":   "a",
+	})
+	names := []string{".", "..", "../../outside/secret.md", "a/b", "A.md", "a.md"}
+	r := httptest.NewRequest("POST", "/admin/copy/", strings.NewReader(url.Values{
+		"folder": {"notes"},
+		"name":   names,
+	}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("Accept", "application/json")
+	w := httptest.NewRecorder()
+	nbrew.cpy(w, r, "", "", false)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusOK)
+	}
+	var response Response
+	err := json.Unmarshal(w.Body.Bytes(), &response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := testutil.Diff(response.Names, []string{"a.md"}); diff != "" {
+		t.Error(testutil.Callers(), diff)
+	}
+	if len(response.Errors) != 5 {
+		t.Errorf("got errors %q, want 5 errors", response.Errors)
+	}
+
+	// The clipboard that was set only contains the valid name.
+	var cookies []*http.Cookie
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == "clipboard" {
+			cookies = append(cookies, cookie)
+		}
+	}
+	if len(cookies) != 1 {
+		t.Fatalf("got %d clipboard cookies, want 1", len(cookies))
+	}
+	r = httptest.NewRequest("GET", "/admin/notes/", nil)
+	r.AddCookie(cookies[0])
+	clip, ok, err := nbrew.getClipboard(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("clipboard is empty")
+	}
+	if diff := testutil.Diff(clip, clipboard{Folder: "notes", Names: []string{"a.md"}}); diff != "" {
+		t.Error(testutil.Callers(), diff)
+	}
+}
+
+func TestPastePathChecks(t *testing.T) {
+	type Response struct {
+		Pasted []string `json:"pasted"`
+		Errors []string `json:"errors"`
+	}
+	type TestTable struct {
+		description string
+		clip        clipboard
+	}
+
+	tests := []TestTable{{
+		description: "dot dot name",
+		clip:        clipboard{Cut: true, Folder: "notes", Names: []string{".."}},
+	}, {
+		description: "dot name",
+		clip:        clipboard{Cut: true, Folder: "notes", Names: []string{"."}},
+	}, {
+		description: "name with a slash",
+		clip:        clipboard{Folder: "notes", Names: []string{"../../outside/secret.md"}},
+	}, {
+		description: "folder outside the root",
+		clip:        clipboard{Folder: "../outside", Names: []string{"secret.md"}},
+	}, {
+		description: "folder outside the content folders",
+		clip:        clipboard{Folder: "system", Names: []string{"a.md"}},
+	}, {
+		description: "site prefix with a slash",
+		clip:        clipboard{SitePrefix: "@other/../..", Folder: "outside", Names: []string{"secret.md"}},
+	}, {
+		description: "invalid site prefix",
+		clip:        clipboard{SitePrefix: "outside", Folder: "notes", Names: []string{"secret.md"}},
+	}}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.description, func(t *testing.T) {
+			nbrew, tempDir := newTestLocalNotebrew(t, map[string]string{
+				"outside/secret.md":   "secret",
+				"root/notes/a.md":     "a",
+				"root/notes/dir/b.md": "b",
+			})
+			var response Response
+			code := postForm(t, func(w http.ResponseWriter, r *http.Request) {
+				nbrew.paste(w, r, "", "")
+			}, "/admin/paste/", url.Values{
+				"folder": {"posts"},
+			}, &response, forgedClipboard(t, tt.clip))
+			if code != http.StatusOK {
+				t.Fatalf("got status %d, want %d", code, http.StatusOK)
+			}
+			if diff := testutil.Diff(response.Errors, []string{"clipboard is empty"}); diff != "" {
+				t.Error(testutil.Callers(), diff)
+			}
+			for _, name := range []string{"outside/secret.md", "root/notes/a.md", "root/notes/dir/b.md"} {
+				_, err := os.Stat(filepath.Join(tempDir, name))
+				if err != nil {
+					t.Errorf("%s: %v", name, err)
+				}
+			}
+			entries, err := os.ReadDir(filepath.Join(tempDir, "root/posts"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) > 0 {
+				t.Errorf("posts is not empty: %v", entries)
+			}
+		})
+	}
+
+	t.Run("valid cut and paste", func(t *testing.T) {
+		nbrew, tempDir := newTestLocalNotebrew(t, map[string]string{
+			"root/notes/a.md": "a",
+		})
+		var response Response
+		code := postForm(t, func(w http.ResponseWriter, r *http.Request) {
+			nbrew.paste(w, r, "", "")
+		}, "/admin/paste/", url.Values{
+			"folder": {"posts"},
+		}, &response, forgedClipboard(t, clipboard{Cut: true, Folder: "notes", Names: []string{"a.md"}}))
+		if code != http.StatusOK {
+			t.Fatalf("got status %d, want %d", code, http.StatusOK)
+		}
+		if len(response.Errors) > 0 {
+			t.Fatal(response.Errors)
+		}
+		b, err := os.ReadFile(filepath.Join(tempDir, "root/posts/a.md"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != "a" {
+			t.Errorf("got %q, want %q", string(b), "a")
+		}
+		_, err = os.Stat(filepath.Join(tempDir, "root/notes/a.md"))
+		if err == nil {
+			t.Error("notes/a.md still exists")
+		}
+	})
+}
@@ -0,0 +1,190 @@
+package nb6
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+
+	"golang.org/x/exp/slog"
+)
+
+// createCategory creates a category inside a parent folder, which is either
+// "notes" or "posts". Categories cannot be nested.
+func (nbrew *Notebrew) createCategory(w http.ResponseWriter, r *http.Request, username, sitePrefix, parentFolder string) {
+	type Request struct {
+		Name string `json:"name,omitempty"`
+	}
+	type Response struct {
+		ParentFolder string     `json:"parent_folder,omitempty"`
+		Name         string     `json:"name,omitempty"`
+		Errors       url.Values `json:"errors,omitempty"`
+	}
+
+	logger, ok := r.Context().Value(loggerKey).(*slog.Logger)
+	if !ok {
+		logger = slog.Default()
+	}
+
+	switch r.Method {
+	case "GET":
+		var response Response
+		_, err := nbrew.getSession(r, "flash", &response)
+		if err != nil {
+			logger.Error(err.Error())
+		}
+		nbrew.clearSession(w, r, "flash")
+		response.ParentFolder = parentFolder
+
+		funcMap := map[string]any{
+			"join":       path.Join,
+			"username":   func() string { return username },
+			"referer":    func() string { return r.Referer() },
+			"sitePrefix": func() string { return sitePrefix },
+		}
+		tmpl, err := template.New("create_category.html").Funcs(funcMap).ParseFS(rootFS, "create_category.html")
+		if err != nil {
+			logger.Error(err.Error())
+			internalServerError(w, r, err)
+			return
+		}
+		buf := bufPool.Get().(*bytes.Buffer)
+		buf.Reset()
+		defer bufPool.Put(buf)
+		err = tmpl.Execute(buf, &response)
+		if err != nil {
+			logger.Error(err.Error())
+			internalServerError(w, r, err)
+			return
+		}
+		w.Header().Add("Content-Security-Policy", defaultContentSecurityPolicy)
+		buf.WriteTo(w)
+	case "POST":
+		writeResponse := func(w http.ResponseWriter, r *http.Request, response Response) {
+			accept, _, _ := mime.ParseMediaType(r.Header.Get("Accept"))
+			if accept == "application/json" {
+				w.Header().Set("Content-Type", "application/json")
+				b, err := json.Marshal(&response)
+				if err != nil {
+					logger.Error(err.Error())
+					internalServerError(w, r, err)
+					return
+				}
+				w.Write(b)
+				return
+			}
+			if len(response.Errors) > 0 {
+				err := nbrew.setSession(w, r, "flash", &response)
+				if err != nil {
+					logger.Error(err.Error())
+					internalServerError(w, r, err)
+					return
+				}
+				http.Redirect(w, r, r.URL.String(), http.StatusFound)
+				return
+			}
+			err := nbrew.setSession(w, r, "flash", map[string]any{
+				"alerts": url.Values{
+					"success": []string{
+						fmt.Sprintf("Category created: %s", template.HTMLEscapeString(response.Name)),
+					},
+				},
+			})
+			if err != nil {
+				logger.Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+			http.Redirect(w, r, nbrew.Scheme+nbrew.AdminDomain+"/"+path.Join("admin", sitePrefix, response.ParentFolder, response.Name)+"/", http.StatusFound)
+		}
+
+		var request Request
+		contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		switch contentType {
+		case "application/json":
+			err := json.NewDecoder(r.Body).Decode(&request)
+			if err != nil {
+				var syntaxErr *json.SyntaxError
+				if errors.As(err, &syntaxErr) {
+					http.Error(w, "400 Bad Request: invalid JSON", http.StatusBadRequest)
+					return
+				}
+				logger.Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+		case "application/x-www-form-urlencoded":
+			err := r.ParseForm()
+			if err != nil {
+				http.Error(w, fmt.Sprintf("400 Bad Request: %s", err), http.StatusBadRequest)
+				return
+			}
+			request.Name = r.Form.Get("name")
+		default:
+			http.Error(w, "415 Unsupported Media Type", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		response := Response{
+			ParentFolder: parentFolder,
+			Name:         request.Name,
+			Errors:       make(url.Values),
+		}
+		if response.Name == "" {
+			response.Errors.Add("name", "cannot be empty")
+		} else {
+			errmsgs := validateName(response.Name)
+			if len(errmsgs) > 0 {
+				response.Errors["name"] = append(response.Errors["name"], errmsgs...)
+			}
+		}
+		if len(response.Errors) > 0 {
+			writeResponse(w, r, response)
+			return
+		}
+
+		ok, err := checkPreconditions(nbrew.FS, r, path.Join(sitePrefix, response.ParentFolder, response.Name))
+		if err != nil {
+			logger.Error(err.Error())
+			internalServerError(w, r, err)
+			return
+		}
+		if !ok {
+			http.Error(w, "412 Precondition Failed", http.StatusPreconditionFailed)
+			return
+		}
+
+		_, err = fs.Stat(nbrew.FS, path.Join(sitePrefix, response.ParentFolder, response.Name))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			logger.Error(err.Error())
+			internalServerError(w, r, err)
+			return
+		}
+		if err == nil {
+			response.Errors.Add("name", "category already exists")
+			writeResponse(w, r, response)
+			return
+		}
+
+		err = nbrew.FS.Mkdir(path.Join(sitePrefix, response.ParentFolder, response.Name), 0755)
+		if err != nil {
+			logger.Error(err.Error())
+			internalServerError(w, r, err)
+			return
+		}
+		// Post categories get their own (initially empty) post list.
+		err = nbrew.generate(r.Context(), sitePrefix, path.Join(response.ParentFolder, response.Name))
+		if err != nil {
+			logger.Error(err.Error())
+		}
+		writeResponse(w, r, response)
+	default:
+		http.Error(w, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
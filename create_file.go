@@ -199,6 +199,17 @@ func (nbrew *Notebrew) createFile(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		ok, err := checkPreconditions(nbrew.FS, r, path.Join(sitePrefix, response.ParentFolder, response.Name))
+		if err != nil {
+			logger.Error(err.Error())
+			internalServerError(w, r, err)
+			return
+		}
+		if !ok {
+			http.Error(w, "412 Precondition Failed", http.StatusPreconditionFailed)
+			return
+		}
+
 		fileInfo, err := fs.Stat(nbrew.FS, path.Join(sitePrefix, response.ParentFolder, response.Name))
 		if err != nil && !errors.Is(err, fs.ErrNotExist) {
 			logger.Error(err.Error())
@@ -215,17 +226,15 @@ func (nbrew *Notebrew) createFile(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		readerFrom, err := nbrew.FS.OpenReaderFrom(path.Join(sitePrefix, response.ParentFolder, response.Name), 0644)
+		err = nbrew.writeFile(r.Context(), sitePrefix, path.Join(response.ParentFolder, response.Name), bytes.NewReader(nil))
 		if err != nil {
 			logger.Error(err.Error())
 			internalServerError(w, r, err)
 			return
 		}
-		_, err = readerFrom.ReadFrom(bytes.NewReader(nil))
+		err = nbrew.generate(r.Context(), sitePrefix, path.Join(response.ParentFolder, response.Name))
 		if err != nil {
 			logger.Error(err.Error())
-			internalServerError(w, r, err)
-			return
 		}
 		writeResponse(w, r, response)
 	default:
@@ -172,6 +172,17 @@ func (nbrew *Notebrew) createFolder(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		ok, err = checkPreconditions(nbrew.FS, r, path.Join(sitePrefix, response.ParentFolder, response.Name))
+		if err != nil {
+			logger.Error(err.Error())
+			internalServerError(w, r, err)
+			return
+		}
+		if !ok {
+			http.Error(w, "412 Precondition Failed", http.StatusPreconditionFailed)
+			return
+		}
+
 		fileInfo, err := fs.Stat(nbrew.FS, path.Join(sitePrefix, response.ParentFolder, response.Name))
 		if err != nil && !errors.Is(err, fs.ErrNotExist) {
 			logger.Error(err.Error())
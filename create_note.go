@@ -200,18 +200,33 @@ func (nbrew *Notebrew) createNote(w http.ResponseWriter, r *http.Request, userna
 			response.NoteID += "-" + response.Slug
 		}
 
-		readerFrom, err := nbrew.FS.OpenReaderFrom(path.Join(sitePrefix, "notes", response.Category, response.NoteID+".md"), 0644)
+		ok, err := checkPreconditions(nbrew.FS, r, path.Join(sitePrefix, "notes", response.Category, response.NoteID+".md"))
 		if err != nil {
 			logger.Error(err.Error())
 			internalServerError(w, r, err)
 			return
 		}
-		_, err = readerFrom.ReadFrom(strings.NewReader(response.Content))
+		if !ok {
+			http.Error(w, "412 Precondition Failed", http.StatusPreconditionFailed)
+			return
+		}
+
+		err = nbrew.writeFile(r.Context(), sitePrefix, path.Join("notes", response.Category, response.NoteID+".md"), strings.NewReader(response.Content))
 		if err != nil {
 			logger.Error(err.Error())
 			internalServerError(w, r, err)
 			return
 		}
+		err = nbrew.setFileAuthor(r.Context(), sitePrefix, path.Join("notes", response.Category, response.NoteID+".md"), username)
+		if err != nil {
+			logger.Error(err.Error())
+			internalServerError(w, r, err)
+			return
+		}
+		err = nbrew.generate(r.Context(), sitePrefix, path.Join("notes", response.Category, response.NoteID+".md"))
+		if err != nil {
+			logger.Error(err.Error())
+		}
 		writeResponse(w, r, response)
 	default:
 		http.Error(w, "405 Method Not Allowed", http.StatusMethodNotAllowed)
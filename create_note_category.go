@@ -1,6 +0,0 @@
-package nb6
-
-import "net/http"
-
-func (nbrew *Notebrew) createNoteCategory(w http.ResponseWriter, r *http.Request) {
-}
@@ -1,6 +1,275 @@
 package nb6
 
-import "net/http"
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
 
-func (nbrew *Notebrew) createPost(w http.ResponseWriter, r *http.Request) {
+	"golang.org/x/exp/slog"
+)
+
+func (nbrew *Notebrew) createPost(w http.ResponseWriter, r *http.Request, username, sitePrefix string) {
+	type Request struct {
+		Slug        string `json:"slug,omitempty"`
+		Category    string `json:"category,omitempty"`
+		Content     string `json:"content,omitempty"`
+		PublishDate string `json:"publish_date,omitempty"`
+		Draft       bool   `json:"draft,omitempty"`
+	}
+	type Response struct {
+		Slug        string     `json:"slug,omitempty"`
+		Category    string     `json:"category,omitempty"`
+		Content     string     `json:"content,omitempty"`
+		PublishDate string     `json:"publish_date,omitempty"`
+		Draft       bool       `json:"draft,omitempty"`
+		PostID      string     `json:"post_id,omitempty"`
+		Errors      url.Values `json:"errors,omitempty"`
+	}
+
+	logger, ok := r.Context().Value(loggerKey).(*slog.Logger)
+	if !ok {
+		logger = slog.Default()
+	}
+
+	switch r.Method {
+	case "GET":
+		err := r.ParseForm()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("400 Bad Request: %s", err), http.StatusBadRequest)
+			return
+		}
+
+		var response Response
+		ok, err := nbrew.getSession(r, "flash", &response)
+		if err != nil {
+			logger.Error(err.Error())
+		} else if !ok {
+			response.Category = r.Form.Get("category")
+		}
+		nbrew.clearSession(w, r, "flash")
+		if response.PublishDate == "" {
+			response.PublishDate = time.Now().UTC().Format("2006-01-02T15:04")
+		}
+
+		dirEntries, err := nbrew.FS.ReadDir(path.Join(sitePrefix, "posts"))
+		if err != nil {
+			logger.Error(err.Error())
+			internalServerError(w, r, err)
+			return
+		}
+		var categories []string
+		for _, dirEntry := range dirEntries {
+			if dirEntry.IsDir() {
+				categories = append(categories, dirEntry.Name())
+			}
+		}
+
+		funcMap := map[string]any{
+			"join":       path.Join,
+			"username":   func() string { return username },
+			"referer":    func() string { return r.Referer() },
+			"categories": func() []string { return categories },
+			"sitePrefix": func() string { return sitePrefix },
+		}
+		tmpl, err := template.New("create_post.html").Funcs(funcMap).ParseFS(rootFS, "create_post.html")
+		if err != nil {
+			logger.Error(err.Error())
+			internalServerError(w, r, err)
+			return
+		}
+		buf := bufPool.Get().(*bytes.Buffer)
+		buf.Reset()
+		defer bufPool.Put(buf)
+		err = tmpl.Execute(buf, &response)
+		if err != nil {
+			logger.Error(err.Error())
+			internalServerError(w, r, err)
+			return
+		}
+		w.Header().Add("Content-Security-Policy", defaultContentSecurityPolicy)
+		buf.WriteTo(w)
+	case "POST":
+		writeResponse := func(w http.ResponseWriter, r *http.Request, response Response) {
+			accept, _, _ := mime.ParseMediaType(r.Header.Get("Accept"))
+			if accept == "application/json" {
+				w.Header().Set("Content-Type", "application/json")
+				b, err := json.Marshal(&response)
+				if err != nil {
+					logger.Error(err.Error())
+					internalServerError(w, r, err)
+					return
+				}
+				w.Write(b)
+				return
+			}
+			if len(response.Errors) > 0 {
+				err := nbrew.setSession(w, r, "flash", &response)
+				if err != nil {
+					logger.Error(err.Error())
+					internalServerError(w, r, err)
+					return
+				}
+				http.Redirect(w, r, r.URL.String(), http.StatusFound)
+				return
+			}
+			msg := "Post created"
+			if response.Draft {
+				msg = "Draft post created"
+			}
+			err := nbrew.setSession(w, r, "flash", map[string]any{
+				"alerts": url.Values{
+					"success": []string{
+						fmt.Sprintf(`%[1]s: <a href="/%[2]s/%[3]s.md" class="linktext">%[3]s.md</a>`, msg, path.Join("admin", sitePrefix, "posts", response.Category), response.PostID),
+					},
+				},
+			})
+			if err != nil {
+				logger.Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+			http.Redirect(w, r, nbrew.Scheme+nbrew.AdminDomain+"/"+path.Join("admin", sitePrefix, "posts", response.Category)+"/", http.StatusFound)
+		}
+
+		var request Request
+		contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		switch contentType {
+		case "application/json":
+			err := json.NewDecoder(r.Body).Decode(&request)
+			if err != nil {
+				var syntaxErr *json.SyntaxError
+				if errors.As(err, &syntaxErr) {
+					http.Error(w, "400 Bad Request: invalid JSON", http.StatusBadRequest)
+					return
+				}
+				logger.Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+		case "application/x-www-form-urlencoded":
+			err := r.ParseForm()
+			if err != nil {
+				http.Error(w, fmt.Sprintf("400 Bad Request: %s", err), http.StatusBadRequest)
+				return
+			}
+			request.Slug = r.Form.Get("slug")
+			request.Category = r.Form.Get("category")
+			request.Content = r.Form.Get("content")
+			request.PublishDate = r.Form.Get("publish_date")
+			request.Draft, _ = strconv.ParseBool(r.Form.Get("draft"))
+		default:
+			http.Error(w, "415 Unsupported Media Type", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		response := Response{
+			Content:     request.Content,
+			PublishDate: strings.TrimSpace(request.PublishDate),
+			Draft:       request.Draft,
+			Errors:      make(url.Values),
+		}
+
+		response.Slug = strings.TrimSpace(request.Slug)
+		if response.Slug == "" {
+			response.Slug, _ = getTitleAndPreview(io.NopCloser(strings.NewReader(response.Content)))
+		}
+		if response.Slug != "" {
+			response.Slug = toSlug(response.Slug)
+		}
+
+		// The publish date is either an RFC 3339 timestamp or the value of a
+		// datetime-local input (which is taken to be in UTC). If it is not
+		// provided, the post is published now.
+		var publishDate time.Time
+		if response.PublishDate == "" {
+			publishDate = time.Now().UTC()
+		} else {
+			var err error
+			publishDate, err = time.Parse(time.RFC3339, response.PublishDate)
+			if err != nil {
+				publishDate, err = time.ParseInLocation("2006-01-02T15:04", response.PublishDate, time.UTC)
+				if err != nil {
+					response.Errors.Add("publish_date", "invalid date")
+				}
+			}
+		}
+
+		// Category names are checked like any other name so that "." and
+		// ".." cannot put the post outside the posts folder.
+		if request.Category != "" && len(validateName(request.Category)) > 0 {
+			response.Errors.Add("category", "category does not exist")
+		} else if request.Category != "" {
+			fileInfo, err := fs.Stat(nbrew.FS, path.Join(sitePrefix, "posts", request.Category))
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				logger.Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+			if fileInfo == nil || !fileInfo.IsDir() || strings.Contains(request.Category, "/") {
+				response.Errors.Add("category", "category does not exist")
+			} else {
+				response.Category = request.Category
+			}
+		}
+		if len(response.Errors) > 0 {
+			writeResponse(w, r, response)
+			return
+		}
+
+		var timestamp [8]byte
+		binary.BigEndian.PutUint64(timestamp[:], uint64(time.Now().Unix()))
+		response.PostID = strings.TrimLeft(base32Encoding.EncodeToString(timestamp[len(timestamp)-5:]), "0")
+		if response.Slug != "" {
+			response.PostID += "-" + response.Slug
+		}
+
+		var b strings.Builder
+		b.WriteString("---\n")
+		b.WriteString("date: " + publishDate.UTC().Format(time.RFC3339) + "\n")
+		b.WriteString("draft: " + strconv.FormatBool(response.Draft) + "\n")
+		b.WriteString("---\n\n")
+		b.WriteString(response.Content)
+		name := path.Join(response.Category, response.PostID+".md")
+		ok, err := checkPreconditions(nbrew.FS, r, path.Join(sitePrefix, "posts", name))
+		if err != nil {
+			logger.Error(err.Error())
+			internalServerError(w, r, err)
+			return
+		}
+		if !ok {
+			http.Error(w, "412 Precondition Failed", http.StatusPreconditionFailed)
+			return
+		}
+		err = nbrew.writeFile(r.Context(), sitePrefix, path.Join("posts", name), strings.NewReader(b.String()))
+		if err != nil {
+			logger.Error(err.Error())
+			internalServerError(w, r, err)
+			return
+		}
+		err = nbrew.setFileAuthor(r.Context(), sitePrefix, path.Join("posts", name), username)
+		if err != nil {
+			logger.Error(err.Error())
+			internalServerError(w, r, err)
+			return
+		}
+		err = nbrew.generate(r.Context(), sitePrefix, path.Join("posts", name))
+		if err != nil {
+			logger.Error(err.Error())
+		}
+		writeResponse(w, r, response)
+	default:
+		http.Error(w, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+	}
 }
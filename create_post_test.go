@@ -0,0 +1,148 @@
+package nb6
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bokwoon95/nb6/internal/testutil"
+)
+
+func TestCreatePostCategory(t *testing.T) {
+	type Response struct {
+		Category string     `json:"category"`
+		PostID   string     `json:"post_id"`
+		Errors   url.Values `json:"errors"`
+	}
+	type TestTable struct {
+		description string
+		category    string
+		wantErrors  []string
+	}
+
+	tests := []TestTable{{
+		description: "no category",
+		category:    "",
+	}, {
+		description: "existing category",
+		category:    "dir",
+	}, {
+		description: "missing category",
+		category:    "missing",
+		wantErrors:  []string{"category does not exist"},
+	}, {
+		description: "dot",
+		category:    ".",
+		wantErrors:  []string{"category does not exist"},
+	}, {
+		description: "dot dot",
+		category:    "..",
+		wantErrors:  []string{"category does not exist"},
+	}, {
+		description: "nested category",
+		category:    "dir/sub",
+		wantErrors:  []string{"category does not exist"},
+	}}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.description, func(t *testing.T) {
+			nbrew, _ := newTestLocalNotebrew(t, map[string]string{
+				"root/posts/dir/sub/a.md": "a",
+			})
+			createPost := func(w http.ResponseWriter, r *http.Request) {
+				nbrew.createPost(w, r, "", "")
+			}
+			var response Response
+			code := postForm(t, createPost, "/admin/posts/create/", url.Values{
+				"category": {tt.category},
+				"content":  {"# hello"},
+			}, &response)
+			if code != http.StatusOK {
+				t.Fatalf("got status %d, want %d", code, http.StatusOK)
+			}
+			if diff := testutil.Diff(response.Errors["category"], tt.wantErrors); diff != "" {
+				t.Error(testutil.Callers(), diff)
+			}
+			var gotNames []string
+			for _, name := range listFSFiles(t, nbrew.FS) {
+				if strings.HasSuffix(name, ".md") && name != "posts/dir/sub/a.md" {
+					gotNames = append(gotNames, name)
+				}
+			}
+			var wantNames []string
+			if len(tt.wantErrors) == 0 {
+				wantNames = []string{path.Join("posts", tt.category, response.PostID+".md")}
+			}
+			if diff := testutil.Diff(gotNames, wantNames); diff != "" {
+				t.Error(testutil.Callers(), diff)
+			}
+		})
+	}
+}
+
+func TestScheduledPost(t *testing.T) {
+	nbrew, _ := newTestLocalNotebrew(t, nil)
+	createPost := func(w http.ResponseWriter, r *http.Request) {
+		nbrew.createPost(w, r, "", "")
+	}
+	var response struct {
+		PostID string `json:"post_id"`
+	}
+	publishDate := time.Now().Add(24 * time.Hour).UTC()
+	code := postForm(t, createPost, "/admin/posts/create/", url.Values{
+		"content":      {"# scheduled"},
+		"publish_date": {publishDate.Format(time.RFC3339)},
+	}, &response)
+	if code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", code, http.StatusOK)
+	}
+	outputFile := path.Join("site/posts", response.PostID, "index.html")
+
+	// A post scheduled for tomorrow is neither generated nor listed.
+	_, err := fs.Stat(nbrew.FS, outputFile)
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("scheduled post was generated: %v", err)
+	}
+	posts, err := nbrew.getPosts(context.Background(), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(posts) != 0 {
+		t.Errorf("got %d posts, want 0", len(posts))
+	}
+	err = nbrew.publishScheduledPosts(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fs.Stat(nbrew.FS, outputFile)
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("scheduled post was published early: %v", err)
+	}
+
+	// Once its publish date has passed, the janitor publishes it.
+	name := path.Join("posts", response.PostID+".md")
+	contents := strings.Replace(readFSFile(t, nbrew.FS, name), publishDate.Format(time.RFC3339), time.Now().Add(-time.Hour).UTC().Format(time.RFC3339), 1)
+	writeFSFile(t, nbrew.FS, name, contents)
+	err = nbrew.publishScheduledPosts(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fs.Stat(nbrew.FS, outputFile)
+	if err != nil {
+		t.Fatalf("due post was not published: %v", err)
+	}
+	posts, err = nbrew.getPosts(context.Background(), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(posts) != 1 {
+		t.Errorf("got %d posts, want 1", len(posts))
+	}
+}
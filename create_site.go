@@ -226,11 +226,12 @@ func (nbrew *Notebrew) createSite(w http.ResponseWriter, r *http.Request, userna
 			}
 			_, err = sq.ExecContext(r.Context(), tx, sq.CustomQuery{
 				Dialect: nbrew.Dialect,
-				Format: "INSERT INTO site_user (site_id, user_id)" +
-					" VALUES ((SELECT site_id FROM site WHERE site_name = {siteName}), (SELECT user_id FROM users WHERE username = {username})) {conflictClause}",
+				Format: "INSERT INTO site_user (site_id, user_id, role)" +
+					" VALUES ((SELECT site_id FROM site WHERE site_name = {siteName}), (SELECT user_id FROM users WHERE username = {username}), {role}) {conflictClause}",
 				Values: []any{
 					sq.StringParam("siteName", request.SiteName),
 					sq.StringParam("username", username),
+					sq.StringParam("role", roleOwner),
 					sq.Param("conflictClause", sq.DialectExpression{
 						Default: sq.Expr("ON CONFLICT DO NOTHING"),
 						Cases: []sq.DialectCase{{
@@ -0,0 +1,733 @@
+package nb6
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"github.com/bokwoon95/sq"
+)
+
+// databaseFSChunkSize is the size of each chunk a file in a DatabaseFS is
+// split into.
+const databaseFSChunkSize = 1 << 20
+
+// DatabaseFS is an FS that stores files and directories in the files and
+// file_chunk tables of a database (see FILES and FILE_CHUNK in schema.go), so
+// that a deployment that uses a single database keeps everything in it.
+type DatabaseFS struct {
+	// DB is the database the files are stored in.
+	DB *sql.DB
+
+	// Dialect is the dialect of the database. Only sqlite, postgres, mysql
+	// and sqlserver are supported.
+	Dialect string
+}
+
+var (
+	_ StatFS      = (*DatabaseFS)(nil)
+	_ WalkDirFS   = (*DatabaseFS)(nil)
+	_ RemoveAllFS = (*DatabaseFS)(nil)
+	_ CopyFS      = (*DatabaseFS)(nil)
+)
+
+// NewDatabaseFS returns a new DatabaseFS, creating the files and file_chunk
+// tables if they don't exist.
+func NewDatabaseFS(dialect string, db *sql.DB) (*DatabaseFS, error) {
+	err := automigrate(dialect, db)
+	if err != nil {
+		return nil, err
+	}
+	return &DatabaseFS{DB: db, Dialect: dialect}, nil
+}
+
+func (dbFS *DatabaseFS) String() string {
+	return dbFS.Dialect + " database"
+}
+
+// databaseFileInfo is the fs.FileInfo of a row in the files table.
+type databaseFileInfo struct {
+	fileID  [16]byte
+	name    string
+	isDir   bool
+	size    int64
+	modTime time.Time
+}
+
+func (info *databaseFileInfo) Name() string { return info.name }
+
+func (info *databaseFileInfo) Size() int64 { return info.size }
+
+func (info *databaseFileInfo) Mode() fs.FileMode {
+	if info.isDir {
+		return fs.ModeDir | 0755
+	}
+	return 0644
+}
+
+func (info *databaseFileInfo) ModTime() time.Time { return info.modTime }
+
+func (info *databaseFileInfo) IsDir() bool { return info.isDir }
+
+func (info *databaseFileInfo) Sys() any { return nil }
+
+// stat looks up name in the files table. The root directory "." has no row,
+// its fileID is all zeroes.
+func (dbFS *DatabaseFS) stat(ctx context.Context, db sq.DB, name string) (*databaseFileInfo, error) {
+	if name == "." {
+		return &databaseFileInfo{name: ".", isDir: true}, nil
+	}
+	fileInfo, err := sq.FetchOneContext(ctx, db, sq.CustomQuery{
+		Dialect: dbFS.Dialect,
+		Format:  "SELECT {*} FROM files WHERE file_path = {name}",
+		Values: []any{
+			sq.StringParam("name", name),
+		},
+	}, func(row *sq.Row) *databaseFileInfo {
+		fileInfo := &databaseFileInfo{name: path.Base(name)}
+		row.UUID(&fileInfo.fileID, "file_id")
+		fileInfo.isDir = row.Bool("is_dir")
+		fileInfo.size = row.Int64("size")
+		fileInfo.modTime = row.Time("mod_time")
+		return fileInfo
+	})
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fs.ErrNotExist
+		}
+		return nil, err
+	}
+	return fileInfo, nil
+}
+
+// statParent looks up the parent directory of name, which must exist.
+func (dbFS *DatabaseFS) statParent(ctx context.Context, db sq.DB, op, name string) (*databaseFileInfo, error) {
+	parent, err := dbFS.stat(ctx, db, path.Dir(name))
+	if err != nil {
+		return nil, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	if !parent.isDir {
+		return nil, &fs.PathError{Op: op, Path: name, Err: syscall.ENOTDIR}
+	}
+	return parent, nil
+}
+
+// parentIDParam returns the parent_id of the children of parent, which is
+// NULL for the root directory.
+func parentIDParam(parent *databaseFileInfo) any {
+	if parent.fileID == ([16]byte{}) {
+		return sq.Param("parentID", nil)
+	}
+	return sq.UUIDParam("parentID", parent.fileID)
+}
+
+// subtreeParams returns the params that match every descendant of the
+// directory name using "file_path >= {prefix} AND file_path < {upperBound}",
+// since '0' is the character after '/'. This relies on file_path comparing
+// byte by byte, which is why FILE_PATH has a binary collation (otherwise
+// siblings like "notes-old" could sort between "notes/" and "notes0").
+func subtreeParams(name string) []any {
+	return []any{
+		sq.StringParam("prefix", name+"/"),
+		sq.StringParam("upperBound", name+"0"),
+	}
+}
+
+func (dbFS *DatabaseFS) Stat(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
+	}
+	fileInfo, err := dbFS.stat(context.Background(), dbFS.DB, name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	return fileInfo, nil
+}
+
+func (dbFS *DatabaseFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	fileInfo, err := dbFS.stat(context.Background(), dbFS.DB, name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	if fileInfo.isDir {
+		return &databaseDir{dbFS: dbFS, name: name, info: fileInfo}, nil
+	}
+	return &databaseFile{dbFS: dbFS, name: name, info: fileInfo}, nil
+}
+
+func (dbFS *DatabaseFS) OpenReaderFrom(name string, perm fs.FileMode) (io.ReaderFrom, error) {
+	if !fs.ValidPath(name) || name == "." {
+		return nil, &fs.PathError{Op: "openreaderfrom", Path: name, Err: fs.ErrInvalid}
+	}
+	return &databaseFileWriter{dbFS: dbFS, name: name}, nil
+}
+
+func (dbFS *DatabaseFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	dir, err := dbFS.stat(context.Background(), dbFS.DB, name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	if !dir.isDir {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: syscall.ENOTDIR}
+	}
+	format := "SELECT {*} FROM files WHERE parent_id = {parentID}"
+	if dir.fileID == ([16]byte{}) {
+		format = "SELECT {*} FROM files WHERE parent_id IS NULL"
+	}
+	dirEntries, err := sq.FetchAllContext(context.Background(), dbFS.DB, sq.CustomQuery{
+		Dialect: dbFS.Dialect,
+		Format:  format,
+		Values: []any{
+			parentIDParam(dir),
+		},
+	}, func(row *sq.Row) fs.DirEntry {
+		fileInfo := &databaseFileInfo{}
+		row.UUID(&fileInfo.fileID, "file_id")
+		fileInfo.name = path.Base(row.String("file_path"))
+		fileInfo.isDir = row.Bool("is_dir")
+		fileInfo.size = row.Int64("size")
+		fileInfo.modTime = row.Time("mod_time")
+		return fs.FileInfoToDirEntry(fileInfo)
+	})
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	// Sort in Go because the database collation may not sort by bytes.
+	sort.Slice(dirEntries, func(i, j int) bool {
+		return dirEntries[i].Name() < dirEntries[j].Name()
+	})
+	return dirEntries, nil
+}
+
+func (dbFS *DatabaseFS) Mkdir(name string, perm fs.FileMode) error {
+	if !fs.ValidPath(name) || name == "." {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrInvalid}
+	}
+	tx, err := dbFS.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	parent, err := dbFS.statParent(context.Background(), tx, "mkdir", name)
+	if err != nil {
+		return err
+	}
+	_, err = dbFS.stat(context.Background(), tx, name)
+	if err == nil {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrExist}
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: err}
+	}
+	err = dbFS.insertFile(context.Background(), tx, NewID(), parent, name, true, 0)
+	if err != nil {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: err}
+	}
+	return tx.Commit()
+}
+
+func (dbFS *DatabaseFS) insertFile(ctx context.Context, db sq.DB, fileID [16]byte, parent *databaseFileInfo, name string, isDir bool, size int64) error {
+	_, err := sq.ExecContext(ctx, db, sq.CustomQuery{
+		Dialect: dbFS.Dialect,
+		Format: "INSERT INTO files (file_id, parent_id, file_path, is_dir, size, mod_time)" +
+			" VALUES ({fileID}, {parentID}, {name}, {isDir}, {size}, {modTime})",
+		Values: []any{
+			sq.UUIDParam("fileID", fileID),
+			parentIDParam(parent),
+			sq.StringParam("name", name),
+			sq.BoolParam("isDir", isDir),
+			sq.Int64Param("size", size),
+			sq.TimeParam("modTime", time.Now().UTC()),
+		},
+	})
+	return err
+}
+
+// deleteFiles deletes the file or directory name and everything inside it.
+func (dbFS *DatabaseFS) deleteFiles(ctx context.Context, db sq.DB, name string) error {
+	values := append(subtreeParams(name), sq.StringParam("name", name))
+	_, err := sq.ExecContext(ctx, db, sq.CustomQuery{
+		Dialect: dbFS.Dialect,
+		Format: "DELETE FROM file_chunk WHERE file_id IN (" +
+			"SELECT file_id FROM files WHERE file_path = {name} OR (file_path >= {prefix} AND file_path < {upperBound})" +
+			")",
+		Values: values,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = sq.ExecContext(ctx, db, sq.CustomQuery{
+		Dialect: dbFS.Dialect,
+		Format:  "DELETE FROM files WHERE file_path = {name} OR (file_path >= {prefix} AND file_path < {upperBound})",
+		Values:  values,
+	})
+	return err
+}
+
+func (dbFS *DatabaseFS) Remove(name string) error {
+	if !fs.ValidPath(name) || name == "." {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrInvalid}
+	}
+	tx, err := dbFS.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	fileInfo, err := dbFS.stat(context.Background(), tx, name)
+	if err != nil {
+		return &fs.PathError{Op: "remove", Path: name, Err: err}
+	}
+	if fileInfo.isDir {
+		exists, err := sq.FetchExistsContext(context.Background(), tx, sq.CustomQuery{
+			Dialect: dbFS.Dialect,
+			Format:  "SELECT 1 FROM files WHERE parent_id = {parentID}",
+			Values: []any{
+				parentIDParam(fileInfo),
+			},
+		})
+		if err != nil {
+			return &fs.PathError{Op: "remove", Path: name, Err: err}
+		}
+		if exists {
+			return &fs.PathError{Op: "remove", Path: name, Err: syscall.ENOTEMPTY}
+		}
+	}
+	err = dbFS.deleteFiles(context.Background(), tx, name)
+	if err != nil {
+		return &fs.PathError{Op: "remove", Path: name, Err: err}
+	}
+	return tx.Commit()
+}
+
+// RemoveAll removes name and everything inside it in a single transaction.
+// If name does not exist, RemoveAll does nothing.
+func (dbFS *DatabaseFS) RemoveAll(name string) error {
+	if !fs.ValidPath(name) || name == "." {
+		return &fs.PathError{Op: "removeall", Path: name, Err: fs.ErrInvalid}
+	}
+	tx, err := dbFS.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	err = dbFS.deleteFiles(context.Background(), tx, name)
+	if err != nil {
+		return &fs.PathError{Op: "removeall", Path: name, Err: err}
+	}
+	return tx.Commit()
+}
+
+// Rename renames oldname to newname. Renaming a directory renames its whole
+// subtree in a single transaction.
+func (dbFS *DatabaseFS) Rename(oldname, newname string) error {
+	if !fs.ValidPath(oldname) || oldname == "." {
+		return &fs.PathError{Op: "rename", Path: oldname, Err: fs.ErrInvalid}
+	}
+	if !fs.ValidPath(newname) || newname == "." {
+		return &fs.PathError{Op: "rename", Path: newname, Err: fs.ErrInvalid}
+	}
+	if oldname == newname {
+		return nil
+	}
+	tx, err := dbFS.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	oldInfo, err := dbFS.stat(context.Background(), tx, oldname)
+	if err != nil {
+		return &fs.PathError{Op: "rename", Path: oldname, Err: err}
+	}
+	if oldInfo.isDir && len(newname) > len(oldname) && newname[:len(oldname)+1] == oldname+"/" {
+		// A directory can't be moved into itself.
+		return &fs.PathError{Op: "rename", Path: newname, Err: fs.ErrInvalid}
+	}
+	parent, err := dbFS.statParent(context.Background(), tx, "rename", newname)
+	if err != nil {
+		return err
+	}
+	newInfo, err := dbFS.stat(context.Background(), tx, newname)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return &fs.PathError{Op: "rename", Path: newname, Err: err}
+	}
+	if newInfo != nil {
+		if newInfo.isDir || oldInfo.isDir {
+			return &fs.PathError{Op: "rename", Path: newname, Err: fs.ErrExist}
+		}
+		err = dbFS.deleteFiles(context.Background(), tx, newname)
+		if err != nil {
+			return &fs.PathError{Op: "rename", Path: newname, Err: err}
+		}
+	}
+	_, err = sq.ExecContext(context.Background(), tx, sq.CustomQuery{
+		Dialect: dbFS.Dialect,
+		Format:  "UPDATE files SET file_path = {newname}, parent_id = {parentID} WHERE file_id = {fileID}",
+		Values: []any{
+			sq.StringParam("newname", newname),
+			parentIDParam(parent),
+			sq.UUIDParam("fileID", oldInfo.fileID),
+		},
+	})
+	if err != nil {
+		return &fs.PathError{Op: "rename", Path: oldname, Err: err}
+	}
+	if oldInfo.isDir {
+		// Descendants keep their parent_id, only the beginning of their
+		// file_path changes. SQL string functions count characters, not
+		// bytes.
+		newPath := "{newname} || SUBSTR(file_path, {start})"
+		switch dbFS.Dialect {
+		case "mysql":
+			newPath = "CONCAT({newname}, SUBSTRING(file_path, {start}))"
+		case "sqlserver":
+			newPath = "{newname} + SUBSTRING(file_path, {start}, LEN(file_path))"
+		}
+		_, err = sq.ExecContext(context.Background(), tx, sq.CustomQuery{
+			Dialect: dbFS.Dialect,
+			Format:  "UPDATE files SET file_path = " + newPath + " WHERE file_path >= {prefix} AND file_path < {upperBound}",
+			Values: append(subtreeParams(oldname),
+				sq.StringParam("newname", newname),
+				sq.IntParam("start", utf8.RuneCountInString(oldname)+1),
+			),
+		})
+		if err != nil {
+			return &fs.PathError{Op: "rename", Path: oldname, Err: err}
+		}
+	}
+	return tx.Commit()
+}
+
+// fetchSubtree fetches name and everything inside it, sorted by file_path (so
+// every directory comes before its contents).
+func (dbFS *DatabaseFS) fetchSubtree(ctx context.Context, db sq.DB, name string) ([]*databaseFileInfo, error) {
+	format := "SELECT {*} FROM files WHERE file_path = {name} OR (file_path >= {prefix} AND file_path < {upperBound})"
+	if name == "." {
+		format = "SELECT {*} FROM files"
+	}
+	fileInfos, err := sq.FetchAllContext(ctx, db, sq.CustomQuery{
+		Dialect: dbFS.Dialect,
+		Format:  format,
+		Values:  append(subtreeParams(name), sq.StringParam("name", name)),
+	}, func(row *sq.Row) *databaseFileInfo {
+		fileInfo := &databaseFileInfo{}
+		row.UUID(&fileInfo.fileID, "file_id")
+		// The full path is kept in name until the caller is done with it.
+		fileInfo.name = row.String("file_path")
+		fileInfo.isDir = row.Bool("is_dir")
+		fileInfo.size = row.Int64("size")
+		fileInfo.modTime = row.Time("mod_time")
+		return fileInfo
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(fileInfos, func(i, j int) bool {
+		return fileInfos[i].name < fileInfos[j].name
+	})
+	return fileInfos, nil
+}
+
+// WalkDir walks the file tree rooted at root like fs.WalkDir, but fetches the
+// whole tree in a single query instead of querying each directory.
+func (dbFS *DatabaseFS) WalkDir(root string, fn fs.WalkDirFunc) error {
+	if !fs.ValidPath(root) {
+		err := fn(root, nil, &fs.PathError{Op: "walkdir", Path: root, Err: fs.ErrInvalid})
+		if err == fs.SkipDir || err == fs.SkipAll {
+			return nil
+		}
+		return err
+	}
+	fileInfos, err := dbFS.fetchSubtree(context.Background(), dbFS.DB, root)
+	if err != nil {
+		return &fs.PathError{Op: "walkdir", Path: root, Err: err}
+	}
+	var rootEntry fs.DirEntry
+	if root == "." {
+		rootEntry = fs.FileInfoToDirEntry(&databaseFileInfo{name: ".", isDir: true})
+	}
+	children := make(map[string][]fs.DirEntry)
+	for _, fileInfo := range fileInfos {
+		name := fileInfo.name
+		fileInfo.name = path.Base(name)
+		if name == root {
+			rootEntry = fs.FileInfoToDirEntry(fileInfo)
+			continue
+		}
+		children[path.Dir(name)] = append(children[path.Dir(name)], fs.FileInfoToDirEntry(fileInfo))
+	}
+	if rootEntry == nil {
+		err := fn(root, nil, &fs.PathError{Op: "walkdir", Path: root, Err: fs.ErrNotExist})
+		if err == fs.SkipDir || err == fs.SkipAll {
+			return nil
+		}
+		return err
+	}
+	return walkDirEntries(root, rootEntry, children, fn)
+}
+
+// Copy copies srcName to destName in a single transaction, without reading
+// the contents out of the database.
+func (dbFS *DatabaseFS) Copy(srcName, destName string) error {
+	if !fs.ValidPath(srcName) || srcName == "." {
+		return &fs.PathError{Op: "copy", Path: srcName, Err: fs.ErrInvalid}
+	}
+	if !fs.ValidPath(destName) || destName == "." {
+		return &fs.PathError{Op: "copy", Path: destName, Err: fs.ErrInvalid}
+	}
+	ctx := context.Background()
+	tx, err := dbFS.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	srcInfo, err := dbFS.stat(ctx, tx, srcName)
+	if err != nil {
+		return &fs.PathError{Op: "copy", Path: srcName, Err: err}
+	}
+	if srcInfo.isDir && strings.HasPrefix(destName, srcName+"/") {
+		// A directory can't be copied into itself.
+		return &fs.PathError{Op: "copy", Path: destName, Err: fs.ErrInvalid}
+	}
+	parent, err := dbFS.statParent(ctx, tx, "copy", destName)
+	if err != nil {
+		return err
+	}
+	destInfo, err := dbFS.stat(ctx, tx, destName)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return &fs.PathError{Op: "copy", Path: destName, Err: err}
+	}
+	if destInfo != nil {
+		if destInfo.isDir || srcInfo.isDir {
+			return &fs.PathError{Op: "copy", Path: destName, Err: fs.ErrExist}
+		}
+		err = dbFS.deleteFiles(ctx, tx, destName)
+		if err != nil {
+			return &fs.PathError{Op: "copy", Path: destName, Err: err}
+		}
+	}
+	fileInfos, err := dbFS.fetchSubtree(ctx, tx, srcName)
+	if err != nil {
+		return &fs.PathError{Op: "copy", Path: srcName, Err: err}
+	}
+	// Every directory comes before its contents, so the parent of each copy
+	// has always been created by the time it is inserted.
+	newParents := map[string]*databaseFileInfo{path.Dir(destName): parent}
+	for _, fileInfo := range fileInfos {
+		newName := destName + strings.TrimPrefix(fileInfo.name, srcName)
+		newInfo := &databaseFileInfo{fileID: NewID(), isDir: fileInfo.isDir}
+		err = dbFS.insertFile(ctx, tx, newInfo.fileID, newParents[path.Dir(newName)], newName, fileInfo.isDir, fileInfo.size)
+		if err != nil {
+			return &fs.PathError{Op: "copy", Path: newName, Err: err}
+		}
+		if fileInfo.isDir {
+			newParents[newName] = newInfo
+			continue
+		}
+		_, err = sq.ExecContext(ctx, tx, sq.CustomQuery{
+			Dialect: dbFS.Dialect,
+			Format: "INSERT INTO file_chunk (file_id, chunk_num, data)" +
+				" SELECT {newFileID}, chunk_num, data FROM file_chunk WHERE file_id = {fileID}",
+			Values: []any{
+				sq.UUIDParam("newFileID", newInfo.fileID),
+				sq.UUIDParam("fileID", fileInfo.fileID),
+			},
+		})
+		if err != nil {
+			return &fs.PathError{Op: "copy", Path: newName, Err: err}
+		}
+	}
+	return tx.Commit()
+}
+
+// databaseFileWriter is the io.ReaderFrom returned by
+// DatabaseFS.OpenReaderFrom.
+type databaseFileWriter struct {
+	dbFS *DatabaseFS
+	name string
+}
+
+// ReadFrom writes the contents of r into the file in chunks, so that only one
+// chunk is held in memory at a time. The file is replaced in a single
+// transaction, so readers never see a partially written file.
+func (writer *databaseFileWriter) ReadFrom(r io.Reader) (n int64, err error) {
+	dbFS, name := writer.dbFS, writer.name
+	ctx := context.Background()
+	tx, err := dbFS.DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	parent, err := dbFS.statParent(ctx, tx, "open", name)
+	if err != nil {
+		return 0, err
+	}
+	fileInfo, err := dbFS.stat(ctx, tx, name)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return 0, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	var fileID [16]byte
+	if fileInfo != nil {
+		if fileInfo.isDir {
+			return 0, &fs.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+		}
+		fileID = fileInfo.fileID
+		_, err = sq.ExecContext(ctx, tx, sq.CustomQuery{
+			Dialect: dbFS.Dialect,
+			Format:  "DELETE FROM file_chunk WHERE file_id = {fileID}",
+			Values: []any{
+				sq.UUIDParam("fileID", fileID),
+			},
+		})
+		if err != nil {
+			return 0, &fs.PathError{Op: "write", Path: name, Err: err}
+		}
+	} else {
+		fileID = NewID()
+		err = dbFS.insertFile(ctx, tx, fileID, parent, name, false, 0)
+		if err != nil {
+			return 0, &fs.PathError{Op: "write", Path: name, Err: err}
+		}
+	}
+	buf := make([]byte, databaseFSChunkSize)
+	for chunkNum := 0; ; chunkNum++ {
+		size, err := io.ReadFull(r, buf)
+		if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			return 0, err
+		}
+		if size > 0 {
+			_, err := sq.ExecContext(ctx, tx, sq.CustomQuery{
+				Dialect: dbFS.Dialect,
+				Format:  "INSERT INTO file_chunk (file_id, chunk_num, data) VALUES ({fileID}, {chunkNum}, {data})",
+				Values: []any{
+					sq.UUIDParam("fileID", fileID),
+					sq.IntParam("chunkNum", chunkNum),
+					sq.BytesParam("data", buf[:size]),
+				},
+			})
+			if err != nil {
+				return 0, &fs.PathError{Op: "write", Path: name, Err: err}
+			}
+			n += int64(size)
+		}
+		if err != nil {
+			break
+		}
+	}
+	_, err = sq.ExecContext(ctx, tx, sq.CustomQuery{
+		Dialect: dbFS.Dialect,
+		Format:  "UPDATE files SET size = {size}, mod_time = {modTime} WHERE file_id = {fileID}",
+		Values: []any{
+			sq.Int64Param("size", n),
+			sq.TimeParam("modTime", time.Now().UTC()),
+			sq.UUIDParam("fileID", fileID),
+		},
+	})
+	if err != nil {
+		return 0, &fs.PathError{Op: "write", Path: name, Err: err}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// databaseFile is a file opened by DatabaseFS.Open. Its contents are fetched
+// one chunk at a time as it is read.
+type databaseFile struct {
+	dbFS     *DatabaseFS
+	name     string
+	info     *databaseFileInfo
+	chunk    []byte
+	chunkNum int
+	eof      bool
+}
+
+func (file *databaseFile) Read(p []byte) (int, error) {
+	for len(file.chunk) == 0 {
+		if file.eof {
+			return 0, io.EOF
+		}
+		chunk, err := sq.FetchOneContext(context.Background(), file.dbFS.DB, sq.CustomQuery{
+			Dialect: file.dbFS.Dialect,
+			Format:  "SELECT {*} FROM file_chunk WHERE file_id = {fileID} AND chunk_num = {chunkNum}",
+			Values: []any{
+				sq.UUIDParam("fileID", file.info.fileID),
+				sq.IntParam("chunkNum", file.chunkNum),
+			},
+		}, func(row *sq.Row) []byte {
+			return row.Bytes("data")
+		})
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				file.eof = true
+				continue
+			}
+			return 0, &fs.PathError{Op: "read", Path: file.name, Err: err}
+		}
+		file.chunk = chunk
+		file.chunkNum++
+	}
+	n := copy(p, file.chunk)
+	file.chunk = file.chunk[n:]
+	return n, nil
+}
+
+func (file *databaseFile) Stat() (fs.FileInfo, error) { return file.info, nil }
+
+func (file *databaseFile) Close() error { return nil }
+
+// databaseDir is a directory opened by DatabaseFS.Open.
+type databaseDir struct {
+	dbFS       *DatabaseFS
+	name       string
+	info       *databaseFileInfo
+	dirEntries []fs.DirEntry
+	offset     int
+	read       bool
+}
+
+func (dir *databaseDir) Read(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: dir.name, Err: syscall.EISDIR}
+}
+
+func (dir *databaseDir) Stat() (fs.FileInfo, error) { return dir.info, nil }
+
+func (dir *databaseDir) Close() error { return nil }
+
+func (dir *databaseDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !dir.read {
+		dirEntries, err := dir.dbFS.ReadDir(dir.name)
+		if err != nil {
+			return nil, err
+		}
+		dir.dirEntries, dir.read = dirEntries, true
+	}
+	remaining := dir.dirEntries[dir.offset:]
+	if n <= 0 {
+		dir.offset = len(dir.dirEntries)
+		return remaining, nil
+	}
+	if len(remaining) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(remaining) {
+		n = len(remaining)
+	}
+	dir.offset += n
+	return remaining[:n], nil
+}
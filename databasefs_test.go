@@ -0,0 +1,121 @@
+package nb6
+
+import (
+	"database/sql"
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"testing"
+
+	"github.com/bokwoon95/nb6/internal/testutil"
+)
+
+// newTestDatabaseFS returns a DatabaseFS backed by an sqlite database that
+// lives for the duration of the test.
+func newTestDatabaseFS(t *testing.T) *DatabaseFS {
+	t.Helper()
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "notebrew.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	dbFS, err := NewDatabaseFS("sqlite", db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dbFS
+}
+
+func TestDatabaseFS(t *testing.T) {
+	testFS(t, newTestDatabaseFS(t))
+}
+
+func TestDatabaseFSRenameSubtree(t *testing.T) {
+	dbFS := newTestDatabaseFS(t)
+	for _, dir := range []string{"notes", "notes/日記", "notes/日記/sub", "notes/日記2"} {
+		err := dbFS.Mkdir(dir, 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFSFile(t, dbFS, "notes/日記/a.md", "a")
+	writeFSFile(t, dbFS, "notes/日記/sub/b.md", "b")
+	// Shares a prefix with notes/日記 but is not inside it.
+	writeFSFile(t, dbFS, "notes/日記2/c.md", "c")
+
+	err := dbFS.Rename("notes/日記", "notes/日記/sub/dir")
+	if !errors.Is(err, fs.ErrInvalid) {
+		t.Errorf("rename into itself: got error %v, want %v", err, fs.ErrInvalid)
+	}
+	err = dbFS.Rename("notes/日記", "notes/日記2")
+	if !errors.Is(err, fs.ErrExist) {
+		t.Errorf("rename onto a directory: got error %v, want %v", err, fs.ErrExist)
+	}
+	err = dbFS.Rename("notes/日記", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := testutil.Diff(listFSFiles(t, dbFS), []string{"journal/a.md", "journal/sub/b.md", "notes/日記2/c.md"}); diff != "" {
+		t.Error(testutil.Callers(), diff)
+	}
+	// The renamed files can still be found by their new parents.
+	dirEntries, err := dbFS.ReadDir("journal/sub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dirEntries) != 1 || dirEntries[0].Name() != "b.md" {
+		t.Errorf("got entries %v in journal/sub, want b.md", dirEntries)
+	}
+	if got := readFSFile(t, dbFS, "journal/sub/b.md"); got != "b" {
+		t.Errorf("got %q, want %q", got, "b")
+	}
+}
+
+func TestDatabaseFSReplaceFile(t *testing.T) {
+	dbFS := newTestDatabaseFS(t)
+	err := dbFS.Mkdir("notes", 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFSFile(t, dbFS, "notes/a.md", "a")
+	writeFSFile(t, dbFS, "notes/b.md", "b")
+	err = dbFS.Rename("notes/a.md", "notes/b.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readFSFile(t, dbFS, "notes/b.md"); got != "a" {
+		t.Errorf("got %q, want %q", got, "a")
+	}
+	// The chunks of the replaced file are gone too.
+	var count int
+	err = dbFS.DB.QueryRow("SELECT COUNT(*) FROM file_chunk").Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("got %d chunks, want 1", count)
+	}
+}
+
+func TestDatabaseFSSubtreeSiblings(t *testing.T) {
+	dbFS := newTestDatabaseFS(t)
+	// "-" and "." sort before "/", and "0" right after it.
+	for _, dir := range []string{"notes", "notes-old", "notes.bak", "notes0"} {
+		err := dbFS.Mkdir(dir, 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeFSFile(t, dbFS, dir+"/a.md", "a")
+	}
+	err := dbFS.Rename("notes", "renamed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = dbFS.RemoveAll("renamed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := testutil.Diff(listFSFiles(t, dbFS), []string{"notes-old/a.md", "notes.bak/a.md", "notes0/a.md"}); diff != "" {
+		t.Error(testutil.Callers(), diff)
+	}
+}
@@ -25,9 +25,10 @@ func (nbrew *Notebrew) delet(w http.ResponseWriter, r *http.Request, username, s
 		Names  []string `json:"names,omitempty"`
 	}
 	type Response struct {
-		Folder  string   `json:"folder,omitempty"`
-		Deleted []string `json:"deleted,omitempty"`
-		Errors  []string `json:"errors,omitempty"`
+		Folder        string   `json:"folder,omitempty"`
+		Deleted       []string `json:"deleted,omitempty"`
+		RecycleBinIDs []string `json:"recycle_bin_ids,omitempty"`
+		Errors        []string `json:"errors,omitempty"`
 	}
 	type Entry struct {
 		Name    string    `json:"name,omitempty"`
@@ -48,18 +49,14 @@ func (nbrew *Notebrew) delet(w http.ResponseWriter, r *http.Request, username, s
 	}
 
 	isValidFolder := func(folder string) bool {
-		head, _, _ := strings.Cut(folder, "/")
-		switch head {
-		case "notes", "pages", "posts", "themes":
-			fileInfo, err := fs.Stat(nbrew.FS, path.Join(sitePrefix, folder))
-			if err != nil {
-				return false
-			}
-			if fileInfo.IsDir() {
-				return true
-			}
+		if !isValidSitePath(folder) {
+			return false
 		}
-		return false
+		fileInfo, err := fs.Stat(nbrew.FS, path.Join(sitePrefix, folder))
+		if err != nil {
+			return false
+		}
+		return fileInfo.IsDir()
 	}
 
 	switch r.Method {
@@ -76,7 +73,7 @@ func (nbrew *Notebrew) delet(w http.ResponseWriter, r *http.Request, username, s
 			seen := make(map[string]bool)
 			for _, name := range r.Form["name"] {
 				name = filepath.ToSlash(name)
-				if strings.Contains(name, "/") {
+				if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
 					continue
 				}
 				if seen[name] {
@@ -142,6 +139,8 @@ func (nbrew *Notebrew) delet(w http.ResponseWriter, r *http.Request, username, s
 				if len(response.Deleted) > 1 {
 					msg = fmt.Sprintf("%d items deleted", len(response.Deleted))
 				}
+				undoURL := "/" + path.Join("admin", sitePrefix, "recycle_bin") + "/?" + url.Values{"id": response.RecycleBinIDs}.Encode()
+				msg += fmt.Sprintf(` (<a href="%s" class="linktext">undo</a>)`, template.HTMLEscapeString(undoURL))
 				err := nbrew.setSession(w, r, "flash", map[string]any{
 					"alerts": url.Values{
 						"success": []string{msg},
@@ -175,13 +174,14 @@ func (nbrew *Notebrew) delet(w http.ResponseWriter, r *http.Request, username, s
 				http.Error(w, fmt.Sprintf("400 Bad Request: %s", err), http.StatusBadRequest)
 				return
 			}
-			request.Folder = path.Clean(strings.Trim(r.Form.Get("folder"), "/"))
+			request.Folder = r.Form.Get("folder")
 			request.Names = r.Form["name"]
 		default:
 			http.Error(w, "415 Unsupported Media Type", http.StatusUnsupportedMediaType)
 			return
 		}
 
+		request.Folder = path.Clean(strings.Trim(request.Folder, "/"))
 		response := Response{}
 		if !isValidFolder(request.Folder) {
 			response.Errors = append(response.Errors, fmt.Sprintf("invalid folder %s", request.Folder))
@@ -189,16 +189,33 @@ func (nbrew *Notebrew) delet(w http.ResponseWriter, r *http.Request, username, s
 			return
 		}
 		response.Folder = request.Folder
+		// The preconditions must hold for every file or folder being deleted,
+		// otherwise nothing is deleted.
+		for _, name := range request.Names {
+			if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+				continue
+			}
+			ok, err := checkPreconditions(nbrew.FS, r, path.Join(sitePrefix, request.Folder, name))
+			if err != nil {
+				logger.Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+			if !ok {
+				http.Error(w, "412 Precondition Failed", http.StatusPreconditionFailed)
+				return
+			}
+		}
 		seen := make(map[string]bool)
 		for _, name := range request.Names {
-			if strings.Contains(name, "/") {
+			if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
 				continue
 			}
 			if seen[name] {
 				continue
 			}
 			seen[name] = true
-			err := removeAll(nbrew.FS, path.Join(sitePrefix, request.Folder, name))
+			id, err := nbrew.recycle(sitePrefix, path.Join(request.Folder, name))
 			if err != nil {
 				if errors.Is(err, fs.ErrNotExist) {
 					continue
@@ -206,6 +223,13 @@ func (nbrew *Notebrew) delet(w http.ResponseWriter, r *http.Request, username, s
 				response.Errors = append(response.Errors, fmt.Sprintf("%s: %v", name, err))
 			} else {
 				response.Deleted = append(response.Deleted, name)
+				response.RecycleBinIDs = append(response.RecycleBinIDs, id)
+			}
+		}
+		for _, name := range response.Deleted {
+			err := nbrew.generate(r.Context(), sitePrefix, path.Join(response.Folder, name))
+			if err != nil {
+				logger.Error(err.Error())
 			}
 		}
 		writeResponse(w, r, response)
@@ -380,57 +404,12 @@ func (nbrew *Notebrew) deletOld(w http.ResponseWriter, r *http.Request, username
 			return
 		}
 
-		if fsys, ok := nbrew.FS.(interface{ RemoveAll(name string) error }); ok {
-			err = fsys.RemoveAll(filePath)
-			if err != nil {
-				logger.Error(err.Error())
-				internalServerError(w, r, err)
-				return
-			}
-			writeResponse(w, r, response)
+		err = removeAll(nbrew.FS, filePath)
+		if err != nil {
+			logger.Error(err.Error())
+			internalServerError(w, r, err)
 			return
 		}
-
-		type Item struct {
-			RelativePath string // path relative to filePath
-			IsFile       bool
-			IsEmptyDir   bool
-		}
-		pushItems := func(items []Item, dir string, dirEntries []fs.DirEntry) []Item {
-			for i := len(dirEntries) - 1; i >= 0; i-- {
-				dirEntry := dirEntries[i]
-				items = append(items, Item{
-					RelativePath: path.Join(dir, dirEntry.Name()),
-					IsFile:       !dirEntry.IsDir(),
-				})
-			}
-			return items
-		}
-		var item Item
-		items := pushItems(nil, "", dirEntries)
-		for len(items) > 0 {
-			item, items = items[len(items)-1], items[:len(items)-1]
-			if item.IsFile || item.IsEmptyDir {
-				err = nbrew.FS.Remove(path.Join(filePath, item.RelativePath))
-				if err != nil {
-					logger.Error(err.Error())
-					internalServerError(w, r, err)
-					return
-				}
-				continue
-			}
-			items = append(items, Item{
-				RelativePath: item.RelativePath,
-				IsEmptyDir:   true,
-			})
-			dirEntries, err := nbrew.FS.ReadDir(path.Join(filePath, item.RelativePath))
-			if err != nil {
-				logger.Error(err.Error())
-				internalServerError(w, r, err)
-				return
-			}
-			items = pushItems(items, item.RelativePath, dirEntries)
-		}
 		writeResponse(w, r, response)
 	default:
 		http.Error(w, "405 Method Not Allowed", http.StatusMethodNotAllowed)
@@ -2,6 +2,7 @@ package nb6
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -44,6 +45,7 @@ func (nbrew *Notebrew) deleteSite(w http.ResponseWriter, r *http.Request, userna
 		if len(siteName) > 30 {
 			return "", false
 		}
+		// Only the owner of a site can delete it.
 		if nbrew.DB != nil {
 			exists, err := sq.FetchExistsContext(r.Context(), nbrew.DB, sq.CustomQuery{
 				Dialect: nbrew.Dialect,
@@ -52,10 +54,12 @@ func (nbrew *Notebrew) deleteSite(w http.ResponseWriter, r *http.Request, userna
 					" JOIN site_user ON site_user.site_id = site.site_id" +
 					" JOIN users ON users.user_id = site_user.user_id" +
 					" WHERE site.site_name = {siteName}" +
-					" AND users.username = {username}",
+					" AND users.username = {username}" +
+					" AND site_user.role = {role}",
 				Values: []any{
 					sq.StringParam("siteName", siteName),
 					sq.StringParam("username", username),
+					sq.StringParam("role", roleOwner),
 				},
 			})
 			if err != nil {
@@ -168,54 +172,28 @@ func (nbrew *Notebrew) deleteSite(w http.ResponseWriter, r *http.Request, userna
 			return
 		}
 
-		err := removeAll(nbrew.FS, sitePrefix)
-		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		ok, err := checkPreconditions(nbrew.FS, r, sitePrefix)
+		if err != nil {
 			logger.Error(err.Error())
 			internalServerError(w, r, err)
 			return
 		}
+		if !ok {
+			http.Error(w, "412 Precondition Failed", http.StatusPreconditionFailed)
+			return
+		}
 
-		if nbrew.DB != nil {
-			tx, err := nbrew.DB.Begin()
-			if err != nil {
-				logger.Error(err.Error())
-				internalServerError(w, r, err)
-				return
-			}
-			defer tx.Rollback()
-			_, err = sq.ExecContext(r.Context(), tx, sq.CustomQuery{
-				Dialect: nbrew.Dialect,
-				Format: "DELETE FROM site_user" +
-					" WHERE EXISTS (" +
-					"SELECT 1 FROM site WHERE site.site_id = site_user.site_id AND site.site_name = {siteName}" +
-					")",
-				Values: []any{
-					sq.StringParam("siteName", request.SiteName),
-				},
-			})
-			if err != nil {
-				logger.Error(err.Error())
-				internalServerError(w, r, err)
-				return
-			}
-			_, err = sq.ExecContext(r.Context(), tx, sq.CustomQuery{
-				Dialect: nbrew.Dialect,
-				Format:  "DELETE FROM site WHERE site_name = {siteName}",
-				Values: []any{
-					sq.StringParam("siteName", request.SiteName),
-				},
-			})
-			if err != nil {
-				logger.Error(err.Error())
-				internalServerError(w, r, err)
-				return
-			}
-			err = tx.Commit()
-			if err != nil {
-				logger.Error(err.Error())
-				internalServerError(w, r, err)
-				return
+		err = nbrew.journaled(journalEntry{Op: "delete_site", Src: sitePrefix, SiteName: request.SiteName}, func() error {
+			err := removeAll(nbrew.FS, sitePrefix)
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
 			}
+			return nbrew.deleteSiteRecords(r.Context(), request.SiteName)
+		})
+		if err != nil {
+			logger.Error(err.Error())
+			internalServerError(w, r, err)
+			return
 		}
 
 		writeResponse(w, r, response, sitePrefix)
@@ -223,3 +201,80 @@ func (nbrew *Notebrew) deleteSite(w http.ResponseWriter, r *http.Request, userna
 		http.Error(w, "405 Method Not Allowed", http.StatusMethodNotAllowed)
 	}
 }
+
+// deleteSiteRecords deletes a site, its users' membership of it, its pending
+// invitations, the authors and the version history of its files from the
+// database.
+func (nbrew *Notebrew) deleteSiteRecords(ctx context.Context, siteName string) error {
+	if nbrew.DB == nil {
+		return nil
+	}
+	tx, err := nbrew.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = sq.ExecContext(ctx, tx, sq.CustomQuery{
+		Dialect: nbrew.Dialect,
+		Format: "DELETE FROM site_user" +
+			" WHERE EXISTS (" +
+			"SELECT 1 FROM site WHERE site.site_id = site_user.site_id AND site.site_name = {siteName}" +
+			")",
+		Values: []any{
+			sq.StringParam("siteName", siteName),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = sq.ExecContext(ctx, tx, sq.CustomQuery{
+		Dialect: nbrew.Dialect,
+		Format: "DELETE FROM invite" +
+			" WHERE EXISTS (" +
+			"SELECT 1 FROM site WHERE site.site_id = invite.site_id AND site.site_name = {siteName}" +
+			")",
+		Values: []any{
+			sq.StringParam("siteName", siteName),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if siteName != "" {
+		sitePrefix := siteName
+		if !strings.Contains(sitePrefix, ".") {
+			sitePrefix = "@" + sitePrefix
+		}
+		_, err = sq.ExecContext(ctx, tx, sq.CustomQuery{
+			Dialect: nbrew.Dialect,
+			Format:  "DELETE FROM file_author WHERE file_path LIKE {pattern}",
+			Values: []any{
+				sq.StringParam("pattern", sitePrefix+"/%"),
+			},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	_, err = sq.ExecContext(ctx, tx, sq.CustomQuery{
+		Dialect: nbrew.Dialect,
+		Format:  "DELETE FROM file_version WHERE site_name = {siteName}",
+		Values: []any{
+			sq.StringParam("siteName", siteName),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = sq.ExecContext(ctx, tx, sq.CustomQuery{
+		Dialect: nbrew.Dialect,
+		Format:  "DELETE FROM site WHERE site_name = {siteName}",
+		Values: []any{
+			sq.StringParam("siteName", siteName),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,205 @@
+package nb6
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// isEditable reports whether a file (relative to the sitePrefix) can be
+// edited and saved in the file view. Only the text files that keep a version
+// history are editable.
+func isEditable(name string) bool {
+	if !isVersioned(name) {
+		return false
+	}
+	switch path.Ext(name) {
+	case ".html", ".css", ".js", ".md", ".txt", ".csv", ".tsv", ".json", ".xml", ".toml", ".yaml", ".yml":
+		return true
+	}
+	return false
+}
+
+// editorImportMap returns the import map needed by the markdown editor and
+// the Content-Security-Policy hash source that allows it. The vendored
+// ProseMirror bundles in static/lib import each other as "/lib/{name}.js.gz"
+// and import markdown-it by its bare name, so every specifier is mapped to
+// where static() serves the bundle.
+func editorImportMap() (importMap template.HTML, hashSource string, err error) {
+	dirEntries, err := fs.ReadDir(rootFS, "static/lib")
+	if err != nil {
+		return "", "", err
+	}
+	imports := make(map[string]string)
+	for _, dirEntry := range dirEntries {
+		name := dirEntry.Name()
+		if !strings.HasSuffix(name, ".js.gz") {
+			continue
+		}
+		imports["/lib/"+name] = "/admin/static/lib/" + strings.TrimSuffix(name, ".gz")
+		if strings.HasPrefix(name, "markdown-it@") {
+			imports["markdown-it"] = "/admin/static/lib/" + strings.TrimSuffix(name, ".gz")
+		}
+	}
+	b, err := json.Marshal(map[string]any{"imports": imports})
+	if err != nil {
+		return "", "", err
+	}
+	checksum := sha256.Sum256(b)
+	return template.HTML(`<script type="importmap">` + string(b) + `</script>`), "'sha256-" + base64.StdEncoding.EncodeToString(checksum[:]) + "'", nil
+}
+
+// saveFile saves the edited contents of a file in the file view. API clients
+// send the ETag of the file they started editing in an If-Match header, the
+// editor sends it in the etag form field. If the file has changed since, the
+// save is rejected so that concurrent edits don't silently overwrite each
+// other.
+func (nbrew *Notebrew) saveFile(w http.ResponseWriter, r *http.Request, username, sitePrefix, filePath string) {
+	type Request struct {
+		Content string `json:"content"`
+		ETag    string `json:"etag,omitempty"`
+	}
+	type Response struct {
+		Path    string     `json:"path"`
+		ETag    string     `json:"etag,omitempty"`
+		ModTime *time.Time `json:"mod_time,omitempty"`
+		Errors  []string   `json:"errors,omitempty"`
+	}
+
+	logger, ok := r.Context().Value(loggerKey).(*slog.Logger)
+	if !ok {
+		logger = slog.Default()
+	}
+
+	var request Request
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch contentType {
+	case "application/json":
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			var syntaxErr *json.SyntaxError
+			if errors.As(err, &syntaxErr) {
+				http.Error(w, "400 Bad Request: invalid JSON", http.StatusBadRequest)
+				return
+			}
+			logger.Error(err.Error())
+			internalServerError(w, r, err)
+			return
+		}
+	case "application/x-www-form-urlencoded":
+		err := r.ParseForm()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("400 Bad Request: %s", err), http.StatusBadRequest)
+			return
+		}
+		request.Content = r.Form.Get("content")
+		request.ETag = r.Form.Get("etag")
+	default:
+		http.Error(w, "415 Unsupported Media Type", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	writeResponse := func(w http.ResponseWriter, r *http.Request, response Response) {
+		accept, _, _ := mime.ParseMediaType(r.Header.Get("Accept"))
+		if accept == "application/json" {
+			w.Header().Set("Content-Type", "application/json")
+			if len(response.Errors) > 0 {
+				w.WriteHeader(http.StatusPreconditionFailed)
+			}
+			b, err := json.Marshal(&response)
+			if err != nil {
+				logger.Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+			w.Write(b)
+			return
+		}
+		flash := map[string]any{}
+		alerts := make(url.Values)
+		if len(response.Errors) > 0 {
+			for _, errmsg := range response.Errors {
+				alerts.Add("danger", template.HTMLEscapeString(errmsg))
+			}
+			// Hand the unsaved contents back to the editor so that they
+			// aren't lost.
+			flash["draft"] = request.Content
+		} else {
+			alerts.Add("success", "Saved")
+		}
+		flash["alerts"] = alerts
+		err := nbrew.setSession(w, r, "flash", flash)
+		if err != nil {
+			logger.Error(err.Error())
+		}
+		http.Redirect(w, r, nbrew.Scheme+nbrew.AdminDomain+"/"+path.Join("admin", sitePrefix, response.Path), http.StatusFound)
+	}
+
+	response := Response{
+		Path: filePath,
+	}
+	fileInfo, err := fs.Stat(nbrew.FS, path.Join(sitePrefix, filePath))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			notFound(w, r)
+			return
+		}
+		logger.Error(err.Error())
+		internalServerError(w, r, err)
+		return
+	}
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch == "" {
+		ifMatch = request.ETag
+	}
+	ok, err = evaluatePreconditions(nbrew.FS, path.Join(sitePrefix, filePath), ifMatch, r.Header.Get("If-Unmodified-Since"))
+	if err != nil {
+		logger.Error(err.Error())
+		internalServerError(w, r, err)
+		return
+	}
+	if !ok {
+		modTime := fileInfo.ModTime()
+		response.ModTime = &modTime
+		response.Errors = append(response.Errors, fmt.Sprintf(
+			"%s was changed by someone else (at %s) after you started editing it. Your changes have not been saved, save again to overwrite their changes.",
+			path.Base(filePath),
+			modTime.Format("2006-01-02 15:04:05 MST"),
+		))
+		writeResponse(w, r, response)
+		return
+	}
+	err = nbrew.writeFile(r.Context(), sitePrefix, filePath, strings.NewReader(request.Content))
+	if err != nil {
+		logger.Error(err.Error())
+		internalServerError(w, r, err)
+		return
+	}
+	fileInfo, err = fs.Stat(nbrew.FS, path.Join(sitePrefix, filePath))
+	if err != nil {
+		logger.Error(err.Error())
+		internalServerError(w, r, err)
+		return
+	}
+	modTime := fileInfo.ModTime()
+	response.ModTime = &modTime
+	response.ETag = contentETag([]byte(request.Content))
+	err = nbrew.generate(r.Context(), sitePrefix, filePath)
+	if err != nil {
+		logger.Error(err.Error())
+	}
+	w.Header().Set("ETag", response.ETag)
+	writeResponse(w, r, response)
+}
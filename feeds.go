@@ -0,0 +1,272 @@
+package nb6
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"io/fs"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// maxFeedItems is the maximum number of posts included in a feed.
+const maxFeedItems = 50
+
+// feedNames are the names of the feeds generated into site/posts and each
+// category folder in site/posts: an Atom feed, an RSS feed and a JSON Feed.
+var feedNames = []string{"feed.xml", "rss.xml", "feed.json"}
+
+// https://validator.w3.org/feed/docs/atom.html
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Author  atomAuthor  `xml:"author"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomEntry struct {
+	ID        string     `xml:"id"`
+	Title     string     `xml:"title"`
+	Published string     `xml:"published"`
+	Updated   string     `xml:"updated"`
+	Links     []atomLink `xml:"link"`
+	Summary   string     `xml:"summary,omitempty"`
+}
+
+// https://www.rssboard.org/rss-specification
+type rssFeed struct {
+	XMLName   xml.Name   `xml:"rss"`
+	Version   string     `xml:"version,attr"`
+	AtomXMLNS string     `xml:"xmlns:atom,attr"`
+	Channel   rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate,omitempty"`
+	AtomLink      atomLink  `xml:"atom:link"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string  `xml:"title"`
+	Link        string  `xml:"link"`
+	GUID        rssGUID `xml:"guid"`
+	PubDate     string  `xml:"pubDate"`
+	Description string  `xml:"description,omitempty"`
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+// https://www.jsonfeed.org/version/1.1/
+type jsonFeed struct {
+	Version     string         `json:"version"`
+	Title       string         `json:"title"`
+	HomePageURL string         `json:"home_page_url"`
+	FeedURL     string         `json:"feed_url"`
+	Items       []jsonFeedItem `json:"items"`
+}
+
+type jsonFeedItem struct {
+	ID            string   `json:"id"`
+	URL           string   `json:"url"`
+	Title         string   `json:"title,omitempty"`
+	Summary       string   `json:"summary,omitempty"`
+	ContentText   string   `json:"content_text"`
+	DatePublished string   `json:"date_published"`
+	DateModified  string   `json:"date_modified"`
+	Tags          []string `json:"tags,omitempty"`
+}
+
+// generateFeeds generates the feeds of a category into site/posts/<category>/.
+// If the category no longer exists, its feeds are removed. The feeds of the
+// root of the posts folder contain the posts of every category, not just the
+// uncategorized ones, so that readers can follow a whole site with a single
+// feed. They are generated by updatePostIndex from the post index instead.
+func (nbrew *Notebrew) generateFeeds(ctx context.Context, sitePrefix, category string) error {
+	posts, err := nbrew.getPosts(ctx, sitePrefix, category)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nbrew.removeFeeds(path.Join(sitePrefix, "site/posts", category))
+		}
+		return err
+	}
+	return nbrew.writeFeeds(sitePrefix, category, posts)
+}
+
+// writeFeeds writes the feeds of a category into site/posts/<category>/ given
+// its posts, newest first. An empty category means the root of the posts
+// folder.
+func (nbrew *Notebrew) writeFeeds(sitePrefix, category string, posts []Post) error {
+	outputDir := path.Join(sitePrefix, "site/posts", category)
+	if len(posts) > maxFeedItems {
+		posts = posts[:maxFeedItems]
+	}
+
+	// All URLs in a feed are absolute, which contentSiteURL takes care of
+	// for the ContentDomain and MultisiteMode.
+	siteURL := nbrew.contentSiteURL(sitePrefix)
+	postsURL := siteURL + path.Join("posts", category) + "/"
+	siteName := siteURL
+	if u, err := url.Parse(siteURL); err == nil {
+		siteName = strings.TrimSuffix(u.Host+u.Path, "/")
+	}
+	title := siteName
+	if category != "" {
+		title += " - " + category
+	}
+	// The feed was last updated whenever its latest post was.
+	var updated time.Time
+	for _, post := range posts {
+		if post.ModTime.After(updated) {
+			updated = post.ModTime
+		}
+	}
+	if updated.IsZero() {
+		updated = time.Now()
+	}
+	updated = updated.UTC()
+
+	atom := atomFeed{
+		ID:      postsURL,
+		Title:   title,
+		Updated: updated.Format(time.RFC3339),
+		Links: []atomLink{
+			{Href: postsURL + "feed.xml", Rel: "self", Type: "application/atom+xml"},
+			{Href: postsURL, Rel: "alternate", Type: "text/html"},
+		},
+		Author:  atomAuthor{Name: siteName},
+		Entries: make([]atomEntry, 0, len(posts)),
+	}
+	rss := rssFeed{
+		Version:   "2.0",
+		AtomXMLNS: "http://www.w3.org/2005/Atom",
+		Channel: rssChannel{
+			Title:         title,
+			Link:          postsURL,
+			Description:   "Posts from " + title,
+			LastBuildDate: updated.Format(time.RFC1123Z),
+			AtomLink:      atomLink{Href: postsURL + "rss.xml", Rel: "self", Type: "application/rss+xml"},
+			Items:         make([]rssItem, 0, len(posts)),
+		},
+	}
+	jsonfeed := jsonFeed{
+		Version:     "https://jsonfeed.org/version/1.1",
+		Title:       title,
+		HomePageURL: postsURL,
+		FeedURL:     postsURL + "feed.json",
+		Items:       make([]jsonFeedItem, 0, len(posts)),
+	}
+	for _, post := range posts {
+		postTitle := post.Title
+		if postTitle == "" {
+			postTitle = post.Name
+		}
+		publishDate, modTime := post.PublishDate.UTC(), post.ModTime.UTC()
+		if modTime.Before(publishDate) {
+			modTime = publishDate
+		}
+		atom.Entries = append(atom.Entries, atomEntry{
+			ID:        post.URL,
+			Title:     postTitle,
+			Published: publishDate.Format(time.RFC3339),
+			Updated:   modTime.Format(time.RFC3339),
+			Links:     []atomLink{{Href: post.URL, Rel: "alternate", Type: "text/html"}},
+			Summary:   post.Preview,
+		})
+		rss.Channel.Items = append(rss.Channel.Items, rssItem{
+			Title:       postTitle,
+			Link:        post.URL,
+			GUID:        rssGUID{IsPermaLink: true, Value: post.URL},
+			PubDate:     publishDate.Format(time.RFC1123Z),
+			Description: post.Preview,
+		})
+		jsonfeed.Items = append(jsonfeed.Items, jsonFeedItem{
+			ID:            post.URL,
+			URL:           post.URL,
+			Title:         postTitle,
+			Summary:       post.Preview,
+			ContentText:   post.Preview,
+			DatePublished: publishDate.Format(time.RFC3339),
+			DateModified:  modTime.Format(time.RFC3339),
+			Tags:          post.Tags,
+		})
+	}
+
+	err := mkdirAll(nbrew.FS, outputDir, 0755)
+	if err != nil {
+		return err
+	}
+	buf := bufPool.Get().(*bytes.Buffer)
+	defer bufPool.Put(buf)
+	for _, name := range feedNames {
+		buf.Reset()
+		switch name {
+		case "feed.xml", "rss.xml":
+			var feed any = &atom
+			if name == "rss.xml" {
+				feed = &rss
+			}
+			buf.WriteString(xml.Header)
+			encoder := xml.NewEncoder(buf)
+			encoder.Indent("", "  ")
+			err = encoder.Encode(feed)
+		case "feed.json":
+			err = jsonEncode(buf, &jsonfeed)
+		}
+		if err != nil {
+			return err
+		}
+		readerFrom, err := nbrew.FS.OpenReaderFrom(path.Join(outputDir, name), 0644)
+		if err != nil {
+			return err
+		}
+		_, err = readerFrom.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeFeeds removes the feeds from dir.
+func (nbrew *Notebrew) removeFeeds(dir string) error {
+	for _, name := range feedNames {
+		err := nbrew.FS.Remove(path.Join(dir, name))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// jsonEncode writes v into buf as indented JSON without escaping HTML
+// characters.
+func jsonEncode(buf *bytes.Buffer, v any) error {
+	encoder := json.NewEncoder(buf)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
@@ -0,0 +1,185 @@
+package nb6
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bokwoon95/nb6/internal/testutil"
+)
+
+func TestGenerateFeeds(t *testing.T) {
+	type Item struct {
+		ID            string
+		Title         string
+		Summary       string
+		DatePublished string
+		Tags          []string
+	}
+	type TestTable struct {
+		description string
+		category    string
+		wantTitle   string
+		wantFeedURL string
+		wantItems   []Item
+	}
+
+	// Only the JSON feed has tags.
+	withoutTags := func(items []Item) []Item {
+		var itemsWithoutTags []Item
+		for _, item := range items {
+			item.Tags = nil
+			itemsWithoutTags = append(itemsWithoutTags, item)
+		}
+		return itemsWithoutTags
+	}
+	a := Item{
+		ID:            "https://example.com/posts/a/",
+		Title:         "A",
+		Summary:       "about a",
+		DatePublished: "2023-01-01T00:00:00Z",
+		Tags:          []string{"go"},
+	}
+	b := Item{
+		ID:            "https://example.com/posts/travel/b/",
+		Title:         "B & co",
+		Summary:       "b & c #japan",
+		DatePublished: "2023-02-01T00:00:00Z",
+		Tags:          []string{"japan"},
+	}
+	tests := []TestTable{{
+		description: "root feeds have every category",
+		category:    "",
+		wantTitle:   "example.com",
+		wantFeedURL: "https://example.com/posts/",
+		wantItems:   []Item{b, a},
+	}, {
+		description: "category feeds",
+		category:    "travel",
+		wantTitle:   "example.com - travel",
+		wantFeedURL: "https://example.com/posts/travel/",
+		wantItems:   []Item{b},
+	}, {
+		description: "empty category",
+		category:    "empty",
+		wantTitle:   "example.com - empty",
+		wantFeedURL: "https://example.com/posts/empty/",
+		wantItems:   nil,
+	}}
+
+	nbrew, tempDir := newTestLocalNotebrew(t, map[string]string{
+		"root/posts/a.md":        "---\ndate: 2023-01-01\ndescription: about a\ntags: [go]\n---\n# A\n\nthe first post\n",
+		"root/posts/travel/b.md": "---\ndate: 2023-02-01\n---\n# B & co\n\nb & c #japan\n",
+		"root/posts/travel/c.md": "---\ndate: 2023-03-01\ndraft: true\n---\n# Draft\n",
+		"root/posts/d.md":        "---\ndate: " + time.Now().Add(24*time.Hour).UTC().Format(time.RFC3339) + "\n---\n# Scheduled\n",
+	})
+	err := os.Mkdir(filepath.Join(tempDir, "root/posts/empty"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nbrew.Scheme = "https://"
+	nbrew.ContentDomain = "example.com"
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.description, func(t *testing.T) {
+			err := nbrew.generate(context.Background(), "", path.Join("posts", tt.category))
+			if err != nil {
+				t.Fatal(err)
+			}
+			outputDir := path.Join("site/posts", tt.category)
+
+			var atom atomFeed
+			err = xml.Unmarshal([]byte(readFSFile(t, nbrew.FS, path.Join(outputDir, "feed.xml"))), &atom)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if atom.Title != tt.wantTitle || atom.ID != tt.wantFeedURL {
+				t.Errorf("atom: got title %q id %q, want %q %q", atom.Title, atom.ID, tt.wantTitle, tt.wantFeedURL)
+			}
+			if len(atom.Links) == 0 || atom.Links[0].Rel != "self" || atom.Links[0].Href != tt.wantFeedURL+"feed.xml" {
+				t.Errorf("atom: got links %v, want a self link to %s", atom.Links, tt.wantFeedURL+"feed.xml")
+			}
+			var atomItems []Item
+			for _, entry := range atom.Entries {
+				atomItems = append(atomItems, Item{
+					ID:            entry.ID,
+					Title:         entry.Title,
+					Summary:       entry.Summary,
+					DatePublished: entry.Published,
+				})
+			}
+			if diff := testutil.Diff(atomItems, withoutTags(tt.wantItems)); diff != "" {
+				t.Error(testutil.Callers(), diff)
+			}
+
+			var rss rssFeed
+			err = xml.Unmarshal([]byte(readFSFile(t, nbrew.FS, path.Join(outputDir, "rss.xml"))), &rss)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var rssItems []Item
+			for _, item := range rss.Channel.Items {
+				pubDate, err := time.Parse(time.RFC1123Z, item.PubDate)
+				if err != nil {
+					t.Fatal(err)
+				}
+				rssItems = append(rssItems, Item{
+					ID:            item.GUID.Value,
+					Title:         item.Title,
+					Summary:       item.Description,
+					DatePublished: pubDate.Format(time.RFC3339),
+				})
+			}
+			if diff := testutil.Diff(rssItems, withoutTags(tt.wantItems)); diff != "" {
+				t.Error(testutil.Callers(), diff)
+			}
+
+			var jsonfeed jsonFeed
+			err = json.Unmarshal([]byte(readFSFile(t, nbrew.FS, path.Join(outputDir, "feed.json"))), &jsonfeed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if jsonfeed.Version != "https://jsonfeed.org/version/1.1" || jsonfeed.Title != tt.wantTitle || jsonfeed.FeedURL != tt.wantFeedURL+"feed.json" {
+				t.Errorf("json feed: got version %q title %q feed_url %q", jsonfeed.Version, jsonfeed.Title, jsonfeed.FeedURL)
+			}
+			var jsonItems []Item
+			for _, item := range jsonfeed.Items {
+				jsonItems = append(jsonItems, Item{
+					ID:            item.ID,
+					Title:         item.Title,
+					Summary:       item.Summary,
+					DatePublished: item.DatePublished,
+					Tags:          item.Tags,
+				})
+			}
+			if diff := testutil.Diff(jsonItems, tt.wantItems); diff != "" {
+				t.Error(testutil.Callers(), diff)
+			}
+		})
+	}
+
+	t.Run("removed category", func(t *testing.T) {
+		err := os.RemoveAll(filepath.Join(tempDir, "root/posts/travel"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = nbrew.generate(context.Background(), "", "posts/travel")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range feedNames {
+			_, err := fs.Stat(nbrew.FS, path.Join("site/posts/travel", name))
+			if !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("%s: got error %v, want %v", name, err, fs.ErrNotExist)
+			}
+		}
+	})
+}
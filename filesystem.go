@@ -21,21 +21,28 @@ import (
 
 func (nbrew *Notebrew) filesystem(w http.ResponseWriter, r *http.Request, username, sitePrefix, filePath string) {
 	type Entry struct {
-		Name    string     `json:"name,omitempty"`
-		IsDir   bool       `json:"is_dir,omitempty"`
-		Title   string     `json:"title,omitempty"`
-		Preview string     `json:"preview,omitempty"`
-		Size    int64      `json:"size,omitempty"`
-		ModTime *time.Time `json:"mod_time,omitempty"`
+		Name        string     `json:"name,omitempty"`
+		IsDir       bool       `json:"is_dir,omitempty"`
+		Title       string     `json:"title,omitempty"`
+		Preview     string     `json:"preview,omitempty"`
+		Date        *time.Time `json:"date,omitempty"`
+		Tags        []string   `json:"tags,omitempty"`
+		Draft       bool       `json:"draft,omitempty"`
+		Description string     `json:"description,omitempty"`
+		Size        int64      `json:"size,omitempty"`
+		ModTime     *time.Time `json:"mod_time,omitempty"`
 	}
 	type Response struct {
 		Path           string     `json:"path"`
 		IsDir          bool       `json:"is_dir"`
 		Content        string     `json:"content,omitempty"`
+		Draft          *string    `json:"draft,omitempty"`
+		ETag           string     `json:"etag,omitempty"`
 		ModTime        *time.Time `json:"mod_time,omitempty"`
 		Entries        []Entry    `json:"entries,omitempty"`
 		Alerts         url.Values `json:"alerts,omitempty"`
 		ContentSiteURL string     `json:"content_site_url,omitempty"`
+		Clipboard      *clipboard `json:"clipboard,omitempty"`
 		Sort           string     `json:"sort,omitempty"`
 		Order          string     `json:"order,omitempty"`
 	}
@@ -45,6 +52,10 @@ func (nbrew *Notebrew) filesystem(w http.ResponseWriter, r *http.Request, userna
 		logger = slog.Default()
 	}
 
+	if r.Method == "POST" && isEditable(filePath) {
+		nbrew.saveFile(w, r, username, sitePrefix, filePath)
+		return
+	}
 	if r.Method != "GET" {
 		http.Error(w, "405 Method Not Allowed", http.StatusMethodNotAllowed)
 		return
@@ -63,17 +74,13 @@ func (nbrew *Notebrew) filesystem(w http.ResponseWriter, r *http.Request, userna
 	}
 	nbrew.clearSession(w, r, "flash")
 	response.Path = filePath
-	if strings.Contains(sitePrefix, ".") {
-		response.ContentSiteURL = "https://" + sitePrefix + "/"
-	} else if sitePrefix != "" {
-		if nbrew.MultisiteMode == "subdomain" {
-			response.ContentSiteURL = nbrew.Scheme + strings.TrimPrefix(sitePrefix, "@") + "." + nbrew.ContentDomain + "/"
-		} else if nbrew.MultisiteMode == "subdirectory" {
-			response.ContentSiteURL = nbrew.Scheme + nbrew.ContentDomain + "/" + sitePrefix + "/"
-		}
+	response.ContentSiteURL = nbrew.contentSiteURL(sitePrefix)
+	clip, ok, err := nbrew.getClipboard(r)
+	if err != nil {
+		logger.Error(err.Error())
 	}
-	if response.ContentSiteURL == "" {
-		response.ContentSiteURL = nbrew.Scheme + nbrew.ContentDomain + "/"
+	if ok {
+		response.Clipboard = &clip
 	}
 	head, _, _ := strings.Cut(response.Path, "/")
 	if response.IsDir && (head == "notes" || head == "posts") {
@@ -91,7 +98,7 @@ func (nbrew *Notebrew) filesystem(w http.ResponseWriter, r *http.Request, userna
 		}
 	}
 	switch response.Sort {
-	case "name", "created", "edited", "title":
+	case "name", "created", "edited", "title", "date":
 		break
 	default:
 		if head == "notes" || head == "posts" {
@@ -111,7 +118,7 @@ func (nbrew *Notebrew) filesystem(w http.ResponseWriter, r *http.Request, userna
 	case "asc", "desc":
 		break
 	default:
-		if response.Sort == "created" || response.Sort == "edited" {
+		if response.Sort == "created" || response.Sort == "edited" || response.Sort == "date" {
 			response.Order = "desc"
 		} else {
 			response.Order = "asc"
@@ -158,6 +165,10 @@ func (nbrew *Notebrew) filesystem(w http.ResponseWriter, r *http.Request, userna
 		"dir":              path.Dir,
 		"trimPrefix":       strings.TrimPrefix,
 		"fileSizeToString": fileSizeToString,
+		"isVersioned":      isVersioned,
+		"isEditable":       isEditable,
+		"isPreviewable":    isPreviewable,
+		"deref":            func(s *string) string { return *s },
 		"safeHTML":         func(s string) template.HTML { return template.HTML(s) },
 		"isEven":           func(i int) bool { return i%2 == 0 },
 		"username":         func() string { return username },
@@ -211,6 +222,11 @@ func (nbrew *Notebrew) filesystem(w http.ResponseWriter, r *http.Request, userna
 		}
 		modTime := fileInfo.ModTime()
 		response.ModTime = &modTime
+		// The ETag is for the contents of the file rather than the page, so
+		// that it can be sent back in an If-Match header (or the etag field of
+		// the editor) when the file is written to.
+		response.ETag = contentETag([]byte(response.Content))
+		w.Header().Set("ETag", response.ETag)
 		accept, _, _ := mime.ParseMediaType(r.Header.Get("Accept"))
 		if accept == "application/json" {
 			w.Header().Set("Content-Type", "application/json")
@@ -224,6 +240,22 @@ func (nbrew *Notebrew) filesystem(w http.ResponseWriter, r *http.Request, userna
 			w.Write(b)
 			return
 		}
+		contentSecurityPolicy := defaultContentSecurityPolicy
+		var importMap template.HTML
+		if path.Ext(response.Path) == ".md" && isEditable(response.Path) {
+			var hashSource string
+			importMap, hashSource, err = editorImportMap()
+			if err != nil {
+				logger.Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+			contentSecurityPolicy = strings.Replace(contentSecurityPolicy, "script-src 'self'", "script-src 'self' "+hashSource, 1)
+		}
+		if isPreviewable(response.Path) {
+			contentSecurityPolicy += "; frame-src 'self'"
+		}
+		funcMap["importMap"] = func() template.HTML { return importMap }
 		tmpl, err := template.New("filesystem_file.html").Funcs(funcMap).ParseFS(rootFS, "filesystem_file.html")
 		if err != nil {
 			logger.Error(err.Error())
@@ -239,7 +271,7 @@ func (nbrew *Notebrew) filesystem(w http.ResponseWriter, r *http.Request, userna
 			internalServerError(w, r, err)
 			return
 		}
-		w.Header().Add("Content-Security-Policy", defaultContentSecurityPolicy)
+		w.Header().Add("Content-Security-Policy", contentSecurityPolicy)
 		buf.WriteTo(w)
 		return
 	}
@@ -379,13 +411,34 @@ func (nbrew *Notebrew) filesystem(w http.ResponseWriter, r *http.Request, userna
 		entry.ModTime = &modTime
 		entry.Size = fileInfo.Size()
 		if head == "notes" || head == "posts" {
+			// Only the front matter and the first few lines are read, so
+			// listing a folder does not cost the size of every file in it.
 			file, err := nbrew.FS.Open(path.Join(sitePrefix, response.Path, entry.Name))
 			if err != nil {
 				logger.Error(err.Error(), slog.String("name", entry.Name))
 				internalServerError(w, r, err)
 				return
 			}
-			entry.Title, entry.Preview = getTitleAndPreview(file)
+			// A malformed front matter should not prevent the folder from
+			// being listed, so we make do with whatever was parsed.
+			frontMatter, title, preview, err := readTitleAndPreview(file)
+			file.Close()
+			if err != nil {
+				logger.Warn(err.Error(), slog.String("name", entry.Name))
+			}
+			entry.Title, entry.Preview = title, preview
+			if frontMatter.Title != "" {
+				entry.Title = frontMatter.Title
+			}
+			if frontMatter.Description != "" {
+				entry.Preview = frontMatter.Description
+			}
+			if !frontMatter.Date.IsZero() {
+				entry.Date = &frontMatter.Date
+			}
+			entry.Tags = frontMatter.Tags
+			entry.Draft = frontMatter.Draft
+			entry.Description = frontMatter.Description
 		}
 		files = append(files, entry)
 	}
@@ -409,6 +462,26 @@ func (nbrew *Notebrew) filesystem(w http.ResponseWriter, r *http.Request, userna
 			}
 			return !less
 		})
+	case "date":
+		// Entries without a date in their front matter are sorted by their
+		// modification time instead.
+		entryDate := func(entry Entry) time.Time {
+			if entry.Date != nil {
+				return *entry.Date
+			}
+			return *entry.ModTime
+		}
+		sort.SliceStable(files, func(i, j int) bool {
+			t1, t2 := entryDate(files[i]), entryDate(files[j])
+			if t1.Equal(t2) {
+				return false
+			}
+			less := t1.Before(t2)
+			if response.Order == "asc" {
+				return less
+			}
+			return !less
+		})
 	case "title":
 		if head == "notes" || head == "posts" {
 			sort.Slice(files, func(i, j int) bool {
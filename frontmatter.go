@@ -0,0 +1,176 @@
+package nb6
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FrontMatter is the optional metadata at the top of a note or post. It is
+// written either as YAML between a pair of "---" lines or as TOML between a
+// pair of "+++" lines:
+//
+//	---
+//	title: My day trip to Hokkaido
+//	date: 2023-07-21
+//	tags: [travel, japan]
+//	draft: false
+//	description: Snow, seafood and a lot of walking.
+//	---
+//
+// Only a small subset of YAML and TOML is understood: one "key: value" (or
+// "key = value") per line, where a value is a string (optionally quoted), a
+// boolean, a date, or a list of strings in square brackets. YAML lists may
+// also be written as "- item" lines below the key. Unrecognized keys are
+// ignored.
+type FrontMatter struct {
+	Title       string    `json:"title,omitempty"`
+	Date        time.Time `json:"date,omitempty"`
+	Tags        []string  `json:"tags,omitempty"`
+	Draft       bool      `json:"draft,omitempty"`
+	Description string    `json:"description,omitempty"`
+}
+
+// splitFrontMatter splits b into its front matter and the markdown content
+// that follows. The delimiter is "---" for YAML and "+++" for TOML. If b has
+// no front matter, frontMatter is nil and markdown is b.
+func splitFrontMatter(b []byte) (frontMatter []byte, delimiter string, markdown []byte) {
+	for _, delimiter := range []string{"---", "+++"} {
+		rest, ok := bytes.CutPrefix(b, []byte(delimiter+"\n"))
+		if !ok {
+			rest, ok = bytes.CutPrefix(b, []byte(delimiter+"\r\n"))
+			if !ok {
+				continue
+			}
+		}
+		for i := 0; i < len(rest); {
+			end := bytes.IndexByte(rest[i:], '\n')
+			if end < 0 {
+				end = len(rest)
+			} else {
+				end += i + 1
+			}
+			if string(bytes.TrimSpace(rest[i:end])) == delimiter {
+				return rest[:i], delimiter, rest[end:]
+			}
+			i = end
+		}
+		return nil, "", b
+	}
+	return nil, "", b
+}
+
+// parseFrontMatter parses the front matter (if any) at the top of b and
+// returns it together with the markdown content that follows. An invalid
+// value does not stop the rest of the front matter from being parsed: it is
+// left out (an invalid draft is taken to mean draft, so that a post is never
+// published by mistake) and the first such error is returned alongside
+// everything else.
+func parseFrontMatter(b []byte) (frontMatter FrontMatter, markdown []byte, err error) {
+	text, delimiter, markdown := splitFrontMatter(b)
+	if delimiter == "" {
+		return frontMatter, markdown, nil
+	}
+	separator := ":"
+	if delimiter == "+++" {
+		separator = "="
+	}
+	var listKey string // the YAML key whose "- item" lines are being read
+	for _, line := range strings.Split(string(text), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if listKey != "" && strings.HasPrefix(line, "- ") {
+			if listKey == "tags" {
+				frontMatter.Tags = append(frontMatter.Tags, unquoteFrontMatterValue(strings.TrimSpace(line[2:])))
+			}
+			continue
+		}
+		key, value, ok := strings.Cut(line, separator)
+		if !ok {
+			continue
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		listKey = ""
+		if value == "" {
+			if delimiter == "---" {
+				listKey = key
+			}
+			continue
+		}
+		switch key {
+		case "title":
+			frontMatter.Title = unquoteFrontMatterValue(value)
+		case "description":
+			frontMatter.Description = unquoteFrontMatterValue(value)
+		case "date", "publish_date":
+			date, parseErr := parseFrontMatterDate(unquoteFrontMatterValue(value))
+			if parseErr != nil {
+				if err == nil {
+					err = fmt.Errorf("front matter: invalid %s %q", key, value)
+				}
+				continue
+			}
+			frontMatter.Date = date
+		case "draft":
+			draft, parseErr := strconv.ParseBool(unquoteFrontMatterValue(value))
+			if parseErr != nil {
+				if err == nil {
+					err = fmt.Errorf("front matter: invalid draft %q", value)
+				}
+				draft = true
+			}
+			frontMatter.Draft = draft
+		case "tags":
+			if !strings.HasPrefix(value, "[") || !strings.HasSuffix(value, "]") {
+				frontMatter.Tags = append(frontMatter.Tags, unquoteFrontMatterValue(value))
+				continue
+			}
+			for _, tag := range strings.Split(value[1:len(value)-1], ",") {
+				tag = unquoteFrontMatterValue(strings.TrimSpace(tag))
+				if tag != "" {
+					frontMatter.Tags = append(frontMatter.Tags, tag)
+				}
+			}
+		}
+	}
+	return frontMatter, markdown, err
+}
+
+// unquoteFrontMatterValue strips the quotes around a front matter value, or
+// the trailing comment if the value is not quoted.
+func unquoteFrontMatterValue(value string) string {
+	if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') {
+		if end := strings.IndexByte(value[1:], value[0]); end >= 0 {
+			if value[0] == '"' {
+				if s, err := strconv.Unquote(value[:end+2]); err == nil {
+					return s
+				}
+			}
+			return value[1 : end+1]
+		}
+	}
+	if i := strings.Index(value, " #"); i >= 0 {
+		value = strings.TrimSpace(value[:i])
+	}
+	return value
+}
+
+// parseFrontMatterDate parses a date in one of the formats commonly found in
+// front matter. Dates without a time zone are taken to be in UTC.
+func parseFrontMatterDate(value string) (time.Time, error) {
+	date, err := time.Parse(time.RFC3339, value)
+	if err == nil {
+		return date, nil
+	}
+	for _, layout := range []string{"2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02T15:04", "2006-01-02 15:04", "2006-01-02"} {
+		date, err = time.ParseInLocation(layout, value, time.UTC)
+		if err == nil {
+			return date, nil
+		}
+	}
+	return time.Time{}, err
+}
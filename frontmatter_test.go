@@ -0,0 +1,201 @@
+package nb6
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bokwoon95/nb6/internal/testutil"
+)
+
+func TestParseFrontMatter(t *testing.T) {
+	type TestTable struct {
+		description     string
+		text            string
+		wantFrontMatter FrontMatter
+		wantMarkdown    string
+		wantErr         bool
+	}
+
+	tests := []TestTable{{
+		description:  "no front matter",
+		text:         "# hello\n",
+		wantMarkdown: "# hello\n",
+	}, {
+		description: "yaml",
+		text:        "---\ntitle: Hello\ndate: 2023-07-21\ntags: [a, b]\ndraft: true\n---\n# hello\n",
+		wantFrontMatter: FrontMatter{
+			Title: "Hello",
+			Date:  time.Date(2023, 7, 21, 0, 0, 0, 0, time.UTC),
+			Tags:  []string{"a", "b"},
+			Draft: true,
+		},
+		wantMarkdown: "# hello\n",
+	}, {
+		description: "invalid date does not stop the rest from being parsed",
+		text:        "---\ndate: yesterday\ntitle: Hello\ntags: [a]\n---\n# hello\n",
+		wantFrontMatter: FrontMatter{
+			Title: "Hello",
+			Tags:  []string{"a"},
+		},
+		wantMarkdown: "# hello\n",
+		wantErr:      true,
+	}, {
+		description: "invalid draft is taken to mean draft",
+		text:        "+++\ndraft = maybe\ntitle = \"Hello\"\n+++\n# hello\n",
+		wantFrontMatter: FrontMatter{
+			Title: "Hello",
+			Draft: true,
+		},
+		wantMarkdown: "# hello\n",
+		wantErr:      true,
+	}, {
+		description:  "unclosed front matter",
+		text:         "---\n# hello\nworld\n",
+		wantMarkdown: "---\n# hello\nworld\n",
+	}}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.description, func(t *testing.T) {
+			frontMatter, markdown, err := parseFrontMatter([]byte(tt.text))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if diff := testutil.Diff(frontMatter, tt.wantFrontMatter); diff != "" {
+				t.Error(testutil.Callers(), diff)
+			}
+			if diff := testutil.Diff(string(markdown), tt.wantMarkdown); diff != "" {
+				t.Error(testutil.Callers(), diff)
+			}
+		})
+	}
+}
+
+func TestGetTitleAndPreview(t *testing.T) {
+	type TestTable struct {
+		description string
+		text        string
+		wantTitle   string
+		wantPreview string
+	}
+
+	tests := []TestTable{{
+		description: "plain",
+		text:        "# Hello\n\nworld\nmore",
+		wantTitle:   "Hello",
+		wantPreview: "world",
+	}, {
+		description: "front matter",
+		text:        "---\ntitle: x\n---\n# Hello\nworld\n",
+		wantTitle:   "Hello",
+		wantPreview: "world",
+	}, {
+		description: "unclosed front matter",
+		text:        "---\n# Hello\nworld\n",
+		wantTitle:   "Hello",
+		wantPreview: "world",
+	}}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.description, func(t *testing.T) {
+			title, preview := getTitleAndPreview(io.NopCloser(strings.NewReader(tt.text)))
+			if title != tt.wantTitle {
+				t.Errorf("got title %q, want %q", title, tt.wantTitle)
+			}
+			if preview != tt.wantPreview {
+				t.Errorf("got preview %q, want %q", preview, tt.wantPreview)
+			}
+		})
+	}
+}
+
+// unreadable is a reader that fails the test if it is ever read from.
+type unreadable struct{ t *testing.T }
+
+func (r unreadable) Read(p []byte) (int, error) {
+	r.t.Error("read past the preview")
+	return 0, io.EOF
+}
+
+func TestReadTitleAndPreview(t *testing.T) {
+	type TestTable struct {
+		description     string
+		text            string
+		wantFrontMatter FrontMatter
+		wantTitle       string
+		wantPreview     string
+	}
+
+	tests := []TestTable{{
+		description: "no front matter",
+		text:        "# Hello\n\nworld\n",
+		wantTitle:   "Hello",
+		wantPreview: "world",
+	}, {
+		description:     "yaml front matter",
+		text:            "---\ntitle: x\ndescription: d\n---\n# Hello\nworld\n",
+		wantFrontMatter: FrontMatter{Title: "x", Description: "d"},
+		wantTitle:       "Hello",
+		wantPreview:     "world",
+	}, {
+		description:     "toml front matter",
+		text:            "+++\r\ndraft = true\r\n+++\r\n\r\n# Hello\r\nworld\r\n",
+		wantFrontMatter: FrontMatter{Draft: true},
+		wantTitle:       "Hello",
+		wantPreview:     "world",
+	}}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.description, func(t *testing.T) {
+			// Anything after the preview must not be read.
+			r := io.MultiReader(strings.NewReader(tt.text), unreadable{t})
+			frontMatter, title, preview, err := readTitleAndPreview(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := testutil.Diff(frontMatter, tt.wantFrontMatter); diff != "" {
+				t.Error(testutil.Callers(), diff)
+			}
+			if title != tt.wantTitle {
+				t.Errorf("got title %q, want %q", title, tt.wantTitle)
+			}
+			if preview != tt.wantPreview {
+				t.Errorf("got preview %q, want %q", preview, tt.wantPreview)
+			}
+		})
+	}
+}
+
+func TestGetPostsWithInvalidFrontMatter(t *testing.T) {
+	nbrew, tempDir := newTestLocalNotebrew(t, map[string]string{
+		"root/posts/a.md": "---\ndate: not a date\n---\n# A\n",
+		"root/posts/b.md": "---\ndate: 2023-07-21\n---\n# B\n",
+		"root/posts/c.md": "---\ndraft: nope\n---\n# C\n",
+	})
+	modTime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	err := os.Chtimes(filepath.Join(tempDir, "root/posts/a.md"), modTime, modTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	posts, err := nbrew.getPosts(context.Background(), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var titles []string
+	for _, post := range posts {
+		titles = append(titles, post.Title)
+		if post.Title == "A" && !post.PublishDate.Equal(modTime) {
+			t.Errorf("got publish date %v for A, want its modification time %v", post.PublishDate, modTime)
+		}
+	}
+	if diff := testutil.Diff(titles, []string{"A", "B"}); diff != "" {
+		t.Error(testutil.Callers(), diff)
+	}
+}
@@ -6,6 +6,9 @@ import (
 	"io/fs"
 	"os"
 	"path"
+	"sort"
+	"strings"
+	"syscall"
 )
 
 type FS interface {
@@ -33,14 +36,55 @@ type FS interface {
 	Rename(oldname, newname string) error
 }
 
-// OpenReaderFrom(name string, perm fs.FileMode) (io.ReaderFrom, error)
+// StatFS is an FS that can look up a file without opening it.
+type StatFS interface {
+	FS
+	Stat(name string) (fs.FileInfo, error)
+}
+
+// WalkDirFS is an FS that can walk a file tree more efficiently than
+// fs.WalkDir, e.g. by listing the whole tree at once. WalkDir must behave
+// like fs.WalkDir.
+type WalkDirFS interface {
+	FS
+	WalkDir(root string, fn fs.WalkDirFunc) error
+}
+
+// RemoveAllFS is an FS that can remove a file or directory and everything
+// inside it at once. Like os.RemoveAll, RemoveAll does nothing if name does
+// not exist.
+type RemoveAllFS interface {
+	FS
+	RemoveAll(name string) error
+}
+
+// MkdirAllFS is an FS that can create a directory along with any necessary
+// parents at once. Like os.MkdirAll, MkdirAll does nothing if name is already
+// a directory.
+type MkdirAllFS interface {
+	FS
+	MkdirAll(name string, perm fs.FileMode) error
+}
+
+// CopyFS is an FS that can copy files without reading them out and writing
+// them back in. Copy copies srcName to destName: if srcName is a directory it
+// is copied recursively, and destName must not exist. If srcName is a file
+// and destName is an existing file, destName is replaced.
+type CopyFS interface {
+	FS
+	Copy(srcName, destName string) error
+}
 
 type LocalFS struct {
 	RootDir string
 	TempDir string
 }
 
-var _ FS = (*LocalFS)(nil)
+var (
+	_ StatFS      = (*LocalFS)(nil)
+	_ RemoveAllFS = (*LocalFS)(nil)
+	_ MkdirAllFS  = (*LocalFS)(nil)
+)
 
 func (localFS *LocalFS) String() string {
 	return localFS.RootDir
@@ -50,6 +94,10 @@ func (localFS *LocalFS) Open(name string) (fs.File, error) {
 	return os.Open(path.Join(localFS.RootDir, name))
 }
 
+func (localFS *LocalFS) Stat(name string) (fs.FileInfo, error) {
+	return os.Stat(path.Join(localFS.RootDir, name))
+}
+
 func (localFS *LocalFS) OpenReaderFrom(name string, perm fs.FileMode) (io.ReaderFrom, error) {
 	return &localFile{
 		localFS: localFS,
@@ -129,74 +177,155 @@ func (localFile *localFile) ReadFrom(r io.Reader) (n int64, err error) {
 	return n, nil
 }
 
-// func mkdirAll()
-
-// removeAll removes the root item from the FS (whether it is a file or a
-// directory).
-func removeAll(fsys FS, root string) error {
-	type Item struct {
-		Path             string // relative to root
-		IsFile           bool   // whether item is file or directory
-		MarkedForRemoval bool   // if true, remove item unconditionally
+// mkdirAll creates a directory named dir along with any necessary parents. If
+// dir is already a directory, mkdirAll does nothing.
+func mkdirAll(fsys FS, dir string, perm fs.FileMode) error {
+	if fsys, ok := fsys.(MkdirAllFS); ok {
+		return fsys.MkdirAll(dir, perm)
 	}
-	fileInfo, err := fs.Stat(fsys, root)
-	if err != nil {
+	fileInfo, err := fs.Stat(fsys, dir)
+	if err == nil {
+		if !fileInfo.IsDir() {
+			return &fs.PathError{Op: "mkdir", Path: dir, Err: syscall.ENOTDIR}
+		}
+		return nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
 		return err
 	}
-	// If root is a file, we can remove it immediately and return.
-	if !fileInfo.IsDir() {
-		return fsys.Remove(root)
+	// Otherwise, create each missing directory from the top down.
+	parent := path.Dir(dir)
+	if parent != "." && parent != "/" {
+		err = mkdirAll(fsys, parent, perm)
+		if err != nil {
+			return err
+		}
 	}
-	// If root is an empty directory, we can remove it immediately and return.
-	dirEntries, err := fsys.ReadDir(root)
-	if len(dirEntries) == 0 {
-		return fsys.Remove(root)
+	err = fsys.Mkdir(dir, perm)
+	if err != nil && !errors.Is(err, fs.ErrExist) {
+		return err
 	}
-	// If the filesystem supports RemoveAll(), we can call that instead and
-	// return.
-	if fsys, ok := fsys.(interface{ RemoveAll(name string) error }); ok {
-		return fsys.RemoveAll(root)
+	return nil
+}
+
+// walkDir walks the file tree rooted at root like fs.WalkDir, using the
+// WalkDir method of the FS if it has one.
+func walkDir(fsys FS, root string, fn fs.WalkDirFunc) error {
+	if fsys, ok := fsys.(WalkDirFS); ok {
+		return fsys.WalkDir(root, fn)
 	}
-	// Otherwise, we need to recursively delete its child items one by one.
-	var item Item
-	items := make([]Item, 0, len(dirEntries))
-	for i := len(dirEntries) - 1; i >= 0; i-- {
-		dirEntry := dirEntries[i]
-		items = append(items, Item{
-			Path:   path.Join(root, dirEntry.Name()),
-			IsFile: !dirEntry.IsDir(),
+	return fs.WalkDir(fsys, root, fn)
+}
+
+// walkDirEntries walks the file tree rooted at root like fs.WalkDir, except
+// that the entries of each directory are looked up in children (keyed by
+// directory name) instead of being read from an FS. It lets an FS that can
+// list a whole file tree at once implement WalkDir.
+func walkDirEntries(root string, rootEntry fs.DirEntry, children map[string][]fs.DirEntry, fn fs.WalkDirFunc) error {
+	var walk func(name string, dirEntry fs.DirEntry) error
+	walk = func(name string, dirEntry fs.DirEntry) error {
+		err := fn(name, dirEntry, nil)
+		if err != nil || !dirEntry.IsDir() {
+			if err == fs.SkipDir && dirEntry.IsDir() {
+				err = nil
+			}
+			return err
+		}
+		dirEntries := children[name]
+		sort.Slice(dirEntries, func(i, j int) bool {
+			return dirEntries[i].Name() < dirEntries[j].Name()
 		})
-	}
-	for len(items) > 0 {
-		// Pop item from stack.
-		item, items = items[len(items)-1], items[:len(items)-1]
-		// If item has been marked for removal or it is a file, we can remove
-		// it immediately.
-		if item.MarkedForRemoval || item.IsFile {
-			err = fsys.Remove(path.Join(root, item.Path))
+		for _, dirEntry := range dirEntries {
+			err := walk(path.Join(name, dirEntry.Name()), dirEntry)
 			if err != nil {
+				if err == fs.SkipDir {
+					break
+				}
 				return err
 			}
-			continue
 		}
-		// Mark directory item for removal and put it back in the stack (when
-		// we get back to it, its child items would already have been removed).
-		item.MarkedForRemoval = true
-		items = append(items, item)
-		// Push directory item's child items onto the stack.
-		dirEntries, err := fsys.ReadDir(path.Join(root, item.Path))
+		return nil
+	}
+	err := walk(root, rootEntry)
+	if err == fs.SkipDir || err == fs.SkipAll {
+		return nil
+	}
+	return err
+}
+
+// removeAll removes the root item from the FS (whether it is a file or a
+// directory). Unlike os.RemoveAll, it returns an error if root does not
+// exist.
+func removeAll(fsys FS, root string) error {
+	_, err := fs.Stat(fsys, root)
+	if err != nil {
+		return err
+	}
+	if fsys, ok := fsys.(RemoveAllFS); ok {
+		return fsys.RemoveAll(root)
+	}
+	// Otherwise, remove every item in the reverse order of the walk so that
+	// the child items of each directory are removed before the directory
+	// itself.
+	var names []string
+	err = walkDir(fsys, root, func(name string, dirEntry fs.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
-		for i := len(dirEntries) - 1; i >= 0; i-- {
-			dirEntry := dirEntries[i]
-			items = append(items, Item{
-				Path:   path.Join(root, dirEntry.Name()),
-				IsFile: !dirEntry.IsDir(),
-			})
+		names = append(names, name)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for i := len(names) - 1; i >= 0; i-- {
+		err = fsys.Remove(names[i])
+		if err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
-// func move()
+// move moves the src item to dest (whether it is a file or a directory). The
+// parent directory of dest must exist, and dest itself must not.
+func move(fsys FS, src, dest string) error {
+	fileInfo, err := fs.Stat(fsys, src)
+	if err != nil {
+		return err
+	}
+	// Try to rename src in one go first, which always works for files and
+	// for directories on LocalFS and DatabaseFS.
+	err = fsys.Rename(src, dest)
+	if err == nil || !fileInfo.IsDir() {
+		return err
+	}
+	// Otherwise, we need to recreate the directory tree in dest and move the
+	// files over one by one.
+	return moveTree(fsys, src, dest)
+}
+
+// moveTree moves the contents of the src directory into dest one file at a
+// time, creating dest and its subdirectories as needed, and then removes src.
+// Directories that already exist in dest are reused, so calling moveTree again
+// finishes a moveTree that was interrupted.
+func moveTree(fsys FS, src, dest string) error {
+	err := walkDir(fsys, src, func(name string, dirEntry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		destName := path.Join(dest, strings.TrimPrefix(name, src))
+		if dirEntry.IsDir() {
+			err := fsys.Mkdir(destName, 0755)
+			if err != nil && !errors.Is(err, fs.ErrExist) {
+				return err
+			}
+			return nil
+		}
+		return fsys.Rename(name, destName)
+	})
+	if err != nil {
+		return err
+	}
+	return removeAll(fsys, src)
+}
@@ -0,0 +1,275 @@
+package nb6
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/bokwoon95/nb6/internal/testutil"
+)
+
+// writeFSFile writes contents to name in fsys.
+func writeFSFile(t *testing.T, fsys FS, name, contents string) {
+	t.Helper()
+	readerFrom, err := fsys.OpenReaderFrom(name, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = readerFrom.ReadFrom(strings.NewReader(contents))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readFSFile returns the contents of name in fsys.
+func readFSFile(t *testing.T, fsys FS, name string) string {
+	t.Helper()
+	file, err := fsys.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	b, err := io.ReadAll(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+// listFSFiles returns the names of every file (but not directory) in fsys,
+// sorted.
+func listFSFiles(t *testing.T, fsys FS) []string {
+	t.Helper()
+	var names []string
+	err := walkDir(fsys, ".", func(name string, dirEntry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !dirEntry.IsDir() {
+			names = append(names, name)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// testFS checks that fsys, which must be empty, behaves the way the rest of
+// the package expects an FS to behave. Each step builds on the previous one.
+func testFS(t *testing.T, fsys FS) {
+	for _, dir := range []string{"notes", "notes/dir", "notes/dir/sub", "posts"} {
+		err := fsys.Mkdir(dir, 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFSFile(t, fsys, "notes/a.md", "a")
+	writeFSFile(t, fsys, "notes/dir/b.md", "b")
+	writeFSFile(t, fsys, "notes/dir/sub/c.md", "c")
+
+	t.Run("read", func(t *testing.T) {
+		if got := readFSFile(t, fsys, "notes/a.md"); got != "a" {
+			t.Errorf("got %q, want %q", got, "a")
+		}
+		fileInfo, err := fs.Stat(fsys, "notes/a.md")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fileInfo.IsDir() || fileInfo.Size() != 1 {
+			t.Errorf("got isDir %v size %d, want a file of size 1", fileInfo.IsDir(), fileInfo.Size())
+		}
+		fileInfo, err = fs.Stat(fsys, "notes/dir")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !fileInfo.IsDir() {
+			t.Error("notes/dir is not a directory")
+		}
+		_, err = fsys.Open("notes/missing.md")
+		if !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("got error %v, want %v", err, fs.ErrNotExist)
+		}
+	})
+
+	t.Run("overwrite", func(t *testing.T) {
+		writeFSFile(t, fsys, "notes/overwrite.md", "a longer file")
+		writeFSFile(t, fsys, "notes/overwrite.md", "short")
+		if got := readFSFile(t, fsys, "notes/overwrite.md"); got != "short" {
+			t.Errorf("got %q, want %q", got, "short")
+		}
+		err := fsys.Remove("notes/overwrite.md")
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("readdir", func(t *testing.T) {
+		dirEntries, err := fsys.ReadDir("notes")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, dirEntry := range dirEntries {
+			name := dirEntry.Name()
+			if dirEntry.IsDir() {
+				name += "/"
+			}
+			names = append(names, name)
+		}
+		if diff := testutil.Diff(names, []string{"a.md", "dir/"}); diff != "" {
+			t.Error(testutil.Callers(), diff)
+		}
+		_, err = fsys.ReadDir("missing")
+		if !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("got error %v, want %v", err, fs.ErrNotExist)
+		}
+	})
+
+	t.Run("mkdir", func(t *testing.T) {
+		err := fsys.Mkdir("notes/dir", 0755)
+		if !errors.Is(err, fs.ErrExist) {
+			t.Errorf("mkdir existing: got error %v, want %v", err, fs.ErrExist)
+		}
+		err = fsys.Mkdir("missing/dir", 0755)
+		if !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("mkdir without parent: got error %v, want %v", err, fs.ErrNotExist)
+		}
+		err = fsys.Mkdir("notes/empty", 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dirEntries, err := fsys.ReadDir("notes/empty")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(dirEntries) != 0 {
+			t.Errorf("got %d entries in a new directory, want 0", len(dirEntries))
+		}
+		err = fsys.Remove("notes/empty")
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("remove non-empty directory", func(t *testing.T) {
+		err := fsys.Remove("notes/dir")
+		if err == nil {
+			t.Fatal("removed a non-empty directory")
+		}
+		if got := readFSFile(t, fsys, "notes/dir/b.md"); got != "b" {
+			t.Errorf("got %q, want %q", got, "b")
+		}
+	})
+
+	t.Run("rename file", func(t *testing.T) {
+		err := fsys.Rename("notes/a.md", "posts/a.md")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := readFSFile(t, fsys, "posts/a.md"); got != "a" {
+			t.Errorf("got %q, want %q", got, "a")
+		}
+		_, err = fs.Stat(fsys, "notes/a.md")
+		if !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("got error %v, want %v", err, fs.ErrNotExist)
+		}
+	})
+
+	t.Run("rename directory", func(t *testing.T) {
+		err := fsys.Rename("notes/dir", "posts/dir")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := testutil.Diff(listFSFiles(t, fsys), []string{"posts/a.md", "posts/dir/b.md", "posts/dir/sub/c.md"}); diff != "" {
+			t.Error(testutil.Callers(), diff)
+		}
+		if got := readFSFile(t, fsys, "posts/dir/sub/c.md"); got != "c" {
+			t.Errorf("got %q, want %q", got, "c")
+		}
+	})
+
+	t.Run("move", func(t *testing.T) {
+		err := move(fsys, "posts/dir", "notes/dir")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := testutil.Diff(listFSFiles(t, fsys), []string{"notes/dir/b.md", "notes/dir/sub/c.md", "posts/a.md"}); diff != "" {
+			t.Error(testutil.Callers(), diff)
+		}
+		_, err = fs.Stat(fsys, "posts/dir")
+		if !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("got error %v, want %v", err, fs.ErrNotExist)
+		}
+	})
+
+	t.Run("copy", func(t *testing.T) {
+		fsys, ok := fsys.(CopyFS)
+		if !ok {
+			t.Skip("not a CopyFS")
+		}
+		err := fsys.Copy("notes/dir", "posts/dir")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := testutil.Diff(listFSFiles(t, fsys), []string{"notes/dir/b.md", "notes/dir/sub/c.md", "posts/a.md", "posts/dir/b.md", "posts/dir/sub/c.md"}); diff != "" {
+			t.Error(testutil.Callers(), diff)
+		}
+		err = fsys.Copy("notes/dir", "notes/dir/sub/dir")
+		if err == nil {
+			t.Error("copied a directory into itself")
+		}
+		err = removeAll(fsys, "posts/dir")
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("removeall", func(t *testing.T) {
+		err := removeAll(fsys, "notes/dir")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := testutil.Diff(listFSFiles(t, fsys), []string{"posts/a.md"}); diff != "" {
+			t.Error(testutil.Callers(), diff)
+		}
+		_, err = fs.Stat(fsys, "notes/dir")
+		if !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("got error %v, want %v", err, fs.ErrNotExist)
+		}
+		err = removeAll(fsys, "notes/dir")
+		if !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("got error %v, want %v", err, fs.ErrNotExist)
+		}
+	})
+
+	t.Run("large file", func(t *testing.T) {
+		// Larger than the minimum S3 part size, so that S3FS uploads it in
+		// more than one part.
+		contents := bytes.Repeat([]byte("0123456789abcdef"), 11<<16)
+		readerFrom, err := fsys.OpenReaderFrom("notes/large.bin", 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := readerFrom.ReadFrom(bytes.NewReader(contents))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != int64(len(contents)) {
+			t.Errorf("wrote %d bytes, want %d", n, len(contents))
+		}
+		if got := readFSFile(t, fsys, "notes/large.bin"); got != string(contents) {
+			t.Errorf("got %d bytes back, want %d", len(got), len(contents))
+		}
+	})
+}
+
+func TestLocalFS(t *testing.T) {
+	testFS(t, &LocalFS{RootDir: t.TempDir()})
+}
@@ -0,0 +1,486 @@
+package nb6
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// generate regenerates the static HTML in the site folder for each of the
+// named files or folders (relative to the sitePrefix). Only names under pages/
+// and posts/ have generated output, everything else is ignored. If a name no
+// longer exists its generated output is removed, which means generate should
+// be called with both the old and new names whenever something is renamed or
+// moved. Names under notes/, pages/ and posts/ are also updated in the search
+// index, and images under site/images/ are processed (see processImages).
+// Problems that do not stop generation, such as a malformed front matter, are
+// logged to the logger in ctx.
+func (nbrew *Notebrew) generate(ctx context.Context, sitePrefix string, names ...string) error {
+	var postNames []string
+	for _, name := range names {
+		name = strings.Trim(path.Clean(name), "/")
+		head, tail, _ := strings.Cut(name, "/")
+		if head == "notes" || head == "pages" || head == "posts" {
+			err := nbrew.indexSearchableFiles(ctx, sitePrefix, name)
+			if err != nil {
+				return err
+			}
+		}
+		var err error
+		switch head {
+		case "pages":
+			err = nbrew.generatePages(sitePrefix, tail)
+		case "posts":
+			postNames = append(postNames, tail)
+			err = nbrew.generatePosts(ctx, sitePrefix, tail)
+		case "site":
+			if tail == "images" || strings.HasPrefix(tail, "images/") {
+				err = nbrew.processImages(sitePrefix, name)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	// The tag pages and the feeds in the root of the posts folder contain
+	// posts from every category, so they are regenerated with the help of
+	// the post index.
+	if len(postNames) > 0 {
+		return nbrew.updatePostIndex(ctx, sitePrefix, postNames...)
+	}
+	return nil
+}
+
+// postIndexEntry is what the post index of a site records about a published
+// post.
+type postIndexEntry struct {
+	PublishDate time.Time `json:"publish_date"`
+	Tags        []string  `json:"tags,omitempty"`
+}
+
+// updatePostIndex updates the post index of a site for the named posts or
+// categories (relative to the posts folder), then regenerates the pages of
+// the tags that those posts had before or have now, as well as the feeds in
+// the root of the posts folder.
+//
+// The post index (system/posts.json) maps the name of every published post to
+// its publish date and tags, so that saving a post does not mean reading every
+// other post to find the ones that share its tags or that are recent enough
+// to be in the feeds. If a site has no post index yet, it is built from every
+// post and every tag page is regenerated.
+func (nbrew *Notebrew) updatePostIndex(ctx context.Context, sitePrefix string, names ...string) error {
+	nbrew.postIndexMutex.Lock()
+	defer nbrew.postIndexMutex.Unlock()
+	indexFile := path.Join(sitePrefix, "system/posts.json")
+	index := make(map[string]postIndexEntry)
+	changedTags := make(map[string]bool)
+	text, err := readFile(nbrew.FS, indexFile)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err == nil {
+		err = json.Unmarshal([]byte(text), &index)
+	}
+	if err != nil {
+		// Build the index from scratch, and regenerate (or remove) every
+		// existing tag page along the way.
+		index = make(map[string]postIndexEntry)
+		names = []string{""}
+		dirEntries, err := nbrew.FS.ReadDir(path.Join(sitePrefix, "site/tags"))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		for _, dirEntry := range dirEntries {
+			if dirEntry.IsDir() {
+				changedTags[dirEntry.Name()] = true
+			}
+		}
+	}
+
+	posts := make(map[string]Post)
+	now := time.Now()
+	for _, name := range names {
+		// Forget what the index knew about the posts under name...
+		for postName, entry := range index {
+			if name == "" || postName == name || strings.HasPrefix(postName, name+"/") {
+				for _, tag := range entry.Tags {
+					changedTags[tag] = true
+				}
+				delete(index, postName)
+			}
+		}
+		// ...and learn what is published there now.
+		var published []Post
+		if path.Ext(name) == ".md" {
+			post, err := nbrew.getPost(ctx, sitePrefix, name)
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+			if err == nil && post.isPublished(now) {
+				published = append(published, post)
+			}
+		} else if name == "" {
+			published, err = nbrew.getAllPosts(ctx, sitePrefix)
+			if err != nil {
+				return err
+			}
+		} else if !strings.Contains(name, "/") {
+			published, err = nbrew.getPosts(ctx, sitePrefix, name)
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+		}
+		for _, post := range published {
+			postName := path.Join(post.Category, post.Name+".md")
+			index[postName] = postIndexEntry{PublishDate: post.PublishDate, Tags: post.Tags}
+			posts[postName] = post
+			for _, tag := range post.Tags {
+				changedTags[tag] = true
+			}
+		}
+	}
+	err = mkdirAll(nbrew.FS, path.Join(sitePrefix, "system"), 0755)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	readerFrom, err := nbrew.FS.OpenReaderFrom(indexFile, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = readerFrom.ReadFrom(bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+
+	// getPosts returns the named posts newest first, reading only the ones
+	// that have not been read yet. Posts that have disappeared or are no
+	// longer published since the index was written are left out.
+	getPosts := func(names []string) ([]Post, error) {
+		postList := make([]Post, 0, len(names))
+		for _, name := range names {
+			post, ok := posts[name]
+			if !ok {
+				post, err = nbrew.getPost(ctx, sitePrefix, name)
+				if err != nil {
+					if errors.Is(err, fs.ErrNotExist) {
+						continue
+					}
+					return nil, err
+				}
+				posts[name] = post
+			}
+			if post.isPublished(now) {
+				postList = append(postList, post)
+			}
+		}
+		sortPosts(postList)
+		return postList, nil
+	}
+	err = nbrew.generateTags(sitePrefix, index, changedTags, getPosts)
+	if err != nil {
+		return err
+	}
+	// Only the newest posts make it into the feeds, and the index is enough
+	// to tell which ones they are.
+	newest := make([]string, 0, len(index))
+	for name := range index {
+		newest = append(newest, name)
+	}
+	sort.Slice(newest, func(i, j int) bool {
+		a, b := index[newest[i]], index[newest[j]]
+		if !a.PublishDate.Equal(b.PublishDate) {
+			return a.PublishDate.After(b.PublishDate)
+		}
+		return strings.TrimSuffix(path.Base(newest[i]), ".md") > strings.TrimSuffix(path.Base(newest[j]), ".md")
+	})
+	if len(newest) > maxFeedItems {
+		newest = newest[:maxFeedItems]
+	}
+	feedPosts, err := getPosts(newest)
+	if err != nil {
+		return err
+	}
+	return nbrew.writeFeeds(sitePrefix, "", feedPosts)
+}
+
+// pageOutputDir returns the folder in the site folder that a page (relative to
+// the pages folder) is generated into. pages/index.html is generated into
+// site/index.html, pages/about.html is generated into site/about/index.html
+// and pages/about/index.html is also generated into site/about/index.html.
+func pageOutputDir(sitePrefix, name string) string {
+	name = strings.TrimSuffix(name, ".html")
+	if path.Base(name) == "index" {
+		name = path.Dir(name)
+	}
+	return path.Join(sitePrefix, "site", name)
+}
+
+// isReservedPage reports whether a page (relative to the pages folder) would
+// be generated into a folder reserved for site assets, posts or tags.
+func isReservedPage(name string) bool {
+	head, _, _ := strings.Cut(name, "/")
+	head = strings.TrimSuffix(head, ".html")
+	return head == "themes" || head == "images" || head == "posts" || head == "tags"
+}
+
+// generatePages generates the page or folder of pages identified by name
+// (relative to the pages folder).
+func (nbrew *Notebrew) generatePages(sitePrefix, name string) error {
+	if name != "" && isReservedPage(name) {
+		return nil
+	}
+	fileInfo, err := fs.Stat(nbrew.FS, path.Join(sitePrefix, "pages", name))
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		if name == "" {
+			return nil
+		}
+		if path.Ext(name) == ".html" {
+			return nbrew.removeGeneratedHTML(sitePrefix, pageOutputDir(sitePrefix, name), false)
+		}
+		return nbrew.removeGeneratedHTML(sitePrefix, path.Join(sitePrefix, "site", name), true)
+	}
+	if fileInfo.IsDir() {
+		dirEntries, err := nbrew.FS.ReadDir(path.Join(sitePrefix, "pages", name))
+		if err != nil {
+			return err
+		}
+		for _, dirEntry := range dirEntries {
+			childName := path.Join(name, dirEntry.Name())
+			if !dirEntry.IsDir() && path.Ext(childName) != ".html" {
+				continue
+			}
+			err = nbrew.generatePages(sitePrefix, childName)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if path.Ext(name) != ".html" {
+		return nil
+	}
+	buf := bufPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer bufPool.Put(buf)
+	err = nbrew.renderPage(buf, sitePrefix, name)
+	if err != nil {
+		return err
+	}
+	return nbrew.writeGeneratedHTML(pageOutputDir(sitePrefix, name), buf.Bytes())
+}
+
+// generatePosts generates the post or category of posts identified by name
+// (relative to the posts folder), as well as the post list of every affected
+// category.
+func (nbrew *Notebrew) generatePosts(ctx context.Context, sitePrefix, name string) error {
+	fileInfo, err := fs.Stat(nbrew.FS, path.Join(sitePrefix, "posts", name))
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		if path.Ext(name) != ".md" {
+			// A category was removed.
+			err = nbrew.removeFeeds(path.Join(sitePrefix, "site/posts", name))
+			if err != nil {
+				return err
+			}
+			return nbrew.removeGeneratedHTML(sitePrefix, path.Join(sitePrefix, "site/posts", name), true)
+		}
+		err = nbrew.removeGeneratedHTML(sitePrefix, path.Join(sitePrefix, "site/posts", strings.TrimSuffix(name, ".md")), false)
+		if err != nil {
+			return err
+		}
+		return nbrew.generatePostList(ctx, sitePrefix, path.Dir(name))
+	}
+	if !fileInfo.IsDir() {
+		if path.Ext(name) != ".md" {
+			return nil
+		}
+		err = nbrew.generatePost(ctx, sitePrefix, name)
+		if err != nil {
+			return err
+		}
+		return nbrew.generatePostList(ctx, sitePrefix, path.Dir(name))
+	}
+	if strings.Contains(name, "/") {
+		// Categories cannot be nested, so there is nothing to generate.
+		return nil
+	}
+	dirEntries, err := nbrew.FS.ReadDir(path.Join(sitePrefix, "posts", name))
+	if err != nil {
+		return err
+	}
+	for _, dirEntry := range dirEntries {
+		if dirEntry.IsDir() {
+			if name == "" {
+				err = nbrew.generatePosts(ctx, sitePrefix, dirEntry.Name())
+				if err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if path.Ext(dirEntry.Name()) != ".md" {
+			continue
+		}
+		err = nbrew.generatePost(ctx, sitePrefix, path.Join(name, dirEntry.Name()))
+		if err != nil {
+			return err
+		}
+	}
+	return nbrew.generatePostList(ctx, sitePrefix, name)
+}
+
+// generatePost generates a single post (relative to the posts folder) into
+// site/posts/<category>/<post>/index.html. Drafts and scheduled posts are not
+// generated, and any output left over from before the post became one is
+// removed. Scheduled posts are generated by the janitor once their publish
+// date has passed (see publishScheduledPosts).
+func (nbrew *Notebrew) generatePost(ctx context.Context, sitePrefix, name string) error {
+	outputDir := path.Join(sitePrefix, "site/posts", strings.TrimSuffix(name, ".md"))
+	post, err := nbrew.getPost(ctx, sitePrefix, name)
+	if err != nil {
+		return err
+	}
+	if !post.isPublished(time.Now()) {
+		return nbrew.removeGeneratedHTML(sitePrefix, outputDir, false)
+	}
+	buf := bufPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer bufPool.Put(buf)
+	err = nbrew.renderPost(buf, sitePrefix, &post)
+	if err != nil {
+		return err
+	}
+	return nbrew.writeGeneratedHTML(outputDir, buf.Bytes())
+}
+
+// generatePostList generates the post list of a category into
+// site/posts/<category>/index.html, along with the feeds of the category. If
+// the category no longer exists, nothing is generated.
+func (nbrew *Notebrew) generatePostList(ctx context.Context, sitePrefix, category string) error {
+	if category == "." {
+		category = ""
+	}
+	buf := bufPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer bufPool.Put(buf)
+	err := nbrew.renderPostList(ctx, buf, sitePrefix, category)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	err = nbrew.writeGeneratedHTML(path.Join(sitePrefix, "site/posts", category), buf.Bytes())
+	if err != nil {
+		return err
+	}
+	// The feeds of the root of the posts folder are generated by
+	// updatePostIndex since they depend on every category.
+	if category == "" {
+		return nil
+	}
+	return nbrew.generateFeeds(ctx, sitePrefix, category)
+}
+
+// writeGeneratedHTML writes b into the index.html of dir, creating dir if
+// necessary. If CompressGeneratedHTML is set, index.html.gz is written instead.
+// Whichever one of index.html or index.html.gz is not written is removed so
+// that stale output is never served.
+func (nbrew *Notebrew) writeGeneratedHTML(dir string, b []byte) error {
+	err := mkdirAll(nbrew.FS, dir, 0755)
+	if err != nil {
+		return err
+	}
+	name, staleName := path.Join(dir, "index.html"), path.Join(dir, "index.html.gz")
+	if nbrew.CompressGeneratedHTML {
+		name, staleName = staleName, name
+	}
+	readerFrom, err := nbrew.FS.OpenReaderFrom(name, 0644)
+	if err != nil {
+		return err
+	}
+	if nbrew.CompressGeneratedHTML {
+		buf := bufPool.Get().(*bytes.Buffer)
+		buf.Reset()
+		defer bufPool.Put(buf)
+		gzipWriter := gzipPool.Get().(*gzip.Writer)
+		gzipWriter.Reset(buf)
+		defer gzipPool.Put(gzipWriter)
+		_, err = gzipWriter.Write(b)
+		if err != nil {
+			return err
+		}
+		err = gzipWriter.Close()
+		if err != nil {
+			return err
+		}
+		b = buf.Bytes()
+	}
+	_, err = readerFrom.ReadFrom(bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	err = nbrew.FS.Remove(staleName)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// removeGeneratedHTML removes the generated index.html and index.html.gz from
+// dir (and its subfolders if recursive is true), then removes dir if it has
+// become empty. Other files in dir are left alone. The site folder itself is
+// never removed.
+func (nbrew *Notebrew) removeGeneratedHTML(sitePrefix, dir string, recursive bool) error {
+	for _, name := range []string{"index.html", "index.html.gz"} {
+		err := nbrew.FS.Remove(path.Join(dir, name))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	dirEntries, err := nbrew.FS.ReadDir(dir)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	if recursive {
+		for _, dirEntry := range dirEntries {
+			if !dirEntry.IsDir() {
+				continue
+			}
+			err = nbrew.removeGeneratedHTML(sitePrefix, path.Join(dir, dirEntry.Name()), true)
+			if err != nil {
+				return err
+			}
+		}
+		dirEntries, err = nbrew.FS.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+	}
+	if len(dirEntries) == 0 && dir != path.Join(sitePrefix, "site") && dir != path.Join(sitePrefix, "site/posts") {
+		err = nbrew.FS.Remove(dir)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package nb6
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bokwoon95/nb6/internal/testutil"
+	"golang.org/x/exp/slog"
+)
+
+func TestGeneratePostTags(t *testing.T) {
+	nbrew, tempDir := newTestLocalNotebrew(t, map[string]string{
+		"root/posts/a.md":        "---\ndate: 2023-01-01\n---\n# A\n\n#go #web\n",
+		"root/posts/b.md":        "---\ndate: 2023-01-02\n---\n# B\n\n#go\n",
+		"root/posts/travel/c.md": "---\ndate: 2023-01-03\n---\n# C\n\n#japan\n",
+	})
+	ctx := context.Background()
+	err := nbrew.generate(ctx, "", "posts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tagPages := func() []string {
+		var tags []string
+		for _, name := range listFiles(t, filepath.Join(tempDir, "root/site/tags")) {
+			tags = append(tags, strings.TrimSuffix(name, "/index.html"))
+		}
+		sort.Strings(tags)
+		return tags
+	}
+	if diff := testutil.Diff(tagPages(), []string{"go", "japan", "web"}); diff != "" {
+		t.Error(testutil.Callers(), diff)
+	}
+	var index map[string]postIndexEntry
+	err = json.Unmarshal([]byte(readFSFile(t, nbrew.FS, "system/posts.json")), &index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := testutil.Diff(index["travel/c.md"].Tags, []string{"japan"}); diff != "" {
+		t.Error(testutil.Callers(), diff)
+	}
+
+	// Editing a post only regenerates the tags it had before and has now.
+	err = os.WriteFile(filepath.Join(tempDir, "root/site/tags/japan/index.html"), []byte("untouched"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(tempDir, "root/posts/a.md"), []byte("---\ndate: 2023-01-01\n---\n# A\n\n#go #rust\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = nbrew.generate(ctx, "", "posts/a.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := testutil.Diff(tagPages(), []string{"go", "japan", "rust"}); diff != "" {
+		t.Error(testutil.Callers(), diff)
+	}
+	if got := readFSFile(t, nbrew.FS, "site/tags/japan/index.html"); got != "untouched" {
+		t.Errorf("japan was regenerated: %q", got)
+	}
+	if got := readFSFile(t, nbrew.FS, "site/tags/go/index.html"); !strings.Contains(got, "posts/a/") || !strings.Contains(got, "posts/b/") {
+		t.Errorf("go does not link to both of its posts: %s", got)
+	}
+
+	// Removing a category removes the tags only its posts had.
+	err = os.RemoveAll(filepath.Join(tempDir, "root/posts/travel"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = nbrew.generate(ctx, "", "posts/travel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := testutil.Diff(tagPages(), []string{"go", "rust"}); diff != "" {
+		t.Error(testutil.Callers(), diff)
+	}
+
+	// A missing post index is rebuilt from every post, and tag pages that
+	// no post has are removed.
+	err = os.Remove(filepath.Join(tempDir, "root/system/posts.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.MkdirAll(filepath.Join(tempDir, "root/site/tags/stale"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(tempDir, "root/site/tags/stale/index.html"), []byte("stale"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = nbrew.generate(ctx, "", "posts/b.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := testutil.Diff(tagPages(), []string{"go", "rust"}); diff != "" {
+		t.Error(testutil.Callers(), diff)
+	}
+	_, err = fs.Stat(nbrew.FS, "system/posts.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParsePostLogger(t *testing.T) {
+	nbrew, _ := newTestLocalNotebrew(t, nil)
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, nil))
+	ctx := context.WithValue(context.Background(), loggerKey, logger)
+	_, err := nbrew.parsePost(ctx, "", "a.md", []byte("---\ndate: not a date\n---\n# A\n"), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "front matter") || !strings.Contains(buf.String(), "posts/a.md") {
+		t.Errorf("got log %q, want a warning about the front matter of posts/a.md", buf.String())
+	}
+}
@@ -0,0 +1,661 @@
+package nb6
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bokwoon95/sq"
+	"golang.org/x/exp/slog"
+)
+
+// defaultHistoryMaxVersions is the maximum number of prior versions kept for
+// each file if HistoryMaxVersions is not set.
+const defaultHistoryMaxVersions = 50
+
+// defaultHistoryRetention is how long prior versions are kept if
+// HistoryRetention is not set.
+const defaultHistoryRetention = 90 * 24 * time.Hour
+
+// fileVersion is a prior version of a file. If there is no database, each
+// version is stored gzipped in system/history/{name}/{id}.gz of its site.
+// Otherwise it is stored gzipped in the file_version table.
+type fileVersion struct {
+	ID string `json:"id"`
+
+	// ModTime is when the contents of the version were saved, which is the
+	// modification time of the file at the point it was overwritten.
+	ModTime time.Time `json:"mod_time"`
+}
+
+// isVersioned reports whether a file (relative to the sitePrefix) keeps a
+// version history. Only the files in notes/, pages/ and posts/ and the text
+// files in the themes folder keep a version history.
+func isVersioned(name string) bool {
+	head, tail, _ := strings.Cut(name, "/")
+	if head == "site" {
+		head, _, _ = strings.Cut(tail, "/")
+	}
+	switch head {
+	case "notes", "pages", "posts":
+		return true
+	case "themes":
+		switch path.Ext(name) {
+		case ".html", ".css", ".js", ".md", ".txt", ".csv", ".tsv", ".json", ".xml", ".toml", ".yaml", ".yml":
+			return true
+		}
+	}
+	return false
+}
+
+// newVersionID returns a new version ID. Like NewStringID it starts with a
+// timestamp, except the timestamp is modTime instead of the current time so
+// that the versions of a file sort in the order they were saved.
+func newVersionID(modTime time.Time) string {
+	var timestamp [8]byte
+	binary.BigEndian.PutUint64(timestamp[:], uint64(modTime.Unix()))
+	var id [16]byte
+	copy(id[:5], timestamp[3:])
+	_, err := rand.Read(id[5:])
+	if err != nil {
+		panic(err)
+	}
+	return base32Encoding.EncodeToString(id[:])
+}
+
+// parseVersionID returns the raw version ID and the modification time encoded
+// in it.
+func parseVersionID(id string) (rawID [16]byte, modTime time.Time, ok bool) {
+	b, err := base32Encoding.DecodeString(id)
+	if err != nil || len(b) != len(rawID) {
+		return rawID, modTime, false
+	}
+	copy(rawID[:], b)
+	var timestamp [8]byte
+	copy(timestamp[3:], b[:5])
+	return rawID, time.Unix(int64(binary.BigEndian.Uint64(timestamp[:])), 0).UTC(), true
+}
+
+// writeFile writes the contents of src into the named file (relative to the
+// sitePrefix). If the file already exists and keeps a version history, its
+// current contents are kept as a prior version before they are overwritten.
+// Every save of a file that the user edits should go through writeFile.
+func (nbrew *Notebrew) writeFile(ctx context.Context, sitePrefix, name string, src io.Reader) error {
+	if isVersioned(name) {
+		err := nbrew.saveVersion(ctx, sitePrefix, name)
+		if err != nil {
+			return err
+		}
+	}
+	readerFrom, err := nbrew.FS.OpenReaderFrom(path.Join(sitePrefix, name), 0644)
+	if err != nil {
+		return err
+	}
+	_, err = readerFrom.ReadFrom(src)
+	if err != nil {
+		return err
+	}
+	if isVersioned(name) {
+		return nbrew.pruneVersions(ctx, sitePrefix, name)
+	}
+	return nil
+}
+
+// saveVersion keeps the current contents of the named file (relative to the
+// sitePrefix) as a prior version. If the file doesn't exist, there is nothing
+// to keep and saveVersion does nothing.
+func (nbrew *Notebrew) saveVersion(ctx context.Context, sitePrefix, name string) error {
+	file, err := nbrew.FS.Open(path.Join(sitePrefix, name))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	defer file.Close()
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if fileInfo.IsDir() {
+		return nil
+	}
+	modTime := fileInfo.ModTime().UTC().Truncate(time.Second)
+	versionID := newVersionID(modTime)
+	buf := bufPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer bufPool.Put(buf)
+	gzipWriter := gzipPool.Get().(*gzip.Writer)
+	gzipWriter.Reset(buf)
+	defer gzipPool.Put(gzipWriter)
+	_, err = io.Copy(gzipWriter, file)
+	if err != nil {
+		return err
+	}
+	err = gzipWriter.Close()
+	if err != nil {
+		return err
+	}
+	if nbrew.DB != nil {
+		rawID, _, _ := parseVersionID(versionID)
+		_, err = sq.ExecContext(ctx, nbrew.DB, sq.CustomQuery{
+			Dialect: nbrew.Dialect,
+			Format: "INSERT INTO file_version (version_id, site_name, file_path, mod_time, data)" +
+				" VALUES ({versionID}, {siteName}, {filePath}, {modTime}, {data})",
+			Values: []any{
+				sq.UUIDParam("versionID", rawID),
+				sq.StringParam("siteName", strings.TrimPrefix(sitePrefix, "@")),
+				sq.StringParam("filePath", name),
+				sq.TimeParam("modTime", modTime),
+				sq.BytesParam("data", buf.Bytes()),
+			},
+		})
+		return err
+	}
+	versionDir := path.Join(sitePrefix, "system/history", name)
+	err = mkdirAll(nbrew.FS, versionDir, 0755)
+	if err != nil {
+		return err
+	}
+	readerFrom, err := nbrew.FS.OpenReaderFrom(path.Join(versionDir, versionID+".gz"), 0644)
+	if err != nil {
+		return err
+	}
+	_, err = readerFrom.ReadFrom(buf)
+	return err
+}
+
+// getVersions returns the prior versions of the named file (relative to the
+// sitePrefix), most recent first.
+func (nbrew *Notebrew) getVersions(ctx context.Context, sitePrefix, name string) ([]fileVersion, error) {
+	var versions []fileVersion
+	if nbrew.DB != nil {
+		var err error
+		versions, err = sq.FetchAllContext(ctx, nbrew.DB, sq.CustomQuery{
+			Dialect: nbrew.Dialect,
+			Format:  "SELECT {*} FROM file_version WHERE site_name = {siteName} AND file_path = {filePath}",
+			Values: []any{
+				sq.StringParam("siteName", strings.TrimPrefix(sitePrefix, "@")),
+				sq.StringParam("filePath", name),
+			},
+		}, func(row *sq.Row) fileVersion {
+			var rawID [16]byte
+			row.UUID(&rawID, "version_id")
+			return fileVersion{
+				ID:      base32Encoding.EncodeToString(rawID[:]),
+				ModTime: row.Time("mod_time").UTC(),
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		dirEntries, err := nbrew.FS.ReadDir(path.Join(sitePrefix, "system/history", name))
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil, nil
+			}
+			return nil, err
+		}
+		for _, dirEntry := range dirEntries {
+			if dirEntry.IsDir() || path.Ext(dirEntry.Name()) != ".gz" {
+				continue
+			}
+			id := strings.TrimSuffix(dirEntry.Name(), ".gz")
+			_, modTime, ok := parseVersionID(id)
+			if !ok {
+				continue
+			}
+			versions = append(versions, fileVersion{ID: id, ModTime: modTime})
+		}
+	}
+	sort.SliceStable(versions, func(i, j int) bool {
+		if versions[i].ModTime.Equal(versions[j].ModTime) {
+			return versions[i].ID > versions[j].ID
+		}
+		return versions[i].ModTime.After(versions[j].ModTime)
+	})
+	return versions, nil
+}
+
+// getVersionContent returns the contents of a prior version of the named file
+// (relative to the sitePrefix).
+func (nbrew *Notebrew) getVersionContent(ctx context.Context, sitePrefix, name, id string) ([]byte, error) {
+	rawID, _, ok := parseVersionID(id)
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	var compressed []byte
+	if nbrew.DB != nil {
+		var err error
+		compressed, err = sq.FetchOneContext(ctx, nbrew.DB, sq.CustomQuery{
+			Dialect: nbrew.Dialect,
+			Format:  "SELECT {*} FROM file_version WHERE version_id = {versionID} AND site_name = {siteName} AND file_path = {filePath}",
+			Values: []any{
+				sq.UUIDParam("versionID", rawID),
+				sq.StringParam("siteName", strings.TrimPrefix(sitePrefix, "@")),
+				sq.StringParam("filePath", name),
+			},
+		}, func(row *sq.Row) []byte {
+			return row.Bytes("data")
+		})
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return nil, fs.ErrNotExist
+			}
+			return nil, err
+		}
+	} else {
+		var err error
+		compressed, err = fs.ReadFile(nbrew.FS, path.Join(sitePrefix, "system/history", name, id+".gz"))
+		if err != nil {
+			return nil, err
+		}
+	}
+	gzipReader, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", id, err)
+	}
+	b, err := io.ReadAll(gzipReader)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", id, err)
+	}
+	return b, nil
+}
+
+// pruneVersions deletes the prior versions of the named file (relative to the
+// sitePrefix) that are older than the HistoryRetention or that go over the
+// HistoryMaxVersions.
+func (nbrew *Notebrew) pruneVersions(ctx context.Context, sitePrefix, name string) error {
+	maxVersions := nbrew.HistoryMaxVersions
+	if maxVersions == 0 {
+		maxVersions = defaultHistoryMaxVersions
+	}
+	retention := nbrew.HistoryRetention
+	if retention == 0 {
+		retention = defaultHistoryRetention
+	}
+	if maxVersions < 0 && retention < 0 {
+		return nil
+	}
+	versions, err := nbrew.getVersions(ctx, sitePrefix, name)
+	if err != nil {
+		return err
+	}
+	cutoff := time.Now().Add(-retention)
+	for i, version := range versions {
+		if (maxVersions < 0 || i < maxVersions) && (retention < 0 || version.ModTime.After(cutoff)) {
+			continue
+		}
+		if nbrew.DB != nil {
+			rawID, _, _ := parseVersionID(version.ID)
+			_, err = sq.ExecContext(ctx, nbrew.DB, sq.CustomQuery{
+				Dialect: nbrew.Dialect,
+				Format:  "DELETE FROM file_version WHERE version_id = {versionID}",
+				Values: []any{
+					sq.UUIDParam("versionID", rawID),
+				},
+			})
+		} else {
+			err = nbrew.FS.Remove(path.Join(sitePrefix, "system/history", name, version.ID+".gz"))
+			if errors.Is(err, fs.ErrNotExist) {
+				err = nil
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// diffLine is a line in a line diff. Op is "=" for a line that is in both
+// versions, "-" for a line that is only in the old version and "+" for a line
+// that is only in the new version.
+type diffLine struct {
+	Op      string `json:"op"`
+	Text    string `json:"text"`
+	OldLine int    `json:"old_line,omitempty"`
+	NewLine int    `json:"new_line,omitempty"`
+}
+
+// maxDiffCells is the largest (old lines × new lines) table that diffLines
+// computes the longest common subsequence for. Anything bigger is shown as
+// the old version being removed and the new version being added in full.
+const maxDiffCells = 4_000_000
+
+// diffLines returns the line diff going from oldText to newText.
+func diffLines(oldText, newText string) []diffLine {
+	splitLines := func(s string) []string {
+		if s == "" {
+			return nil
+		}
+		return strings.Split(strings.TrimSuffix(strings.ReplaceAll(s, "\r\n", "\n"), "\n"), "\n")
+	}
+	oldLines, newLines := splitLines(oldText), splitLines(newText)
+	var diff []diffLine
+	oldNum, newNum := 0, 0
+	equal := func(text string) {
+		oldNum++
+		newNum++
+		diff = append(diff, diffLine{Op: "=", Text: text, OldLine: oldNum, NewLine: newNum})
+	}
+	removed := func(text string) {
+		oldNum++
+		diff = append(diff, diffLine{Op: "-", Text: text, OldLine: oldNum})
+	}
+	added := func(text string) {
+		newNum++
+		diff = append(diff, diffLine{Op: "+", Text: text, NewLine: newNum})
+	}
+	// Strip the common prefix and suffix, so that the LCS table only has to
+	// cover the part that changed.
+	prefix := 0
+	for prefix < len(oldLines) && prefix < len(newLines) && oldLines[prefix] == newLines[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(oldLines)-prefix && suffix < len(newLines)-prefix && oldLines[len(oldLines)-1-suffix] == newLines[len(newLines)-1-suffix] {
+		suffix++
+	}
+	for _, line := range oldLines[:prefix] {
+		equal(line)
+	}
+	a, b := oldLines[prefix:len(oldLines)-suffix], newLines[prefix:len(newLines)-suffix]
+	if len(a)*len(b) > maxDiffCells {
+		for _, line := range a {
+			removed(line)
+		}
+		for _, line := range b {
+			added(line)
+		}
+	} else {
+		// lcs[i][j] is the length of the longest common subsequence of a[i:]
+		// and b[j:].
+		lcs := make([][]int32, len(a)+1)
+		for i := range lcs {
+			lcs[i] = make([]int32, len(b)+1)
+		}
+		for i := len(a) - 1; i >= 0; i-- {
+			for j := len(b) - 1; j >= 0; j-- {
+				if a[i] == b[j] {
+					lcs[i][j] = lcs[i+1][j+1] + 1
+				} else if lcs[i+1][j] >= lcs[i][j+1] {
+					lcs[i][j] = lcs[i+1][j]
+				} else {
+					lcs[i][j] = lcs[i][j+1]
+				}
+			}
+		}
+		i, j := 0, 0
+		for i < len(a) && j < len(b) {
+			switch {
+			case a[i] == b[j]:
+				equal(a[i])
+				i++
+				j++
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				removed(a[i])
+				i++
+			default:
+				added(b[j])
+				j++
+			}
+		}
+		for ; i < len(a); i++ {
+			removed(a[i])
+		}
+		for ; j < len(b); j++ {
+			added(b[j])
+		}
+	}
+	for _, line := range oldLines[len(oldLines)-suffix:] {
+		equal(line)
+	}
+	return diff
+}
+
+func (nbrew *Notebrew) history(w http.ResponseWriter, r *http.Request, username, sitePrefix, filePath string) {
+	type Request struct {
+		VersionID string `json:"version_id,omitempty"`
+	}
+	type Response struct {
+		Path      string   `json:"path"`
+		VersionID string   `json:"version_id,omitempty"`
+		Errors    []string `json:"errors,omitempty"`
+	}
+	type TemplateData struct {
+		Path      string        `json:"path"`
+		ModTime   *time.Time    `json:"mod_time,omitempty"`
+		Versions  []fileVersion `json:"versions,omitempty"`
+		VersionID string        `json:"version_id,omitempty"`
+		Diff      []diffLine    `json:"diff,omitempty"`
+		Alerts    url.Values    `json:"alerts,omitempty"`
+	}
+
+	logger, ok := r.Context().Value(loggerKey).(*slog.Logger)
+	if !ok {
+		logger = slog.Default()
+	}
+
+	filePath = strings.Trim(path.Clean(filePath), "/")
+	if !isVersioned(filePath) {
+		notFound(w, r)
+		return
+	}
+	fileInfo, err := fs.Stat(nbrew.FS, path.Join(sitePrefix, filePath))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			notFound(w, r)
+			return
+		}
+		logger.Error(err.Error())
+		internalServerError(w, r, err)
+		return
+	}
+	if fileInfo.IsDir() {
+		notFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		err := r.ParseForm()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("400 Bad Request: %s", err), http.StatusBadRequest)
+			return
+		}
+		var templateData TemplateData
+		_, err = nbrew.getSession(r, "flash", &templateData)
+		if err != nil {
+			logger.Error(err.Error())
+		}
+		nbrew.clearSession(w, r, "flash")
+		templateData.Path = filePath
+		modTime := fileInfo.ModTime()
+		templateData.ModTime = &modTime
+		templateData.Versions, err = nbrew.getVersions(r.Context(), sitePrefix, filePath)
+		if err != nil {
+			logger.Error(err.Error())
+			internalServerError(w, r, err)
+			return
+		}
+		templateData.VersionID = r.Form.Get("version")
+		if templateData.VersionID != "" {
+			versionContent, err := nbrew.getVersionContent(r.Context(), sitePrefix, filePath, templateData.VersionID)
+			if err != nil {
+				if errors.Is(err, fs.ErrNotExist) {
+					notFound(w, r)
+					return
+				}
+				logger.Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+			content, err := readFile(nbrew.FS, path.Join(sitePrefix, filePath))
+			if err != nil {
+				logger.Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+			templateData.Diff = diffLines(string(versionContent), content)
+		}
+
+		accept, _, _ := mime.ParseMediaType(r.Header.Get("Accept"))
+		if accept == "application/json" {
+			w.Header().Set("Content-Type", "application/json")
+			b, err := json.Marshal(&templateData)
+			if err != nil {
+				logger.Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+			w.Write(b)
+			return
+		}
+
+		funcMap := map[string]any{
+			"join":       path.Join,
+			"base":       path.Base,
+			"safeHTML":   func(s string) template.HTML { return template.HTML(s) },
+			"username":   func() string { return username },
+			"referer":    func() string { return r.Referer() },
+			"sitePrefix": func() string { return sitePrefix },
+		}
+		tmpl, err := template.New("history.html").Funcs(funcMap).ParseFS(rootFS, "history.html")
+		if err != nil {
+			logger.Error(err.Error())
+			internalServerError(w, r, err)
+			return
+		}
+		buf := bufPool.Get().(*bytes.Buffer)
+		buf.Reset()
+		defer bufPool.Put(buf)
+		err = tmpl.Execute(buf, &templateData)
+		if err != nil {
+			logger.Error(err.Error())
+			internalServerError(w, r, err)
+			return
+		}
+		w.Header().Add("Content-Security-Policy", defaultContentSecurityPolicy)
+		buf.WriteTo(w)
+	case "POST":
+		writeResponse := func(w http.ResponseWriter, r *http.Request, response Response) {
+			accept, _, _ := mime.ParseMediaType(r.Header.Get("Accept"))
+			if accept == "application/json" {
+				w.Header().Set("Content-Type", "application/json")
+				b, err := json.Marshal(&response)
+				if err != nil {
+					logger.Error(err.Error())
+					internalServerError(w, r, err)
+					return
+				}
+				w.Write(b)
+				return
+			}
+			alerts := make(url.Values)
+			if len(response.Errors) > 0 {
+				for _, errmsg := range response.Errors {
+					alerts.Add("danger", template.HTMLEscapeString(errmsg))
+				}
+			} else {
+				alerts.Add("success", fmt.Sprintf(
+					`Restored <a href="%s" class="linktext">%s</a> to an earlier version`,
+					template.HTMLEscapeString("/"+path.Join("admin", sitePrefix, response.Path)),
+					template.HTMLEscapeString(response.Path),
+				))
+			}
+			err := nbrew.setSession(w, r, "flash", map[string]any{
+				"alerts": alerts,
+			})
+			if err != nil {
+				logger.Error(err.Error())
+			}
+			http.Redirect(w, r, nbrew.Scheme+nbrew.AdminDomain+"/"+path.Join("admin", sitePrefix, "history", response.Path), http.StatusFound)
+		}
+
+		var request Request
+		contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		switch contentType {
+		case "application/json":
+			err := json.NewDecoder(r.Body).Decode(&request)
+			if err != nil {
+				var syntaxErr *json.SyntaxError
+				if errors.As(err, &syntaxErr) {
+					http.Error(w, "400 Bad Request: invalid JSON", http.StatusBadRequest)
+					return
+				}
+				logger.Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+		case "application/x-www-form-urlencoded":
+			err := r.ParseForm()
+			if err != nil {
+				http.Error(w, fmt.Sprintf("400 Bad Request: %s", err), http.StatusBadRequest)
+				return
+			}
+			request.VersionID = r.Form.Get("version_id")
+		default:
+			http.Error(w, "415 Unsupported Media Type", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		ok, err := checkPreconditions(nbrew.FS, r, path.Join(sitePrefix, filePath))
+		if err != nil {
+			logger.Error(err.Error())
+			internalServerError(w, r, err)
+			return
+		}
+		if !ok {
+			http.Error(w, "412 Precondition Failed", http.StatusPreconditionFailed)
+			return
+		}
+		response := Response{
+			Path:      filePath,
+			VersionID: request.VersionID,
+		}
+		versionContent, err := nbrew.getVersionContent(r.Context(), sitePrefix, filePath, request.VersionID)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				response.Errors = append(response.Errors, fmt.Sprintf("version %q does not exist", request.VersionID))
+				writeResponse(w, r, response)
+				return
+			}
+			logger.Error(err.Error())
+			internalServerError(w, r, err)
+			return
+		}
+		// Restoring a version is a save like any other, so the contents being
+		// replaced are kept in the history and the restore can be undone.
+		err = nbrew.writeFile(r.Context(), sitePrefix, filePath, bytes.NewReader(versionContent))
+		if err != nil {
+			logger.Error(err.Error())
+			internalServerError(w, r, err)
+			return
+		}
+		err = nbrew.generate(r.Context(), sitePrefix, filePath)
+		if err != nil {
+			logger.Error(err.Error())
+		}
+		writeResponse(w, r, response)
+	default:
+		http.Error(w, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,566 @@
+package nb6
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io/fs"
+	"math"
+	"path"
+	"strconv"
+	"strings"
+
+	_ "image/gif"
+)
+
+// imageWidths are the widths of the resized variants generated for every
+// JPEG and PNG image in site/images. Only widths smaller than the image itself
+// are generated.
+//
+// A variant of images/photo.jpg that is 480 pixels wide is named
+// images/photo-480w.jpg. Variants are JPEGs unless the image has transparent
+// pixels, in which case they are PNGs (so images/logo.png might have a variant
+// named images/logo-480w.png while images/photo.png might have a variant named
+// images/photo-480w.jpg). The srcset template function finds the variants of
+// an image for use in the srcset attribute of an <img> element.
+var imageWidths = []int{480, 960, 1920}
+
+// maxImagePixels is the largest number of pixels (width times height) an
+// image may have for it to be decoded. Decoding takes 4 bytes per pixel and
+// more for every intermediate copy, so a small file that claims to be huge
+// could otherwise exhaust the memory of the server.
+const maxImagePixels = 50_000_000
+
+// errImageTooLarge is returned by decodeImage for images with more than
+// maxImagePixels pixels.
+var errImageTooLarge = errors.New("image too large")
+
+// imageVariantName returns the name of the variant of an image with the given
+// width and extension.
+func imageVariantName(name string, width int, ext string) string {
+	return strings.TrimSuffix(name, path.Ext(name)) + "-" + strconv.Itoa(width) + "w" + ext
+}
+
+// isImageVariant reports whether name is named like a resized variant of
+// another image. Images named like variants are never processed themselves.
+func isImageVariant(name string) bool {
+	ext := path.Ext(name)
+	if ext != ".jpg" && ext != ".png" {
+		return false
+	}
+	stem := strings.TrimSuffix(path.Base(name), ext)
+	for _, width := range imageWidths {
+		if suffix := "-" + strconv.Itoa(width) + "w"; strings.HasSuffix(stem, suffix) && len(stem) > len(suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// processImages processes every image in the named file or folder in
+// site/images (relative to the sitePrefix): metadata such as EXIF (including
+// GPS coordinates) is stripped from the image itself and resized variants are
+// generated alongside it. If name no longer exists, the variants left over
+// from it are removed.
+func (nbrew *Notebrew) processImages(sitePrefix, name string) error {
+	if isImageVariant(name) {
+		return nil
+	}
+	fileInfo, err := fs.Stat(nbrew.FS, path.Join(sitePrefix, name))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nbrew.removeImageVariants(sitePrefix, name, 0)
+		}
+		return err
+	}
+	if !fileInfo.IsDir() {
+		return nbrew.processImage(sitePrefix, name)
+	}
+	dirEntries, err := nbrew.FS.ReadDir(path.Join(sitePrefix, name))
+	if err != nil {
+		return err
+	}
+	for _, dirEntry := range dirEntries {
+		err = nbrew.processImages(sitePrefix, path.Join(name, dirEntry.Name()))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeImageVariants removes the variants of an image that are at least
+// minWidth wide.
+func (nbrew *Notebrew) removeImageVariants(sitePrefix, name string, minWidth int) error {
+	ext := path.Ext(name)
+	if ext != ".jpeg" && ext != ".jpg" && ext != ".png" {
+		return nil
+	}
+	for _, width := range imageWidths {
+		if width < minWidth {
+			continue
+		}
+		for _, ext := range []string{".jpg", ".png"} {
+			err := nbrew.FS.Remove(path.Join(sitePrefix, imageVariantName(name, width, ext)))
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// processImage strips the metadata from a single image and generates its
+// resized variants. Everything is done in memory and read from and written to
+// the FS, so it works the same regardless of where the FS stores its files.
+func (nbrew *Notebrew) processImage(sitePrefix, name string) error {
+	filePath := path.Join(sitePrefix, name)
+	text, err := readFile(nbrew.FS, filePath)
+	if err != nil {
+		return err
+	}
+	b := []byte(text)
+	var stripped []byte
+	var img *image.RGBA
+	switch path.Ext(name) {
+	case ".jpeg", ".jpg":
+		// Stripping EXIF also strips the orientation, so images that are
+		// meant to be displayed rotated are rotated for real (which means
+		// they have to be encoded again).
+		orientation := jpegOrientation(b)
+		stripped, err = stripJPEGMetadata(b)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if orientation > 1 {
+			img, err = decodeImage(stripped)
+			if err != nil {
+				if errors.Is(err, errImageTooLarge) {
+					// Only the metadata is stripped from images that are
+					// too large to decode.
+					if !bytes.Equal(stripped, b) {
+						err = nbrew.writeImage(filePath, stripped)
+						if err != nil {
+							return err
+						}
+					}
+					return nbrew.removeImageVariants(sitePrefix, name, 0)
+				}
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			img = orientImage(img, orientation)
+			var buf bytes.Buffer
+			err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 90})
+			if err != nil {
+				return err
+			}
+			stripped = buf.Bytes()
+		}
+	case ".png":
+		stripped, err = stripPNGMetadata(b)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	case ".webp":
+		// There is no WebP decoder in the standard library, so WebP images
+		// only have their metadata stripped.
+		stripped, err = stripWebPMetadata(b)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if !bytes.Equal(stripped, b) {
+			return nbrew.writeImage(filePath, stripped)
+		}
+		return nil
+	default:
+		// GIFs may be animated, and SVGs and icons don't need resizing.
+		return nil
+	}
+	if !bytes.Equal(stripped, b) {
+		err = nbrew.writeImage(filePath, stripped)
+		if err != nil {
+			return err
+		}
+	}
+	if img == nil {
+		img, err = decodeImage(stripped)
+		if err != nil {
+			if errors.Is(err, errImageTooLarge) {
+				return nbrew.removeImageVariants(sitePrefix, name, 0)
+			}
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+
+	// Each variant is resized from the next larger one, which is much
+	// cheaper than resizing every variant from the original and looks the
+	// same with an area-averaging filter.
+	srcWidth, srcHeight := img.Rect.Dx(), img.Rect.Dy()
+	ext := ".jpg"
+	if hasTransparency(img) {
+		ext = ".png"
+	}
+	err = nbrew.removeImageVariants(sitePrefix, name, srcWidth)
+	if err != nil {
+		return err
+	}
+	src := img
+	for i := len(imageWidths) - 1; i >= 0; i-- {
+		width := imageWidths[i]
+		if width >= srcWidth {
+			continue
+		}
+		height := int(math.Round(float64(srcHeight) * float64(width) / float64(srcWidth)))
+		if height < 1 {
+			height = 1
+		}
+		src = resizeImage(src, width, height)
+		var buf bytes.Buffer
+		if ext == ".png" {
+			err = png.Encode(&buf, src)
+		} else {
+			err = jpeg.Encode(&buf, src, &jpeg.Options{Quality: 85})
+		}
+		if err != nil {
+			return err
+		}
+		err = nbrew.writeImage(path.Join(sitePrefix, imageVariantName(name, width, ext)), buf.Bytes())
+		if err != nil {
+			return err
+		}
+		// Remove the variant with the other extension, in case the image
+		// used to have (or not have) transparent pixels.
+		staleExt := ".png"
+		if ext == ".png" {
+			staleExt = ".jpg"
+		}
+		err = nbrew.FS.Remove(path.Join(sitePrefix, imageVariantName(name, width, staleExt)))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (nbrew *Notebrew) writeImage(name string, b []byte) error {
+	readerFrom, err := nbrew.FS.OpenReaderFrom(name, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = readerFrom.ReadFrom(bytes.NewReader(b))
+	return err
+}
+
+// imageSrcset returns the value of a srcset attribute for an image (relative
+// to the site folder e.g. images/photo.jpg), listing the URLs of the image and
+// its variants together with their widths. If the image has no variants or
+// its width cannot be determined, only the URL of the image is returned.
+func (nbrew *Notebrew) imageSrcset(sitePrefix, name string) (string, error) {
+	name = strings.Trim(path.Clean(name), "/")
+	siteURL := nbrew.contentSiteURL(sitePrefix)
+	file, err := nbrew.FS.Open(path.Join(sitePrefix, "site", name))
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	config, _, err := image.DecodeConfig(file)
+	if err != nil {
+		return siteURL + name, nil
+	}
+	var candidates []string
+	for _, width := range imageWidths {
+		if width >= config.Width {
+			break
+		}
+		for _, ext := range []string{".jpg", ".png"} {
+			variantName := imageVariantName(name, width, ext)
+			_, err := fs.Stat(nbrew.FS, path.Join(sitePrefix, "site", variantName))
+			if err != nil {
+				if errors.Is(err, fs.ErrNotExist) {
+					continue
+				}
+				return "", err
+			}
+			candidates = append(candidates, siteURL+variantName+" "+strconv.Itoa(width)+"w")
+			break
+		}
+	}
+	candidates = append(candidates, siteURL+name+" "+strconv.Itoa(config.Width)+"w")
+	return strings.Join(candidates, ", "), nil
+}
+
+// decodeImage decodes an image into an *image.RGBA whose bounds start at
+// (0, 0). The dimensions of the image are checked before it is decoded, and
+// errImageTooLarge is returned if it has more than maxImagePixels pixels.
+func decodeImage(b []byte) (*image.RGBA, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	if int64(config.Width)*int64(config.Height) > maxImagePixels {
+		return nil, errImageTooLarge
+	}
+	src, _, err := image.Decode(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	bounds := src.Bounds()
+	img := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(img, img.Rect, src, bounds.Min, draw.Src)
+	return img, nil
+}
+
+// hasTransparency reports whether any pixel of img is not fully opaque.
+func hasTransparency(img *image.RGBA) bool {
+	for y := 0; y < img.Rect.Dy(); y++ {
+		row := img.Pix[y*img.Stride : y*img.Stride+img.Rect.Dx()*4]
+		for i := 3; i < len(row); i += 4 {
+			if row[i] != 0xff {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// resizeImage downscales src to width by height using an area-averaging (box)
+// filter, where every destination pixel is the average of the source pixels it
+// covers. It is only meant for making images smaller.
+func resizeImage(src *image.RGBA, width, height int) *image.RGBA {
+	srcWidth, srcHeight := src.Rect.Dx(), src.Rect.Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	scaleX := float64(srcWidth) / float64(width)
+	scaleY := float64(srcHeight) / float64(height)
+	// Each destination row is the weighted sum of the source rows it covers,
+	// which is then averaged horizontally into the destination pixels.
+	row := make([]float32, srcWidth*4)
+	for y := 0; y < height; y++ {
+		for i := range row {
+			row[i] = 0
+		}
+		y0, y1 := float64(y)*scaleY, float64(y+1)*scaleY
+		for srcY := int(y0); srcY < srcHeight && float64(srcY) < y1; srcY++ {
+			weight := float32((math.Min(y1, float64(srcY+1)) - math.Max(y0, float64(srcY))) / scaleY)
+			pix := src.Pix[srcY*src.Stride : srcY*src.Stride+srcWidth*4]
+			for i, value := range pix {
+				row[i] += float32(value) * weight
+			}
+		}
+		for x := 0; x < width; x++ {
+			x0, x1 := float64(x)*scaleX, float64(x+1)*scaleX
+			var sum [4]float32
+			for srcX := int(x0); srcX < srcWidth && float64(srcX) < x1; srcX++ {
+				weight := float32((math.Min(x1, float64(srcX+1)) - math.Max(x0, float64(srcX))) / scaleX)
+				for i := 0; i < 4; i++ {
+					sum[i] += row[srcX*4+i] * weight
+				}
+			}
+			offset := y*dst.Stride + x*4
+			for i := 0; i < 4; i++ {
+				dst.Pix[offset+i] = uint8(math.Min(255, math.Max(0, math.Round(float64(sum[i])))))
+			}
+		}
+	}
+	return dst
+}
+
+// orientImage transforms img according to its EXIF orientation (1 to 8) so
+// that it displays correctly without the orientation.
+func orientImage(img *image.RGBA, orientation int) *image.RGBA {
+	width, height := img.Rect.Dx(), img.Rect.Dy()
+	dstWidth, dstHeight := width, height
+	if orientation >= 5 {
+		dstWidth, dstHeight = height, width
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dstWidth, dstHeight))
+	for y := 0; y < dstHeight; y++ {
+		for x := 0; x < dstWidth; x++ {
+			var srcX, srcY int
+			switch orientation {
+			case 2: // flipped horizontally
+				srcX, srcY = width-1-x, y
+			case 3: // rotated 180°
+				srcX, srcY = width-1-x, height-1-y
+			case 4: // flipped vertically
+				srcX, srcY = x, height-1-y
+			case 5: // transposed
+				srcX, srcY = y, x
+			case 6: // rotated 90° clockwise
+				srcX, srcY = y, height-1-x
+			case 7: // transversed
+				srcX, srcY = width-1-y, height-1-x
+			case 8: // rotated 90° counterclockwise
+				srcX, srcY = width-1-y, x
+			default:
+				srcX, srcY = x, y
+			}
+			copy(dst.Pix[y*dst.Stride+x*4:y*dst.Stride+x*4+4], img.Pix[srcY*img.Stride+srcX*4:srcY*img.Stride+srcX*4+4])
+		}
+	}
+	return dst
+}
+
+// jpegSegments calls fn with the marker and contents of every segment of a
+// JPEG before the image data. It returns the offset of the image data (the
+// start of scan segment), which runs until the end of the file.
+func jpegSegments(b []byte, fn func(marker byte, segment []byte)) (int, error) {
+	if len(b) < 2 || b[0] != 0xff || b[1] != 0xd8 {
+		return 0, errors.New("not a JPEG")
+	}
+	i := 2
+	for i+4 <= len(b) {
+		if b[i] != 0xff {
+			return 0, errors.New("invalid JPEG marker")
+		}
+		marker := b[i+1]
+		if marker == 0xff {
+			// Fill byte.
+			i++
+			continue
+		}
+		if marker == 0xda || marker == 0xd9 {
+			return i, nil
+		}
+		if (marker >= 0xd0 && marker <= 0xd7) || marker == 0x01 {
+			// Standalone markers have no length.
+			fn(marker, b[i:i+2])
+			i += 2
+			continue
+		}
+		length := int(binary.BigEndian.Uint16(b[i+2 : i+4]))
+		if length < 2 || i+2+length > len(b) {
+			return 0, errors.New("invalid JPEG segment length")
+		}
+		fn(marker, b[i:i+2+length])
+		i += 2 + length
+	}
+	return 0, errors.New("JPEG has no image data")
+}
+
+// stripJPEGMetadata removes the EXIF and XMP (APP1), IPTC (APP13) and comment
+// segments from a JPEG. The JFIF, ICC profile and Adobe segments are kept
+// since they affect how the image is displayed. The image data itself is left
+// untouched, so nothing is lost.
+func stripJPEGMetadata(b []byte) ([]byte, error) {
+	stripped := make([]byte, 0, len(b))
+	stripped = append(stripped, b[:2]...)
+	offset, err := jpegSegments(b, func(marker byte, segment []byte) {
+		if marker == 0xe1 || marker == 0xed || marker == 0xfe {
+			return
+		}
+		stripped = append(stripped, segment...)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return append(stripped, b[offset:]...), nil
+}
+
+// jpegOrientation returns the EXIF orientation of a JPEG (between 1 and 8),
+// or 1 if it does not have one.
+func jpegOrientation(b []byte) int {
+	orientation := 1
+	jpegSegments(b, func(marker byte, segment []byte) {
+		if marker != 0xe1 || len(segment) < 4 {
+			return
+		}
+		exif, ok := bytes.CutPrefix(segment[4:], []byte("Exif\x00\x00"))
+		if !ok || len(exif) < 8 {
+			return
+		}
+		var byteOrder binary.ByteOrder
+		switch string(exif[:2]) {
+		case "II":
+			byteOrder = binary.LittleEndian
+		case "MM":
+			byteOrder = binary.BigEndian
+		default:
+			return
+		}
+		ifdOffset := int(byteOrder.Uint32(exif[4:8]))
+		if ifdOffset+2 > len(exif) {
+			return
+		}
+		count := int(byteOrder.Uint16(exif[ifdOffset : ifdOffset+2]))
+		for i := 0; i < count; i++ {
+			entry := ifdOffset + 2 + i*12
+			if entry+12 > len(exif) {
+				return
+			}
+			if byteOrder.Uint16(exif[entry:entry+2]) == 0x0112 {
+				value := int(byteOrder.Uint16(exif[entry+8 : entry+10]))
+				if value >= 1 && value <= 8 {
+					orientation = value
+				}
+				return
+			}
+		}
+	})
+	return orientation
+}
+
+// stripPNGMetadata removes the EXIF, text and timestamp chunks from a PNG.
+func stripPNGMetadata(b []byte) ([]byte, error) {
+	const signature = "\x89PNG\r\n\x1a\n"
+	if !bytes.HasPrefix(b, []byte(signature)) {
+		return nil, errors.New("not a PNG")
+	}
+	stripped := make([]byte, 0, len(b))
+	stripped = append(stripped, signature...)
+	for i := len(signature); i < len(b); {
+		if i+8 > len(b) {
+			return nil, errors.New("invalid PNG chunk")
+		}
+		length := int(binary.BigEndian.Uint32(b[i : i+4]))
+		end := i + 12 + length // length, type, data and CRC
+		if length < 0 || end > len(b) {
+			return nil, errors.New("invalid PNG chunk length")
+		}
+		switch string(b[i+4 : i+8]) {
+		case "eXIf", "tEXt", "zTXt", "iTXt", "tIME":
+		default:
+			stripped = append(stripped, b[i:end]...)
+		}
+		i = end
+	}
+	return stripped, nil
+}
+
+// stripWebPMetadata removes the EXIF and XMP chunks from a WebP.
+func stripWebPMetadata(b []byte) ([]byte, error) {
+	if len(b) < 12 || string(b[:4]) != "RIFF" || string(b[8:12]) != "WEBP" {
+		return nil, errors.New("not a WebP")
+	}
+	stripped := make([]byte, 0, len(b))
+	stripped = append(stripped, b[:12]...)
+	for i := 12; i < len(b); {
+		if i+8 > len(b) {
+			return nil, errors.New("invalid WebP chunk")
+		}
+		size := int(binary.LittleEndian.Uint32(b[i+4 : i+8]))
+		end := i + 8 + size + size%2 // chunks are padded to an even size
+		if size < 0 || end > len(b) {
+			return nil, errors.New("invalid WebP chunk size")
+		}
+		switch string(b[i : i+4]) {
+		case "EXIF", "XMP ":
+		case "VP8X":
+			chunk := append([]byte(nil), b[i:end]...)
+			if len(chunk) > 8 {
+				// Clear the EXIF and XMP flags.
+				chunk[8] &^= 0x08 | 0x04
+			}
+			stripped = append(stripped, chunk...)
+		default:
+			stripped = append(stripped, b[i:end]...)
+		}
+		i = end
+	}
+	binary.LittleEndian.PutUint32(stripped[4:8], uint32(len(stripped)-8))
+	return stripped, nil
+}
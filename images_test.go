@@ -0,0 +1,240 @@
+package nb6
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/bokwoon95/nb6/internal/testutil"
+)
+
+// hugePNG returns a tiny PNG whose header claims that it is width by height
+// pixels.
+func hugePNG(t *testing.T, width, height uint32) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 1, 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := buf.Bytes()
+	// The IHDR chunk comes right after the 8 byte signature: a 4 byte
+	// length, "IHDR", the width and height and then the CRC of the chunk.
+	ihdr := b[8+4 : 8+4+4+13]
+	binary.BigEndian.PutUint32(ihdr[4:8], width)
+	binary.BigEndian.PutUint32(ihdr[8:12], height)
+	binary.BigEndian.PutUint32(b[8+4+4+13:], crc32.ChecksumIEEE(ihdr))
+	return b
+}
+
+func TestProcessImageTooLarge(t *testing.T) {
+	b := hugePNG(t, 60000, 60000)
+	_, err := decodeImage(b)
+	if !errors.Is(err, errImageTooLarge) {
+		t.Fatalf("got error %v, want %v", err, errImageTooLarge)
+	}
+	nbrew, tempDir := newTestLocalNotebrew(t, map[string]string{
+		"root/site/images/huge.png":      string(b),
+		"root/site/images/huge-480w.jpg": "stale",
+	})
+	err = nbrew.processImages("", "site/images/huge.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// No variants are generated, and stale ones are removed.
+	if diff := testutil.Diff(listFiles(t, filepath.Join(tempDir, "root/site")), []string{"images/huge.png"}); diff != "" {
+		t.Error(testutil.Callers(), diff)
+	}
+	got, err := os.ReadFile(filepath.Join(tempDir, "root/site/images/huge.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, b) {
+		t.Error("huge.png was modified")
+	}
+}
+
+func TestOrientImage(t *testing.T) {
+	type TestTable struct {
+		orientation int
+		// wantPixels are the rows of the oriented image, where every pixel
+		// is identified by its position in the 2x3 source image:
+		//
+		//	1 2
+		//	3 4
+		//	5 6
+		wantPixels [][]uint8
+	}
+
+	tests := []TestTable{
+		{orientation: 1, wantPixels: [][]uint8{{1, 2}, {3, 4}, {5, 6}}},
+		{orientation: 2, wantPixels: [][]uint8{{2, 1}, {4, 3}, {6, 5}}},
+		{orientation: 3, wantPixels: [][]uint8{{6, 5}, {4, 3}, {2, 1}}},
+		{orientation: 4, wantPixels: [][]uint8{{5, 6}, {3, 4}, {1, 2}}},
+		{orientation: 5, wantPixels: [][]uint8{{1, 3, 5}, {2, 4, 6}}},
+		{orientation: 6, wantPixels: [][]uint8{{5, 3, 1}, {6, 4, 2}}},
+		{orientation: 7, wantPixels: [][]uint8{{6, 4, 2}, {5, 3, 1}}},
+		{orientation: 8, wantPixels: [][]uint8{{2, 4, 6}, {1, 3, 5}}},
+	}
+
+	src := image.NewRGBA(image.Rect(0, 0, 2, 3))
+	for i := 0; i < 6; i++ {
+		src.SetRGBA(i%2, i/2, color.RGBA{R: uint8(i + 1), A: 255})
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(strconv.Itoa(tt.orientation), func(t *testing.T) {
+			dst := orientImage(src, tt.orientation)
+			var gotPixels [][]uint8
+			for y := 0; y < dst.Rect.Dy(); y++ {
+				var row []uint8
+				for x := 0; x < dst.Rect.Dx(); x++ {
+					row = append(row, dst.RGBAAt(x, y).R)
+				}
+				gotPixels = append(gotPixels, row)
+			}
+			if diff := testutil.Diff(gotPixels, tt.wantPixels); diff != "" {
+				t.Error(testutil.Callers(), diff)
+			}
+		})
+	}
+}
+
+// jpegWithMetadata returns a JPEG of img with an EXIF segment carrying the
+// orientation (and GPS-like junk standing in for the rest of the EXIF data),
+// an IPTC segment and a comment.
+func jpegWithMetadata(t *testing.T, img image.Image, orientation uint16) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A big-endian TIFF header followed by an IFD with a single orientation
+	// entry (tag 0x0112, type SHORT, count 1).
+	exif := []byte("Exif\x00\x00MM\x00\x2a\x00\x00\x00\x08\x00\x01\x01\x12\x00\x03\x00\x00\x00\x01\x00\x00\x00\x00\x00\x00\x00\x00GPS 1.3521,103.8198")
+	binary.BigEndian.PutUint16(exif[6+8+2+8:], orientation)
+	segment := func(marker byte, payload []byte) []byte {
+		b := []byte{0xff, marker, 0, 0}
+		binary.BigEndian.PutUint16(b[2:], uint16(2+len(payload)))
+		return append(b, payload...)
+	}
+	var b []byte
+	b = append(b, buf.Bytes()[:2]...)
+	b = append(b, segment(0xe1, exif)...)
+	b = append(b, segment(0xed, []byte("Photoshop 3.0\x00"))...)
+	b = append(b, segment(0xfe, []byte("a comment"))...)
+	return append(b, buf.Bytes()[2:]...)
+}
+
+func TestStripJPEGMetadata(t *testing.T) {
+	b := jpegWithMetadata(t, image.NewRGBA(image.Rect(0, 0, 8, 8)), 6)
+	if got := jpegOrientation(b); got != 6 {
+		t.Errorf("got orientation %d, want 6", got)
+	}
+	stripped, err := stripJPEGMetadata(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var markers []byte
+	_, err = jpegSegments(stripped, func(marker byte, segment []byte) {
+		markers = append(markers, marker)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, marker := range markers {
+		if marker == 0xe1 || marker == 0xed || marker == 0xfe {
+			t.Errorf("marker %#x was not stripped", marker)
+		}
+	}
+	if got := jpegOrientation(stripped); got != 1 {
+		t.Errorf("got orientation %d after stripping, want 1", got)
+	}
+	if bytes.Contains(stripped, []byte("GPS")) {
+		t.Error("stripped JPEG still contains the GPS coordinates")
+	}
+	_, err = jpeg.Decode(bytes.NewReader(stripped))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStripPNGMetadata(t *testing.T) {
+	var buf bytes.Buffer
+	err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 1, 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Insert a tEXt chunk right after the IHDR chunk.
+	chunk := func(chunkType string, data []byte) []byte {
+		b := make([]byte, 4, 12+len(data))
+		binary.BigEndian.PutUint32(b, uint32(len(data)))
+		b = append(b, chunkType...)
+		b = append(b, data...)
+		return binary.BigEndian.AppendUint32(b, crc32.ChecksumIEEE(b[4:]))
+	}
+	ihdrEnd := 8 + 12 + 13
+	var b []byte
+	b = append(b, buf.Bytes()[:ihdrEnd]...)
+	b = append(b, chunk("tEXt", []byte("Comment\x00GPS 1.3521,103.8198"))...)
+	b = append(b, buf.Bytes()[ihdrEnd:]...)
+	stripped, err := stripPNGMetadata(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(stripped, buf.Bytes()) {
+		t.Error("stripped PNG is not the original PNG")
+	}
+}
+
+func TestProcessImageOrientation(t *testing.T) {
+	// Red on the left and blue on the right, displayed rotated 90°
+	// clockwise so that red ends up on top.
+	img := image.NewRGBA(image.Rect(0, 0, 32, 16))
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 32; x++ {
+			if x < 16 {
+				img.SetRGBA(x, y, color.RGBA{R: 255, A: 255})
+			} else {
+				img.SetRGBA(x, y, color.RGBA{B: 255, A: 255})
+			}
+		}
+	}
+	nbrew, tempDir := newTestLocalNotebrew(t, map[string]string{
+		"root/site/images/photo.jpg": string(jpegWithMetadata(t, img, 6)),
+	})
+	err := nbrew.processImages("", "site/images/photo.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(filepath.Join(tempDir, "root/site/images/photo.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(b, []byte("GPS")) || jpegOrientation(b) != 1 {
+		t.Error("metadata was not stripped")
+	}
+	got, err := jpeg.Decode(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := got.Bounds().Size(); size != image.Pt(16, 32) {
+		t.Fatalf("got size %v, want %v", size, image.Pt(16, 32))
+	}
+	for _, point := range []image.Point{{8, 4}, {8, 28}} {
+		r, _, b, _ := got.At(point.X, point.Y).RGBA()
+		if isRed := r > b; isRed != (point.Y < 16) {
+			t.Errorf("pixel %v: got r %d b %d, want red on top and blue below", point, r>>8, b>>8)
+		}
+	}
+}
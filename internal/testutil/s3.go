@@ -0,0 +1,383 @@
+package testutil
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// S3Server is an in-process fake of the subset of the S3 API used by
+// nb6.S3FS: GetObject, HeadObject, PutObject, CopyObject, DeleteObject,
+// ListObjectsV2 and multipart uploads. Use it with httptest.NewServer and
+// point the S3FS Endpoint at the server's URL. Buckets are created on first
+// use.
+//
+// If AccessKeyID is set, every request must be signed with AWS Signature
+// Version 4 using AccessKeyID and SecretAccessKey.
+type S3Server struct {
+	AccessKeyID     string
+	SecretAccessKey string
+
+	mu      sync.Mutex
+	objects map[string]s3Object // bucket + "/" + key
+	uploads map[string]map[int][]byte
+}
+
+type s3Object struct {
+	data    []byte
+	modTime time.Time
+}
+
+func NewS3Server(accessKeyID, secretAccessKey string) *S3Server {
+	return &S3Server{
+		AccessKeyID:     accessKeyID,
+		SecretAccessKey: secretAccessKey,
+		objects:         make(map[string]s3Object),
+		uploads:         make(map[string]map[int][]byte),
+	}
+}
+
+// Keys returns the sorted keys of every object in bucket.
+func (srv *S3Server) Keys(bucket string) []string {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	var keys []string
+	for name := range srv.objects {
+		if key, ok := strings.CutPrefix(name, bucket+"/"); ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (srv *S3Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		s3WriteError(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+		return
+	}
+	if srv.AccessKeyID != "" {
+		err = srv.verifySignature(r, body)
+		if err != nil {
+			s3WriteError(w, http.StatusForbidden, "SignatureDoesNotMatch", err.Error())
+			return
+		}
+	}
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket == "" {
+		s3WriteError(w, http.StatusBadRequest, "InvalidBucketName", "bucket not specified")
+		return
+	}
+	query := r.URL.Query()
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	switch {
+	case r.Method == "GET" && key == "" && query.Get("list-type") == "2":
+		srv.listObjects(w, bucket, query)
+	case (r.Method == "GET" || r.Method == "HEAD") && key != "":
+		object, ok := srv.objects[bucket+"/"+key]
+		if !ok {
+			s3WriteError(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(object.data)))
+		w.Header().Set("Last-Modified", object.modTime.UTC().Format(http.TimeFormat))
+		w.Header().Set("ETag", s3ETag(object.data))
+		if r.Method == "GET" {
+			w.Write(object.data)
+		}
+	case r.Method == "PUT" && key != "" && query.Has("uploadId"):
+		parts, ok := srv.uploads[query.Get("uploadId")]
+		if !ok {
+			s3WriteError(w, http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist.")
+			return
+		}
+		partNumber, err := strconv.Atoi(query.Get("partNumber"))
+		if err != nil || partNumber < 1 || partNumber > 10000 {
+			s3WriteError(w, http.StatusBadRequest, "InvalidArgument", "invalid partNumber")
+			return
+		}
+		parts[partNumber] = body
+		w.Header().Set("ETag", s3ETag(body))
+	case r.Method == "PUT" && key != "" && r.Header.Get("X-Amz-Copy-Source") != "":
+		source, err := url.PathUnescape(strings.TrimPrefix(r.Header.Get("X-Amz-Copy-Source"), "/"))
+		if err != nil {
+			s3WriteError(w, http.StatusBadRequest, "InvalidArgument", err.Error())
+			return
+		}
+		object, ok := srv.objects[source]
+		if !ok {
+			s3WriteError(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+			return
+		}
+		object.modTime = time.Now()
+		srv.objects[bucket+"/"+key] = object
+		fmt.Fprintf(w, "<CopyObjectResult><ETag>%s</ETag></CopyObjectResult>", s3ETag(object.data))
+	case r.Method == "PUT" && key != "":
+		srv.objects[bucket+"/"+key] = s3Object{data: body, modTime: time.Now()}
+		w.Header().Set("ETag", s3ETag(body))
+	case r.Method == "DELETE" && key != "" && query.Has("uploadId"):
+		delete(srv.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == "DELETE" && key != "":
+		delete(srv.objects, bucket+"/"+key)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == "POST" && key != "" && query.Has("uploads"):
+		var b [16]byte
+		_, _ = rand.Read(b[:])
+		uploadID := hex.EncodeToString(b[:])
+		srv.uploads[uploadID] = make(map[int][]byte)
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><Bucket>%s</Bucket><Key>%s</Key><UploadId>%s</UploadId></InitiateMultipartUploadResult>", bucket, key, uploadID)
+	case r.Method == "POST" && key != "" && query.Has("uploadId"):
+		parts, ok := srv.uploads[query.Get("uploadId")]
+		if !ok {
+			s3WriteError(w, http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist.")
+			return
+		}
+		var complete struct {
+			Parts []struct {
+				PartNumber int    `xml:"PartNumber"`
+				ETag       string `xml:"ETag"`
+			} `xml:"Part"`
+		}
+		err := xml.Unmarshal(body, &complete)
+		if err != nil || len(complete.Parts) == 0 {
+			s3WriteError(w, http.StatusBadRequest, "MalformedXML", "invalid CompleteMultipartUpload body")
+			return
+		}
+		var data []byte
+		for i, part := range complete.Parts {
+			partData, ok := parts[part.PartNumber]
+			if !ok || part.ETag != s3ETag(partData) || (i > 0 && part.PartNumber <= complete.Parts[i-1].PartNumber) {
+				s3WriteError(w, http.StatusBadRequest, "InvalidPart", "invalid part "+strconv.Itoa(part.PartNumber))
+				return
+			}
+			if i < len(complete.Parts)-1 && len(partData) < 5<<20 {
+				s3WriteError(w, http.StatusBadRequest, "EntityTooSmall", "part "+strconv.Itoa(part.PartNumber)+" is smaller than 5 MB")
+				return
+			}
+			data = append(data, partData...)
+		}
+		delete(srv.uploads, query.Get("uploadId"))
+		srv.objects[bucket+"/"+key] = s3Object{data: data, modTime: time.Now()}
+		fmt.Fprintf(w, "<CompleteMultipartUploadResult><Key>%s</Key><ETag>%s</ETag></CompleteMultipartUploadResult>", key, s3ETag(data))
+	default:
+		s3WriteError(w, http.StatusNotImplemented, "NotImplemented", r.Method+" "+r.URL.String()+" is not implemented")
+	}
+}
+
+// listObjects implements ListObjectsV2. The continuation token is the hex
+// encoded last key (or common prefix) of the previous page.
+func (srv *S3Server) listObjects(w http.ResponseWriter, bucket string, query url.Values) {
+	prefix, delimiter := query.Get("prefix"), query.Get("delimiter")
+	maxKeys := 1000
+	if s := query.Get("max-keys"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			s3WriteError(w, http.StatusBadRequest, "InvalidArgument", "invalid max-keys")
+			return
+		}
+		maxKeys = n
+	}
+	var keys []string
+	for name := range srv.objects {
+		if key, ok := strings.CutPrefix(name, bucket+"/"); ok && strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	type Contents struct {
+		Key          string `xml:"Key"`
+		LastModified string `xml:"LastModified"`
+		ETag         string `xml:"ETag"`
+		Size         int    `xml:"Size"`
+	}
+	type CommonPrefix struct {
+		Prefix string `xml:"Prefix"`
+	}
+	var result struct {
+		XMLName               xml.Name       `xml:"ListBucketResult"`
+		Name                  string         `xml:"Name"`
+		Prefix                string         `xml:"Prefix"`
+		KeyCount              int            `xml:"KeyCount"`
+		MaxKeys               int            `xml:"MaxKeys"`
+		IsTruncated           bool           `xml:"IsTruncated"`
+		NextContinuationToken string         `xml:"NextContinuationToken,omitempty"`
+		Contents              []Contents     `xml:"Contents"`
+		CommonPrefixes        []CommonPrefix `xml:"CommonPrefixes"`
+	}
+	result.Name, result.Prefix, result.MaxKeys = bucket, prefix, maxKeys
+	b, err := hex.DecodeString(query.Get("continuation-token"))
+	if err != nil {
+		s3WriteError(w, http.StatusBadRequest, "InvalidArgument", "invalid continuation-token")
+		return
+	}
+	after := string(b)
+	lastKey := ""
+	for _, key := range keys {
+		if key <= after {
+			continue
+		}
+		if result.KeyCount >= maxKeys {
+			result.IsTruncated = true
+			result.NextContinuationToken = hex.EncodeToString([]byte(lastKey))
+			break
+		}
+		if delimiter != "" {
+			if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+				commonPrefix := key[:len(prefix)+i+len(delimiter)]
+				if len(result.CommonPrefixes) == 0 || result.CommonPrefixes[len(result.CommonPrefixes)-1].Prefix != commonPrefix {
+					result.CommonPrefixes = append(result.CommonPrefixes, CommonPrefix{Prefix: commonPrefix})
+					result.KeyCount++
+				}
+				// Every key in the common prefix sorts before this.
+				lastKey = commonPrefix + "\xff"
+				continue
+			}
+		}
+		object := srv.objects[bucket+"/"+key]
+		result.Contents = append(result.Contents, Contents{
+			Key:          key,
+			LastModified: object.modTime.UTC().Format(time.RFC3339),
+			ETag:         s3ETag(object.data),
+			Size:         len(object.data),
+		})
+		result.KeyCount++
+		lastKey = key
+	}
+	b, err = xml.Marshal(&result)
+	if err != nil {
+		s3WriteError(w, http.StatusInternalServerError, "InternalError", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.Write(b)
+}
+
+// verifySignature recomputes the AWS Signature Version 4 of the request and
+// checks that it matches the one in the Authorization header.
+func (srv *S3Server) verifySignature(r *http.Request, body []byte) error {
+	credential, signedHeaders, signature, err := parseAuthorization(r.Header.Get("Authorization"))
+	if err != nil {
+		return err
+	}
+	accessKeyID, scope, _ := strings.Cut(credential, "/")
+	if accessKeyID != srv.AccessKeyID {
+		return fmt.Errorf("unknown access key %q", accessKeyID)
+	}
+	scopeParts := strings.Split(scope, "/")
+	if len(scopeParts) != 4 || scopeParts[2] != "s3" || scopeParts[3] != "aws4_request" {
+		return fmt.Errorf("invalid credential scope %q", scope)
+	}
+	amzDate := r.Header.Get("X-Amz-Date")
+	if !strings.HasPrefix(amzDate, scopeParts[0]) {
+		return fmt.Errorf("X-Amz-Date %q does not match credential scope %q", amzDate, scope)
+	}
+	payloadHash := sha256.Sum256(body)
+	if r.Header.Get("X-Amz-Content-Sha256") != hex.EncodeToString(payloadHash[:]) {
+		return fmt.Errorf("X-Amz-Content-Sha256 does not match the payload")
+	}
+	var canonicalHeaders strings.Builder
+	for _, name := range strings.Split(signedHeaders, ";") {
+		value := r.Header.Get(name)
+		if name == "host" {
+			value = r.Host
+		}
+		canonicalHeaders.WriteString(name + ":" + strings.Join(strings.Fields(value), " ") + "\n")
+	}
+	var queryPairs []string
+	for key, values := range r.URL.Query() {
+		for _, value := range values {
+			queryPairs = append(queryPairs, s3URIEncode(key, true)+"="+s3URIEncode(value, true))
+		}
+	}
+	sort.Strings(queryPairs)
+	canonicalRequest := r.Method + "\n" +
+		s3URIEncode(r.URL.Path, false) + "\n" +
+		strings.Join(queryPairs, "&") + "\n" +
+		canonicalHeaders.String() + "\n" +
+		signedHeaders + "\n" +
+		hex.EncodeToString(payloadHash[:])
+	canonicalRequestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalRequestHash[:])
+	key := []byte("AWS4" + srv.SecretAccessKey)
+	for _, s := range scopeParts {
+		h := hmac.New(sha256.New, key)
+		h.Write([]byte(s))
+		key = h.Sum(nil)
+	}
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(stringToSign))
+	if !hmac.Equal([]byte(signature), []byte(hex.EncodeToString(h.Sum(nil)))) {
+		return fmt.Errorf("signature does not match")
+	}
+	return nil
+}
+
+func parseAuthorization(authorization string) (credential, signedHeaders, signature string, err error) {
+	fields, ok := strings.CutPrefix(authorization, "AWS4-HMAC-SHA256 ")
+	if !ok {
+		return "", "", "", fmt.Errorf("unsupported Authorization header %q", authorization)
+	}
+	for _, field := range strings.Split(fields, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+		switch name {
+		case "Credential":
+			credential = value
+		case "SignedHeaders":
+			signedHeaders = value
+		case "Signature":
+			signature = value
+		}
+	}
+	if credential == "" || signedHeaders == "" || signature == "" {
+		return "", "", "", fmt.Errorf("malformed Authorization header %q", authorization)
+	}
+	return credential, signedHeaders, signature, nil
+}
+
+func s3URIEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		char := s[i]
+		if (char >= 'A' && char <= 'Z') || (char >= 'a' && char <= 'z') || (char >= '0' && char <= '9') ||
+			char == '-' || char == '_' || char == '.' || char == '~' || (char == '/' && !encodeSlash) {
+			b.WriteByte(char)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", char)
+	}
+	return b.String()
+}
+
+func s3ETag(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func s3WriteError(w http.ResponseWriter, statusCode int, code, message string) {
+	var b bytes.Buffer
+	b.WriteString(xml.Header)
+	_ = xml.NewEncoder(&b).Encode(struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string   `xml:"Code"`
+		Message string   `xml:"Message"`
+	}{Code: code, Message: message})
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(statusCode)
+	w.Write(b.Bytes())
+}
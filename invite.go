@@ -0,0 +1,452 @@
+package nb6
+
+import (
+	"bytes"
+	"crypto/rand"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/bokwoon95/sq"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/exp/slog"
+)
+
+// inviteTokenLifetime is how long an invitation can be accepted for.
+const inviteTokenLifetime = 7 * 24 * time.Hour
+
+// newToken generates a token and the hash of it that is stored in the
+// database. The token is an 8 byte big endian unix timestamp followed by 16
+// random bytes, hex encoded with leading zeros trimmed. The hash keeps the
+// timestamp and replaces the random bytes with their blake2b-256 checksum.
+func newToken() (token string, tokenHash []byte, err error) {
+	var rawToken [8 + 16]byte
+	binary.BigEndian.PutUint64(rawToken[:8], uint64(time.Now().Unix()))
+	_, err = rand.Read(rawToken[8:])
+	if err != nil {
+		return "", nil, err
+	}
+	checksum := blake2b.Sum256(rawToken[8:])
+	tokenHash = make([]byte, 8+blake2b.Size256)
+	copy(tokenHash[:8], rawToken[:8])
+	copy(tokenHash[8:], checksum[:])
+	return strings.TrimLeft(hex.EncodeToString(rawToken[:]), "0"), tokenHash, nil
+}
+
+// hashToken returns the hash of a token generated by newToken, and the time
+// it was generated at. It returns false if the token is malformed.
+func hashToken(token string) (tokenHash []byte, issuedAt time.Time, ok bool) {
+	if token == "" || len(token) > 48 {
+		return nil, time.Time{}, false
+	}
+	rawToken, err := hex.DecodeString(fmt.Sprintf("%048s", token))
+	if err != nil {
+		return nil, time.Time{}, false
+	}
+	checksum := blake2b.Sum256(rawToken[8:])
+	tokenHash = make([]byte, 8+blake2b.Size256)
+	copy(tokenHash[:8], rawToken[:8])
+	copy(tokenHash[8:], checksum[:])
+	return tokenHash, time.Unix(int64(binary.BigEndian.Uint64(rawToken[:8])), 0), true
+}
+
+// acceptInvite accepts an invitation to a site. If there is no user with the
+// email the invitation was sent to, a user is created with the username and
+// password given. Each invitation can only be accepted once.
+func (nbrew *Notebrew) acceptInvite(w http.ResponseWriter, r *http.Request) {
+	type Request struct {
+		Token           string `json:"token,omitempty"`
+		Username        string `json:"username,omitempty"`
+		Password        string `json:"password,omitempty"`
+		ConfirmPassword string `json:"confirm_password,omitempty"`
+	}
+	type Response struct {
+		Token      string     `json:"token,omitempty"`
+		SiteName   string     `json:"site_name"`
+		Email      string     `json:"email,omitempty"`
+		Role       string     `json:"role,omitempty"`
+		Username   string     `json:"username,omitempty"`
+		UserExists bool       `json:"user_exists"`
+		Errors     url.Values `json:"errors,omitempty"`
+	}
+	type Invite struct {
+		SiteID     [16]byte
+		SiteName   string
+		Email      string
+		Role       string
+		UserExists bool
+	}
+
+	logger, ok := r.Context().Value(loggerKey).(*slog.Logger)
+	if !ok {
+		logger = slog.Default()
+	}
+
+	if nbrew.DB == nil {
+		notFound(w, r)
+		return
+	}
+
+	getInvite := func(token string) (invite Invite, ok bool, err error) {
+		inviteTokenHash, issuedAt, ok := hashToken(token)
+		if !ok || time.Since(issuedAt) > inviteTokenLifetime {
+			return invite, false, nil
+		}
+		invite, err = sq.FetchOneContext(r.Context(), nbrew.DB, sq.CustomQuery{
+			Dialect: nbrew.Dialect,
+			Format: "SELECT {*}" +
+				" FROM invite" +
+				" JOIN site ON site.site_id = invite.site_id" +
+				" LEFT JOIN users ON users.email = invite.email" +
+				" WHERE invite.invite_token_hash = {inviteTokenHash}",
+			Values: []any{
+				sq.BytesParam("inviteTokenHash", inviteTokenHash),
+			},
+		}, func(row *sq.Row) (invite Invite) {
+			row.UUID(&invite.SiteID, "site.site_id")
+			invite.SiteName = row.String("site.site_name")
+			invite.Email = row.String("invite.email")
+			invite.Role = row.String("invite.role")
+			invite.UserExists = row.Bool("users.user_id IS NOT NULL")
+			return invite
+		})
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return invite, false, nil
+			}
+			return invite, false, err
+		}
+		return invite, true, nil
+	}
+
+	switch r.Method {
+	case "GET":
+		err := r.ParseForm()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid request query or body: %v", err), http.StatusBadRequest)
+			return
+		}
+		token := r.Form.Get("token")
+		invite, ok, err := getInvite(token)
+		if err != nil {
+			logger.Error(err.Error())
+			internalServerError(w, r, err)
+			return
+		}
+		if !ok {
+			http.Error(w, "invitation invalid or expired", http.StatusBadRequest)
+			return
+		}
+
+		var response Response
+		_, err = nbrew.getSession(r, "flash", &response)
+		if err != nil {
+			logger.Error(err.Error())
+		}
+		nbrew.clearSession(w, r, "flash")
+		response.Token = token
+		response.SiteName = invite.SiteName
+		response.Email = invite.Email
+		response.Role = invite.Role
+		response.UserExists = invite.UserExists
+
+		accept, _, _ := mime.ParseMediaType(r.Header.Get("Accept"))
+		if accept == "application/json" {
+			w.Header().Set("Content-Type", "application/json")
+			b, err := json.Marshal(&response)
+			if err != nil {
+				logger.Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+			w.Write(b)
+			return
+		}
+
+		buf := bufPool.Get().(*bytes.Buffer)
+		buf.Reset()
+		defer bufPool.Put(buf)
+		tmpl, err := template.ParseFS(rootFS, "invite.html")
+		if err != nil {
+			logger.Error(err.Error())
+			internalServerError(w, r, err)
+			return
+		}
+		err = tmpl.Execute(buf, &response)
+		if err != nil {
+			logger.Error(err.Error())
+			internalServerError(w, r, err)
+			return
+		}
+		w.Header().Add("Content-Security-Policy", defaultContentSecurityPolicy)
+		buf.WriteTo(w)
+	case "POST":
+		writeResponse := func(w http.ResponseWriter, r *http.Request, response Response) {
+			accept, _, _ := mime.ParseMediaType(r.Header.Get("Accept"))
+			if accept == "application/json" {
+				w.Header().Set("Content-Type", "application/json")
+				b, err := json.Marshal(&response)
+				if err != nil {
+					logger.Error(err.Error())
+					internalServerError(w, r, err)
+					return
+				}
+				w.Write(b)
+				return
+			}
+			if len(response.Errors) > 0 {
+				err := nbrew.setSession(w, r, "flash", &response)
+				if err != nil {
+					logger.Error(err.Error())
+					internalServerError(w, r, err)
+					return
+				}
+				values := make(url.Values)
+				values.Set("token", response.Token)
+				http.Redirect(w, r, nbrew.Scheme+nbrew.AdminDomain+"/admin/invite/?"+values.Encode(), http.StatusFound)
+				return
+			}
+			sitePrefix := response.SiteName
+			if sitePrefix != "" && !strings.Contains(sitePrefix, ".") {
+				sitePrefix = "@" + sitePrefix
+			}
+			referer := "/admin/"
+			if sitePrefix != "" {
+				referer = "/admin/" + sitePrefix + "/"
+			}
+			err := nbrew.setSession(w, r, "flash", map[string]any{
+				"invite_accepted": true,
+				"referer":         referer,
+			})
+			if err != nil {
+				logger.Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+			http.Redirect(w, r, nbrew.Scheme+nbrew.AdminDomain+"/admin/login/", http.StatusFound)
+		}
+
+		var request Request
+		contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		switch contentType {
+		case "application/json":
+			err := json.NewDecoder(r.Body).Decode(&request)
+			if err != nil {
+				var syntaxErr *json.SyntaxError
+				if errors.As(err, &syntaxErr) {
+					http.Error(w, "400 Bad Request: invalid JSON", http.StatusBadRequest)
+					return
+				}
+				logger.Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+		case "application/x-www-form-urlencoded":
+			err := r.ParseForm()
+			if err != nil {
+				http.Error(w, fmt.Sprintf("400 Bad Request: %s", err), http.StatusBadRequest)
+				return
+			}
+			request.Token = r.Form.Get("token")
+			request.Username = r.Form.Get("username")
+			request.Password = r.Form.Get("password")
+			request.ConfirmPassword = r.Form.Get("confirm_password")
+		default:
+			http.Error(w, "415 Unsupported Media Type", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		invite, ok, err := getInvite(request.Token)
+		if err != nil {
+			logger.Error(err.Error())
+			internalServerError(w, r, err)
+			return
+		}
+		if !ok {
+			http.Error(w, "invitation invalid or expired", http.StatusBadRequest)
+			return
+		}
+		response := Response{
+			Token:      request.Token,
+			SiteName:   invite.SiteName,
+			Email:      invite.Email,
+			Role:       invite.Role,
+			Username:   strings.TrimPrefix(strings.TrimSpace(request.Username), "@"),
+			UserExists: invite.UserExists,
+			Errors:     make(url.Values),
+		}
+
+		var passwordHash []byte
+		if !invite.UserExists {
+			if response.Username == "" {
+				response.Errors.Add("username", "cannot be blank")
+			}
+			for _, char := range response.Username {
+				if (char >= 'a' && char <= 'z') || (char >= '0' && char <= '9') || char == '-' {
+					continue
+				}
+				response.Errors.Add("username", "forbidden characters - only lowercase letters, numbers and hyphen are allowed")
+				break
+			}
+			if len(response.Username) > 30 {
+				response.Errors.Add("username", "length cannot exceed 30 characters")
+			}
+			if utf8.RuneCountInString(request.Password) < 8 {
+				response.Errors.Add("password", "must be at least 8 characters")
+			} else if request.ConfirmPassword != request.Password {
+				response.Errors.Add("confirm_password", "passwords do not match")
+			}
+			if len(response.Errors) > 0 {
+				writeResponse(w, r, response)
+				return
+			}
+			exists, err := sq.FetchExistsContext(r.Context(), nbrew.DB, sq.CustomQuery{
+				Dialect: nbrew.Dialect,
+				Format:  "SELECT 1 FROM site WHERE site_name = {username}",
+				Values: []any{
+					sq.StringParam("username", response.Username),
+				},
+			})
+			if err != nil {
+				logger.Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+			if exists {
+				response.Errors.Add("username", "username already taken")
+				writeResponse(w, r, response)
+				return
+			}
+			passwordHash, err = bcrypt.GenerateFromPassword([]byte(request.Password), bcrypt.DefaultCost)
+			if err != nil {
+				logger.Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+		}
+
+		tx, err := nbrew.DB.Begin()
+		if err != nil {
+			logger.Error(err.Error())
+			internalServerError(w, r, err)
+			return
+		}
+		defer tx.Rollback()
+		// Deleting the invitation first makes sure that it can only be
+		// accepted once, even if it is accepted twice at the same time.
+		inviteTokenHash, _, _ := hashToken(request.Token)
+		result, err := sq.ExecContext(r.Context(), tx, sq.CustomQuery{
+			Dialect: nbrew.Dialect,
+			Format:  "DELETE FROM invite WHERE invite_token_hash = {inviteTokenHash}",
+			Values: []any{
+				sq.BytesParam("inviteTokenHash", inviteTokenHash),
+			},
+		})
+		if err != nil {
+			logger.Error(err.Error())
+			internalServerError(w, r, err)
+			return
+		}
+		if result.RowsAffected == 0 {
+			http.Error(w, "invitation invalid or expired", http.StatusBadRequest)
+			return
+		}
+		if !invite.UserExists {
+			// Like the users created by the createuser command, every user
+			// gets a site of their own named after them.
+			siteID := NewID()
+			userID := NewID()
+			_, err = sq.ExecContext(r.Context(), tx, sq.CustomQuery{
+				Dialect: nbrew.Dialect,
+				Format:  "INSERT INTO site (site_id, site_name) VALUES ({siteID}, {siteName})",
+				Values: []any{
+					sq.UUIDParam("siteID", siteID),
+					sq.StringParam("siteName", response.Username),
+				},
+			})
+			if err != nil {
+				if nbrew.IsKeyViolation(err) {
+					response.Errors.Add("username", "username already taken")
+					writeResponse(w, r, response)
+					return
+				}
+				logger.Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+			_, err = sq.ExecContext(r.Context(), tx, sq.CustomQuery{
+				Dialect: nbrew.Dialect,
+				Format: "INSERT INTO users (user_id, username, email, password_hash)" +
+					" VALUES ({userID}, {username}, {email}, {passwordHash})",
+				Values: []any{
+					sq.UUIDParam("userID", userID),
+					sq.StringParam("username", response.Username),
+					sq.StringParam("email", invite.Email),
+					sq.StringParam("passwordHash", string(passwordHash)),
+				},
+			})
+			if err != nil {
+				logger.Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+			_, err = sq.ExecContext(r.Context(), tx, sq.CustomQuery{
+				Dialect: nbrew.Dialect,
+				Format:  "INSERT INTO site_user (site_id, user_id, role) VALUES ({siteID}, {userID}, {role})",
+				Values: []any{
+					sq.UUIDParam("siteID", siteID),
+					sq.UUIDParam("userID", userID),
+					sq.StringParam("role", roleOwner),
+				},
+			})
+			if err != nil {
+				logger.Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+		}
+		_, err = sq.ExecContext(r.Context(), tx, sq.CustomQuery{
+			Dialect: nbrew.Dialect,
+			Format: "INSERT INTO site_user (site_id, user_id, role)" +
+				" VALUES ({siteID}, (SELECT user_id FROM users WHERE email = {email}), {role}) {conflictClause}",
+			Values: []any{
+				sq.UUIDParam("siteID", invite.SiteID),
+				sq.StringParam("email", invite.Email),
+				sq.StringParam("role", invite.Role),
+				sq.Param("conflictClause", sq.DialectExpression{
+					Default: sq.Expr("ON CONFLICT DO NOTHING"),
+					Cases: []sq.DialectCase{{
+						Dialect: sq.DialectMySQL,
+						Result:  sq.Expr("ON DUPLICATE KEY UPDATE site_id = site_id"),
+					}},
+				}),
+			},
+		})
+		if err != nil {
+			logger.Error(err.Error())
+			internalServerError(w, r, err)
+			return
+		}
+		err = tx.Commit()
+		if err != nil {
+			logger.Error(err.Error())
+			internalServerError(w, r, err)
+			return
+		}
+		response.Token = ""
+		writeResponse(w, r, response)
+	default:
+		http.Error(w, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,221 @@
+package nb6
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/bokwoon95/sq"
+)
+
+// janitorInterval is how often the janitor purges expired tokens from the
+// database and expired items from the recycle bins. It is also how late a
+// scheduled post may be published.
+const janitorInterval = time.Hour
+
+// startJanitor starts a goroutine that purges expired tokens from the
+// database and expired items from the recycle bin of every site, and
+// publishes the scheduled posts that have come due, every janitorInterval
+// until Close is called.
+func (nbrew *Notebrew) startJanitor() {
+	ctx, cancel := context.WithCancel(context.Background())
+	nbrew.stopJanitor = cancel
+	nbrew.janitorDone = make(chan struct{})
+	go func() {
+		defer close(nbrew.janitorDone)
+		ticker := time.NewTicker(janitorInterval)
+		defer ticker.Stop()
+		for {
+			err := nbrew.purgeExpiredTokens(ctx)
+			if err != nil && ctx.Err() == nil {
+				log.Printf("purging expired tokens: %v", err)
+			}
+			err = nbrew.purgeExpiredRecycleBins(ctx)
+			if err != nil && ctx.Err() == nil {
+				log.Printf("purging expired recycle bin items: %v", err)
+			}
+			err = nbrew.publishScheduledPosts(ctx)
+			if err != nil && ctx.Err() == nil {
+				log.Printf("publishing scheduled posts: %v", err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// tokenHashCutoff returns the prefix of the hash of a token issued at t.
+// Every token hash starts with the big-endian unix time that the token was
+// issued at, so the hashes of the tokens issued before t are exactly the ones
+// that compare less than the prefix in every dialect.
+func tokenHashCutoff(t time.Time) []byte {
+	var cutoff [8]byte
+	binary.BigEndian.PutUint64(cutoff[:], uint64(t.Unix()))
+	return cutoff[:]
+}
+
+// purgeExpiredTokens deletes the sessions, login sessions, password reset
+// tokens, invites and API tokens that can no longer be used.
+func (nbrew *Notebrew) purgeExpiredTokens(ctx context.Context) error {
+	if nbrew.DB == nil {
+		return nil
+	}
+	now := time.Now()
+	queries := []sq.CustomQuery{{
+		Format: "DELETE FROM session WHERE session_token_hash < {cutoff}",
+		Values: []any{
+			sq.BytesParam("cutoff", tokenHashCutoff(now.Add(-sessionLifetime))),
+		},
+	}, {
+		Format: "UPDATE users SET reset_token_hash = NULL WHERE reset_token_hash < {cutoff}",
+		Values: []any{
+			sq.BytesParam("cutoff", tokenHashCutoff(now.Add(-resetTokenLifetime))),
+		},
+	}, {
+		Format: "DELETE FROM invite WHERE invite_token_hash < {cutoff}",
+		Values: []any{
+			sq.BytesParam("cutoff", tokenHashCutoff(now.Add(-inviteTokenLifetime))),
+		},
+	}, {
+		Format: "DELETE FROM api_token_site WHERE api_token_hash IN (SELECT api_token_hash FROM api_token WHERE expiry_time < {now})",
+		Values: []any{
+			sq.TimeParam("now", now.UTC()),
+		},
+	}, {
+		Format: "DELETE FROM api_token WHERE expiry_time < {now}",
+		Values: []any{
+			sq.TimeParam("now", now.UTC()),
+		},
+	}}
+	if maxAge := nbrew.sessionMaxAge(); maxAge > 0 {
+		queries = append(queries, sq.CustomQuery{
+			Format: "DELETE FROM authentication WHERE authentication_token_hash < {cutoff}",
+			Values: []any{
+				sq.BytesParam("cutoff", tokenHashCutoff(now.Add(-maxAge))),
+			},
+		})
+	}
+	if idleTimeout := nbrew.sessionIdleTimeout(); idleTimeout > 0 {
+		queries = append(queries, sq.CustomQuery{
+			Format: "DELETE FROM authentication WHERE last_active_time < {cutoff}",
+			Values: []any{
+				sq.TimeParam("cutoff", now.Add(-idleTimeout).UTC()),
+			},
+		})
+	}
+	var errs []error
+	for _, query := range queries {
+		query.Dialect = nbrew.Dialect
+		_, err := sq.ExecContext(ctx, nbrew.DB, query)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// sitePrefixes returns the prefix of every site: the empty prefix of the
+// main site followed by the folders of the other sites.
+func (nbrew *Notebrew) sitePrefixes() ([]string, error) {
+	sitePrefixes := []string{""}
+	dirEntries, err := nbrew.FS.ReadDir(".")
+	if err != nil {
+		return nil, err
+	}
+	for _, dirEntry := range dirEntries {
+		name := dirEntry.Name()
+		if dirEntry.IsDir() && (strings.HasPrefix(name, "@") || strings.Contains(name, ".")) {
+			sitePrefixes = append(sitePrefixes, name)
+		}
+	}
+	return sitePrefixes, nil
+}
+
+// purgeExpiredRecycleBins purges the expired items from the recycle bin of
+// every site.
+func (nbrew *Notebrew) purgeExpiredRecycleBins(ctx context.Context) error {
+	sitePrefixes, err := nbrew.sitePrefixes()
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, sitePrefix := range sitePrefixes {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		err = nbrew.purgeExpiredRecycleBinItems(sitePrefix)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", sitePrefix, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// publishScheduledPosts generates the posts of every site whose publish date
+// has passed but which have not been generated yet, i.e. scheduled posts that
+// have come due.
+func (nbrew *Notebrew) publishScheduledPosts(ctx context.Context) error {
+	sitePrefixes, err := nbrew.sitePrefixes()
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, sitePrefix := range sitePrefixes {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		err = nbrew.publishDuePosts(ctx, sitePrefix)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", sitePrefix, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// publishDuePosts generates the published posts of a site that have no
+// generated output.
+func (nbrew *Notebrew) publishDuePosts(ctx context.Context, sitePrefix string) error {
+	dirEntries, err := nbrew.FS.ReadDir(path.Join(sitePrefix, "posts"))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	categories := []string{""}
+	for _, dirEntry := range dirEntries {
+		if dirEntry.IsDir() {
+			categories = append(categories, dirEntry.Name())
+		}
+	}
+	var names []string
+	for _, category := range categories {
+		posts, err := nbrew.getPosts(ctx, sitePrefix, category)
+		if err != nil {
+			return err
+		}
+		for _, post := range posts {
+			_, err := fs.Stat(nbrew.FS, path.Join(sitePrefix, "site/posts", post.Category, post.Name, "index.html"))
+			if err == nil {
+				continue
+			}
+			if !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+			names = append(names, path.Join("posts", post.Category, post.Name+".md"))
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	return nbrew.generate(ctx, sitePrefix, names...)
+}
@@ -0,0 +1,76 @@
+package nb6
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestPurgeExpiredRecycleBins(t *testing.T) {
+	nbrew, _ := newTestLocalNotebrew(t, map[string]string{
+		"root/notes/old.md":        "old",
+		"root/notes/new.md":        "new",
+		"root/@other/notes/old.md": "old",
+	})
+	nbrew.RecycleBinRetention = time.Hour
+	type Item struct {
+		sitePrefix string
+		name       string
+		deletedAt  time.Time
+		wantPurged bool
+	}
+	items := []Item{
+		{sitePrefix: "", name: "notes/old.md", deletedAt: time.Now().Add(-2 * time.Hour), wantPurged: true},
+		{sitePrefix: "", name: "notes/new.md", deletedAt: time.Now(), wantPurged: false},
+		{sitePrefix: "@other", name: "notes/old.md", deletedAt: time.Now().Add(-2 * time.Hour), wantPurged: true},
+	}
+	ids := make([]string, len(items))
+	for i, item := range items {
+		id, err := nbrew.recycle(item.sitePrefix, item.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[i] = id
+		// Backdate the recycle bin item.
+		recycleBinItem, err := nbrew.getRecycleBinItem(item.sitePrefix, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		recycleBinItem.DeletedAt = item.deletedAt
+		b, err := json.Marshal(&recycleBinItem)
+		if err != nil {
+			t.Fatal(err)
+		}
+		readerFrom, err := nbrew.FS.OpenReaderFrom(path.Join(item.sitePrefix, "system/recycle_bin", id+".json"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = readerFrom.ReadFrom(bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := nbrew.purgeExpiredRecycleBins(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, item := range items {
+		_, err := nbrew.getRecycleBinItem(item.sitePrefix, ids[i])
+		purged := errors.Is(err, fs.ErrNotExist)
+		if !purged && err != nil {
+			t.Fatal(err)
+		}
+		if purged != item.wantPurged {
+			t.Errorf("%s %s: got purged %v, want %v", item.sitePrefix, item.name, purged, item.wantPurged)
+		}
+		_, err = fs.Stat(nbrew.FS, path.Join(item.sitePrefix, "system/recycle_bin", ids[i]))
+		if purged != errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("%s %s: recycle bin item folder: %v", item.sitePrefix, item.name, err)
+		}
+	}
+}
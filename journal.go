@@ -0,0 +1,290 @@
+package nb6
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// journalDir is where the intent log is kept. Before an operation that
+// touches many files starts, a journal entry describing it is written into
+// journalDir, and it is only removed once the operation is done. If notebrew
+// crashes in the middle of the operation, the entry is still there the next
+// time it starts and recoverJournal rolls the operation forward (or back) so
+// that a site is never left half moved or half deleted.
+const journalDir = "system/journal"
+
+// journalEntry is an operation in the intent log. Src and Dest are relative
+// to the root of the FS (they include the site prefix).
+type journalEntry struct {
+	ID string `json:"id"`
+
+	// Op is the operation:
+	//
+	//   - "move" moves Src to Dest. It is rolled forward.
+	//   - "copy" copies the directory Src to Dest. It is rolled back by
+	//     removing Dest.
+	//   - "delete_site" removes the site folder Src and the database records
+	//     of SiteName. It is rolled forward.
+	//   - "recycle" moves Src into the recycle bin item folder Dest. It is
+	//     rolled back by removing the recycle bin item if Src never made it
+	//     into Dest.
+	//   - "restore" moves the recycle bin item folder Src back to Dest. It is
+	//     rolled forward.
+	//   - "purge" removes the recycle bin item folder Src. It is rolled
+	//     forward.
+	Op string `json:"op"`
+
+	Src       string    `json:"src,omitempty"`
+	Dest      string    `json:"dest,omitempty"`
+	SiteName  string    `json:"site_name,omitempty"`
+	StartedAt time.Time `json:"started_at"`
+}
+
+// journaled records entry in the intent log, runs fn and then removes entry
+// from the intent log. If fn fails, the caller reports the error, so the
+// operation is rolled back as far as it can be (see rollbackJournalEntry) and
+// entry is removed regardless: an operation that failed must not be finished
+// behind the user's back on the next startup.
+func (nbrew *Notebrew) journaled(entry journalEntry, fn func() error) error {
+	entry.ID = NewStringID()
+	entry.StartedAt = time.Now().UTC()
+	err := mkdirAll(nbrew.FS, journalDir, 0755)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(&entry)
+	if err != nil {
+		return err
+	}
+	name := path.Join(journalDir, entry.ID+".json")
+	readerFrom, err := nbrew.FS.OpenReaderFrom(name, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = readerFrom.ReadFrom(bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	err = fn()
+	if err != nil {
+		rollbackErr := nbrew.rollbackJournalEntry(entry)
+		_ = nbrew.FS.Remove(name)
+		if rollbackErr != nil {
+			return fmt.Errorf("%w (rolling back %s %s failed: %v)", err, entry.Op, entry.Src, rollbackErr)
+		}
+		return err
+	}
+	return nbrew.FS.Remove(name)
+}
+
+// rollbackJournalEntry undoes as much as possible of an operation that failed
+// while it was running. A move or restore is moved back to where it came
+// from, and a copy or recycle is rolled back the same way recoverJournal
+// would. A delete_site or purge cannot be undone, whatever was deleted stays
+// deleted and the rest is left alone.
+func (nbrew *Notebrew) rollbackJournalEntry(entry journalEntry) error {
+	switch entry.Op {
+	case "move":
+		fileInfo, err := fs.Stat(nbrew.FS, entry.Dest)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				// Nothing was moved.
+				return nil
+			}
+			return err
+		}
+		if !fileInfo.IsDir() {
+			_, err = fs.Stat(nbrew.FS, entry.Src)
+			if err == nil {
+				// Nothing was moved, dest was already there.
+				return nil
+			}
+			if !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+			return nbrew.FS.Rename(entry.Dest, entry.Src)
+		}
+		return moveTree(nbrew.FS, entry.Dest, entry.Src)
+	case "restore":
+		content := path.Join(entry.Src, path.Base(entry.Dest))
+		_, err := fs.Stat(nbrew.FS, content)
+		if err == nil {
+			// The item never left the recycle bin.
+			return nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		_, err = fs.Stat(nbrew.FS, entry.Dest)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		err = mkdirAll(nbrew.FS, entry.Src, 0755)
+		if err != nil {
+			return err
+		}
+		return nbrew.FS.Rename(entry.Dest, content)
+	case "copy", "recycle":
+		return nbrew.recoverJournalEntry(entry)
+	case "delete_site", "purge":
+		return nil
+	default:
+		return fmt.Errorf("unknown operation %q", entry.Op)
+	}
+}
+
+// recoverJournal recovers every operation left in the intent log, oldest
+// first. It is called by New before notebrew starts serving requests.
+func (nbrew *Notebrew) recoverJournal() error {
+	dirEntries, err := nbrew.FS.ReadDir(journalDir)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	var entries []journalEntry
+	for _, dirEntry := range dirEntries {
+		if dirEntry.IsDir() || path.Ext(dirEntry.Name()) != ".json" {
+			continue
+		}
+		b, err := fs.ReadFile(nbrew.FS, path.Join(journalDir, dirEntry.Name()))
+		if err != nil {
+			return err
+		}
+		var entry journalEntry
+		err = json.Unmarshal(b, &entry)
+		if err != nil {
+			return fmt.Errorf("%s: %w", dirEntry.Name(), err)
+		}
+		entry.ID = strings.TrimSuffix(dirEntry.Name(), ".json")
+		entries = append(entries, entry)
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].StartedAt.Before(entries[j].StartedAt)
+	})
+	// An operation that can't be recovered stays in the intent log to be
+	// retried on the next startup, it doesn't stop the others from being
+	// recovered.
+	var errs []error
+	for _, entry := range entries {
+		err = nbrew.recoverJournalEntry(entry)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s %s: %w", entry.Op, entry.Src, err))
+			continue
+		}
+		err = nbrew.FS.Remove(path.Join(journalDir, entry.ID+".json"))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// recoverJournalEntry rolls the operation of entry forward or back. Every
+// step tolerates having already been done, so it can be called as many times
+// as needed.
+func (nbrew *Notebrew) recoverJournalEntry(entry journalEntry) error {
+	switch entry.Op {
+	case "move":
+		fileInfo, err := fs.Stat(nbrew.FS, entry.Src)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				// The move finished.
+				return nil
+			}
+			return err
+		}
+		if !fileInfo.IsDir() {
+			return nbrew.FS.Rename(entry.Src, entry.Dest)
+		}
+		return moveTree(nbrew.FS, entry.Src, entry.Dest)
+	case "copy":
+		err := removeAll(nbrew.FS, entry.Dest)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	case "delete_site":
+		err := removeAll(nbrew.FS, entry.Src)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nbrew.deleteSiteRecords(context.Background(), entry.SiteName)
+	case "recycle":
+		_, err := fs.Stat(nbrew.FS, path.Join(entry.Dest, path.Base(entry.Src)))
+		if err == nil {
+			// The item made it into the recycle bin.
+			return nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		err = removeAll(nbrew.FS, entry.Dest)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		err = nbrew.FS.Remove(entry.Dest + ".json")
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	case "restore":
+		content := path.Join(entry.Src, path.Base(entry.Dest))
+		_, err := fs.Stat(nbrew.FS, content)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		if err == nil {
+			_, err = fs.Stat(nbrew.FS, entry.Dest)
+			if err == nil {
+				// Something else took the original path in the meantime, so
+				// leave the item in the recycle bin.
+				return nil
+			}
+			if !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+			err = mkdirAll(nbrew.FS, path.Dir(entry.Dest), 0755)
+			if err != nil {
+				return err
+			}
+			err = nbrew.FS.Rename(content, entry.Dest)
+			if err != nil {
+				return err
+			}
+		}
+		err = nbrew.FS.Remove(entry.Src)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		err = nbrew.FS.Remove(entry.Src + ".json")
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	case "purge":
+		err := removeAll(nbrew.FS, entry.Src)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		err = nbrew.FS.Remove(entry.Src + ".json")
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown operation %q", entry.Op)
+	}
+}
@@ -0,0 +1,221 @@
+package nb6
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/bokwoon95/nb6/internal/testutil"
+)
+
+// listFiles returns the slash separated paths of every file under dir,
+// sorted.
+func listFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	var names []string
+	err := filepath.WalkDir(dir, func(name string, dirEntry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !dirEntry.IsDir() {
+			rel, err := filepath.Rel(dir, name)
+			if err != nil {
+				return err
+			}
+			names = append(names, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestRecoverJournal(t *testing.T) {
+	type TestTable struct {
+		description string
+		// files is the state of the FS at the time of the crash.
+		files     map[string]string
+		entry     journalEntry
+		wantFiles []string
+	}
+
+	tests := []TestTable{{
+		description: "move of a folder is rolled forward",
+		files: map[string]string{
+			"root/notes/dir/a.md":     "a",
+			"root/notes/dir/sub/b.md": "b",
+			"root/posts/dir/c.md":     "c",
+		},
+		entry:     journalEntry{Op: "move", Src: "notes/dir", Dest: "posts/dir"},
+		wantFiles: []string{"posts/dir/a.md", "posts/dir/c.md", "posts/dir/sub/b.md"},
+	}, {
+		description: "move of a file is rolled forward",
+		files: map[string]string{
+			"root/notes/a.md": "a",
+		},
+		entry:     journalEntry{Op: "move", Src: "notes/a.md", Dest: "posts/a.md"},
+		wantFiles: []string{"posts/a.md"},
+	}, {
+		description: "copy is rolled back",
+		files: map[string]string{
+			"root/notes/dir/a.md":      "a",
+			"root/notes/dir-copy/a.md": "a",
+		},
+		entry:     journalEntry{Op: "copy", Src: "notes/dir", Dest: "notes/dir-copy"},
+		wantFiles: []string{"notes/dir/a.md"},
+	}, {
+		description: "recycle that never moved the item is rolled back",
+		files: map[string]string{
+			"root/notes/a.md":                   "a",
+			"root/system/recycle_bin/item.json": "{}",
+		},
+		entry:     journalEntry{Op: "recycle", Src: "notes/a.md", Dest: "system/recycle_bin/item"},
+		wantFiles: []string{"notes/a.md"},
+	}, {
+		description: "restore is rolled forward",
+		files: map[string]string{
+			"root/system/recycle_bin/item/a.md": "a",
+			"root/system/recycle_bin/item.json": "{}",
+		},
+		entry:     journalEntry{Op: "restore", Src: "system/recycle_bin/item", Dest: "notes/a.md"},
+		wantFiles: []string{"notes/a.md"},
+	}, {
+		description: "purge is rolled forward",
+		files: map[string]string{
+			"root/notes/a.md":                   "a",
+			"root/system/recycle_bin/item/b.md": "b",
+			"root/system/recycle_bin/item.json": "{}",
+		},
+		entry:     journalEntry{Op: "purge", Src: "system/recycle_bin/item"},
+		wantFiles: []string{"notes/a.md"},
+	}}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.description, func(t *testing.T) {
+			nbrew, tempDir := newTestLocalNotebrew(t, tt.files)
+			// Leave the entry behind the way a crash would.
+			tt.entry.ID = NewStringID()
+			tt.entry.StartedAt = time.Now().UTC()
+			b, err := json.Marshal(&tt.entry)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = os.MkdirAll(filepath.Join(tempDir, "root", journalDir), 0755)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = os.WriteFile(filepath.Join(tempDir, "root", journalDir, tt.entry.ID+".json"), b, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = nbrew.recoverJournal()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := testutil.Diff(listFiles(t, filepath.Join(tempDir, "root")), tt.wantFiles); diff != "" {
+				t.Error(testutil.Callers(), diff)
+			}
+			// Recovering again is a no-op.
+			err = nbrew.recoverJournal()
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestJournaledRollsBackFailures(t *testing.T) {
+	errFailed := errors.New("failed")
+
+	t.Run("move", func(t *testing.T) {
+		nbrew, tempDir := newTestLocalNotebrew(t, map[string]string{
+			"root/notes/dir/a.md":     "a",
+			"root/notes/dir/sub/b.md": "b",
+		})
+		err := nbrew.journaled(journalEntry{Op: "move", Src: "notes/dir", Dest: "posts/dir"}, func() error {
+			// Move part of the folder, then fail.
+			err := nbrew.FS.Mkdir("posts/dir", 0755)
+			if err != nil {
+				return err
+			}
+			err = nbrew.FS.Rename("notes/dir/a.md", "posts/dir/a.md")
+			if err != nil {
+				return err
+			}
+			return errFailed
+		})
+		if !errors.Is(err, errFailed) {
+			t.Fatalf("got error %v, want %v", err, errFailed)
+		}
+		if diff := testutil.Diff(listFiles(t, filepath.Join(tempDir, "root")), []string{"notes/dir/a.md", "notes/dir/sub/b.md"}); diff != "" {
+			t.Error(testutil.Callers(), diff)
+		}
+		// The failed move must not be finished on the next startup.
+		err = nbrew.recoverJournal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := testutil.Diff(listFiles(t, filepath.Join(tempDir, "root")), []string{"notes/dir/a.md", "notes/dir/sub/b.md"}); diff != "" {
+			t.Error(testutil.Callers(), diff)
+		}
+	})
+
+	t.Run("restore", func(t *testing.T) {
+		nbrew, tempDir := newTestLocalNotebrew(t, map[string]string{
+			"root/notes/a.md": "a",
+		})
+		id, err := nbrew.recycle("", "notes/a.md")
+		if err != nil {
+			t.Fatal(err)
+		}
+		itemDir := path.Join("system/recycle_bin", id)
+		err = nbrew.journaled(journalEntry{Op: "restore", Src: itemDir, Dest: "notes/a.md"}, func() error {
+			err := nbrew.FS.Rename(path.Join(itemDir, "a.md"), "notes/a.md")
+			if err != nil {
+				return err
+			}
+			return errFailed
+		})
+		if !errors.Is(err, errFailed) {
+			t.Fatalf("got error %v, want %v", err, errFailed)
+		}
+		if diff := testutil.Diff(listFiles(t, filepath.Join(tempDir, "root")), []string{itemDir + ".json", itemDir + "/a.md"}); diff != "" {
+			t.Error(testutil.Callers(), diff)
+		}
+	})
+}
+
+func TestMoveRenamesFolders(t *testing.T) {
+	nbrew, tempDir := newTestLocalNotebrew(t, map[string]string{
+		"root/notes/dir/a.md": "a",
+	})
+	before, err := os.Stat(filepath.Join(tempDir, "root/notes/dir"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = move(nbrew.FS, "notes/dir", "posts/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, err := os.Stat(filepath.Join(tempDir, "root/posts/dir"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The folder itself was renamed rather than recreated.
+	if !os.SameFile(before, after) {
+		t.Error("posts/dir is not the same folder as notes/dir")
+	}
+	if diff := testutil.Diff(listFiles(t, filepath.Join(tempDir, "root")), []string{"posts/dir/a.md"}); diff != "" {
+		t.Error(testutil.Callers(), diff)
+	}
+}
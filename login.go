@@ -38,6 +38,7 @@ func (nbrew *Notebrew) login(w http.ResponseWriter, r *http.Request) {
 		IncorrectLoginCredentials bool       `json:"incorrect_login_credentials,omitempty"`
 		AlreadyLoggedIn           bool       `json:"already_logged_in,omitempty"`
 		PasswordReset             bool       `json:"password_reset,omitempty"`
+		InviteAccepted            bool       `json:"invite_accepted,omitempty"`
 	}
 
 	logger, ok := r.Context().Value(loggerKey).(*slog.Logger)
@@ -59,15 +60,20 @@ func (nbrew *Notebrew) login(w http.ResponseWriter, r *http.Request) {
 	var alreadyLoggedIn bool
 	authenticationTokenHash := getAuthenticationTokenHash(r)
 	if authenticationTokenHash != nil {
-		exists, err := sq.FetchExistsContext(r.Context(), nbrew.DB, sq.CustomQuery{
-			Format: "SELECT 1 FROM authentication WHERE authentication_token_hash = {authenticationTokenHash}",
+		lastActiveTime, err := sq.FetchOneContext(r.Context(), nbrew.DB, sq.CustomQuery{
+			Dialect: nbrew.Dialect,
+			Format:  "SELECT {*} FROM authentication WHERE authentication_token_hash = {authenticationTokenHash}",
 			Values: []any{
 				sq.BytesParam("authenticationTokenHash", authenticationTokenHash),
 			},
+		}, func(row *sq.Row) sql.NullTime {
+			return row.NullTime("last_active_time")
 		})
 		if err != nil {
-			logger.Error(err.Error())
-		} else if exists {
+			if !errors.Is(err, sql.ErrNoRows) {
+				logger.Error(err.Error())
+			}
+		} else if !nbrew.isSessionExpired(authenticationTokenHash, lastActiveTime) {
 			alreadyLoggedIn = true
 		}
 	}
@@ -125,6 +131,12 @@ func (nbrew *Notebrew) login(w http.ResponseWriter, r *http.Request) {
 				http.Redirect(w, r, r.URL.String(), http.StatusFound)
 				return
 			}
+			// The cookie outlives the session if sessions have no maximum
+			// age, the session still times out when it is not used.
+			maxAge := nbrew.sessionMaxAge()
+			if maxAge < 0 {
+				maxAge = defaultSessionMaxAge
+			}
 			http.SetCookie(w, &http.Cookie{
 				Path:     "/",
 				Name:     "authentication",
@@ -132,7 +144,7 @@ func (nbrew *Notebrew) login(w http.ResponseWriter, r *http.Request) {
 				Secure:   nbrew.Scheme == "https://",
 				HttpOnly: true,
 				SameSite: http.SameSiteLaxMode,
-				MaxAge:   int((time.Hour * 24 * 365).Seconds()),
+				MaxAge:   int(maxAge.Seconds()),
 			})
 			referer := strings.Trim(path.Clean(response.Referer), "/")
 			head, tail, _ := strings.Cut(referer, "/")
@@ -255,13 +267,21 @@ func (nbrew *Notebrew) login(w http.ResponseWriter, r *http.Request) {
 		checksum := blake2b.Sum256([]byte(authenticationToken[8:]))
 		copy(authenticationTokenHash[:8], authenticationToken[:8])
 		copy(authenticationTokenHash[8:], checksum[:])
+		userAgent := r.UserAgent()
+		if len(userAgent) > 500 {
+			userAgent = strings.ToValidUTF8(userAgent[:500], "")
+		}
+		ipAddress, _ := getIP(r)
 		if email != "" {
 			_, err = sq.ExecContext(r.Context(), nbrew.DB, sq.CustomQuery{
 				Dialect: nbrew.Dialect,
-				Format: "INSERT INTO authentication (authentication_token_hash, user_id)" +
-					" VALUES ({authenticationTokenHash}, (SELECT user_id FROM users WHERE email = {email}))",
+				Format: "INSERT INTO authentication (authentication_token_hash, user_id, last_active_time, user_agent, ip_address)" +
+					" VALUES ({authenticationTokenHash}, (SELECT user_id FROM users WHERE email = {email}), {lastActiveTime}, {userAgent}, {ipAddress})",
 				Values: []any{
 					sq.BytesParam("authenticationTokenHash", authenticationTokenHash[:]),
+					sq.TimeParam("lastActiveTime", time.Now().UTC()),
+					sq.StringParam("userAgent", userAgent),
+					sq.StringParam("ipAddress", ipAddress),
 					sq.StringParam("email", email),
 				},
 			})
@@ -273,10 +293,13 @@ func (nbrew *Notebrew) login(w http.ResponseWriter, r *http.Request) {
 		} else {
 			_, err = sq.ExecContext(r.Context(), nbrew.DB, sq.CustomQuery{
 				Dialect: nbrew.Dialect,
-				Format: "INSERT INTO authentication (authentication_token_hash, user_id)" +
-					" VALUES ({authenticationTokenHash}, (SELECT user_id FROM users WHERE username = {username}))",
+				Format: "INSERT INTO authentication (authentication_token_hash, user_id, last_active_time, user_agent, ip_address)" +
+					" VALUES ({authenticationTokenHash}, (SELECT user_id FROM users WHERE username = {username}), {lastActiveTime}, {userAgent}, {ipAddress})",
 				Values: []any{
 					sq.BytesParam("authenticationTokenHash", authenticationTokenHash[:]),
+					sq.TimeParam("lastActiveTime", time.Now().UTC()),
+					sq.StringParam("userAgent", userAgent),
+					sq.StringParam("ipAddress", ipAddress),
 					sq.StringParam("username", strings.TrimPrefix(response.Username, "@")),
 				},
 			})
@@ -0,0 +1,674 @@
+package nb6
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"mime"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/bokwoon95/sq"
+	"golang.org/x/exp/slog"
+)
+
+// siteMember is a member of a site.
+type siteMember struct {
+	Username string `json:"username"`
+	Email    string `json:"email"`
+	Role     string `json:"role"`
+}
+
+// siteInvite is a pending invitation to a site.
+type siteInvite struct {
+	Email     string    `json:"email"`
+	Role      string    `json:"role"`
+	InvitedAt time.Time `json:"invited_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// hasSiteRoles reports whether the site_user table already has a role
+// column. Databases created before sites had owners don't, and get their
+// owners assigned once automigrate has added the column.
+func hasSiteRoles(db *sql.DB) bool {
+	if db == nil {
+		return true
+	}
+	rows, err := db.Query("SELECT role FROM site_user WHERE 1 = 0")
+	if err != nil {
+		return false
+	}
+	rows.Close()
+	return true
+}
+
+// assignSiteOwners makes one member of every site that has no owner its
+// owner, leaving every other member with the role they already have. The
+// owner is the user the site is named after if they are a member (every user
+// has a site named after them), otherwise the member who signed up first (user
+// IDs start with their creation time).
+func assignSiteOwners(dialect string, db *sql.DB) error {
+	if db == nil {
+		return nil
+	}
+	type member struct {
+		SiteID     [16]byte
+		UserID     [16]byte
+		IsNamesake bool
+	}
+	members, err := sq.FetchAll(db, sq.CustomQuery{
+		Dialect: dialect,
+		Format: "SELECT {*}" +
+			" FROM site_user" +
+			" JOIN site ON site.site_id = site_user.site_id" +
+			" JOIN users ON users.user_id = site_user.user_id" +
+			" WHERE site_user.site_id NOT IN (SELECT site_id FROM site_user WHERE role = {role})" +
+			" ORDER BY site_user.site_id, site_user.user_id",
+		Values: []any{
+			sq.StringParam("role", roleOwner),
+		},
+	}, func(row *sq.Row) member {
+		var m member
+		row.UUID(&m.SiteID, "site_user.site_id")
+		row.UUID(&m.UserID, "site_user.user_id")
+		m.IsNamesake = row.String("site.site_name") == row.String("users.username")
+		return m
+	})
+	if err != nil {
+		return err
+	}
+	owners := make(map[[16]byte][16]byte)
+	var siteIDs [][16]byte
+	for _, m := range members {
+		_, ok := owners[m.SiteID]
+		if !ok {
+			siteIDs = append(siteIDs, m.SiteID)
+		}
+		if !ok || m.IsNamesake {
+			owners[m.SiteID] = m.UserID
+		}
+	}
+	for _, siteID := range siteIDs {
+		_, err = sq.Exec(db, sq.CustomQuery{
+			Dialect: dialect,
+			Format:  "UPDATE site_user SET role = {role} WHERE site_id = {siteID} AND user_id = {userID}",
+			Values: []any{
+				sq.StringParam("role", roleOwner),
+				sq.UUIDParam("siteID", siteID),
+				sq.UUIDParam("userID", owners[siteID]),
+			},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getSiteMembers returns the members of a site, ordered by username.
+func (nbrew *Notebrew) getSiteMembers(ctx context.Context, siteName string) ([]siteMember, error) {
+	return sq.FetchAllContext(ctx, nbrew.DB, sq.CustomQuery{
+		Dialect: nbrew.Dialect,
+		Format: "SELECT {*}" +
+			" FROM site_user" +
+			" JOIN site ON site.site_id = site_user.site_id" +
+			" JOIN users ON users.user_id = site_user.user_id" +
+			" WHERE site.site_name = {siteName}" +
+			" ORDER BY users.username",
+		Values: []any{
+			sq.StringParam("siteName", siteName),
+		},
+	}, func(row *sq.Row) siteMember {
+		return siteMember{
+			Username: row.String("users.username"),
+			Email:    row.String("users.email"),
+			Role:     row.String("site_user.role"),
+		}
+	})
+}
+
+// getSiteInvites returns the pending invitations to a site, ordered by email.
+// Expired invitations are deleted instead of being returned.
+func (nbrew *Notebrew) getSiteInvites(ctx context.Context, siteName string) ([]siteInvite, error) {
+	type inviteRow struct {
+		InviteTokenHash []byte
+		Email           string
+		Role            string
+	}
+	rows, err := sq.FetchAllContext(ctx, nbrew.DB, sq.CustomQuery{
+		Dialect: nbrew.Dialect,
+		Format: "SELECT {*}" +
+			" FROM invite" +
+			" JOIN site ON site.site_id = invite.site_id" +
+			" WHERE site.site_name = {siteName}" +
+			" ORDER BY invite.email",
+		Values: []any{
+			sq.StringParam("siteName", siteName),
+		},
+	}, func(row *sq.Row) inviteRow {
+		return inviteRow{
+			InviteTokenHash: row.Bytes("invite.invite_token_hash"),
+			Email:           row.String("invite.email"),
+			Role:            row.String("invite.role"),
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	invites := make([]siteInvite, 0, len(rows))
+	for _, row := range rows {
+		if len(row.InviteTokenHash) < 8 {
+			continue
+		}
+		invitedAt := time.Unix(int64(binary.BigEndian.Uint64(row.InviteTokenHash[:8])), 0).UTC()
+		expiresAt := invitedAt.Add(inviteTokenLifetime)
+		if time.Now().After(expiresAt) {
+			_, err := sq.ExecContext(ctx, nbrew.DB, sq.CustomQuery{
+				Dialect: nbrew.Dialect,
+				Format:  "DELETE FROM invite WHERE invite_token_hash = {inviteTokenHash}",
+				Values: []any{
+					sq.BytesParam("inviteTokenHash", row.InviteTokenHash),
+				},
+			})
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		invites = append(invites, siteInvite{
+			Email:     row.Email,
+			Role:      row.Role,
+			InvitedAt: invitedAt,
+			ExpiresAt: expiresAt,
+		})
+	}
+	return invites, nil
+}
+
+// members lists the members and pending invitations of a site. The owner of
+// the site can also invite people by email, add existing users, change the
+// role of members, remove members, revoke invitations and transfer the
+// ownership of the site to another member (authorize makes sure that only the
+// owner gets to POST).
+func (nbrew *Notebrew) members(w http.ResponseWriter, r *http.Request, username, sitePrefix string) {
+	type Request struct {
+		Action   string `json:"action,omitempty"`
+		Username string `json:"username,omitempty"`
+		Email    string `json:"email,omitempty"`
+		Role     string `json:"role,omitempty"`
+	}
+	type Response struct {
+		Action     string   `json:"action,omitempty"`
+		Username   string   `json:"username,omitempty"`
+		Email      string   `json:"email,omitempty"`
+		Role       string   `json:"role,omitempty"`
+		InviteLink string   `json:"invite_link,omitempty"`
+		Errors     []string `json:"errors,omitempty"`
+		Success    []string `json:"success,omitempty"`
+	}
+	type TemplateData struct {
+		IsOwner bool         `json:"is_owner"`
+		Members []siteMember `json:"members"`
+		Invites []siteInvite `json:"invites"`
+		Alerts  url.Values   `json:"alerts,omitempty"`
+	}
+
+	logger, ok := r.Context().Value(loggerKey).(*slog.Logger)
+	if !ok {
+		logger = slog.Default()
+	}
+
+	if nbrew.DB == nil {
+		notFound(w, r)
+		return
+	}
+	siteName := strings.TrimPrefix(sitePrefix, "@")
+
+	switch r.Method {
+	case "GET":
+		var templateData TemplateData
+		_, err := nbrew.getSession(r, "flash", &templateData)
+		if err != nil {
+			logger.Error(err.Error())
+		}
+		nbrew.clearSession(w, r, "flash")
+		role, err := nbrew.getSiteRole(r.Context(), username, siteName)
+		if err != nil {
+			logger.Error(err.Error())
+			internalServerError(w, r, err)
+			return
+		}
+		templateData.IsOwner = role == roleOwner
+		templateData.Members, err = nbrew.getSiteMembers(r.Context(), siteName)
+		if err != nil {
+			logger.Error(err.Error())
+			internalServerError(w, r, err)
+			return
+		}
+		// Only the owner gets to see who has been invited.
+		if templateData.IsOwner {
+			templateData.Invites, err = nbrew.getSiteInvites(r.Context(), siteName)
+			if err != nil {
+				logger.Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+		}
+
+		accept, _, _ := mime.ParseMediaType(r.Header.Get("Accept"))
+		if accept == "application/json" {
+			w.Header().Set("Content-Type", "application/json")
+			b, err := json.Marshal(&templateData)
+			if err != nil {
+				logger.Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+			w.Write(b)
+			return
+		}
+
+		funcMap := map[string]any{
+			"join":       path.Join,
+			"safeHTML":   func(s string) template.HTML { return template.HTML(s) },
+			"username":   func() string { return username },
+			"sitePrefix": func() string { return sitePrefix },
+			"roles":      func() []string { return []string{roleEditor, roleAuthor, roleViewer} },
+		}
+		tmpl, err := template.New("members.html").Funcs(funcMap).ParseFS(rootFS, "members.html")
+		if err != nil {
+			logger.Error(err.Error())
+			internalServerError(w, r, err)
+			return
+		}
+		buf := bufPool.Get().(*bytes.Buffer)
+		buf.Reset()
+		defer bufPool.Put(buf)
+		err = tmpl.Execute(buf, &templateData)
+		if err != nil {
+			logger.Error(err.Error())
+			internalServerError(w, r, err)
+			return
+		}
+		w.Header().Add("Content-Security-Policy", defaultContentSecurityPolicy)
+		buf.WriteTo(w)
+	case "POST":
+		writeResponse := func(w http.ResponseWriter, r *http.Request, response Response) {
+			accept, _, _ := mime.ParseMediaType(r.Header.Get("Accept"))
+			if accept == "application/json" {
+				w.Header().Set("Content-Type", "application/json")
+				b, err := json.Marshal(&response)
+				if err != nil {
+					logger.Error(err.Error())
+					internalServerError(w, r, err)
+					return
+				}
+				w.Write(b)
+				return
+			}
+			alerts := make(url.Values)
+			for _, msg := range response.Success {
+				alerts.Add("success", msg)
+			}
+			for _, errmsg := range response.Errors {
+				alerts.Add("danger", template.HTMLEscapeString(errmsg))
+			}
+			err := nbrew.setSession(w, r, "flash", map[string]any{
+				"alerts": alerts,
+			})
+			if err != nil {
+				logger.Error(err.Error())
+			}
+			http.Redirect(w, r, nbrew.Scheme+nbrew.AdminDomain+"/"+path.Join("admin", sitePrefix, "members")+"/", http.StatusFound)
+		}
+
+		var request Request
+		contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		switch contentType {
+		case "application/json":
+			err := json.NewDecoder(r.Body).Decode(&request)
+			if err != nil {
+				var syntaxErr *json.SyntaxError
+				if errors.As(err, &syntaxErr) {
+					http.Error(w, "400 Bad Request: invalid JSON", http.StatusBadRequest)
+					return
+				}
+				logger.Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+		case "application/x-www-form-urlencoded":
+			err := r.ParseForm()
+			if err != nil {
+				http.Error(w, fmt.Sprintf("400 Bad Request: %s", err), http.StatusBadRequest)
+				return
+			}
+			request.Action = r.Form.Get("action")
+			request.Username = r.Form.Get("username")
+			request.Email = r.Form.Get("email")
+			request.Role = r.Form.Get("role")
+		default:
+			http.Error(w, "415 Unsupported Media Type", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		response := Response{
+			Action:   request.Action,
+			Username: strings.TrimPrefix(strings.TrimSpace(request.Username), "@"),
+			Email:    strings.TrimSpace(request.Email),
+			Role:     request.Role,
+		}
+		if response.Role == "" {
+			response.Role = roleEditor
+		}
+		if (response.Action == "invite" || response.Action == "add" || response.Action == "set_role") && !isAssignableRole(response.Role) {
+			response.Errors = append(response.Errors, fmt.Sprintf("invalid role %q (must be editor, author or viewer)", response.Role))
+			writeResponse(w, r, response)
+			return
+		}
+		siteID, err := sq.FetchOneContext(r.Context(), nbrew.DB, sq.CustomQuery{
+			Dialect: nbrew.Dialect,
+			Format:  "SELECT {*} FROM site WHERE site_name = {siteName}",
+			Values: []any{
+				sq.StringParam("siteName", siteName),
+			},
+		}, func(row *sq.Row) (siteID [16]byte) {
+			row.UUID(&siteID, "site_id")
+			return siteID
+		})
+		if err != nil {
+			logger.Error(err.Error())
+			internalServerError(w, r, err)
+			return
+		}
+
+		switch response.Action {
+		case "invite":
+			if response.Email == "" {
+				response.Errors = append(response.Errors, "email cannot be blank")
+				writeResponse(w, r, response)
+				return
+			}
+			_, err := mail.ParseAddress(response.Email)
+			if err != nil {
+				response.Errors = append(response.Errors, fmt.Sprintf("%s is not a valid email address", response.Email))
+				writeResponse(w, r, response)
+				return
+			}
+			isMember, err := sq.FetchExistsContext(r.Context(), nbrew.DB, sq.CustomQuery{
+				Dialect: nbrew.Dialect,
+				Format: "SELECT 1" +
+					" FROM site_user" +
+					" JOIN users ON users.user_id = site_user.user_id" +
+					" WHERE site_user.site_id = {siteID}" +
+					" AND users.email = {email}",
+				Values: []any{
+					sq.UUIDParam("siteID", siteID),
+					sq.StringParam("email", response.Email),
+				},
+			})
+			if err != nil {
+				logger.Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+			if isMember {
+				response.Errors = append(response.Errors, fmt.Sprintf("%s is already a member", response.Email))
+				writeResponse(w, r, response)
+				return
+			}
+			inviteToken, inviteTokenHash, err := newToken()
+			if err != nil {
+				logger.Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+			// Inviting someone again replaces their previous invitation, so
+			// the old link stops working.
+			tx, err := nbrew.DB.Begin()
+			if err != nil {
+				logger.Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+			defer tx.Rollback()
+			_, err = sq.ExecContext(r.Context(), tx, sq.CustomQuery{
+				Dialect: nbrew.Dialect,
+				Format:  "DELETE FROM invite WHERE site_id = {siteID} AND email = {email}",
+				Values: []any{
+					sq.UUIDParam("siteID", siteID),
+					sq.StringParam("email", response.Email),
+				},
+			})
+			if err != nil {
+				logger.Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+			_, err = sq.ExecContext(r.Context(), tx, sq.CustomQuery{
+				Dialect: nbrew.Dialect,
+				Format: "INSERT INTO invite (invite_token_hash, site_id, email, role)" +
+					" VALUES ({inviteTokenHash}, {siteID}, {email}, {role})",
+				Values: []any{
+					sq.BytesParam("inviteTokenHash", inviteTokenHash),
+					sq.UUIDParam("siteID", siteID),
+					sq.StringParam("email", response.Email),
+					sq.StringParam("role", response.Role),
+				},
+			})
+			if err != nil {
+				logger.Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+			err = tx.Commit()
+			if err != nil {
+				logger.Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+			values := make(url.Values)
+			values.Set("token", inviteToken)
+			response.InviteLink = nbrew.Scheme + nbrew.AdminDomain + "/admin/invite/?" + values.Encode()
+			response.Success = append(response.Success, fmt.Sprintf(
+				`Invited %s as %s. Send them this link to accept the invitation (it expires in %d days): <a href="%[4]s" class="linktext">%[4]s</a>`,
+				template.HTMLEscapeString(response.Email),
+				response.Role,
+				int(inviteTokenLifetime/(24*time.Hour)),
+				template.HTMLEscapeString(response.InviteLink),
+			))
+		case "revoke":
+			result, err := sq.ExecContext(r.Context(), nbrew.DB, sq.CustomQuery{
+				Dialect: nbrew.Dialect,
+				Format:  "DELETE FROM invite WHERE site_id = {siteID} AND email = {email}",
+				Values: []any{
+					sq.UUIDParam("siteID", siteID),
+					sq.StringParam("email", response.Email),
+				},
+			})
+			if err != nil {
+				logger.Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+			if result.RowsAffected == 0 {
+				response.Errors = append(response.Errors, fmt.Sprintf("no invitation for %s", response.Email))
+				writeResponse(w, r, response)
+				return
+			}
+			response.Success = append(response.Success, fmt.Sprintf("Revoked the invitation for %s", template.HTMLEscapeString(response.Email)))
+		case "add":
+			userID, err := sq.FetchOneContext(r.Context(), nbrew.DB, sq.CustomQuery{
+				Dialect: nbrew.Dialect,
+				Format:  "SELECT {*} FROM users WHERE username = {username}",
+				Values: []any{
+					sq.StringParam("username", response.Username),
+				},
+			}, func(row *sq.Row) (userID [16]byte) {
+				row.UUID(&userID, "user_id")
+				return userID
+			})
+			if err != nil {
+				if errors.Is(err, sql.ErrNoRows) {
+					response.Errors = append(response.Errors, fmt.Sprintf("no such user @%s", response.Username))
+					writeResponse(w, r, response)
+					return
+				}
+				logger.Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+			result, err := sq.ExecContext(r.Context(), nbrew.DB, sq.CustomQuery{
+				Dialect: nbrew.Dialect,
+				Format: "INSERT INTO site_user (site_id, user_id, role)" +
+					" VALUES ({siteID}, {userID}, {role}) {conflictClause}",
+				Values: []any{
+					sq.UUIDParam("siteID", siteID),
+					sq.UUIDParam("userID", userID),
+					sq.StringParam("role", response.Role),
+					sq.Param("conflictClause", sq.DialectExpression{
+						Default: sq.Expr("ON CONFLICT DO NOTHING"),
+						Cases: []sq.DialectCase{{
+							Dialect: sq.DialectMySQL,
+							Result:  sq.Expr("ON DUPLICATE KEY UPDATE site_id = site_id"),
+						}},
+					}),
+				},
+			})
+			if err != nil {
+				logger.Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+			if result.RowsAffected == 0 {
+				response.Errors = append(response.Errors, fmt.Sprintf("@%s is already a member", response.Username))
+				writeResponse(w, r, response)
+				return
+			}
+			response.Success = append(response.Success, fmt.Sprintf("Added @%s as %s", template.HTMLEscapeString(response.Username), response.Role))
+		case "set_role":
+			result, err := sq.ExecContext(r.Context(), nbrew.DB, sq.CustomQuery{
+				Dialect: nbrew.Dialect,
+				Format: "UPDATE site_user SET role = {role}" +
+					" WHERE site_id = {siteID}" +
+					" AND user_id = (SELECT user_id FROM users WHERE username = {username})" +
+					" AND role <> {ownerRole}",
+				Values: []any{
+					sq.StringParam("role", response.Role),
+					sq.UUIDParam("siteID", siteID),
+					sq.StringParam("username", response.Username),
+					sq.StringParam("ownerRole", roleOwner),
+				},
+			})
+			if err != nil {
+				logger.Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+			if result.RowsAffected == 0 {
+				response.Errors = append(response.Errors, fmt.Sprintf("cannot change the role of @%s: not a member, or the owner of the site (transfer the ownership instead)", response.Username))
+				writeResponse(w, r, response)
+				return
+			}
+			response.Success = append(response.Success, fmt.Sprintf("@%s is now %s", template.HTMLEscapeString(response.Username), response.Role))
+		case "remove":
+			result, err := sq.ExecContext(r.Context(), nbrew.DB, sq.CustomQuery{
+				Dialect: nbrew.Dialect,
+				Format: "DELETE FROM site_user" +
+					" WHERE site_id = {siteID}" +
+					" AND user_id = (SELECT user_id FROM users WHERE username = {username})" +
+					" AND role <> {ownerRole}",
+				Values: []any{
+					sq.UUIDParam("siteID", siteID),
+					sq.StringParam("username", response.Username),
+					sq.StringParam("ownerRole", roleOwner),
+				},
+			})
+			if err != nil {
+				logger.Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+			if result.RowsAffected == 0 {
+				response.Errors = append(response.Errors, fmt.Sprintf("cannot remove @%s: not a member, or the owner of the site (transfer the ownership first)", response.Username))
+				writeResponse(w, r, response)
+				return
+			}
+			response.Success = append(response.Success, fmt.Sprintf("Removed @%s", template.HTMLEscapeString(response.Username)))
+		case "transfer":
+			if response.Username == username {
+				response.Errors = append(response.Errors, "you already own this site")
+				writeResponse(w, r, response)
+				return
+			}
+			tx, err := nbrew.DB.Begin()
+			if err != nil {
+				logger.Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+			defer tx.Rollback()
+			result, err := sq.ExecContext(r.Context(), tx, sq.CustomQuery{
+				Dialect: nbrew.Dialect,
+				Format: "UPDATE site_user SET role = {role}" +
+					" WHERE site_id = {siteID}" +
+					" AND user_id = (SELECT user_id FROM users WHERE username = {username})",
+				Values: []any{
+					sq.StringParam("role", roleOwner),
+					sq.UUIDParam("siteID", siteID),
+					sq.StringParam("username", response.Username),
+				},
+			})
+			if err != nil {
+				logger.Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+			if result.RowsAffected == 0 {
+				response.Errors = append(response.Errors, fmt.Sprintf("@%s is not a member", response.Username))
+				writeResponse(w, r, response)
+				return
+			}
+			// The previous owner stays on as an editor.
+			_, err = sq.ExecContext(r.Context(), tx, sq.CustomQuery{
+				Dialect: nbrew.Dialect,
+				Format: "UPDATE site_user SET role = {role}" +
+					" WHERE site_id = {siteID}" +
+					" AND role = {ownerRole}" +
+					" AND user_id <> (SELECT user_id FROM users WHERE username = {username})",
+				Values: []any{
+					sq.StringParam("role", roleEditor),
+					sq.StringParam("ownerRole", roleOwner),
+					sq.UUIDParam("siteID", siteID),
+					sq.StringParam("username", response.Username),
+				},
+			})
+			if err != nil {
+				logger.Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+			err = tx.Commit()
+			if err != nil {
+				logger.Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+			response.Success = append(response.Success, fmt.Sprintf("Transferred the ownership of the site to @%s", template.HTMLEscapeString(response.Username)))
+		default:
+			response.Errors = append(response.Errors, fmt.Sprintf("invalid action %q (must be invite, revoke, add, set_role, remove or transfer)", response.Action))
+		}
+		writeResponse(w, r, response)
+	default:
+		http.Error(w, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
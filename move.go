@@ -46,7 +46,7 @@ func (nbrew *Notebrew) move(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		var response Response
-		ok, err := nbrew.getSession(r, "flash_session", &response)
+		ok, err := nbrew.getSession(r, "flash", &response)
 		if err != nil {
 			logger.Error(err.Error())
 		}
@@ -60,7 +60,7 @@ func (nbrew *Notebrew) move(w http.ResponseWriter, r *http.Request) {
 		if response.DestinationFolder != "" {
 			response.DestinationFolder = strings.Trim(path.Clean(response.DestinationFolder), "/")
 		}
-		nbrew.clearSession(w, r, "flash_session")
+		nbrew.clearSession(w, r, "flash")
 
 		tmpl, err := template.ParseFS(rootFS, "move.html")
 		if err != nil {
@@ -139,15 +139,21 @@ func (nbrew *Notebrew) move(w http.ResponseWriter, r *http.Request) {
 			DestinationFolder: request.DestinationFolder,
 			Errors:            make(url.Values),
 		}
+		response.Path = strings.Trim(response.Path, "/")
+		response.DestinationFolder = strings.Trim(response.DestinationFolder, "/")
 		if response.Path == "" {
 			response.Errors.Add("path", "cannot be empty")
-		} else {
-			response.Path = strings.Trim(path.Clean(response.Path), "/")
+		} else if !isValidSitePath(response.Path) {
+			response.Errors.Add("path", "invalid path")
+		} else if !strings.Contains(response.Path, "/") {
+			response.Errors.Add("path", "cannot move a top-level folder")
 		}
 		if response.DestinationFolder == "" {
 			response.Errors.Add("destination_folder", "cannot be empty")
-		} else {
-			response.DestinationFolder = strings.Trim(path.Clean(response.DestinationFolder), "/")
+		} else if !isValidSitePath(response.DestinationFolder) {
+			response.Errors.Add("destination_folder", "invalid folder")
+		} else if response.DestinationFolder == response.Path || strings.HasPrefix(response.DestinationFolder, response.Path+"/") {
+			response.Errors.Add("destination_folder", "cannot move a folder into itself")
 		}
 		if len(response.Errors) > 0 {
 			writeResponse(w, r, response)
@@ -166,7 +172,16 @@ func (nbrew *Notebrew) move(w http.ResponseWriter, r *http.Request) {
 			internalServerError(w, r, err)
 			return
 		}
-		srcIsDir := fileInfo.IsDir()
+		ok, err := checkPreconditions(nbrew.FS, r, srcPath)
+		if err != nil {
+			logger.Error(err.Error())
+			internalServerError(w, r, err)
+			return
+		}
+		if !ok {
+			http.Error(w, "412 Precondition Failed", http.StatusPreconditionFailed)
+			return
+		}
 
 		destFolder := path.Join(sitePrefix, response.DestinationFolder)
 		fileInfo, err = fs.Stat(nbrew.FS, destFolder)
@@ -199,75 +214,23 @@ func (nbrew *Notebrew) move(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		if !srcIsDir {
-			err = nbrew.FS.Rename(srcPath, destPath)
+		// Regenerate the site output for both the old and new locations once the
+		// move is done.
+		defer func() {
+			err := nbrew.generate(r.Context(), sitePrefix, response.Path, path.Join(response.DestinationFolder, path.Base(response.Path)))
 			if err != nil {
 				logger.Error(err.Error())
-				internalServerError(w, r, err)
-				return
 			}
-			writeResponse(w, r, response)
-			return
-		}
+		}()
 
-		dirEntries, err := nbrew.FS.ReadDir(srcPath)
+		err = nbrew.journaled(journalEntry{Op: "move", Src: srcPath, Dest: destPath}, func() error {
+			return move(nbrew.FS, srcPath, destPath)
+		})
 		if err != nil {
 			logger.Error(err.Error())
 			internalServerError(w, r, err)
 			return
 		}
-		if len(dirEntries) == 0 {
-			err = nbrew.FS.Rename(srcPath, destPath)
-			if err != nil {
-				logger.Error(err.Error())
-				internalServerError(w, r, err)
-				return
-			}
-			writeResponse(w, r, response)
-			return
-		}
-
-		type Item struct {
-			RelativePath string // path relative to srcPath/destPath
-			IsFile       bool
-		}
-		pushItems := func(items []Item, dir string, dirEntries []fs.DirEntry) []Item {
-			for i := len(dirEntries) - 1; i >= 0; i-- {
-				dirEntry := dirEntries[i]
-				items = append(items, Item{
-					RelativePath: path.Join(dir, dirEntry.Name()),
-					IsFile:       !dirEntry.IsDir(),
-				})
-			}
-			return items
-		}
-		var item Item
-		items := pushItems(nil, "", dirEntries)
-		for len(items) > 0 {
-			item, items = items[len(items)-1], items[:len(items)-1]
-			if item.IsFile {
-				err = nbrew.FS.Rename(path.Join(srcPath, item.RelativePath), path.Join(destPath, item.RelativePath))
-				if err != nil {
-					logger.Error(err.Error())
-					internalServerError(w, r, err)
-					return
-				}
-				continue
-			}
-			err = nbrew.FS.Mkdir(path.Join(destPath, item.RelativePath), 0755)
-			if err != nil {
-				logger.Error(err.Error())
-				internalServerError(w, r, err)
-				return
-			}
-			dirEntries, err := nbrew.FS.ReadDir(path.Join(srcPath, item.RelativePath))
-			if err != nil {
-				logger.Error(err.Error())
-				internalServerError(w, r, err)
-				return
-			}
-			items = pushItems(items, item.RelativePath, dirEntries)
-		}
 		writeResponse(w, r, response)
 	default:
 		http.Error(w, "405 Method Not Allowed", http.StatusMethodNotAllowed)
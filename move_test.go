@@ -0,0 +1,384 @@
+package nb6
+
+import (
+	"encoding/json"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bokwoon95/nb6/internal/testutil"
+)
+
+// newTestLocalNotebrew returns a notebrew instance without a database whose
+// LocalFS is rooted at a subdirectory of a temporary directory, so that tests
+// can check that nothing outside the root is touched. files maps slash
+// separated paths relative to the temporary directory to their contents.
+func newTestLocalNotebrew(t *testing.T, files map[string]string) (nbrew *Notebrew, tempDir string) {
+	t.Helper()
+	tempDir = t.TempDir()
+	for _, dir := range []string{"root/notes", "root/pages", "root/posts", "root/site", "root/@other/notes"} {
+		err := os.MkdirAll(filepath.Join(tempDir, dir), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, contents := range files {
+		err := os.MkdirAll(filepath.Dir(filepath.Join(tempDir, name)), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(filepath.Join(tempDir, name), []byte(contents), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	nbrew = &Notebrew{
+		FS:          &LocalFS{RootDir: filepath.Join(tempDir, "root")},
+		Scheme:      "http://",
+		AdminDomain: "localhost",
+	}
+	return nbrew, tempDir
+}
+
+// postForm sends a form POST with Accept: application/json and the given
+// cookies to handler and decodes the JSON response into response.
+func postForm(t *testing.T, handler http.HandlerFunc, target string, values url.Values, response any, cookies ...*http.Cookie) int {
+	t.Helper()
+	r := httptest.NewRequest("POST", target, strings.NewReader(values.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("Accept", "application/json")
+	for _, cookie := range cookies {
+		r.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	handler(w, r)
+	if w.Code == http.StatusOK && response != nil {
+		err := json.Unmarshal(w.Body.Bytes(), response)
+		if err != nil {
+			t.Fatalf("%s: %v", w.Body.String(), err)
+		}
+	}
+	return w.Code
+}
+
+func TestMovePathChecks(t *testing.T) {
+	type Response struct {
+		Errors url.Values `json:"errors"`
+	}
+	type TestTable struct {
+		description       string
+		path              string
+		destinationFolder string
+		wantErrors        []string
+	}
+
+	tests := []TestTable{{
+		description:       "path outside the root",
+		path:              "../outside/secret.md",
+		destinationFolder: "notes",
+		wantErrors:        []string{"path"},
+	}, {
+		description:       "path into another site",
+		path:              "../@other/notes/other.md",
+		destinationFolder: "notes",
+		wantErrors:        []string{"path"},
+	}, {
+		description:       "dot dot segment inside a valid folder",
+		path:              "notes/../../outside/secret.md",
+		destinationFolder: "notes",
+		wantErrors:        []string{"path"},
+	}, {
+		description:       "destination outside the root",
+		path:              "notes/a.md",
+		destinationFolder: "../outside",
+		wantErrors:        []string{"destination_folder"},
+	}, {
+		description:       "destination in another site",
+		path:              "notes/a.md",
+		destinationFolder: "notes/../@other/notes",
+		wantErrors:        []string{"destination_folder"},
+	}, {
+		description:       "path outside the content folders",
+		path:              "system/a.md",
+		destinationFolder: "notes",
+		wantErrors:        []string{"path"},
+	}, {
+		description:       "top-level folder",
+		path:              "notes",
+		destinationFolder: "posts",
+		wantErrors:        []string{"path"},
+	}, {
+		description:       "folder into itself",
+		path:              "notes/dir",
+		destinationFolder: "notes/dir/sub",
+		wantErrors:        []string{"destination_folder"},
+	}}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.description, func(t *testing.T) {
+			nbrew, tempDir := newTestLocalNotebrew(t, map[string]string{
+				"outside/secret.md":          "secret",
+				"root/@other/notes/other.md": "other",
+				"root/notes/a.md":            "a",
+				"root/notes/dir/sub/b.md":    "b",
+			})
+			var response Response
+			code := postForm(t, nbrew.move, "/admin/move/", url.Values{
+				"path":               {tt.path},
+				"destination_folder": {tt.destinationFolder},
+			}, &response)
+			if code != http.StatusOK {
+				t.Fatalf("got status %d, want %d", code, http.StatusOK)
+			}
+			var gotErrors []string
+			for field := range response.Errors {
+				gotErrors = append(gotErrors, field)
+			}
+			if diff := testutil.Diff(gotErrors, tt.wantErrors); diff != "" {
+				t.Error(testutil.Callers(), diff)
+			}
+			for _, name := range []string{"outside/secret.md", "root/@other/notes/other.md", "root/notes/a.md", "root/notes/dir/sub/b.md"} {
+				_, err := os.Stat(filepath.Join(tempDir, name))
+				if err != nil {
+					t.Errorf("%s: %v", name, err)
+				}
+			}
+		})
+	}
+
+	t.Run("valid move", func(t *testing.T) {
+		nbrew, tempDir := newTestLocalNotebrew(t, map[string]string{
+			"root/notes/a.md": "a",
+		})
+		var response Response
+		code := postForm(t, nbrew.move, "/admin/move/", url.Values{
+			"path":               {"notes/a.md"},
+			"destination_folder": {"posts"},
+		}, &response)
+		if code != http.StatusOK {
+			t.Fatalf("got status %d, want %d", code, http.StatusOK)
+		}
+		if len(response.Errors) > 0 {
+			t.Fatal(response.Errors)
+		}
+		b, err := os.ReadFile(filepath.Join(tempDir, "root/posts/a.md"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != "a" {
+			t.Errorf("got %q, want %q", string(b), "a")
+		}
+	})
+}
+
+func TestRenamePathChecks(t *testing.T) {
+	type Response struct {
+		Errors url.Values `json:"errors"`
+	}
+	type TestTable struct {
+		description  string
+		parentFolder string
+		oldName      string
+		newName      string
+		wantErrors   []string
+	}
+
+	tests := []TestTable{{
+		description:  "parent folder outside the root",
+		parentFolder: "../outside",
+		oldName:      "secret.md",
+		newName:      "secret2.md",
+		wantErrors:   []string{"parent_folder"},
+	}, {
+		description:  "parent folder in another site",
+		parentFolder: "notes/../../@other/notes",
+		oldName:      "other.md",
+		newName:      "other2.md",
+		wantErrors:   []string{"parent_folder"},
+	}, {
+		description:  "old name with a slash",
+		parentFolder: "notes",
+		oldName:      "../../outside/secret.md",
+		newName:      "secret.md",
+		wantErrors:   []string{"old_name"},
+	}, {
+		description:  "old name is dot dot",
+		parentFolder: "notes/dir",
+		oldName:      "..",
+		newName:      "x",
+		wantErrors:   []string{"old_name"},
+	}, {
+		description:  "new name with a slash",
+		parentFolder: "notes",
+		oldName:      "a.md",
+		newName:      "../../outside/a.md",
+		wantErrors:   []string{"new_name"},
+	}}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.description, func(t *testing.T) {
+			nbrew, tempDir := newTestLocalNotebrew(t, map[string]string{
+				"outside/secret.md":          "secret",
+				"root/@other/notes/other.md": "other",
+				"root/notes/a.md":            "a",
+				"root/notes/dir/b.md":        "b",
+			})
+			var response Response
+			code := postForm(t, nbrew.rename, "/admin/rename/", url.Values{
+				"parent_folder": {tt.parentFolder},
+				"old_name":      {tt.oldName},
+				"new_name":      {tt.newName},
+			}, &response)
+			if code != http.StatusOK {
+				t.Fatalf("got status %d, want %d", code, http.StatusOK)
+			}
+			var gotErrors []string
+			for field := range response.Errors {
+				gotErrors = append(gotErrors, field)
+			}
+			if diff := testutil.Diff(gotErrors, tt.wantErrors); diff != "" {
+				t.Error(testutil.Callers(), diff)
+			}
+			for _, name := range []string{"outside/secret.md", "root/@other/notes/other.md", "root/notes/a.md", "root/notes/dir/b.md"} {
+				_, err := os.Stat(filepath.Join(tempDir, name))
+				if err != nil {
+					t.Errorf("%s: %v", name, err)
+				}
+			}
+		})
+	}
+
+	t.Run("valid rename", func(t *testing.T) {
+		nbrew, tempDir := newTestLocalNotebrew(t, map[string]string{
+			"root/notes/a.md": "a",
+		})
+		var response Response
+		code := postForm(t, nbrew.rename, "/admin/rename/", url.Values{
+			"parent_folder": {"notes"},
+			"old_name":      {"a.md"},
+			"new_name":      {"b.md"},
+		}, &response)
+		if code != http.StatusOK {
+			t.Fatalf("got status %d, want %d", code, http.StatusOK)
+		}
+		if len(response.Errors) > 0 {
+			t.Fatal(response.Errors)
+		}
+		_, err := fs.Stat(nbrew.FS, "notes/b.md")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = os.Stat(filepath.Join(tempDir, "root/notes/a.md"))
+		if err == nil {
+			t.Error("notes/a.md still exists")
+		}
+	})
+}
+
+func TestDeletePathChecks(t *testing.T) {
+	type Response struct {
+		Deleted []string `json:"deleted"`
+		Errors  []string `json:"errors"`
+	}
+	type TestTable struct {
+		description string
+		folder      string
+		names       []string
+		// isJSON sends the request as JSON instead of as a form.
+		isJSON      bool
+		wantDeleted []string
+	}
+
+	tests := []TestTable{{
+		description: "folder outside the root",
+		folder:      "../outside",
+		names:       []string{"secret.md"},
+	}, {
+		description: "folder in another site",
+		folder:      "notes/../@other/notes",
+		names:       []string{"other.md"},
+	}, {
+		description: "folder in another site (json)",
+		folder:      "notes/../@other/notes",
+		names:       []string{"other.md"},
+		isJSON:      true,
+	}, {
+		description: "folder outside the content folders (json)",
+		folder:      "system",
+		names:       []string{"a.md"},
+		isJSON:      true,
+	}, {
+		description: "name with a slash",
+		folder:      "notes",
+		names:       []string{"../../outside/secret.md"},
+		isJSON:      true,
+	}, {
+		description: "dot dot name",
+		folder:      "notes/dir",
+		names:       []string{".."},
+	}, {
+		description: "site folder",
+		folder:      "site/images",
+		names:       []string{"a.png"},
+		wantDeleted: []string{"a.png"},
+	}}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.description, func(t *testing.T) {
+			files := map[string]string{
+				"outside/secret.md":          "secret",
+				"root/@other/notes/other.md": "other",
+				"root/system/a.md":           "a",
+				"root/notes/dir/b.md":        "b",
+				"root/site/images/a.png":     "\x89PNG\r\n\x1a\n",
+			}
+			nbrew, tempDir := newTestLocalNotebrew(t, files)
+			var r *http.Request
+			if tt.isJSON {
+				b, err := json.Marshal(map[string]any{"folder": tt.folder, "names": tt.names})
+				if err != nil {
+					t.Fatal(err)
+				}
+				r = httptest.NewRequest("POST", "/admin/delete/", strings.NewReader(string(b)))
+				r.Header.Set("Content-Type", "application/json")
+			} else {
+				r = httptest.NewRequest("POST", "/admin/delete/", strings.NewReader(url.Values{
+					"folder": {tt.folder},
+					"name":   tt.names,
+				}.Encode()))
+				r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+			r.Header.Set("Accept", "application/json")
+			w := httptest.NewRecorder()
+			nbrew.delet(w, r, "", "")
+			if w.Code != http.StatusOK {
+				t.Fatalf("got status %d, want %d: %s", w.Code, http.StatusOK, w.Body.String())
+			}
+			var response Response
+			err := json.Unmarshal(w.Body.Bytes(), &response)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := testutil.Diff(response.Deleted, tt.wantDeleted); diff != "" {
+				t.Error(testutil.Callers(), diff)
+			}
+			for name := range files {
+				if len(tt.wantDeleted) > 0 && name == "root/site/images/a.png" {
+					continue
+				}
+				_, err := os.Stat(filepath.Join(tempDir, name))
+				if err != nil {
+					t.Errorf("%s: %v", name, err)
+				}
+			}
+		})
+	}
+}
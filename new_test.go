@@ -0,0 +1,136 @@
+package nb6
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bokwoon95/nb6/internal/testutil"
+)
+
+func TestNewFS(t *testing.T) {
+	type TestTable struct {
+		description string
+		text        string
+		hasDB       bool
+		wantFS      FS
+		wantErr     string
+	}
+
+	tests := []TestTable{{
+		description: "empty",
+		text:        "\n",
+	}, {
+		description: "local",
+		text:        "local\n",
+	}, {
+		description: "database without a database",
+		text:        "database",
+		wantErr:     "needs a database",
+	}, {
+		description: "database",
+		text:        "database",
+		hasDB:       true,
+		wantFS:      &DatabaseFS{Dialect: "sqlite"},
+	}, {
+		description: "s3",
+		text: "s3\n" +
+			"endpoint: http://localhost:9000\n" +
+			"# a comment\n" +
+			"bucket: notebrew\n" +
+			"access_key_id: id\n" +
+			"secret_access_key: secret\n" +
+			"prefix: /admin/\n" +
+			"part_size: 16\n",
+		wantFS: &S3FS{
+			Endpoint:        "http://localhost:9000",
+			Region:          "us-east-1",
+			Bucket:          "notebrew",
+			AccessKeyID:     "id",
+			SecretAccessKey: "secret",
+			Prefix:          "admin",
+			PartSize:        16 << 20,
+		},
+	}, {
+		description: "s3 part size below the S3 minimum",
+		text:        "s3\nendpoint: http://localhost:9000\nbucket: notebrew\npart_size: 1\n",
+		wantErr:     "part_size",
+	}, {
+		description: "s3 without a bucket",
+		text:        "s3\nendpoint: http://localhost:9000\n",
+		wantErr:     "bucket",
+	}, {
+		description: "s3 with an unknown key",
+		text:        "s3\nendpoint: http://localhost:9000\nbucket: notebrew\nsecret: x\n",
+		wantErr:     "unknown s3 key",
+	}, {
+		description: "unknown FS",
+		text:        "ftp",
+		wantErr:     "unknown FS",
+	}}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.description, func(t *testing.T) {
+			nbrew := &Notebrew{}
+			if tt.hasDB {
+				newTestDatabase(t, nbrew)
+			}
+			fsys, err := nbrew.newFS(tt.text)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want an error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantFS == nil {
+				if fsys != nil {
+					t.Fatalf("got %v, want nil", fsys)
+				}
+				return
+			}
+			if dbFS, ok := fsys.(*DatabaseFS); ok {
+				if dbFS.DB != nbrew.DB {
+					t.Error("DatabaseFS does not use the database of database.txt")
+				}
+				fsys = &DatabaseFS{Dialect: dbFS.Dialect}
+			}
+			if diff := testutil.Diff(fsys, tt.wantFS); diff != "" {
+				t.Error(testutil.Callers(), diff)
+			}
+		})
+	}
+}
+
+func TestNewWithS3FS(t *testing.T) {
+	s3Server := testutil.NewS3Server("", "")
+	server := httptest.NewServer(s3Server)
+	defer server.Close()
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "fs.txt"), []byte("s3\nendpoint: "+server.URL+"\nbucket: notebrew\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nbrew, err := New(&LocalFS{RootDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nbrew.Close()
+	if _, ok := nbrew.FS.(*S3FS); !ok {
+		t.Fatalf("got FS %T, want *S3FS", nbrew.FS)
+	}
+	// The folders are created in the bucket, not next to fs.txt.
+	wantKeys := []string{"notes/", "pages/", "posts/", "site/", "site/images/", "site/themes/", "system/"}
+	if diff := testutil.Diff(s3Server.Keys("notebrew"), wantKeys); diff != "" {
+		t.Error(testutil.Callers(), diff)
+	}
+	_, err = os.Stat(filepath.Join(dir, "notes"))
+	if !os.IsNotExist(err) {
+		t.Errorf("got error %v for the local notes folder, want it to not exist", err)
+	}
+}
@@ -90,6 +90,50 @@ type Notebrew struct {
 	Stdout io.Writer
 
 	CompressGeneratedHTML bool
+
+	// RecycleBinRetention is how long deleted items are kept in the recycle
+	// bin before they are purged automatically. If zero, items are kept for 30
+	// days. If negative, items are never purged automatically.
+	RecycleBinRetention time.Duration
+
+	// HistoryMaxVersions is the maximum number of prior versions kept for
+	// each file. If zero, 50 versions are kept. If negative, there is no
+	// limit.
+	HistoryMaxVersions int
+
+	// HistoryRetention is how long prior versions of a file are kept. If
+	// zero, versions are kept for 90 days. If negative, versions are kept
+	// until they go over the HistoryMaxVersions.
+	HistoryRetention time.Duration
+
+	// SessionIdleTimeout is how long a login session lasts without being
+	// used. If zero, sessions last for 30 days of inactivity. If negative,
+	// sessions never time out.
+	SessionIdleTimeout time.Duration
+
+	// SessionMaxAge is how long a login session lasts after logging in,
+	// however often it is used. If zero, sessions last for 365 days. If
+	// negative, sessions last until they time out.
+	SessionMaxAge time.Duration
+
+	// SearchIndex reports whether the notes, posts and pages of every site
+	// are kept in a full-text search index in the database. It is set by New
+	// for sqlite, postgres and mysql databases. If false, searches fall back
+	// to scanning through the files.
+	SearchIndex bool
+
+	// StaticOnly disables the admin interface, leaving only the static content
+	// of each site to be served. It is set by NewStatic.
+	StaticOnly bool
+
+	// stopJanitor stops the janitor started by New, and janitorDone is closed
+	// once it has stopped.
+	stopJanitor func()
+	janitorDone chan struct{}
+
+	// postIndexMutex serializes updates to the post index of every site
+	// (see updatePostIndex).
+	postIndexMutex sync.Mutex
 }
 
 func (nbrew *Notebrew) notFound(w http.ResponseWriter, r *http.Request, sitePrefix string) {
@@ -101,6 +145,10 @@ func (nbrew *Notebrew) notFound(w http.ResponseWriter, r *http.Request, sitePref
 	notFound(w, r)
 }
 
+// sessionLifetime is how long the data stored by setSession can be read back
+// by getSession.
+const sessionLifetime = 5 * time.Minute
+
 func (nbrew *Notebrew) setSession(w http.ResponseWriter, r *http.Request, name string, value any) error {
 	buf := bufPool.Get().(*bytes.Buffer)
 	buf.Reset()
@@ -172,7 +220,7 @@ func (nbrew *Notebrew) getSession(r *http.Request, name string, valuePtr any) (o
 		copy(sessionTokenHash[:8], sessionToken[:8])
 		copy(sessionTokenHash[8:], checksum[:])
 		createdAt := time.Unix(int64(binary.BigEndian.Uint64(sessionTokenHash[:8])), 0)
-		if time.Now().Sub(createdAt) > 5*time.Minute {
+		if time.Now().Sub(createdAt) > sessionLifetime {
 			return false, nil
 		}
 		dataBytes, err = sq.FetchOneContext(r.Context(), nbrew.DB, sq.CustomQuery{
@@ -314,6 +362,22 @@ func validateName(name string) []string {
 	return errmsgs
 }
 
+// isValidSitePath reports whether name, a slash-trimmed path relative to the
+// sitePrefix that came from the user, points inside the notes, pages, posts or
+// site folder. Paths with "." or ".." segments are rejected rather than
+// cleaned, so that they can never reach another site or leave the FS root.
+func isValidSitePath(name string) bool {
+	if !fs.ValidPath(name) || name == "." {
+		return false
+	}
+	head, _, _ := strings.Cut(name, "/")
+	switch head {
+	case "notes", "pages", "posts", "site":
+		return true
+	}
+	return false
+}
+
 func getAuthenticationTokenHash(r *http.Request) []byte {
 	var rawValue string
 	header := r.Header.Get("Authorization")
@@ -446,7 +510,10 @@ func ParseTemplate(fsys fs.FS, funcMap template.FuncMap, text string) (*template
 			return nil, err
 		}
 	}
-	return finalTemplate, nil
+	// AddParseTree returns a new *template.Template for the primary template
+	// instead of updating finalTemplate, so we have to look it up again for
+	// it to be executable.
+	return finalTemplate.Lookup(""), nil
 }
 
 func (nbrew *Notebrew) IsKeyViolation(err error) bool {
@@ -614,17 +681,44 @@ func stripMarkdownStyles(dest io.Writer, src []byte) {
 }
 
 func getTitleAndPreview(r io.ReadCloser) (title, preview string) {
+	defer r.Close()
+	_, title, preview, _ = readTitleAndPreview(r)
+	return title, preview
+}
+
+// readTitleAndPreview reads the front matter (if any) of a note or post and
+// the title and preview that follow it, which are the first two non-empty
+// lines with their markdown styles stripped. It stops reading as soon as it
+// has them, so only the top of the file is ever read. As with
+// parseFrontMatter, an invalid front matter is returned as an error
+// alongside whatever could be parsed.
+func readTitleAndPreview(r io.Reader) (frontMatter FrontMatter, title, preview string, err error) {
 	// reference:
 	// https://github.com/bokwoon95/nb4/blob/68a2df18cdbeb94ff359233e7ddc54f6afe27c79/test/main.go
-	defer r.Close()
 	reader := bufio.NewReader(r)
-	done := false
-	for {
-		if done {
-			return title, preview
+	// Read up to the end of the front matter (or the first line, if there is
+	// no front matter). A leading "---" or "+++" without a closing delimiter
+	// is not front matter and ends up being read as part of the content.
+	head, readErr := reader.ReadBytes('\n')
+	if delimiter := string(bytes.TrimRight(head, "\r\n")); (delimiter == "---" || delimiter == "+++") && len(head) > len(delimiter) {
+		for readErr == nil {
+			var line []byte
+			line, readErr = reader.ReadBytes('\n')
+			head = append(head, line...)
+			if string(bytes.TrimSpace(line)) == delimiter {
+				break
+			}
 		}
-		line, err := reader.ReadBytes('\n')
-		if err != nil {
+	}
+	if readErr != nil && readErr != io.EOF {
+		return frontMatter, "", "", readErr
+	}
+	frontMatter, markdown, err := parseFrontMatter(head)
+	reader = bufio.NewReader(io.MultiReader(bytes.NewReader(markdown), reader))
+	done := false
+	for !done {
+		line, readErr := reader.ReadBytes('\n')
+		if readErr != nil {
 			done = true
 		}
 		line = bytes.TrimSpace(line)
@@ -637,14 +731,12 @@ func getTitleAndPreview(r io.ReadCloser) (title, preview string) {
 			title = b.String()
 			continue
 		}
-		if preview == "" {
-			var b strings.Builder
-			stripMarkdownStyles(&b, line)
-			preview = b.String()
-			continue
-		}
-		return title, preview
+		var b strings.Builder
+		stripMarkdownStyles(&b, line)
+		preview = b.String()
+		break
 	}
+	return frontMatter, title, preview, err
 }
 
 func toSlug(s string) string {
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/bokwoon95/nb6"
+)
+
+type APITokenCmd struct {
+	Notebrew  *nb6.Notebrew
+	Stdout    io.Writer
+	Stderr    io.Writer
+	Username  string
+	Name      string
+	SiteNames []string
+	ReadOnly  bool
+	ExpiresIn int
+	Revoke    bool
+	List      bool
+}
+
+func APITokenCommand(nb *nb6.Notebrew, args ...string) (*APITokenCmd, error) {
+	var cmd APITokenCmd
+	cmd.Notebrew = nb
+	flagset := flag.NewFlagSet("", flag.ContinueOnError)
+	flagset.StringVar(&cmd.Username, "username", "", "")
+	flagset.StringVar(&cmd.Name, "name", "", "")
+	flagset.Func("site", "", func(s string) error {
+		cmd.SiteNames = append(cmd.SiteNames, strings.TrimPrefix(s, "@"))
+		return nil
+	})
+	flagset.BoolVar(&cmd.ReadOnly, "read-only", false, "")
+	flagset.IntVar(&cmd.ExpiresIn, "expires-in", 0, "")
+	flagset.BoolVar(&cmd.Revoke, "revoke", false, "")
+	flagset.BoolVar(&cmd.List, "list", false, "")
+	err := flagset.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	flagArgs := flagset.Args()
+	if len(flagArgs) > 0 {
+		flagset.Usage()
+		return nil, fmt.Errorf("unexpected arguments: %s", strings.Join(flagArgs, " "))
+	}
+	cmd.Username = strings.TrimPrefix(strings.TrimSpace(cmd.Username), "@")
+	cmd.Name = strings.TrimSpace(cmd.Name)
+	if cmd.Revoke && cmd.List {
+		return nil, fmt.Errorf("-revoke and -list cannot be used together")
+	}
+	if !cmd.List && cmd.Name == "" {
+		return nil, fmt.Errorf("-name cannot be blank")
+	}
+	if cmd.ExpiresIn < 0 {
+		return nil, fmt.Errorf("-expires-in cannot be negative")
+	}
+	return &cmd, nil
+}
+
+func (cmd *APITokenCmd) Run() error {
+	if cmd.Stdout == nil {
+		cmd.Stdout = os.Stdout
+	}
+	if cmd.Stderr == nil {
+		cmd.Stderr = os.Stderr
+	}
+	name := cmd.Username
+	if name == "" {
+		name = "default user"
+	}
+	if cmd.List {
+		apiTokens, err := cmd.Notebrew.GetAPITokens(context.Background(), cmd.Username)
+		if err != nil {
+			return err
+		}
+		for _, apiToken := range apiTokens {
+			siteNames := "all sites"
+			if len(apiToken.SiteNames) > 0 {
+				siteNames = strings.Join(apiToken.SiteNames, ",")
+			}
+			access := "read-write"
+			if apiToken.ReadOnly {
+				access = "read-only"
+			}
+			lastUsed := "never"
+			if !apiToken.LastUsedTime.IsZero() {
+				lastUsed = apiToken.LastUsedTime.Format(time.RFC3339)
+			}
+			expires := "never"
+			if !apiToken.ExpiryTime.IsZero() {
+				expires = apiToken.ExpiryTime.Format(time.RFC3339)
+			}
+			fmt.Fprintf(cmd.Stdout, "%s\t%s\t%s\tlast used: %s\texpires: %s\n", apiToken.Name, siteNames, access, lastUsed, expires)
+		}
+		return nil
+	}
+	if cmd.Revoke {
+		err := cmd.Notebrew.RevokeAPIToken(context.Background(), cmd.Username, cmd.Name)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return fmt.Errorf("%s has no API token called %s", name, cmd.Name)
+			}
+			return err
+		}
+		fmt.Fprintf(cmd.Stderr, "API token %s revoked for %s.\n", cmd.Name, name)
+		return nil
+	}
+	apiToken := nb6.APIToken{
+		Name:      cmd.Name,
+		Username:  cmd.Username,
+		SiteNames: cmd.SiteNames,
+		ReadOnly:  cmd.ReadOnly,
+	}
+	if cmd.ExpiresIn > 0 {
+		apiToken.ExpiryTime = time.Now().Add(time.Duration(cmd.ExpiresIn) * 24 * time.Hour)
+	}
+	token, err := cmd.Notebrew.CreateAPIToken(context.Background(), apiToken)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(cmd.Stderr, "API token %s created for %s:\n", cmd.Name, name)
+	_, err = fmt.Fprintln(cmd.Stdout, token)
+	return err
+}
@@ -194,7 +194,7 @@ func (cmd *CreateUserCmd) Run() error {
 	}
 	_, err = sq.Exec(tx, sq.CustomQuery{
 		Dialect: cmd.Notebrew.Dialect,
-		Format:  "INSERT INTO site_user (site_id, user_id) VALUES ({siteID}, {userID})",
+		Format:  "INSERT INTO site_user (site_id, user_id, role) VALUES ({siteID}, {userID}, 'owner')",
 		Values: []any{
 			sq.UUIDParam("siteID", siteID),
 			sq.UUIDParam("userID", userID),
@@ -27,12 +27,13 @@ import (
 var open = func(address string) {}
 
 func main() {
-	var dir, addr, multisite, db, debug string
+	var dir, addr, multisite, db, fsys, debug string
 	flagset := flag.NewFlagSet("", flag.ContinueOnError)
 	flagset.StringVar(&dir, "dir", "", "")
 	flagset.StringVar(&addr, "addr", "", "")
 	flagset.StringVar(&multisite, "multisite", "", "")
 	flagset.StringVar(&db, "db", "", "")
+	flagset.StringVar(&fsys, "fs", "", "")
 	flagset.StringVar(&debug, "debug", "", "")
 	err := flagset.Parse(os.Args[1:])
 	if err != nil {
@@ -77,6 +78,19 @@ func main() {
 			exit(err)
 		}
 	}
+	fsys = strings.TrimSpace(fsys)
+	if fsys != "" {
+		// Like -addr, commas separate the lines of fs.txt e.g.
+		// -fs "s3,endpoint: https://s3.us-east-1.amazonaws.com,bucket: notebrew,...".
+		lines := strings.Split(fsys, ",")
+		for i := range lines {
+			lines[i] = strings.TrimSpace(lines[i])
+		}
+		err = os.WriteFile(filepath.Join(dir, "fs.txt"), []byte(strings.Join(lines, "\n")), 0644)
+		if err != nil {
+			exit(err)
+		}
+	}
 	debug = strings.TrimSpace(debug)
 	if debug != "" {
 		isDebug, _ := strconv.ParseBool(debug)
@@ -91,6 +105,7 @@ func main() {
 		}
 	}
 
+	var nbrew *nb6.Notebrew
 	args := flagset.Args()
 	if len(args) > 0 {
 		command, args := args[0], args[1:]
@@ -143,6 +158,30 @@ func main() {
 			if err != nil {
 				exit(fmt.Errorf(command+": %w", err))
 			}
+		case "apitoken":
+			b, err := os.ReadFile(filepath.Join(dir, "database.txt"))
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				exit(err)
+			}
+			if len(bytes.TrimSpace(b)) == 0 {
+				err = os.WriteFile(filepath.Join(dir, "database.txt"), []byte("sqlite"), 0644)
+				if err != nil {
+					exit(err)
+				}
+			}
+			nbrew, err := NewNotebrew(dir)
+			if err != nil {
+				exit(err)
+			}
+			defer nbrew.Close()
+			apiTokenCmd, err := APITokenCommand(nbrew, args...)
+			if err != nil {
+				exit(fmt.Errorf(command+": %w", err))
+			}
+			err = apiTokenCmd.Run()
+			if err != nil {
+				exit(fmt.Errorf(command+": %w", err))
+			}
 		case "hashpassword":
 			hashPasswordCmd, err := HashPasswordCommand(args...)
 			if err != nil {
@@ -152,15 +191,27 @@ func main() {
 			if err != nil {
 				exit(fmt.Errorf(command+": %w", err))
 			}
+		case "static":
+			// Serve every site in dir as static files only, without the
+			// admin interface or a database.
+			if len(args) > 0 {
+				exit(fmt.Errorf(command+": unexpected arguments: %s", strings.Join(args, " ")))
+			}
+			nbrew, err = nb6.NewStatic(&nb6.LocalFS{RootDir: dir})
+			if err != nil {
+				exit(err)
+			}
 		default:
 			exit(fmt.Errorf("unknown command %s", command))
 		}
-		return
-	}
-
-	nbrew, err := NewNotebrew(dir)
-	if err != nil {
-		exit(err)
+		if nbrew == nil {
+			return
+		}
+	} else {
+		nbrew, err = NewNotebrew(dir)
+		if err != nil {
+			exit(err)
+		}
 	}
 	defer nbrew.Close()
 	server, err := nbrew.NewServer()
@@ -236,8 +287,9 @@ func NewNotebrew(dir string) (*nb6.Notebrew, error) {
 			logger.SqLogQuery(ctx, queryStats)
 			return
 		}
-		// Otherwise, log the query depending on the contents inside debug.txt.
-		file, err := nbrew.FS.Open("debug.txt")
+		// Otherwise, log the query depending on the contents inside debug.txt
+		// (which is in dir even if fs.txt moved nbrew.FS elsewhere).
+		file, err := os.Open(filepath.Join(dir, "debug.txt"))
 		if err != nil {
 			return
 		}
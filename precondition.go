@@ -0,0 +1,94 @@
+package nb6
+
+import (
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// contentETag returns the strong entity tag of the contents of a file, which
+// is the hex encoded blake2b-256 checksum of its contents in double quotes.
+func contentETag(b []byte) string {
+	checksum := blake2b.Sum256(b)
+	return `"` + hex.EncodeToString(checksum[:]) + `"`
+}
+
+// fileETag returns the strong entity tag of the named file (see contentETag).
+func fileETag(fsys fs.FS, name string) (string, error) {
+	file, err := fsys.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash, err := blake2b.New256(nil)
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		return "", err
+	}
+	return `"` + hex.EncodeToString(hash.Sum(nil)) + `"`, nil
+}
+
+// checkPreconditions evaluates the If-Match and If-Unmodified-Since headers of
+// a write request against the named file (relative to the root of the FS). If
+// it returns false, a precondition failed and the request must not be carried
+// out (respond with 412 Precondition Failed instead). A request without either
+// header always passes.
+func checkPreconditions(fsys fs.FS, r *http.Request, name string) (bool, error) {
+	return evaluatePreconditions(fsys, name, r.Header.Get("If-Match"), r.Header.Get("If-Unmodified-Since"))
+}
+
+// evaluatePreconditions evaluates an If-Match and If-Unmodified-Since
+// precondition against the named file according to RFC 9110. If-Match uses
+// the strong comparison, so a weak entity tag never matches, and only "*"
+// matches a folder. If-Unmodified-Since is ignored if there is an If-Match.
+func evaluatePreconditions(fsys fs.FS, name, ifMatch, ifUnmodifiedSince string) (bool, error) {
+	ifMatch = strings.TrimSpace(ifMatch)
+	ifUnmodifiedSince = strings.TrimSpace(ifUnmodifiedSince)
+	if ifMatch == "" && ifUnmodifiedSince == "" {
+		return true, nil
+	}
+	fileInfo, err := fs.Stat(fsys, name)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return false, err
+	}
+	exists := err == nil
+	if ifMatch != "" {
+		if !exists {
+			return false, nil
+		}
+		if ifMatch == "*" {
+			return true, nil
+		}
+		if fileInfo.IsDir() {
+			return false, nil
+		}
+		etag, err := fileETag(fsys, name)
+		if err != nil {
+			return false, err
+		}
+		for _, tag := range strings.Split(ifMatch, ",") {
+			if strings.TrimSpace(tag) == etag {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	if !exists {
+		return true, nil
+	}
+	// An invalid date is ignored.
+	unmodifiedSince, err := http.ParseTime(ifUnmodifiedSince)
+	if err != nil {
+		return true, nil
+	}
+	return !fileInfo.ModTime().Truncate(time.Second).After(unmodifiedSince), nil
+}
@@ -0,0 +1,230 @@
+package nb6
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPreconditionsOnWrites(t *testing.T) {
+	type TestTable struct {
+		description string
+		files       map[string]string
+		// request returns the request to make and the handler to make it to.
+		request func(t *testing.T, nbrew *Notebrew) (*http.Request, http.HandlerFunc)
+		// check checks that nothing was written.
+		check func(t *testing.T, tempDir string)
+	}
+
+	formRequest := func(target string, values url.Values) *http.Request {
+		r := httptest.NewRequest("POST", target, strings.NewReader(values.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("Accept", "application/json")
+		r.Header.Set("If-Match", `"stale"`)
+		return r
+	}
+	wantContents := func(name, want string) func(*testing.T, string) {
+		return func(t *testing.T, tempDir string) {
+			b, err := os.ReadFile(filepath.Join(tempDir, name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != want {
+				t.Errorf("%s: got %q, want %q", name, string(b), want)
+			}
+		}
+	}
+	wantEmpty := func(name string) func(*testing.T, string) {
+		return func(t *testing.T, tempDir string) {
+			entries, err := os.ReadDir(filepath.Join(tempDir, name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) > 0 {
+				t.Errorf("%s is not empty: %v", name, entries)
+			}
+		}
+	}
+
+	tests := []TestTable{{
+		description: "create folder",
+		request: func(t *testing.T, nbrew *Notebrew) (*http.Request, http.HandlerFunc) {
+			r := formRequest("/admin/create-folder/", url.Values{
+				"parent_folder": {"pages"},
+				"name":          {"dir"},
+			})
+			r.Header.Set("If-Match", "*")
+			return r, nbrew.createFolder
+		},
+		check: wantEmpty("root/pages"),
+	}, {
+		description: "create category",
+		request: func(t *testing.T, nbrew *Notebrew) (*http.Request, http.HandlerFunc) {
+			r := formRequest("/admin/create-category/", url.Values{
+				"name": {"dir"},
+			})
+			r.Header.Set("If-Match", "*")
+			return r, func(w http.ResponseWriter, r *http.Request) {
+				nbrew.createCategory(w, r, "", "", "notes")
+			}
+		},
+		check: wantEmpty("root/notes"),
+	}, {
+		description: "create note",
+		request: func(t *testing.T, nbrew *Notebrew) (*http.Request, http.HandlerFunc) {
+			r := formRequest("/admin/create-note/", url.Values{
+				"content": {"# hello"},
+			})
+			r.Header.Set("If-Match", "*")
+			return r, func(w http.ResponseWriter, r *http.Request) {
+				nbrew.createNote(w, r, "", "")
+			}
+		},
+		check: wantEmpty("root/notes"),
+	}, {
+		description: "create post",
+		request: func(t *testing.T, nbrew *Notebrew) (*http.Request, http.HandlerFunc) {
+			r := formRequest("/admin/create-post/", url.Values{
+				"content": {"# hello"},
+			})
+			r.Header.Set("If-Match", "*")
+			return r, func(w http.ResponseWriter, r *http.Request) {
+				nbrew.createPost(w, r, "", "")
+			}
+		},
+		check: wantEmpty("root/posts"),
+	}, {
+		description: "paste with replace",
+		files: map[string]string{
+			"root/notes/a.md": "old",
+			"root/posts/a.md": "new",
+		},
+		request: func(t *testing.T, nbrew *Notebrew) (*http.Request, http.HandlerFunc) {
+			r := formRequest("/admin/paste/", url.Values{
+				"folder":              {"notes"},
+				"conflict_resolution": {"replace"},
+			})
+			r.AddCookie(forgedClipboard(t, clipboard{Folder: "posts", Names: []string{"a.md"}}))
+			return r, func(w http.ResponseWriter, r *http.Request) {
+				nbrew.paste(w, r, "", "")
+			}
+		},
+		check: wantContents("root/notes/a.md", "old"),
+	}, {
+		description: "upload over an existing image",
+		files: map[string]string{
+			"root/site/images/a.png": "\x89PNG\r\n\x1a\nold",
+		},
+		request: func(t *testing.T, nbrew *Notebrew) (*http.Request, http.HandlerFunc) {
+			body := &bytes.Buffer{}
+			writer := multipart.NewWriter(body)
+			err := writer.WriteField("parent_folder", "site/images")
+			if err != nil {
+				t.Fatal(err)
+			}
+			part, err := writer.CreateFormFile("file", "a.png")
+			if err != nil {
+				t.Fatal(err)
+			}
+			part.Write([]byte("\x89PNG\r\n\x1a\nnew"))
+			writer.Close()
+			r := httptest.NewRequest("POST", "/admin/upload/", body)
+			r.Header.Set("Content-Type", writer.FormDataContentType())
+			r.Header.Set("Accept", "application/json")
+			r.Header.Set("If-Match", `"stale"`)
+			return r, func(w http.ResponseWriter, r *http.Request) {
+				nbrew.upload(w, r, "", "")
+			}
+		},
+		check: wantContents("root/site/images/a.png", "\x89PNG\r\n\x1a\nold"),
+	}, {
+		description: "purge recycle bin item",
+		files: map[string]string{
+			"root/notes/a.md": "a",
+		},
+		request: func(t *testing.T, nbrew *Notebrew) (*http.Request, http.HandlerFunc) {
+			id, err := nbrew.recycle("", "notes/a.md")
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := formRequest("/admin/recyclebin/", url.Values{
+				"action": {"purge"},
+				"id":     {id},
+			})
+			return r, func(w http.ResponseWriter, r *http.Request) {
+				nbrew.recycleBin(w, r, "", "")
+			}
+		},
+		check: func(t *testing.T, tempDir string) {
+			entries, err := os.ReadDir(filepath.Join(tempDir, "root/system/recycle_bin"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 2 {
+				t.Errorf("got %d recycle bin entries, want 2", len(entries))
+			}
+		},
+	}, {
+		description: "restore recycle bin item",
+		files: map[string]string{
+			"root/notes/a.md": "a",
+		},
+		request: func(t *testing.T, nbrew *Notebrew) (*http.Request, http.HandlerFunc) {
+			id, err := nbrew.recycle("", "notes/a.md")
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := formRequest("/admin/recyclebin/", url.Values{
+				"action": {"restore"},
+				"id":     {id},
+			})
+			return r, func(w http.ResponseWriter, r *http.Request) {
+				nbrew.recycleBin(w, r, "", "")
+			}
+		},
+		check: wantEmpty("root/notes"),
+	}}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.description, func(t *testing.T) {
+			nbrew, tempDir := newTestLocalNotebrew(t, tt.files)
+			r, handler := tt.request(t, nbrew)
+			w := httptest.NewRecorder()
+			handler(w, r)
+			if w.Code != http.StatusPreconditionFailed {
+				t.Fatalf("got status %d, want %d: %s", w.Code, http.StatusPreconditionFailed, w.Body.String())
+			}
+			tt.check(t, tempDir)
+		})
+	}
+
+	t.Run("paste with replace and a matching etag", func(t *testing.T) {
+		nbrew, tempDir := newTestLocalNotebrew(t, map[string]string{
+			"root/notes/a.md": "old",
+			"root/posts/a.md": "new",
+		})
+		etag, err := fileETag(nbrew.FS, "notes/a.md")
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := formRequest("/admin/paste/", url.Values{
+			"folder":              {"notes"},
+			"conflict_resolution": {"replace"},
+		})
+		r.Header.Set("If-Match", etag)
+		r.AddCookie(forgedClipboard(t, clipboard{Folder: "posts", Names: []string{"a.md"}}))
+		w := httptest.NewRecorder()
+		nbrew.paste(w, r, "", "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("got status %d, want %d: %s", w.Code, http.StatusOK, w.Body.String())
+		}
+		wantContents("root/notes/a.md", "new")(t, tempDir)
+	})
+}
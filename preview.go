@@ -0,0 +1,150 @@
+package nb6
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// previewContentSecurityPolicy is the Content-Security-Policy of a preview.
+// A preview is rendered from whatever the user is typing, so it is sandboxed
+// and never runs scripts. It may only be framed by the admin interface.
+const previewContentSecurityPolicy = "default-src 'none'; img-src * data:; style-src * 'unsafe-inline'; font-src * data:; media-src *; base-uri 'none'; form-action 'none'; frame-ancestors 'self'; sandbox"
+
+// isPreviewable reports whether a file (relative to the sitePrefix) can be
+// previewed. Posts and pages are previewed as they would look on the site,
+// notes are previewed as plain markdown.
+func isPreviewable(name string) bool {
+	head, _, _ := strings.Cut(name, "/")
+	switch head {
+	case "notes", "posts":
+		return path.Ext(name) == ".md"
+	case "pages":
+		return path.Ext(name) == ".html"
+	}
+	return false
+}
+
+// renderPreview renders the contents of a file (relative to the sitePrefix)
+// into w the same way generate would, without writing anything.
+func (nbrew *Notebrew) renderPreview(ctx context.Context, w io.Writer, sitePrefix, name, text string) error {
+	head, tail, _ := strings.Cut(name, "/")
+	switch head {
+	case "posts":
+		modTime := time.Now()
+		fileInfo, err := fs.Stat(nbrew.FS, path.Join(sitePrefix, name))
+		if err == nil {
+			modTime = fileInfo.ModTime()
+		}
+		post, err := nbrew.parsePost(ctx, sitePrefix, tail, []byte(text), modTime)
+		if err != nil {
+			return err
+		}
+		return nbrew.renderPost(w, sitePrefix, &post)
+	case "pages":
+		return nbrew.renderPageText(w, sitePrefix, text)
+	case "notes":
+		_, markdown, err := parseFrontMatter([]byte(text))
+		if err != nil {
+			return err
+		}
+		title, _ := getTitleAndPreview(io.NopCloser(bytes.NewReader(markdown)))
+		io.WriteString(w, "<!DOCTYPE html>\n<html lang=\"en\">\n<meta charset=\"utf-8\">\n<title>"+template.HTMLEscapeString(title)+"</title>\n")
+		io.WriteString(w, "<body style=\"font-family: Helvetica, Arial, sans-serif; line-height: 1.5;\">\n")
+		return goldmarkMarkdown.Convert(markdown, w)
+	}
+	return fmt.Errorf("%s: cannot be previewed", name)
+}
+
+// preview renders a post, page or note inside the preview frame of the file
+// view. GET renders the file as it is saved, POST renders the draft contents
+// sent by the editor.
+func (nbrew *Notebrew) preview(w http.ResponseWriter, r *http.Request, username, sitePrefix, filePath string) {
+	type Request struct {
+		Content string `json:"content"`
+	}
+
+	logger, ok := r.Context().Value(loggerKey).(*slog.Logger)
+	if !ok {
+		logger = slog.Default()
+	}
+
+	filePath = strings.Trim(path.Clean(filePath), "/")
+	if !isPreviewable(filePath) {
+		notFound(w, r)
+		return
+	}
+
+	var request Request
+	switch r.Method {
+	case "GET":
+		var err error
+		request.Content, err = readFile(nbrew.FS, path.Join(sitePrefix, filePath))
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				notFound(w, r)
+				return
+			}
+			logger.Error(err.Error())
+			internalServerError(w, r, err)
+			return
+		}
+	case "POST":
+		contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		switch contentType {
+		case "application/json":
+			err := json.NewDecoder(r.Body).Decode(&request)
+			if err != nil {
+				var syntaxErr *json.SyntaxError
+				if errors.As(err, &syntaxErr) {
+					http.Error(w, "400 Bad Request: invalid JSON", http.StatusBadRequest)
+					return
+				}
+				logger.Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+		case "application/x-www-form-urlencoded":
+			err := r.ParseForm()
+			if err != nil {
+				http.Error(w, fmt.Sprintf("400 Bad Request: %s", err), http.StatusBadRequest)
+				return
+			}
+			request.Content = r.Form.Get("content")
+		default:
+			http.Error(w, "415 Unsupported Media Type", http.StatusUnsupportedMediaType)
+			return
+		}
+	default:
+		http.Error(w, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	buf := bufPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer bufPool.Put(buf)
+	err := nbrew.renderPreview(r.Context(), buf, sitePrefix, filePath, request.Content)
+	if err != nil {
+		// Mistakes in a draft are expected while the user is still typing,
+		// so they are shown in the preview instead of being logged.
+		buf.Reset()
+		buf.WriteString("<!DOCTYPE html>\n<html lang=\"en\">\n<meta charset=\"utf-8\">\n<title>preview error</title>\n")
+		buf.WriteString("<pre style=\"white-space: pre-wrap; color: #721c24;\">" + template.HTMLEscapeString(err.Error()) + "</pre>\n")
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", previewContentSecurityPolicy)
+	w.Header().Set("X-Frame-Options", "SAMEORIGIN")
+	buf.WriteTo(w)
+}
@@ -1,6 +1,450 @@
 package nb6
 
-import "net/http"
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
 
-func (nbrew *Notebrew) recycleBin(w http.ResponseWriter, r *http.Request) {
+	"golang.org/x/exp/slog"
+)
+
+// defaultRecycleBinRetention is how long deleted items are kept in the
+// recycle bin if RecycleBinRetention is not set.
+const defaultRecycleBinRetention = 30 * 24 * time.Hour
+
+// recycleBinItem is an item that was deleted and is sitting in the recycle
+// bin. Each item is stored in system/recycle_bin/{id}/{name} of its site, with
+// its metadata stored alongside in system/recycle_bin/{id}.json.
+type recycleBinItem struct {
+	ID           string    `json:"id"`
+	OriginalPath string    `json:"original_path"`
+	IsDir        bool      `json:"is_dir,omitempty"`
+	DeletedAt    time.Time `json:"deleted_at"`
+}
+
+// recycle moves the named file or folder (relative to the sitePrefix) into the
+// recycle bin of the site and returns the ID of its recycle bin item.
+func (nbrew *Notebrew) recycle(sitePrefix, name string) (id string, err error) {
+	fileInfo, err := fs.Stat(nbrew.FS, path.Join(sitePrefix, name))
+	if err != nil {
+		return "", err
+	}
+	item := recycleBinItem{
+		ID:           NewStringID(),
+		OriginalPath: name,
+		IsDir:        fileInfo.IsDir(),
+		DeletedAt:    time.Now().UTC().Truncate(time.Second),
+	}
+	itemDir := path.Join(sitePrefix, "system/recycle_bin", item.ID)
+	// If the item doesn't make it into the recycle bin, the journal cleans up
+	// the recycle bin item.
+	err = nbrew.journaled(journalEntry{Op: "recycle", Src: path.Join(sitePrefix, name), Dest: itemDir}, func() error {
+		err := mkdirAll(nbrew.FS, itemDir, 0755)
+		if err != nil {
+			return err
+		}
+		b, err := json.Marshal(&item)
+		if err != nil {
+			return err
+		}
+		readerFrom, err := nbrew.FS.OpenReaderFrom(itemDir+".json", 0644)
+		if err != nil {
+			return err
+		}
+		_, err = readerFrom.ReadFrom(bytes.NewReader(b))
+		if err != nil {
+			return err
+		}
+		return nbrew.FS.Rename(path.Join(sitePrefix, name), path.Join(itemDir, path.Base(name)))
+	})
+	if err != nil {
+		return "", err
+	}
+	return item.ID, nil
+}
+
+// getRecycleBinItem returns the recycle bin item identified by id.
+func (nbrew *Notebrew) getRecycleBinItem(sitePrefix, id string) (recycleBinItem, error) {
+	var item recycleBinItem
+	if id == "" || strings.ContainsAny(id, "/.") {
+		return item, fs.ErrNotExist
+	}
+	file, err := nbrew.FS.Open(path.Join(sitePrefix, "system/recycle_bin", id+".json"))
+	if err != nil {
+		return item, err
+	}
+	defer file.Close()
+	err = json.NewDecoder(file).Decode(&item)
+	if err != nil {
+		return item, fmt.Errorf("%s: %w", id, err)
+	}
+	item.ID = id
+	return item, nil
+}
+
+// getRecycleBinItems returns every item in the recycle bin of a site, most
+// recently deleted first.
+func (nbrew *Notebrew) getRecycleBinItems(sitePrefix string) ([]recycleBinItem, error) {
+	dirEntries, err := nbrew.FS.ReadDir(path.Join(sitePrefix, "system/recycle_bin"))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var items []recycleBinItem
+	for _, dirEntry := range dirEntries {
+		if dirEntry.IsDir() || path.Ext(dirEntry.Name()) != ".json" {
+			continue
+		}
+		item, err := nbrew.getRecycleBinItem(sitePrefix, strings.TrimSuffix(dirEntry.Name(), ".json"))
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[i].DeletedAt.After(items[j].DeletedAt)
+	})
+	return items, nil
+}
+
+// restoreRecycleBinItem moves a recycle bin item back to its original path. If
+// something already exists at the original path, restoreRecycleBinItem
+// returns an error wrapping fs.ErrExist.
+func (nbrew *Notebrew) restoreRecycleBinItem(sitePrefix, id string) (recycleBinItem, error) {
+	item, err := nbrew.getRecycleBinItem(sitePrefix, id)
+	if err != nil {
+		return item, err
+	}
+	_, err = fs.Stat(nbrew.FS, path.Join(sitePrefix, item.OriginalPath))
+	if err == nil {
+		return item, fmt.Errorf("%s: %w", item.OriginalPath, fs.ErrExist)
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return item, err
+	}
+	itemDir := path.Join(sitePrefix, "system/recycle_bin", item.ID)
+	err = nbrew.journaled(journalEntry{Op: "restore", Src: itemDir, Dest: path.Join(sitePrefix, item.OriginalPath)}, func() error {
+		err := mkdirAll(nbrew.FS, path.Join(sitePrefix, path.Dir(item.OriginalPath)), 0755)
+		if err != nil {
+			return err
+		}
+		err = nbrew.FS.Rename(path.Join(itemDir, path.Base(item.OriginalPath)), path.Join(sitePrefix, item.OriginalPath))
+		if err != nil {
+			return err
+		}
+		err = nbrew.FS.Remove(itemDir)
+		if err != nil {
+			return err
+		}
+		return nbrew.FS.Remove(itemDir + ".json")
+	})
+	if err != nil {
+		return item, err
+	}
+	return item, nil
+}
+
+// purgeRecycleBinItem permanently deletes a recycle bin item.
+func (nbrew *Notebrew) purgeRecycleBinItem(sitePrefix, id string) error {
+	if id == "" || strings.ContainsAny(id, "/.") {
+		return fs.ErrNotExist
+	}
+	itemDir := path.Join(sitePrefix, "system/recycle_bin", id)
+	return nbrew.journaled(journalEntry{Op: "purge", Src: itemDir}, func() error {
+		err := removeAll(nbrew.FS, itemDir)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nbrew.FS.Remove(itemDir + ".json")
+	})
+}
+
+// purgeExpiredRecycleBinItems permanently deletes the recycle bin items of a
+// site that have been in the recycle bin for longer than the
+// RecycleBinRetention. It is run by the janitor.
+func (nbrew *Notebrew) purgeExpiredRecycleBinItems(sitePrefix string) error {
+	retention := nbrew.RecycleBinRetention
+	if retention < 0 {
+		return nil
+	}
+	if retention == 0 {
+		retention = defaultRecycleBinRetention
+	}
+	items, err := nbrew.getRecycleBinItems(sitePrefix)
+	if err != nil {
+		return err
+	}
+	cutoff := time.Now().Add(-retention)
+	for _, item := range items {
+		if item.DeletedAt.After(cutoff) {
+			continue
+		}
+		err = nbrew.purgeRecycleBinItem(sitePrefix, item.ID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (nbrew *Notebrew) recycleBin(w http.ResponseWriter, r *http.Request, username, sitePrefix string) {
+	type Request struct {
+		Action string   `json:"action,omitempty"`
+		IDs    []string `json:"ids,omitempty"`
+	}
+	type Response struct {
+		Action  string   `json:"action,omitempty"`
+		IDs     []string `json:"ids,omitempty"`
+		Errors  []string `json:"errors,omitempty"`
+		Success []string `json:"success,omitempty"`
+	}
+	type TemplateData struct {
+		Items    []recycleBinItem `json:"items,omitempty"`
+		Selected []string         `json:"selected,omitempty"`
+		Alerts   url.Values       `json:"alerts,omitempty"`
+	}
+
+	logger, ok := r.Context().Value(loggerKey).(*slog.Logger)
+	if !ok {
+		logger = slog.Default()
+	}
+
+	switch r.Method {
+	case "GET":
+		err := r.ParseForm()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("400 Bad Request: %s", err), http.StatusBadRequest)
+			return
+		}
+		var templateData TemplateData
+		_, err = nbrew.getSession(r, "flash", &templateData)
+		if err != nil {
+			logger.Error(err.Error())
+		}
+		nbrew.clearSession(w, r, "flash")
+		templateData.Items, err = nbrew.getRecycleBinItems(sitePrefix)
+		if err != nil {
+			logger.Error(err.Error())
+			internalServerError(w, r, err)
+			return
+		}
+		templateData.Selected = r.Form["id"]
+
+		accept, _, _ := mime.ParseMediaType(r.Header.Get("Accept"))
+		if accept == "application/json" {
+			w.Header().Set("Content-Type", "application/json")
+			b, err := json.Marshal(&templateData)
+			if err != nil {
+				logger.Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+			w.Write(b)
+			return
+		}
+
+		retention := nbrew.RecycleBinRetention
+		if retention == 0 {
+			retention = defaultRecycleBinRetention
+		}
+		funcMap := map[string]any{
+			"join":       path.Join,
+			"base":       path.Base,
+			"safeHTML":   func(s string) template.HTML { return template.HTML(s) },
+			"username":   func() string { return username },
+			"referer":    func() string { return r.Referer() },
+			"sitePrefix": func() string { return sitePrefix },
+			"isSelected": func(id string) bool {
+				for _, selected := range templateData.Selected {
+					if selected == id {
+						return true
+					}
+				}
+				return false
+			},
+			"retentionDays": func() int {
+				if retention < 0 {
+					return 0
+				}
+				return int(retention / (24 * time.Hour))
+			},
+		}
+		tmpl, err := template.New("recycle_bin.html").Funcs(funcMap).ParseFS(rootFS, "recycle_bin.html")
+		if err != nil {
+			logger.Error(err.Error())
+			internalServerError(w, r, err)
+			return
+		}
+		buf := bufPool.Get().(*bytes.Buffer)
+		buf.Reset()
+		defer bufPool.Put(buf)
+		err = tmpl.Execute(buf, &templateData)
+		if err != nil {
+			logger.Error(err.Error())
+			internalServerError(w, r, err)
+			return
+		}
+		w.Header().Add("Content-Security-Policy", defaultContentSecurityPolicy)
+		buf.WriteTo(w)
+	case "POST":
+		writeResponse := func(w http.ResponseWriter, r *http.Request, response Response) {
+			accept, _, _ := mime.ParseMediaType(r.Header.Get("Accept"))
+			if accept == "application/json" {
+				w.Header().Set("Content-Type", "application/json")
+				b, err := json.Marshal(&response)
+				if err != nil {
+					logger.Error(err.Error())
+					internalServerError(w, r, err)
+					return
+				}
+				w.Write(b)
+				return
+			}
+			alerts := make(url.Values)
+			for _, msg := range response.Success {
+				alerts.Add("success", msg)
+			}
+			for _, errmsg := range response.Errors {
+				alerts.Add("danger", template.HTMLEscapeString(errmsg))
+			}
+			err := nbrew.setSession(w, r, "flash", map[string]any{
+				"alerts": alerts,
+			})
+			if err != nil {
+				logger.Error(err.Error())
+			}
+			http.Redirect(w, r, nbrew.Scheme+nbrew.AdminDomain+"/"+path.Join("admin", sitePrefix, "recycle_bin")+"/", http.StatusFound)
+		}
+
+		var request Request
+		contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		switch contentType {
+		case "application/json":
+			err := json.NewDecoder(r.Body).Decode(&request)
+			if err != nil {
+				var syntaxErr *json.SyntaxError
+				if errors.As(err, &syntaxErr) {
+					http.Error(w, "400 Bad Request: invalid JSON", http.StatusBadRequest)
+					return
+				}
+				logger.Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+		case "application/x-www-form-urlencoded":
+			err := r.ParseForm()
+			if err != nil {
+				http.Error(w, fmt.Sprintf("400 Bad Request: %s", err), http.StatusBadRequest)
+				return
+			}
+			request.Action = r.Form.Get("action")
+			request.IDs = r.Form["id"]
+		default:
+			http.Error(w, "415 Unsupported Media Type", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		response := Response{
+			Action: request.Action,
+		}
+		if response.Action != "restore" && response.Action != "purge" {
+			response.Errors = append(response.Errors, fmt.Sprintf("invalid action %q (must be restore or purge)", response.Action))
+			writeResponse(w, r, response)
+			return
+		}
+		// The preconditions are evaluated against the deleted file or folder
+		// in the recycle bin and must hold for every item, otherwise nothing
+		// is restored or purged. Items that no longer exist are skipped
+		// below anyway.
+		for _, id := range request.IDs {
+			item, err := nbrew.getRecycleBinItem(sitePrefix, id)
+			if err != nil {
+				if errors.Is(err, fs.ErrNotExist) {
+					continue
+				}
+				logger.Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+			ok, err := checkPreconditions(nbrew.FS, r, path.Join(sitePrefix, "system/recycle_bin", item.ID, path.Base(item.OriginalPath)))
+			if err != nil {
+				logger.Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+			if !ok {
+				http.Error(w, "412 Precondition Failed", http.StatusPreconditionFailed)
+				return
+			}
+		}
+		seen := make(map[string]bool)
+		for _, id := range request.IDs {
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+			if response.Action == "purge" {
+				err := nbrew.purgeRecycleBinItem(sitePrefix, id)
+				if err != nil {
+					if errors.Is(err, fs.ErrNotExist) {
+						continue
+					}
+					logger.Error(err.Error())
+					response.Errors = append(response.Errors, fmt.Sprintf("%s: %v", id, err))
+					continue
+				}
+				response.IDs = append(response.IDs, id)
+				continue
+			}
+			item, err := nbrew.restoreRecycleBinItem(sitePrefix, id)
+			if err != nil {
+				if errors.Is(err, fs.ErrNotExist) {
+					continue
+				}
+				if errors.Is(err, fs.ErrExist) {
+					response.Errors = append(response.Errors, fmt.Sprintf("cannot restore %s: a file or folder already exists there", item.OriginalPath))
+					continue
+				}
+				logger.Error(err.Error())
+				response.Errors = append(response.Errors, fmt.Sprintf("%s: %v", id, err))
+				continue
+			}
+			response.IDs = append(response.IDs, id)
+			err = nbrew.generate(r.Context(), sitePrefix, item.OriginalPath)
+			if err != nil {
+				logger.Error(err.Error())
+			}
+			href := "/" + path.Join("admin", sitePrefix, item.OriginalPath)
+			if item.IsDir {
+				href += "/"
+			}
+			response.Success = append(response.Success, fmt.Sprintf(
+				`Restored <a href="%s" class="linktext">%s</a>`,
+				template.HTMLEscapeString(href),
+				template.HTMLEscapeString(item.OriginalPath),
+			))
+		}
+		if response.Action == "purge" && len(response.IDs) > 0 {
+			msg := "1 item permanently deleted"
+			if len(response.IDs) > 1 {
+				msg = fmt.Sprintf("%d items permanently deleted", len(response.IDs))
+			}
+			response.Success = append(response.Success, msg)
+		}
+		writeResponse(w, r, response)
+	default:
+		http.Error(w, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+	}
 }
@@ -17,9 +17,6 @@ import (
 )
 
 func (nbrew *Notebrew) rename(w http.ResponseWriter, r *http.Request) {
-}
-
-func (nbrew *Notebrew) rename_Old(w http.ResponseWriter, r *http.Request) {
 	type Request struct {
 		ParentFolder string `json:"parent_folder,omitempty"`
 		OldName      string `json:"old_name,omitempty"`
@@ -64,7 +61,7 @@ func (nbrew *Notebrew) rename_Old(w http.ResponseWriter, r *http.Request) {
 		}
 		nbrew.clearSession(w, r, "flash")
 
-		tmpl, err := template.ParseFS(rootFS, "html/rename.html")
+		tmpl, err := template.ParseFS(rootFS, "rename.html")
 		if err != nil {
 			logger.Error(err.Error())
 			internalServerError(w, r, err)
@@ -143,13 +140,21 @@ func (nbrew *Notebrew) rename_Old(w http.ResponseWriter, r *http.Request) {
 			NewName:      request.NewName,
 			Errors:       make(url.Values),
 		}
+		response.ParentFolder = strings.Trim(response.ParentFolder, "/")
 		if response.ParentFolder == "" {
 			response.Errors.Add("parent_folder", "cannot be empty")
-		} else {
-			response.ParentFolder = strings.Trim(path.Clean(response.ParentFolder), "/")
+		} else if !isValidSitePath(response.ParentFolder) {
+			response.Errors.Add("parent_folder", "invalid folder")
 		}
+		// validateName rejects "/" as well as "." and "..", so the names
+		// cannot point outside the parent folder.
 		if response.OldName == "" {
 			response.Errors.Add("old_name", "cannot be empty")
+		} else {
+			errmsgs := validateName(response.OldName)
+			if len(errmsgs) > 0 {
+				response.Errors["old_name"] = append(response.Errors["old_name"], errmsgs...)
+			}
 		}
 		if response.NewName == "" {
 			response.Errors.Add("new_name", "cannot be empty")
@@ -193,6 +198,16 @@ func (nbrew *Notebrew) rename_Old(w http.ResponseWriter, r *http.Request) {
 			internalServerError(w, r, err)
 			return
 		}
+		ok, err := checkPreconditions(nbrew.FS, r, oldPath)
+		if err != nil {
+			logger.Error(err.Error())
+			internalServerError(w, r, err)
+			return
+		}
+		if !ok {
+			http.Error(w, "412 Precondition Failed", http.StatusPreconditionFailed)
+			return
+		}
 
 		newPath := path.Join(sitePrefix, response.ParentFolder, response.NewName)
 		_, err = fs.Stat(nbrew.FS, newPath)
@@ -209,9 +224,14 @@ func (nbrew *Notebrew) rename_Old(w http.ResponseWriter, r *http.Request) {
 
 		err = nbrew.FS.Rename(oldPath, newPath)
 		if err != nil {
+			logger.Error(err.Error())
 			internalServerError(w, r, err)
 			return
 		}
+		err = nbrew.generate(r.Context(), sitePrefix, path.Join(response.ParentFolder, response.OldName), path.Join(response.ParentFolder, response.NewName))
+		if err != nil {
+			logger.Error(err.Error())
+		}
 		writeResponse(w, r, response)
 	default:
 		http.Error(w, "405 Method Not Allowed", http.StatusMethodNotAllowed)
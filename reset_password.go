@@ -2,6 +2,7 @@ package nb6
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
@@ -10,6 +11,7 @@ import (
 	"mime"
 	"net/http"
 	"net/url"
+	"time"
 	"unicode/utf8"
 
 	"github.com/bokwoon95/sq"
@@ -20,6 +22,9 @@ import (
 
 // https://notebrew.blog/admin/@this-is-mee/createfile/
 
+// resetTokenLifetime is how long a password reset link can be used for.
+const resetTokenLifetime = 24 * time.Hour
+
 func (nbrew *Notebrew) resetPassword(w http.ResponseWriter, r *http.Request) {
 	type Request struct {
 		Token           string `json:"token,omitempty"`
@@ -62,6 +67,11 @@ func (nbrew *Notebrew) resetPassword(w http.ResponseWriter, r *http.Request) {
 		var resetTokenHash [8 + blake2b.Size256]byte
 		copy(resetTokenHash[:8], resetToken[:8])
 		copy(resetTokenHash[8:], checksum[:])
+		issuedAt := time.Unix(int64(binary.BigEndian.Uint64(resetTokenHash[:8])), 0)
+		if time.Since(issuedAt) > resetTokenLifetime {
+			http.Error(w, "token expired", http.StatusBadRequest)
+			return
+		}
 		exists, err := sq.FetchExistsContext(r.Context(), nbrew.DB, sq.CustomQuery{
 			Dialect: nbrew.Dialect,
 			Format:  "SELECT 1 FROM users WHERE reset_token_hash = {resetTokenHash}",
@@ -202,6 +212,11 @@ func (nbrew *Notebrew) resetPassword(w http.ResponseWriter, r *http.Request) {
 		var resetTokenHash [8 + blake2b.Size256]byte
 		copy(resetTokenHash[:8], resetToken[:8])
 		copy(resetTokenHash[8:], checksum[:])
+		issuedAt := time.Unix(int64(binary.BigEndian.Uint64(resetTokenHash[:8])), 0)
+		if time.Since(issuedAt) > resetTokenLifetime {
+			http.Error(w, "token expired", http.StatusBadRequest)
+			return
+		}
 		tx, err := nbrew.DB.Begin()
 		if err != nil {
 			logger.Error(err.Error())
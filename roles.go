@@ -0,0 +1,150 @@
+package nb6
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/bokwoon95/sq"
+)
+
+// The roles a member of a site can have.
+const (
+	roleOwner  = "owner"
+	roleEditor = "editor"
+	roleAuthor = "author"
+	roleViewer = "viewer"
+)
+
+// isAssignableRole reports whether role can be given to a member directly.
+// There is only one owner per site, and the only way to become it is to have
+// the ownership transferred.
+func isAssignableRole(role string) bool {
+	return role == roleEditor || role == roleAuthor || role == roleViewer
+}
+
+// getSiteRole returns the role of the user in the site, or an empty string if
+// the user is not a member of the site.
+func (nbrew *Notebrew) getSiteRole(ctx context.Context, username, siteName string) (string, error) {
+	role, err := sq.FetchOneContext(ctx, nbrew.DB, sq.CustomQuery{
+		Dialect: nbrew.Dialect,
+		Format: "SELECT {*}" +
+			" FROM site_user" +
+			" JOIN site ON site.site_id = site_user.site_id" +
+			" JOIN users ON users.user_id = site_user.user_id" +
+			" WHERE site.site_name = {siteName}" +
+			" AND users.username = {username}",
+		Values: []any{
+			sq.StringParam("siteName", siteName),
+			sq.StringParam("username", username),
+		},
+	}, func(row *sq.Row) string {
+		return row.String("site_user.role")
+	})
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", nil
+		}
+		return "", err
+	}
+	return role, nil
+}
+
+// setFileAuthor records the user as the author of a file (relative to the
+// sitePrefix), replacing whoever authored a file previously at that path.
+func (nbrew *Notebrew) setFileAuthor(ctx context.Context, sitePrefix, name, username string) error {
+	if nbrew.DB == nil {
+		return nil
+	}
+	tx, err := nbrew.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = sq.ExecContext(ctx, tx, sq.CustomQuery{
+		Dialect: nbrew.Dialect,
+		Format:  "DELETE FROM file_author WHERE file_path = {filePath}",
+		Values: []any{
+			sq.StringParam("filePath", path.Join(sitePrefix, name)),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = sq.ExecContext(ctx, tx, sq.CustomQuery{
+		Dialect: nbrew.Dialect,
+		Format: "INSERT INTO file_author (file_path, user_id)" +
+			" VALUES ({filePath}, (SELECT user_id FROM users WHERE username = {username}))",
+		Values: []any{
+			sq.StringParam("filePath", path.Join(sitePrefix, name)),
+			sq.StringParam("username", username),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// isFileAuthor reports whether the user is the author of a file (relative to
+// the sitePrefix).
+func (nbrew *Notebrew) isFileAuthor(ctx context.Context, sitePrefix, name, username string) (bool, error) {
+	return sq.FetchExistsContext(ctx, nbrew.DB, sq.CustomQuery{
+		Dialect: nbrew.Dialect,
+		Format: "SELECT 1" +
+			" FROM file_author" +
+			" JOIN users ON users.user_id = file_author.user_id" +
+			" WHERE file_author.file_path = {filePath}" +
+			" AND users.username = {username}",
+		Values: []any{
+			sq.StringParam("filePath", path.Join(sitePrefix, name)),
+			sq.StringParam("username", username),
+		},
+	})
+}
+
+// authorize reports whether a member of a site with the given role may make
+// the request to the admin page at urlPath (relative to the sitePrefix).
+// Every member can read everything, what they can change depends on their
+// role:
+//
+//   - owners can change anything, delete the site and manage its members.
+//   - editors can change anything except the members.
+//   - authors can only create notes and posts and edit the ones they created.
+//   - viewers cannot change anything.
+//
+// The site deleted by delete-site is named in the request instead of the URL,
+// so deleteSite checks that the user owns it by itself.
+func (nbrew *Notebrew) authorize(r *http.Request, username, sitePrefix, role, urlPath string) (bool, error) {
+	if r.Method == "GET" || r.Method == "HEAD" {
+		return true, nil
+	}
+	head, tail, _ := strings.Cut(urlPath, "/")
+	switch role {
+	case roleOwner:
+		return true, nil
+	case roleEditor:
+		return head != "members", nil
+	case roleAuthor:
+		switch head {
+		case "create-note", "create-post":
+			return tail == "", nil
+		case "notes", "posts":
+			// Saving a file in the file view.
+			return nbrew.isFileAuthor(r.Context(), sitePrefix, urlPath, username)
+		case "history", "preview":
+			// Restoring or previewing a version of a file.
+			filePath := strings.Trim(path.Clean(tail), "/")
+			next, _, _ := strings.Cut(filePath, "/")
+			if next != "notes" && next != "posts" {
+				return false, nil
+			}
+			return nbrew.isFileAuthor(r.Context(), sitePrefix, filePath, username)
+		}
+		return false, nil
+	}
+	return false, nil
+}
@@ -0,0 +1,277 @@
+package nb6
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bokwoon95/nb6/internal/testutil"
+	"github.com/bokwoon95/sq"
+	_ "modernc.org/sqlite"
+)
+
+// newTestDatabase gives nbrew a fresh SQLite database with the notebrew
+// schema, closed at the end of the test.
+func newTestDatabase(t *testing.T, nbrew *Notebrew) {
+	t.Helper()
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "notebrew.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	err = automigrate("sqlite", db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nbrew.DB = db
+	nbrew.Dialect = "sqlite"
+}
+
+// addTestMember makes username a member of siteName with the given role,
+// creating the user and the site if they do not exist yet.
+func addTestMember(t *testing.T, nbrew *Notebrew, username, siteName, role string) {
+	t.Helper()
+	for _, name := range []string{username, siteName} {
+		_, err := sq.Exec(nbrew.DB, sq.CustomQuery{
+			Dialect: nbrew.Dialect,
+			Format:  "INSERT INTO site (site_id, site_name) VALUES ({siteID}, {siteName}) ON CONFLICT DO NOTHING",
+			Values: []any{
+				sq.UUIDParam("siteID", NewID()),
+				sq.StringParam("siteName", name),
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := sq.Exec(nbrew.DB, sq.CustomQuery{
+		Dialect: nbrew.Dialect,
+		Format: "INSERT INTO users (user_id, username, email, password_hash)" +
+			" VALUES ({userID}, {username}, {email}, '') ON CONFLICT DO NOTHING",
+		Values: []any{
+			sq.UUIDParam("userID", NewID()),
+			sq.StringParam("username", username),
+			sq.StringParam("email", username+"@example.com"),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = sq.Exec(nbrew.DB, sq.CustomQuery{
+		Dialect: nbrew.Dialect,
+		Format: "INSERT INTO site_user (site_id, user_id, role)" +
+			" VALUES ((SELECT site_id FROM site WHERE site_name = {siteName}), (SELECT user_id FROM users WHERE username = {username}), {role})",
+		Values: []any{
+			sq.StringParam("siteName", siteName),
+			sq.StringParam("username", username),
+			sq.StringParam("role", role),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	nbrew := &Notebrew{}
+	newTestDatabase(t, nbrew)
+	addTestMember(t, nbrew, "alice", "site", roleAuthor)
+	addTestMember(t, nbrew, "bob", "site", roleAuthor)
+	err := nbrew.setFileAuthor(context.Background(), "@site", "notes/alice.md", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = nbrew.setFileAuthor(context.Background(), "@site", "posts/other.md", "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type TestTable struct {
+		description string
+		role        string
+		method      string
+		urlPath     string
+		want        bool
+	}
+
+	tests := []TestTable{
+		{"viewer can read", roleViewer, "GET", "notes/alice.md", true},
+		{"viewer cannot save", roleViewer, "POST", "notes/alice.md", false},
+		{"viewer cannot create notes", roleViewer, "POST", "create-note", false},
+		{"author can create notes", roleAuthor, "POST", "create-note", true},
+		{"author can create posts", roleAuthor, "POST", "create-post", true},
+		{"author cannot create categories", roleAuthor, "POST", "create-category", false},
+		{"author can save own note", roleAuthor, "POST", "notes/alice.md", true},
+		{"author cannot save other note", roleAuthor, "POST", "posts/other.md", false},
+		{"author cannot save unowned note", roleAuthor, "POST", "notes/nobody.md", false},
+		{"author can restore own note", roleAuthor, "POST", "history/notes/alice.md", true},
+		{"author cannot restore page", roleAuthor, "POST", "history/pages/index.html", false},
+		{"author cannot restore via dot dot", roleAuthor, "POST", "history/posts/../notes/alice.md/../../pages/index.html", false},
+		{"author cannot cut", roleAuthor, "POST", "cut", false},
+		{"author cannot delete", roleAuthor, "POST", "delete", false},
+		{"editor can cut", roleEditor, "POST", "cut", true},
+		{"editor can delete", roleEditor, "POST", "delete", true},
+		{"editor cannot manage members", roleEditor, "POST", "members", false},
+		{"owner can manage members", roleOwner, "POST", "members", true},
+		{"non-member cannot save", "", "POST", "notes/alice.md", false},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.description, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/admin/@site/"+tt.urlPath, nil)
+			got, err := nbrew.authorize(r, "alice", "@site", tt.role, tt.urlPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPasteAcrossSites(t *testing.T) {
+	type Response struct {
+		Pasted []string `json:"pasted"`
+		Errors []string `json:"errors"`
+	}
+	type TestTable struct {
+		description string
+		sourceRole  string
+		cut         bool
+		wantPasted  bool
+	}
+
+	tests := []TestTable{
+		{"editor can cut", roleEditor, true, true},
+		{"owner can cut", roleOwner, true, true},
+		{"author cannot cut", roleAuthor, true, false},
+		{"viewer cannot cut", roleViewer, true, false},
+		{"viewer can copy", roleViewer, false, true},
+		{"non-member cannot cut", "", true, false},
+		{"non-member cannot copy", "", false, false},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.description, func(t *testing.T) {
+			nbrew, tempDir := newTestLocalNotebrew(t, map[string]string{
+				"root/@source/notes/a.md": "a",
+			})
+			newTestDatabase(t, nbrew)
+			addTestMember(t, nbrew, "alice", "other", roleEditor)
+			if tt.sourceRole != "" {
+				addTestMember(t, nbrew, "alice", "source", tt.sourceRole)
+			}
+			// The clipboard is stored in the database, so it has to be set
+			// with setSession like cpy does.
+			w := httptest.NewRecorder()
+			err := nbrew.setSession(w, httptest.NewRequest("POST", "/admin/@source/cut/", nil), "clipboard", &clipboard{
+				Cut:        tt.cut,
+				SitePrefix: "@source",
+				Folder:     "notes",
+				Names:      []string{"a.md"},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var response Response
+			code := postForm(t, func(w http.ResponseWriter, r *http.Request) {
+				nbrew.paste(w, r, "alice", "@other")
+			}, "/admin/@other/paste/", url.Values{
+				"folder": {"notes"},
+			}, &response, w.Result().Cookies()...)
+			if code != http.StatusOK {
+				t.Fatalf("got status %d, want %d", code, http.StatusOK)
+			}
+			if pasted := len(response.Pasted) > 0; pasted != tt.wantPasted {
+				t.Fatalf("got pasted %v, want %v (errors: %q)", pasted, tt.wantPasted, response.Errors)
+			}
+			_, err = os.Stat(filepath.Join(tempDir, "root/@source/notes/a.md"))
+			if sourceExists := err == nil; sourceExists != (!tt.cut || !tt.wantPasted) {
+				t.Errorf("source exists: %v", sourceExists)
+			}
+		})
+	}
+}
+
+func TestAssignSiteOwners(t *testing.T) {
+	nbrew := &Notebrew{}
+	newTestDatabase(t, nbrew)
+	// bob's own site, which alice is also a member of.
+	addTestMember(t, nbrew, "alice", "bob", roleEditor)
+	addTestMember(t, nbrew, "bob", "bob", roleEditor)
+	// A site named after nobody.
+	addTestMember(t, nbrew, "alice", "shared", roleEditor)
+	addTestMember(t, nbrew, "bob", "shared", roleViewer)
+	addTestMember(t, nbrew, "carol", "shared", roleAuthor)
+	// A site that already has an owner.
+	addTestMember(t, nbrew, "carol", "owned", roleOwner)
+	addTestMember(t, nbrew, "alice", "owned", roleViewer)
+
+	err := assignSiteOwners(nbrew.Dialect, nbrew.DB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roles := make(map[string]map[string]string)
+	for _, siteName := range []string{"bob", "shared", "owned"} {
+		members, err := nbrew.getSiteMembers(context.Background(), siteName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		roles[siteName] = make(map[string]string)
+		for _, member := range members {
+			roles[siteName][member.Username] = member.Role
+		}
+	}
+	if diff := testutil.Diff(roles["bob"], map[string]string{"alice": roleEditor, "bob": roleOwner}); diff != "" {
+		t.Error(testutil.Callers(), diff)
+	}
+	if diff := testutil.Diff(roles["owned"], map[string]string{"alice": roleViewer, "carol": roleOwner}); diff != "" {
+		t.Error(testutil.Callers(), diff)
+	}
+	// Exactly one member of shared is made its owner, and the rest keep
+	// their roles.
+	wantRoles := map[string]string{"alice": roleEditor, "bob": roleViewer, "carol": roleAuthor}
+	owners := 0
+	for username, role := range roles["shared"] {
+		if role == roleOwner {
+			owners++
+			continue
+		}
+		if role != wantRoles[username] {
+			t.Errorf("shared: got role %q for %s, want %q", role, username, wantRoles[username])
+		}
+	}
+	if owners != 1 {
+		t.Errorf("shared: got %d owners, want 1", owners)
+	}
+}
+
+func TestHasSiteRoles(t *testing.T) {
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "notebrew.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	_, err = db.Exec("CREATE TABLE site_user (site_id BLOB, user_id BLOB)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hasSiteRoles(db) {
+		t.Error("got true before the role column was added, want false")
+	}
+	err = automigrate("sqlite", db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hasSiteRoles(db) {
+		t.Error("got false after automigrate, want true")
+	}
+}
@@ -0,0 +1,901 @@
+package nb6
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// minS3PartSize is the smallest part S3 accepts in a multipart upload (except
+// for the last part).
+const minS3PartSize = 5 << 20
+
+// S3FS is an FS backed by a bucket in an S3-compatible object storage (AWS
+// S3, MinIO, Cloudflare R2, etc). Objects are addressed using path-style URLs
+// (<Endpoint>/<Bucket>/<key>) and requests are signed with AWS Signature
+// Version 4.
+//
+// Object storage has no directories, so directories are emulated: creating a
+// directory creates an empty marker object whose key is the directory name
+// followed by a slash, and any key prefix that contains objects is also
+// treated as a directory (so buckets populated by other tools work as
+// expected).
+type S3FS struct {
+	// Endpoint is the scheme and host of the object storage e.g.
+	// https://s3.us-east-1.amazonaws.com or http://localhost:9000.
+	Endpoint string
+
+	// Region is the region of the bucket e.g. us-east-1. Object storage that
+	// doesn't have regions usually accepts us-east-1 or auto.
+	Region string
+
+	// Bucket is the name of the bucket.
+	Bucket string
+
+	// AccessKeyID and SecretAccessKey are the credentials used to sign
+	// requests.
+	AccessKeyID     string
+	SecretAccessKey string
+
+	// Prefix is prepended to every key, which allows the FS to live in a
+	// subfolder of the bucket.
+	Prefix string
+
+	// PartSize is the size of each part when uploading files in multiple
+	// parts. Files smaller than PartSize are uploaded in a single request. If
+	// zero, 8 MB is used. If less than 5 MB (the minimum imposed by S3), 5 MB
+	// is used.
+	PartSize int64
+
+	// HTTPClient is the client used to make requests. If nil,
+	// http.DefaultClient is used.
+	HTTPClient *http.Client
+}
+
+var (
+	_ StatFS      = (*S3FS)(nil)
+	_ WalkDirFS   = (*S3FS)(nil)
+	_ RemoveAllFS = (*S3FS)(nil)
+	_ CopyFS      = (*S3FS)(nil)
+)
+
+func (s3FS *S3FS) String() string {
+	return strings.TrimSuffix(s3FS.Endpoint, "/") + "/" + path.Join(s3FS.Bucket, s3FS.Prefix)
+}
+
+// key returns the object key of name.
+func (s3FS *S3FS) key(name string) string {
+	if name == "." {
+		return strings.Trim(s3FS.Prefix, "/")
+	}
+	return strings.Trim(path.Join(s3FS.Prefix, name), "/")
+}
+
+// dirPrefix returns the key prefix of everything in the directory name.
+func (s3FS *S3FS) dirPrefix(name string) string {
+	key := s3FS.key(name)
+	if key == "" {
+		return ""
+	}
+	return key + "/"
+}
+
+func (s3FS *S3FS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	if name != "." {
+		response, err := s3FS.do(context.Background(), "GET", s3FS.key(name), nil, nil, nil)
+		if err == nil {
+			modTime, _ := http.ParseTime(response.Header.Get("Last-Modified"))
+			return &s3File{
+				body: response.Body,
+				info: &s3FileInfo{
+					name:    path.Base(name),
+					size:    response.ContentLength,
+					modTime: modTime,
+				},
+			}, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+	}
+	fileInfo, err := s3FS.statDir(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return &s3Dir{s3FS: s3FS, name: name, info: fileInfo}, nil
+}
+
+// Stat returns the fs.FileInfo of name without downloading it.
+func (s3FS *S3FS) Stat(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
+	}
+	if name != "." {
+		response, err := s3FS.do(context.Background(), "HEAD", s3FS.key(name), nil, nil, nil)
+		if err == nil {
+			response.Body.Close()
+			modTime, _ := http.ParseTime(response.Header.Get("Last-Modified"))
+			return &s3FileInfo{
+				name:    path.Base(name),
+				size:    response.ContentLength,
+				modTime: modTime,
+			}, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+		}
+	}
+	fileInfo, err := s3FS.statDir(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	return fileInfo, nil
+}
+
+// statDir returns the fs.FileInfo of the directory name, which exists if it
+// has a marker object or contains any objects.
+func (s3FS *S3FS) statDir(name string) (fs.FileInfo, error) {
+	fileInfo := &s3FileInfo{name: path.Base(name), isDir: true}
+	if name == "." {
+		return fileInfo, nil
+	}
+	// Directories have no modification time, even if they have a marker
+	// object, so that they look the same whether listed or stat-ed.
+	response, err := s3FS.do(context.Background(), "HEAD", s3FS.dirPrefix(name), nil, nil, nil)
+	if err == nil {
+		response.Body.Close()
+		return fileInfo, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	result, err := s3FS.listObjects(context.Background(), s3FS.dirPrefix(name), "", "", 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Contents) == 0 {
+		return nil, fs.ErrNotExist
+	}
+	return fileInfo, nil
+}
+
+func (s3FS *S3FS) OpenReaderFrom(name string, perm fs.FileMode) (io.ReaderFrom, error) {
+	if !fs.ValidPath(name) || name == "." {
+		return nil, &fs.PathError{Op: "openreaderfrom", Path: name, Err: fs.ErrInvalid}
+	}
+	return &s3Writer{s3FS: s3FS, name: name}, nil
+}
+
+func (s3FS *S3FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	prefix := s3FS.dirPrefix(name)
+	var dirEntries []fs.DirEntry
+	exists := name == "."
+	continuationToken := ""
+	for {
+		result, err := s3FS.listObjects(context.Background(), prefix, "/", continuationToken, 0)
+		if err != nil {
+			return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+		}
+		for _, commonPrefix := range result.CommonPrefixes {
+			exists = true
+			dirEntries = append(dirEntries, fs.FileInfoToDirEntry(&s3FileInfo{
+				name:  strings.TrimSuffix(strings.TrimPrefix(commonPrefix.Prefix, prefix), "/"),
+				isDir: true,
+			}))
+		}
+		for _, object := range result.Contents {
+			exists = true
+			if object.Key == prefix {
+				// The directory marker.
+				continue
+			}
+			modTime, _ := time.Parse(time.RFC3339, object.LastModified)
+			dirEntries = append(dirEntries, fs.FileInfoToDirEntry(&s3FileInfo{
+				name:    strings.TrimPrefix(object.Key, prefix),
+				size:    object.Size,
+				modTime: modTime,
+			}))
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		continuationToken = result.NextContinuationToken
+	}
+	if !exists {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+	sort.Slice(dirEntries, func(i, j int) bool {
+		return dirEntries[i].Name() < dirEntries[j].Name()
+	})
+	return dirEntries, nil
+}
+
+func (s3FS *S3FS) Mkdir(name string, perm fs.FileMode) error {
+	if !fs.ValidPath(name) || name == "." {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrInvalid}
+	}
+	_, err := s3FS.Stat(name)
+	if err == nil {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrExist}
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	err = s3FS.checkParentDir("mkdir", name)
+	if err != nil {
+		return err
+	}
+	response, err := s3FS.do(context.Background(), "PUT", s3FS.dirPrefix(name), nil, nil, nil)
+	if err != nil {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: err}
+	}
+	response.Body.Close()
+	return nil
+}
+
+// checkParentDir checks that the parent directory of name exists.
+func (s3FS *S3FS) checkParentDir(op, name string) error {
+	parent := path.Dir(name)
+	if parent == "." {
+		return nil
+	}
+	fileInfo, err := s3FS.Stat(parent)
+	if err != nil {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	if !fileInfo.IsDir() {
+		return &fs.PathError{Op: op, Path: name, Err: syscall.ENOTDIR}
+	}
+	return nil
+}
+
+func (s3FS *S3FS) Remove(name string) error {
+	if !fs.ValidPath(name) || name == "." {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrInvalid}
+	}
+	fileInfo, err := s3FS.Stat(name)
+	if err != nil {
+		return err
+	}
+	if !fileInfo.IsDir() {
+		return s3FS.deleteObject(s3FS.key(name))
+	}
+	result, err := s3FS.listObjects(context.Background(), s3FS.dirPrefix(name), "", "", 2)
+	if err != nil {
+		return &fs.PathError{Op: "remove", Path: name, Err: err}
+	}
+	for _, object := range result.Contents {
+		if object.Key != s3FS.dirPrefix(name) {
+			return &fs.PathError{Op: "remove", Path: name, Err: syscall.ENOTEMPTY}
+		}
+	}
+	return s3FS.deleteObject(s3FS.dirPrefix(name))
+}
+
+// RemoveAll removes name and everything inside it. If name does not exist,
+// RemoveAll does nothing.
+func (s3FS *S3FS) RemoveAll(name string) error {
+	if !fs.ValidPath(name) || name == "." {
+		return &fs.PathError{Op: "removeall", Path: name, Err: fs.ErrInvalid}
+	}
+	err := s3FS.deleteObject(s3FS.key(name))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return s3FS.walkObjects(s3FS.dirPrefix(name), func(object s3Object) error {
+		return s3FS.deleteObject(object.Key)
+	})
+}
+
+func (s3FS *S3FS) Rename(oldname, newname string) error {
+	if !fs.ValidPath(oldname) || oldname == "." {
+		return &fs.PathError{Op: "rename", Path: oldname, Err: fs.ErrInvalid}
+	}
+	if !fs.ValidPath(newname) || newname == "." {
+		return &fs.PathError{Op: "rename", Path: newname, Err: fs.ErrInvalid}
+	}
+	oldFileInfo, err := s3FS.Stat(oldname)
+	if err != nil {
+		return err
+	}
+	newFileInfo, err := s3FS.Stat(newname)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if newFileInfo != nil && newFileInfo.IsDir() {
+		return &fs.PathError{Op: "rename", Path: newname, Err: fs.ErrExist}
+	}
+	err = s3FS.checkParentDir("rename", newname)
+	if err != nil {
+		return err
+	}
+	if !oldFileInfo.IsDir() {
+		err = s3FS.copyObject(s3FS.key(oldname), s3FS.key(newname))
+		if err != nil {
+			return err
+		}
+		return s3FS.deleteObject(s3FS.key(oldname))
+	}
+	// Object storage can't rename a prefix, so every object in the directory
+	// is copied over and then deleted.
+	oldPrefix, newPrefix := s3FS.dirPrefix(oldname), s3FS.dirPrefix(newname)
+	hasMarker := false
+	err = s3FS.walkObjects(oldPrefix, func(object s3Object) error {
+		if object.Key == oldPrefix {
+			hasMarker = true
+		}
+		err := s3FS.copyObject(object.Key, newPrefix+strings.TrimPrefix(object.Key, oldPrefix))
+		if err != nil {
+			return err
+		}
+		return s3FS.deleteObject(object.Key)
+	})
+	if err != nil {
+		return err
+	}
+	if !hasMarker {
+		response, err := s3FS.do(context.Background(), "PUT", newPrefix, nil, nil, nil)
+		if err != nil {
+			return &fs.PathError{Op: "rename", Path: newname, Err: err}
+		}
+		response.Body.Close()
+	}
+	return nil
+}
+
+// WalkDir walks the file tree rooted at root like fs.WalkDir, but lists every
+// object in it in as few requests as possible instead of listing each
+// directory.
+func (s3FS *S3FS) WalkDir(root string, fn fs.WalkDirFunc) error {
+	fileInfo, err := s3FS.Stat(root)
+	if err != nil {
+		err = fn(root, nil, err)
+		if err == fs.SkipDir || err == fs.SkipAll {
+			return nil
+		}
+		return err
+	}
+	rootEntry := fs.FileInfoToDirEntry(fileInfo)
+	if !fileInfo.IsDir() {
+		return walkDirEntries(root, rootEntry, nil, fn)
+	}
+	children := make(map[string][]fs.DirEntry)
+	seenDirs := make(map[string]bool)
+	// addDir adds the directory name (and its parents) to the children of its
+	// parent, since directories without a marker only show up as part of the
+	// keys of the objects inside them.
+	var addDir func(name string)
+	addDir = func(name string) {
+		if name == root || seenDirs[name] {
+			return
+		}
+		seenDirs[name] = true
+		addDir(path.Dir(name))
+		children[path.Dir(name)] = append(children[path.Dir(name)], fs.FileInfoToDirEntry(&s3FileInfo{
+			name:  path.Base(name),
+			isDir: true,
+		}))
+	}
+	prefix := s3FS.dirPrefix(root)
+	err = s3FS.walkObjects(prefix, func(object s3Object) error {
+		relativePath := strings.TrimPrefix(object.Key, prefix)
+		if relativePath == "" {
+			return nil
+		}
+		if strings.HasSuffix(relativePath, "/") {
+			addDir(path.Join(root, relativePath))
+			return nil
+		}
+		name := path.Join(root, relativePath)
+		addDir(path.Dir(name))
+		modTime, _ := time.Parse(time.RFC3339, object.LastModified)
+		children[path.Dir(name)] = append(children[path.Dir(name)], fs.FileInfoToDirEntry(&s3FileInfo{
+			name:    path.Base(name),
+			size:    object.Size,
+			modTime: modTime,
+		}))
+		return nil
+	})
+	if err != nil {
+		return &fs.PathError{Op: "walkdir", Path: root, Err: err}
+	}
+	return walkDirEntries(root, rootEntry, children, fn)
+}
+
+// Copy copies srcName to destName using server-side copies, so the contents
+// are never downloaded.
+func (s3FS *S3FS) Copy(srcName, destName string) error {
+	if !fs.ValidPath(srcName) || srcName == "." {
+		return &fs.PathError{Op: "copy", Path: srcName, Err: fs.ErrInvalid}
+	}
+	if !fs.ValidPath(destName) || destName == "." {
+		return &fs.PathError{Op: "copy", Path: destName, Err: fs.ErrInvalid}
+	}
+	srcFileInfo, err := s3FS.Stat(srcName)
+	if err != nil {
+		return err
+	}
+	destFileInfo, err := s3FS.Stat(destName)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if destFileInfo != nil && (destFileInfo.IsDir() || srcFileInfo.IsDir()) {
+		return &fs.PathError{Op: "copy", Path: destName, Err: fs.ErrExist}
+	}
+	err = s3FS.checkParentDir("copy", destName)
+	if err != nil {
+		return err
+	}
+	if !srcFileInfo.IsDir() {
+		return s3FS.copyObject(s3FS.key(srcName), s3FS.key(destName))
+	}
+	srcPrefix, destPrefix := s3FS.dirPrefix(srcName), s3FS.dirPrefix(destName)
+	if strings.HasPrefix(destPrefix, srcPrefix) {
+		// A directory can't be copied into itself.
+		return &fs.PathError{Op: "copy", Path: destName, Err: fs.ErrInvalid}
+	}
+	response, err := s3FS.do(context.Background(), "PUT", destPrefix, nil, nil, nil)
+	if err != nil {
+		return &fs.PathError{Op: "copy", Path: destName, Err: err}
+	}
+	response.Body.Close()
+	return s3FS.walkObjects(srcPrefix, func(object s3Object) error {
+		if object.Key == srcPrefix {
+			return nil
+		}
+		return s3FS.copyObject(object.Key, destPrefix+strings.TrimPrefix(object.Key, srcPrefix))
+	})
+}
+
+// walkObjects calls fn for every object whose key starts with prefix.
+func (s3FS *S3FS) walkObjects(prefix string, fn func(object s3Object) error) error {
+	continuationToken := ""
+	for {
+		result, err := s3FS.listObjects(context.Background(), prefix, "", continuationToken, 0)
+		if err != nil {
+			return err
+		}
+		for _, object := range result.Contents {
+			err = fn(object)
+			if err != nil {
+				return err
+			}
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return nil
+		}
+		continuationToken = result.NextContinuationToken
+	}
+}
+
+func (s3FS *S3FS) deleteObject(key string) error {
+	response, err := s3FS.do(context.Background(), "DELETE", key, nil, nil, nil)
+	if err != nil {
+		return &fs.PathError{Op: "remove", Path: key, Err: err}
+	}
+	response.Body.Close()
+	return nil
+}
+
+func (s3FS *S3FS) copyObject(srcKey, destKey string) error {
+	header := http.Header{}
+	header.Set("X-Amz-Copy-Source", "/"+s3FS.Bucket+"/"+awsURIEncode(srcKey, false))
+	response, err := s3FS.do(context.Background(), "PUT", destKey, nil, header, nil)
+	if err != nil {
+		return &fs.PathError{Op: "copy", Path: srcKey, Err: err}
+	}
+	defer response.Body.Close()
+	// CopyObject may fail after it has already responded with 200 OK, in
+	// which case the error is in the body.
+	b, err := io.ReadAll(response.Body)
+	if err != nil {
+		return &fs.PathError{Op: "copy", Path: srcKey, Err: err}
+	}
+	if bytes.Contains(b, []byte("<Error>")) {
+		return &fs.PathError{Op: "copy", Path: srcKey, Err: parseS3Error(response.StatusCode, b)}
+	}
+	return nil
+}
+
+type s3Object struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	Size         int64  `xml:"Size"`
+}
+
+type s3ListBucketResult struct {
+	IsTruncated           bool       `xml:"IsTruncated"`
+	NextContinuationToken string     `xml:"NextContinuationToken"`
+	Contents              []s3Object `xml:"Contents"`
+	CommonPrefixes        []struct {
+		Prefix string `xml:"Prefix"`
+	} `xml:"CommonPrefixes"`
+}
+
+// listObjects lists the objects whose keys start with prefix using
+// ListObjectsV2. If maxKeys is zero, the default maximum (1000) is used.
+func (s3FS *S3FS) listObjects(ctx context.Context, prefix, delimiter, continuationToken string, maxKeys int) (*s3ListBucketResult, error) {
+	query := url.Values{
+		"list-type": []string{"2"},
+		"prefix":    []string{prefix},
+	}
+	if delimiter != "" {
+		query.Set("delimiter", delimiter)
+	}
+	if continuationToken != "" {
+		query.Set("continuation-token", continuationToken)
+	}
+	if maxKeys > 0 {
+		query.Set("max-keys", strconv.Itoa(maxKeys))
+	}
+	response, err := s3FS.do(ctx, "GET", "", query, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	var result s3ListBucketResult
+	err = xml.NewDecoder(response.Body).Decode(&result)
+	if err != nil {
+		return nil, fmt.Errorf("decoding ListObjectsV2 response: %w", err)
+	}
+	return &result, nil
+}
+
+// s3Error is an error returned by the object storage.
+type s3Error struct {
+	StatusCode int
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *s3Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("%d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("%d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// Is makes 404 Not Found errors match fs.ErrNotExist.
+func (e *s3Error) Is(target error) bool {
+	return target == fs.ErrNotExist && e.StatusCode == http.StatusNotFound
+}
+
+func parseS3Error(statusCode int, b []byte) error {
+	s3Err := &s3Error{StatusCode: statusCode}
+	_ = xml.Unmarshal(b, s3Err)
+	return s3Err
+}
+
+// do makes a signed request for the object key (or the bucket itself if key is
+// empty). Responses that are not 2xx are returned as an *s3Error. The caller
+// is responsible for closing the response body.
+func (s3FS *S3FS) do(ctx context.Context, method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	canonicalURI := "/" + awsURIEncode(s3FS.Bucket, true) + "/" + awsURIEncode(key, false)
+	if key == "" {
+		canonicalURI = "/" + awsURIEncode(s3FS.Bucket, true)
+	}
+	requestURL, err := url.Parse(strings.TrimSuffix(s3FS.Endpoint, "/") + canonicalURI)
+	if err != nil {
+		return nil, err
+	}
+	requestURL.RawQuery = awsCanonicalQuery(query)
+	request, err := http.NewRequestWithContext(ctx, method, requestURL.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		request.Header[name] = values
+	}
+	signAWSRequest(request, body, s3FS.Region, "s3", s3FS.AccessKeyID, s3FS.SecretAccessKey, time.Now())
+	client := s3FS.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode >= 200 && response.StatusCode <= 299 {
+		return response, nil
+	}
+	defer response.Body.Close()
+	b, _ := io.ReadAll(io.LimitReader(response.Body, 1<<20))
+	return nil, parseS3Error(response.StatusCode, b)
+}
+
+// signAWSRequest signs a request using AWS Signature Version 4.
+// https://docs.aws.amazon.com/IAM/latest/UserGuide/create-signed-request.html
+func signAWSRequest(request *http.Request, body []byte, region, service, accessKeyID, secretAccessKey string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	payloadHash := sha256.Sum256(body)
+	request.Header.Set("X-Amz-Date", amzDate)
+	request.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+
+	// The host and every x-amz-* header are signed, as well as the few
+	// standard headers that S3 requires to be signed if present.
+	host := request.Host
+	if host == "" {
+		host = request.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for name, values := range request.Header {
+		name = strings.ToLower(name)
+		if name == "content-type" || name == "content-md5" || name == "range" || strings.HasPrefix(name, "x-amz-") {
+			headers[name] = strings.Join(strings.Fields(strings.Join(values, ",")), " ")
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := request.Method + "\n" +
+		request.URL.EscapedPath() + "\n" +
+		awsCanonicalQuery(request.URL.Query()) + "\n" +
+		canonicalHeaders.String() + "\n" +
+		signedHeaders + "\n" +
+		hex.EncodeToString(payloadHash[:])
+	canonicalRequestHash := sha256.Sum256([]byte(canonicalRequest))
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalRequestHash[:])
+
+	signingKey := hmacSHA256([]byte("AWS4"+secretAccessKey), date)
+	signingKey = hmacSHA256(signingKey, region)
+	signingKey = hmacSHA256(signingKey, service)
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+	request.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+accessKeyID+"/"+scope+", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// awsURIEncode percent-encodes every byte of s except the unreserved
+// characters (and slashes, unless encodeSlash is true), as required by AWS
+// Signature Version 4.
+func awsURIEncode(s string, encodeSlash bool) string {
+	const hexDigits = "0123456789ABCDEF"
+	var b strings.Builder
+	b.Grow(len(s))
+	for i := 0; i < len(s); i++ {
+		char := s[i]
+		if (char >= 'A' && char <= 'Z') || (char >= 'a' && char <= 'z') || (char >= '0' && char <= '9') ||
+			char == '-' || char == '_' || char == '.' || char == '~' || (char == '/' && !encodeSlash) {
+			b.WriteByte(char)
+			continue
+		}
+		b.WriteByte('%')
+		b.WriteByte(hexDigits[char>>4])
+		b.WriteByte(hexDigits[char&15])
+	}
+	return b.String()
+}
+
+// awsCanonicalQuery encodes query sorted by key (then value) as required by
+// AWS Signature Version 4.
+func awsCanonicalQuery(query url.Values) string {
+	pairs := make([]string, 0, len(query))
+	for key, values := range query {
+		for _, value := range values {
+			pairs = append(pairs, awsURIEncode(key, true)+"="+awsURIEncode(value, true))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// s3Writer is the io.ReaderFrom returned by S3FS.OpenReaderFrom.
+type s3Writer struct {
+	s3FS *S3FS
+	name string
+}
+
+// ReadFrom uploads the contents of r. Contents smaller than PartSize are
+// uploaded in a single request, otherwise they are uploaded in parts using a
+// multipart upload so that only one part is held in memory at a time.
+func (s3Writer *s3Writer) ReadFrom(r io.Reader) (n int64, err error) {
+	s3FS := s3Writer.s3FS
+	err = s3FS.checkParentDir("open", s3Writer.name)
+	if err != nil {
+		return 0, err
+	}
+	partSize := s3FS.PartSize
+	if partSize <= 0 {
+		partSize = 8 << 20
+	} else if partSize < minS3PartSize {
+		partSize = minS3PartSize
+	}
+	key := s3FS.key(s3Writer.name)
+	buf := make([]byte, partSize)
+	size, err := io.ReadFull(r, buf)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return 0, err
+	}
+	if err != nil {
+		response, err := s3FS.do(context.Background(), "PUT", key, nil, nil, buf[:size])
+		if err != nil {
+			return 0, &fs.PathError{Op: "write", Path: s3Writer.name, Err: err}
+		}
+		response.Body.Close()
+		return int64(size), nil
+	}
+
+	response, err := s3FS.do(context.Background(), "POST", key, url.Values{"uploads": []string{""}}, nil, nil)
+	if err != nil {
+		return 0, &fs.PathError{Op: "write", Path: s3Writer.name, Err: err}
+	}
+	var initiateResult struct {
+		UploadID string `xml:"UploadId"`
+	}
+	err = xml.NewDecoder(response.Body).Decode(&initiateResult)
+	response.Body.Close()
+	if err != nil {
+		return 0, &fs.PathError{Op: "write", Path: s3Writer.name, Err: err}
+	}
+	uploadID := initiateResult.UploadID
+	type Part struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	}
+	var parts []Part
+	abort := func(err error) (int64, error) {
+		response, abortErr := s3FS.do(context.Background(), "DELETE", key, url.Values{"uploadId": []string{uploadID}}, nil, nil)
+		if abortErr == nil {
+			response.Body.Close()
+		}
+		return 0, &fs.PathError{Op: "write", Path: s3Writer.name, Err: err}
+	}
+	for {
+		partNumber := len(parts) + 1
+		response, err := s3FS.do(context.Background(), "PUT", key, url.Values{
+			"partNumber": []string{strconv.Itoa(partNumber)},
+			"uploadId":   []string{uploadID},
+		}, nil, buf[:size])
+		if err != nil {
+			return abort(err)
+		}
+		response.Body.Close()
+		parts = append(parts, Part{PartNumber: partNumber, ETag: response.Header.Get("ETag")})
+		n += int64(size)
+		size, err = io.ReadFull(r, buf)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if !errors.Is(err, io.ErrUnexpectedEOF) {
+				return abort(err)
+			}
+		}
+	}
+	completeBody, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []Part   `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return abort(err)
+	}
+	response, err = s3FS.do(context.Background(), "POST", key, url.Values{"uploadId": []string{uploadID}}, nil, completeBody)
+	if err != nil {
+		return abort(err)
+	}
+	defer response.Body.Close()
+	// Like CopyObject, CompleteMultipartUpload may report an error in the
+	// body of a 200 OK response.
+	b, err := io.ReadAll(response.Body)
+	if err != nil {
+		return abort(err)
+	}
+	if bytes.Contains(b, []byte("<Error>")) {
+		return abort(parseS3Error(response.StatusCode, b))
+	}
+	return n, nil
+}
+
+// s3File is a file opened by S3FS.Open.
+type s3File struct {
+	body io.ReadCloser
+	info *s3FileInfo
+}
+
+func (file *s3File) Read(p []byte) (int, error) { return file.body.Read(p) }
+
+func (file *s3File) Stat() (fs.FileInfo, error) { return file.info, nil }
+
+func (file *s3File) Close() error { return file.body.Close() }
+
+// s3Dir is a directory opened by S3FS.Open.
+type s3Dir struct {
+	s3FS       *S3FS
+	name       string
+	info       fs.FileInfo
+	dirEntries []fs.DirEntry
+	offset     int
+	read       bool
+}
+
+func (dir *s3Dir) Read(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: dir.name, Err: syscall.EISDIR}
+}
+
+func (dir *s3Dir) Stat() (fs.FileInfo, error) { return dir.info, nil }
+
+func (dir *s3Dir) Close() error { return nil }
+
+func (dir *s3Dir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !dir.read {
+		dirEntries, err := dir.s3FS.ReadDir(dir.name)
+		if err != nil {
+			return nil, err
+		}
+		dir.dirEntries, dir.read = dirEntries, true
+	}
+	remaining := dir.dirEntries[dir.offset:]
+	if n <= 0 {
+		dir.offset = len(dir.dirEntries)
+		return remaining, nil
+	}
+	if len(remaining) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(remaining) {
+		n = len(remaining)
+	}
+	dir.offset += n
+	return remaining[:n], nil
+}
+
+// s3FileInfo is the fs.FileInfo of an object or emulated directory.
+type s3FileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	isDir   bool
+}
+
+func (info *s3FileInfo) Name() string { return info.name }
+
+func (info *s3FileInfo) Size() int64 { return info.size }
+
+func (info *s3FileInfo) Mode() fs.FileMode {
+	if info.isDir {
+		return fs.ModeDir | 0755
+	}
+	return 0644
+}
+
+func (info *s3FileInfo) ModTime() time.Time { return info.modTime }
+
+func (info *s3FileInfo) IsDir() bool { return info.isDir }
+
+func (info *s3FileInfo) Sys() any { return nil }
@@ -0,0 +1,105 @@
+package nb6
+
+import (
+	"errors"
+	"io/fs"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bokwoon95/nb6/internal/testutil"
+)
+
+// newTestS3FS returns an S3FS backed by a fake S3 server that lives for the
+// duration of the test.
+func newTestS3FS(t *testing.T) (*S3FS, *testutil.S3Server) {
+	t.Helper()
+	s3Server := testutil.NewS3Server("access-key-id", "secret-access-key")
+	server := httptest.NewServer(s3Server)
+	t.Cleanup(server.Close)
+	s3FS := &S3FS{
+		Endpoint:        server.URL,
+		Region:          "us-east-1",
+		Bucket:          "bucket",
+		AccessKeyID:     "access-key-id",
+		SecretAccessKey: "secret-access-key",
+		Prefix:          "prefix",
+		HTTPClient:      server.Client(),
+	}
+	return s3FS, s3Server
+}
+
+func TestS3FS(t *testing.T) {
+	s3FS, s3Server := newTestS3FS(t)
+	s3FS.PartSize = 5 << 20
+	testFS(t, s3FS)
+	// Everything lives under the prefix, and emptied directories keep their
+	// markers.
+	wantKeys := []string{"prefix/notes/", "prefix/notes/large.bin", "prefix/posts/", "prefix/posts/a.md"}
+	if diff := testutil.Diff(s3Server.Keys("bucket"), wantKeys); diff != "" {
+		t.Error(testutil.Callers(), diff)
+	}
+}
+
+func TestS3FSDirectoryWithoutMarker(t *testing.T) {
+	s3FS, s3Server := newTestS3FS(t)
+	// Buckets populated by other tools often have no directory markers.
+	s3FS.Prefix = ""
+	for _, dir := range []string{"notes", "notes/dir"} {
+		err := s3FS.Mkdir(dir, 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFSFile(t, s3FS, "notes/dir/a.md", "a")
+	err := s3FS.deleteObject("notes/dir/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileInfo, err := s3FS.Stat("notes/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fileInfo.IsDir() {
+		t.Error("notes/dir is not a directory")
+	}
+	err = s3FS.Rename("notes/dir", "notes/renamed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The renamed directory gets a marker so that it outlives its files.
+	if diff := testutil.Diff(s3Server.Keys("bucket"), []string{"notes/", "notes/renamed/", "notes/renamed/a.md"}); diff != "" {
+		t.Error(testutil.Callers(), diff)
+	}
+}
+
+func TestS3FSSignature(t *testing.T) {
+	s3FS, s3Server := newTestS3FS(t)
+	s3FS.SecretAccessKey = "wrong-secret-access-key"
+	_, err := s3FS.Open("notes/a.md")
+	if err == nil || errors.Is(err, fs.ErrNotExist) || !strings.Contains(err.Error(), "SignatureDoesNotMatch") {
+		t.Errorf("got error %v, want SignatureDoesNotMatch", err)
+	}
+	err = s3FS.Mkdir("notes", 0755)
+	if err == nil {
+		t.Error("mkdir with the wrong secret access key succeeded")
+	}
+	if keys := s3Server.Keys("bucket"); len(keys) > 0 {
+		t.Errorf("got keys %v, want none", keys)
+	}
+}
+
+func TestS3FSPartSizeBelowMinimum(t *testing.T) {
+	s3FS, _ := newTestS3FS(t)
+	// The fake S3 server rejects parts smaller than 5 MB like S3 does.
+	s3FS.PartSize = 1 << 20
+	err := s3FS.Mkdir("notes", 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents := strings.Repeat("a", 6<<20)
+	writeFSFile(t, s3FS, "notes/large.bin", contents)
+	if got := readFSFile(t, s3FS, "notes/large.bin"); got != contents {
+		t.Errorf("got %d bytes back, want %d", len(got), len(contents))
+	}
+}
@@ -47,6 +47,17 @@ func automigrate(dialect string, db *sql.DB) error {
 	return nil
 }
 
+// createSearchIndex creates the FTS5 table that is the search index for
+// SQLite. SQLite virtual tables are not managed by automigrate, unlike the
+// search indexes for postgres and mysql which are regular tables.
+func createSearchIndex(dialect string, db *sql.DB) error {
+	if db == nil || dialect != "sqlite" {
+		return nil
+	}
+	_, err := db.Exec("CREATE VIRTUAL TABLE IF NOT EXISTS file_index USING fts5 (site_name UNINDEXED, file_path UNINDEXED, title, body)")
+	return err
+}
+
 type SITE struct {
 	sq.TableStruct
 	SITE_ID   sq.UUIDField   `ddl:"primarykey"`
@@ -62,16 +73,64 @@ type USERS struct {
 	RESET_TOKEN_HASH sq.BinaryField `ddl:"mysql:type=BINARY(40) unique"`
 }
 
+// SITE_USER is the membership of a user in a site. ROLE is one of owner,
+// editor, author or viewer (see authorize). Every site has an owner.
 type SITE_USER struct {
 	sq.TableStruct `ddl:"primarykey=site_id,user_id"`
-	SITE_ID        sq.UUIDField `ddl:"references={site onupdate=cascade}"`
-	USER_ID        sq.UUIDField `ddl:"references={users onupdate=cascade index}"`
+	SITE_ID        sq.UUIDField   `ddl:"references={site onupdate=cascade}"`
+	USER_ID        sq.UUIDField   `ddl:"references={users onupdate=cascade index}"`
+	ROLE           sq.StringField `ddl:"notnull len=20 default='editor'"`
+}
+
+// INVITE is an invitation for EMAIL to become a member of a site with ROLE.
+// The invite token is single-use and hashed the same way as the reset token
+// of USERS.
+type INVITE struct {
+	sq.TableStruct    `ddl:"unique=site_id,email"`
+	INVITE_TOKEN_HASH sq.BinaryField `ddl:"mysql:type=BINARY(40) primarykey"`
+	SITE_ID           sq.UUIDField   `ddl:"notnull references={site onupdate=cascade}"`
+	EMAIL             sq.StringField `ddl:"notnull len=500"`
+	ROLE              sq.StringField `ddl:"notnull len=20 default='editor'"`
 }
 
+// FILE_AUTHOR is the user who created a note or post. FILE_PATH includes the
+// site prefix. Members who are authors can only edit the files they created.
+type FILE_AUTHOR struct {
+	sq.TableStruct
+	FILE_PATH sq.StringField `ddl:"len=500 primarykey"`
+	USER_ID   sq.UUIDField   `ddl:"notnull references={users onupdate=cascade index}"`
+}
+
+// AUTHENTICATION is a login session of a user on a device. The time it was
+// created is in the first 8 bytes of AUTHENTICATION_TOKEN_HASH.
 type AUTHENTICATION struct {
 	sq.TableStruct
 	AUTHENTICATION_TOKEN_HASH sq.BinaryField `ddl:"mysql:type=BINARY(40) primarykey"`
 	USER_ID                   sq.UUIDField   `ddl:"notnull references={users onupdate=cascade index}"`
+	LAST_ACTIVE_TIME          sq.TimeField
+	USER_AGENT                sq.StringField `ddl:"len=500"`
+	IP_ADDRESS                sq.StringField `ddl:"len=45"`
+}
+
+// API_TOKEN is a long-lived authentication token created by a user for
+// scripts. A READ_ONLY token only gets viewer access to its sites.
+type API_TOKEN struct {
+	sq.TableStruct `ddl:"unique=user_id,token_name"`
+	API_TOKEN_HASH sq.BinaryField  `ddl:"mysql:type=BINARY(40) primarykey"`
+	USER_ID        sq.UUIDField    `ddl:"notnull references={users onupdate=cascade}"`
+	TOKEN_NAME     sq.StringField  `ddl:"notnull len=500"`
+	READ_ONLY      sq.BooleanField `ddl:"notnull default=false"`
+	CREATION_TIME  sq.TimeField    `ddl:"notnull"`
+	LAST_USED_TIME sq.TimeField
+	EXPIRY_TIME    sq.TimeField
+}
+
+// API_TOKEN_SITE restricts an API token to a site. A token without any
+// API_TOKEN_SITE rows can be used on every site of its user.
+type API_TOKEN_SITE struct {
+	sq.TableStruct `ddl:"primarykey=api_token_hash,site_name"`
+	API_TOKEN_HASH sq.BinaryField `ddl:"mysql:type=BINARY(40) references={api_token onupdate=cascade}"`
+	SITE_NAME      sq.StringField `ddl:"len=500"`
 }
 
 type SESSION struct {
@@ -79,3 +138,48 @@ type SESSION struct {
 	SESSION_TOKEN_HASH sq.BinaryField `ddl:"mysql:type=BINARY(40) primarykey"`
 	DATA               sq.JSONField
 }
+
+// FILE_INDEX is the full-text search index of the notes, posts and pages of
+// every site. In SQLite it is an FTS5 table created by createSearchIndex.
+type FILE_INDEX struct {
+	sq.TableStruct `ddl:"virtual"`
+	SITE_NAME      sq.StringField `ddl:"notnull len=500 index"`
+	FILE_PATH      sq.StringField `ddl:"notnull len=500"`
+	TITLE          sq.StringField `ddl:"mysql:type=TEXT"`
+	BODY           sq.StringField `ddl:"mysql:type=MEDIUMTEXT"`
+	FTS            sq.AnyField    `ddl:"dialect=postgres type=TSVECTOR index={. using=gin}"`
+	_              struct{}       `ddl:"mysql:index={title,body using=fulltext}"`
+}
+
+// FILES is the files and directories of a DatabaseFS. PARENT_ID is not a
+// foreign key so that a whole subtree can be deleted in a single statement.
+type FILES struct {
+	sq.TableStruct
+	FILE_ID   sq.UUIDField    `ddl:"primarykey"`
+	PARENT_ID sq.UUIDField    `ddl:"index"`
+	FILE_PATH sq.StringField  `ddl:"notnull len=500 unique mysql:collate=utf8mb4_bin postgres:collate=C sqlserver:collate=Latin1_General_100_BIN2_UTF8"`
+	IS_DIR    sq.BooleanField `ddl:"notnull"`
+	SIZE      sq.NumberField  `ddl:"type=BIGINT notnull default=0"`
+	MOD_TIME  sq.TimeField    `ddl:"notnull"`
+}
+
+// FILE_CHUNK is the contents of a file in a DatabaseFS, split into chunks so
+// that large files can be written and read without holding them entirely in
+// memory.
+type FILE_CHUNK struct {
+	sq.TableStruct `ddl:"primarykey=file_id,chunk_num"`
+	FILE_ID        sq.UUIDField `ddl:"references={files onupdate=cascade}"`
+	CHUNK_NUM      sq.NumberField
+	DATA           sq.BinaryField `ddl:"notnull"`
+}
+
+// FILE_VERSION is a prior version of a file, kept by the version history if
+// there is a database. DATA is the gzipped contents of the file.
+type FILE_VERSION struct {
+	sq.TableStruct
+	VERSION_ID sq.UUIDField   `ddl:"primarykey"`
+	SITE_NAME  sq.StringField `ddl:"notnull len=500"`
+	FILE_PATH  sq.StringField `ddl:"notnull len=500 index"`
+	MOD_TIME   sq.TimeField   `ddl:"notnull"`
+	DATA       sq.BinaryField `ddl:"notnull"`
+}
@@ -0,0 +1,508 @@
+package nb6
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"html/template"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/bokwoon95/sq"
+	"golang.org/x/exp/slog"
+)
+
+// maxSearchResults is the maximum number of results returned by a search.
+const maxSearchResults = 100
+
+// isSearchable reports whether a file (relative to the sitePrefix) is
+// searchable. Only the markdown files in notes/ and posts/ and the HTML files
+// in pages/ are searchable.
+func isSearchable(name string) bool {
+	head, _, _ := strings.Cut(name, "/")
+	switch head {
+	case "notes", "posts":
+		return path.Ext(name) == ".md"
+	case "pages":
+		return path.Ext(name) == ".html"
+	}
+	return false
+}
+
+// getSearchDocument returns the title and body of a searchable file. The
+// title of a markdown file comes from its front matter or its first line, the
+// title of an HTML file comes from its <title> or first <h1> element. The body
+// of an HTML file is its text with the tags and template actions removed.
+func getSearchDocument(name string, text []byte) (title, body string) {
+	if path.Ext(name) == ".md" {
+		frontMatter, markdown, _ := parseFrontMatter(text)
+		title, _ = getTitleAndPreview(io.NopCloser(bytes.NewReader(markdown)))
+		if frontMatter.Title != "" {
+			title = frontMatter.Title
+		}
+		return title, string(markdown)
+	}
+	for _, element := range []string{"title", "h1"} {
+		_, after, ok := strings.Cut(string(text), "<"+element)
+		if !ok {
+			continue
+		}
+		_, after, ok = strings.Cut(after, ">")
+		if !ok {
+			continue
+		}
+		before, _, ok := strings.Cut(after, "</"+element+">")
+		if !ok {
+			continue
+		}
+		title = strings.Join(strings.Fields(html.UnescapeString(stripHTML(before))), " ")
+		if title != "" {
+			break
+		}
+	}
+	return title, html.UnescapeString(stripHTML(string(text)))
+}
+
+// stripHTML removes the tags, comments and template actions from an HTML
+// document as well as the contents of any <script> and <style> elements.
+func stripHTML(s string) string {
+	var b strings.Builder
+	b.Grow(len(s))
+	for len(s) > 0 {
+		var end string
+		switch {
+		case strings.HasPrefix(s, "{{"):
+			end = "}}"
+		case strings.HasPrefix(s, "<!--"):
+			end = "-->"
+		case hasPrefixFold(s, "<script"):
+			end = "</script>"
+		case hasPrefixFold(s, "<style"):
+			end = "</style>"
+		case strings.HasPrefix(s, "<"):
+			end = ">"
+		default:
+			i := strings.IndexAny(s, "<{")
+			if i < 0 {
+				b.WriteString(s)
+				return b.String()
+			}
+			if i == 0 {
+				// A lone '{' that does not start a template action.
+				i = 1
+			}
+			b.WriteString(s[:i])
+			s = s[i:]
+			continue
+		}
+		i := indexFold(s, end)
+		if i < 0 {
+			break
+		}
+		s = s[i+len(end):]
+		b.WriteByte(' ')
+	}
+	return b.String()
+}
+
+func hasPrefixFold(s, prefix string) bool {
+	return len(s) >= len(prefix) && strings.EqualFold(s[:len(prefix)], prefix)
+}
+
+func indexFold(s, substr string) int {
+	for i := 0; i+len(substr) <= len(s); i++ {
+		if strings.EqualFold(s[i:i+len(substr)], substr) {
+			return i
+		}
+	}
+	return -1
+}
+
+// walkSearchableFiles calls fn for every searchable file in the named file or
+// folder (relative to the sitePrefix). If name is empty, every searchable file
+// in the site is walked.
+func (nbrew *Notebrew) walkSearchableFiles(sitePrefix, name string, fn func(name string, text []byte) error) error {
+	roots := []string{name}
+	if name == "" {
+		roots = []string{"notes", "pages", "posts"}
+	}
+	for _, root := range roots {
+		err := walkDir(nbrew.FS, path.Join(sitePrefix, root), func(filePath string, dirEntry fs.DirEntry, err error) error {
+			if err != nil {
+				if errors.Is(err, fs.ErrNotExist) {
+					return nil
+				}
+				return err
+			}
+			if dirEntry.IsDir() {
+				return nil
+			}
+			name := strings.TrimPrefix(strings.TrimPrefix(filePath, sitePrefix), "/")
+			if !isSearchable(name) {
+				return nil
+			}
+			text, err := readFile(nbrew.FS, filePath)
+			if err != nil {
+				return err
+			}
+			return fn(name, []byte(text))
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// indexSearchableFiles updates the search index for the named file or folder
+// (relative to the sitePrefix). The old entries for the name are removed and
+// every searchable file that still exists under the name is indexed again, so
+// it handles creates, edits and deletes alike. It does nothing if the search
+// index is not enabled.
+func (nbrew *Notebrew) indexSearchableFiles(ctx context.Context, sitePrefix, name string) error {
+	if !nbrew.SearchIndex {
+		return nil
+	}
+	siteName := strings.TrimPrefix(sitePrefix, "@")
+	// Everything inside a folder sorts between "folder/" and "folder0" ('0'
+	// is the character after '/'), which avoids having to escape the name
+	// for a LIKE pattern.
+	var err error
+	if name == "" {
+		_, err = sq.ExecContext(ctx, nbrew.DB, sq.CustomQuery{
+			Dialect: nbrew.Dialect,
+			Format:  "DELETE FROM file_index WHERE site_name = {siteName}",
+			Values: []any{
+				sq.StringParam("siteName", siteName),
+			},
+		})
+	} else {
+		_, err = sq.ExecContext(ctx, nbrew.DB, sq.CustomQuery{
+			Dialect: nbrew.Dialect,
+			Format: "DELETE FROM file_index WHERE site_name = {siteName}" +
+				" AND (file_path = {name} OR (file_path >= {lowerBound} AND file_path < {upperBound}))",
+			Values: []any{
+				sq.StringParam("siteName", siteName),
+				sq.StringParam("name", name),
+				sq.StringParam("lowerBound", name+"/"),
+				sq.StringParam("upperBound", name+"0"),
+			},
+		})
+	}
+	if err != nil {
+		return fmt.Errorf("removing %q from the search index: %w", path.Join(sitePrefix, name), err)
+	}
+	return nbrew.walkSearchableFiles(sitePrefix, name, func(name string, text []byte) error {
+		title, body := getSearchDocument(name, text)
+		query := sq.CustomQuery{
+			Dialect: nbrew.Dialect,
+			Format:  "INSERT INTO file_index (site_name, file_path, title, body) VALUES ({siteName}, {name}, {title}, {body})",
+			Values: []any{
+				sq.StringParam("siteName", siteName),
+				sq.StringParam("name", name),
+				sq.StringParam("title", title),
+				sq.StringParam("body", body),
+			},
+		}
+		if nbrew.Dialect == "postgres" {
+			// Matches in the title rank higher than matches in the body.
+			query.Format = "INSERT INTO file_index (site_name, file_path, title, body, fts)" +
+				" VALUES ({siteName}, {name}, {title}, {body}, setweight(to_tsvector('english', {title}), 'A') || setweight(to_tsvector('english', {body}), 'B'))"
+		}
+		_, err := sq.ExecContext(ctx, nbrew.DB, query)
+		if err != nil {
+			return fmt.Errorf("adding %q to the search index: %w", path.Join(sitePrefix, name), err)
+		}
+		return nil
+	})
+}
+
+// rebuildSearchIndex indexes every site from scratch if the search index is
+// empty, which is the case the first time the search index is enabled for an
+// existing notebrew folder.
+func (nbrew *Notebrew) rebuildSearchIndex(ctx context.Context) error {
+	if !nbrew.SearchIndex {
+		return nil
+	}
+	exists, err := sq.FetchExistsContext(ctx, nbrew.DB, sq.CustomQuery{
+		Dialect: nbrew.Dialect,
+		Format:  "SELECT 1 FROM file_index",
+	})
+	if err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+	sitePrefixes, err := nbrew.sitePrefixes()
+	if err != nil {
+		return err
+	}
+	for _, sitePrefix := range sitePrefixes {
+		err = nbrew.indexSearchableFiles(ctx, sitePrefix, "")
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// searchTerms splits a search query into lowercased terms, ignoring any
+// quotes.
+func searchTerms(query string) []string {
+	return strings.FieldsFunc(strings.ToLower(query), func(char rune) bool {
+		return unicode.IsSpace(char) || char == '"' || char == '\''
+	})
+}
+
+// searchSnippet returns an excerpt of the body around the first occurrence of
+// any of the terms, with every occurrence of the terms highlighted. If none of
+// the terms occur in the body, the excerpt is taken from the start of the
+// body.
+func searchSnippet(body string, terms []string) template.HTML {
+	const before, after = 60, 160
+	body = strings.Join(strings.Fields(body), " ")
+	// The terms are matched against the lowercased body, but the excerpt is
+	// taken from the original body. Lowercasing can change the number of
+	// bytes in a character (e.g. 'İ' or the Kelvin sign), so offsets maps
+	// every byte offset in lowerBody to the byte offset of the same
+	// character in body.
+	var lower strings.Builder
+	offsets := make([]int, 0, len(body)+1)
+	for i, char := range body {
+		n, _ := lower.WriteRune(unicode.ToLower(char))
+		for ; n > 0; n-- {
+			offsets = append(offsets, i)
+		}
+	}
+	offsets = append(offsets, len(body))
+	lowerBody := lower.String()
+	start := -1
+	for _, term := range terms {
+		if i := strings.Index(lowerBody, term); i >= 0 && (start < 0 || i < start) {
+			start = i
+		}
+	}
+	if start < 0 {
+		start = 0
+	}
+	end := start + after
+	if start = start - before; start < 0 {
+		start = 0
+	}
+	if end > len(lowerBody) {
+		end = len(lowerBody)
+	}
+	for start > 0 && !utf8.RuneStart(lowerBody[start]) {
+		start--
+	}
+	for end < len(lowerBody) && !utf8.RuneStart(lowerBody[end]) {
+		end++
+	}
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString("…")
+	}
+	for pos := start; pos < end; {
+		i, length := -1, 0
+		for _, term := range terms {
+			if j := strings.Index(lowerBody[pos:end], term); j >= 0 && (i < 0 || j < i || (j == i && len(term) > length)) {
+				i, length = j, len(term)
+			}
+		}
+		if i < 0 {
+			b.WriteString(template.HTMLEscapeString(body[offsets[pos]:offsets[end]]))
+			break
+		}
+		b.WriteString(template.HTMLEscapeString(body[offsets[pos]:offsets[pos+i]]))
+		b.WriteString("<mark>" + template.HTMLEscapeString(body[offsets[pos+i]:offsets[pos+i+length]]) + "</mark>")
+		pos += i + length
+	}
+	if end < len(lowerBody) {
+		b.WriteString("…")
+	}
+	return template.HTML(b.String())
+}
+
+func (nbrew *Notebrew) search(w http.ResponseWriter, r *http.Request, username, sitePrefix string) {
+	type Result struct {
+		Path    string        `json:"path,omitempty"`
+		Title   string        `json:"title,omitempty"`
+		Snippet template.HTML `json:"snippet,omitempty"`
+	}
+	type Response struct {
+		Query   string   `json:"query,omitempty"`
+		Results []Result `json:"results"`
+	}
+
+	logger, ok := r.Context().Value(loggerKey).(*slog.Logger)
+	if !ok {
+		logger = slog.Default()
+	}
+
+	if r.Method != "GET" {
+		http.Error(w, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("400 Bad Request: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	response := Response{
+		Query:   strings.TrimSpace(r.Form.Get("q")),
+		Results: []Result{},
+	}
+	terms := searchTerms(response.Query)
+	if len(terms) > 0 && nbrew.SearchIndex {
+		// Every term has to match. For FTS5 and MySQL's boolean mode each
+		// term is quoted so that it is matched as a string rather than
+		// parsed as query syntax.
+		query := response.Query
+		switch nbrew.Dialect {
+		case "sqlite":
+			quotedTerms := make([]string, len(terms))
+			for i, term := range terms {
+				quotedTerms[i] = `"` + strings.ReplaceAll(term, `"`, `""`) + `"`
+			}
+			query = strings.Join(quotedTerms, " ")
+		case "mysql":
+			quotedTerms := make([]string, len(terms))
+			for i, term := range terms {
+				quotedTerms[i] = `+"` + term + `"`
+			}
+			query = strings.Join(quotedTerms, " ")
+		}
+		var format string
+		switch nbrew.Dialect {
+		case "sqlite":
+			format = "SELECT {*} FROM file_index" +
+				" WHERE file_index MATCH {query} AND site_name = {siteName}" +
+				" ORDER BY bm25(file_index, 0, 0, 10, 1)" +
+				" LIMIT {limit}"
+		case "postgres":
+			format = "SELECT {*} FROM file_index" +
+				" WHERE site_name = {siteName} AND fts @@ plainto_tsquery('english', {query})" +
+				" ORDER BY ts_rank(fts, plainto_tsquery('english', {query})) DESC" +
+				" LIMIT {limit}"
+		case "mysql":
+			format = "SELECT {*} FROM file_index" +
+				" WHERE site_name = {siteName} AND MATCH (title, body) AGAINST ({query} IN BOOLEAN MODE)" +
+				" ORDER BY MATCH (title, body) AGAINST ({query} IN BOOLEAN MODE) DESC" +
+				" LIMIT {limit}"
+		}
+		response.Results, err = sq.FetchAllContext(r.Context(), nbrew.DB, sq.CustomQuery{
+			Dialect: nbrew.Dialect,
+			Format:  format,
+			Values: []any{
+				sq.StringParam("query", query),
+				sq.StringParam("siteName", strings.TrimPrefix(sitePrefix, "@")),
+				sq.IntParam("limit", maxSearchResults),
+			},
+		}, func(row *sq.Row) Result {
+			result := Result{
+				Path:  row.String("file_path"),
+				Title: row.String("title"),
+			}
+			result.Snippet = searchSnippet(row.String("body"), terms)
+			return result
+		})
+		if err != nil {
+			logger.Error(err.Error())
+			internalServerError(w, r, err)
+			return
+		}
+	} else if len(terms) > 0 {
+		// Without a search index, scan through every searchable file. Files
+		// are read one at a time and matches in the title are ranked above
+		// matches in the body.
+		var titleResults, bodyResults []Result
+		err = nbrew.walkSearchableFiles(sitePrefix, "", func(name string, text []byte) error {
+			title, body := getSearchDocument(name, text)
+			lowerTitle, lowerBody := strings.ToLower(title), strings.ToLower(body)
+			inTitle := false
+			for _, term := range terms {
+				if strings.Contains(lowerTitle, term) {
+					inTitle = true
+				} else if !strings.Contains(lowerBody, term) {
+					return nil
+				}
+			}
+			result := Result{
+				Path:    name,
+				Title:   title,
+				Snippet: searchSnippet(body, terms),
+			}
+			if inTitle {
+				titleResults = append(titleResults, result)
+			} else {
+				bodyResults = append(bodyResults, result)
+			}
+			return nil
+		})
+		if err != nil {
+			logger.Error(err.Error())
+			internalServerError(w, r, err)
+			return
+		}
+		// Notes and posts are named after the time they were created, so
+		// the newest files come first.
+		for _, results := range [][]Result{titleResults, bodyResults} {
+			sort.SliceStable(results, func(i, j int) bool {
+				return path.Base(results[i].Path) > path.Base(results[j].Path)
+			})
+			response.Results = append(response.Results, results...)
+		}
+		if len(response.Results) > maxSearchResults {
+			response.Results = response.Results[:maxSearchResults]
+		}
+	}
+
+	accept, _, _ := mime.ParseMediaType(r.Header.Get("Accept"))
+	if accept == "application/json" {
+		w.Header().Set("Content-Type", "application/json")
+		b, err := json.Marshal(&response)
+		if err != nil {
+			logger.Error(err.Error())
+			internalServerError(w, r, err)
+			return
+		}
+		w.Write(b)
+		return
+	}
+
+	funcMap := map[string]any{
+		"join":       path.Join,
+		"username":   func() string { return username },
+		"referer":    func() string { return r.Referer() },
+		"sitePrefix": func() string { return sitePrefix },
+	}
+	tmpl, err := template.New("search.html").Funcs(funcMap).ParseFS(rootFS, "search.html")
+	if err != nil {
+		logger.Error(err.Error())
+		internalServerError(w, r, err)
+		return
+	}
+	buf := bufPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer bufPool.Put(buf)
+	err = tmpl.Execute(buf, &response)
+	if err != nil {
+		logger.Error(err.Error())
+		internalServerError(w, r, err)
+		return
+	}
+	w.Header().Add("Content-Security-Policy", defaultContentSecurityPolicy)
+	buf.WriteTo(w)
+}
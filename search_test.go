@@ -0,0 +1,84 @@
+package nb6
+
+import (
+	"html/template"
+	"strings"
+	"testing"
+
+	"github.com/bokwoon95/nb6/internal/testutil"
+)
+
+func TestSearchTerms(t *testing.T) {
+	got := searchTerms(`Hello "World" it's	GO`)
+	if diff := testutil.Diff(got, []string{"hello", "world", "it", "s", "go"}); diff != "" {
+		t.Error(testutil.Callers(), diff)
+	}
+}
+
+func TestSearchSnippet(t *testing.T) {
+	type TestTable struct {
+		description string
+		body        string
+		query       string
+		wantSnippet template.HTML
+	}
+
+	tests := []TestTable{{
+		description: "no match",
+		body:        "hello world",
+		query:       "missing",
+		wantSnippet: "hello world",
+	}, {
+		description: "case is kept",
+		body:        "Hello World",
+		query:       "world",
+		wantSnippet: "Hello <mark>World</mark>",
+	}, {
+		description: "every term is highlighted",
+		body:        "the cat sat on the mat with another cat",
+		query:       "cat mat",
+		wantSnippet: "the <mark>cat</mark> sat on the <mark>mat</mark> with another <mark>cat</mark>",
+	}, {
+		description: "longest term wins",
+		body:        "category",
+		query:       "cat category",
+		wantSnippet: "<mark>category</mark>",
+	}, {
+		description: "whitespace is collapsed",
+		body:        "hello\n\n  world",
+		query:       "world",
+		wantSnippet: "hello <mark>world</mark>",
+	}, {
+		description: "html is escaped",
+		body:        "<b>bold</b> & more",
+		query:       "bold",
+		wantSnippet: "&lt;b&gt;<mark>bold</mark>&lt;/b&gt; &amp; more",
+	}, {
+		// 'İ' (2 bytes) lowercases to 'i' (1 byte) and the Kelvin sign
+		// 'K' (3 bytes) lowercases to 'k' (1 byte).
+		description: "lowercasing changes the length",
+		body:        "İstanbul is 300 K in Summer",
+		query:       "summer",
+		wantSnippet: "İstanbul is 300 K in <mark>Summer</mark>",
+	}, {
+		description: "match inside a character whose length changes",
+		body:        "200 K",
+		query:       "k",
+		wantSnippet: "200 <mark>K</mark>",
+	}, {
+		description: "excerpt around the match",
+		body:        strings.Repeat("a ", 50) + "Needle" + strings.Repeat(" b", 100),
+		query:       "needle",
+		wantSnippet: template.HTML("…" + strings.Repeat("a ", 30) + "<mark>Needle</mark>" + strings.Repeat(" b", 77) + "…"),
+	}}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.description, func(t *testing.T) {
+			gotSnippet := searchSnippet(tt.body, searchTerms(tt.query))
+			if diff := testutil.Diff(gotSnippet, tt.wantSnippet); diff != "" {
+				t.Error(testutil.Callers(), diff)
+			}
+		})
+	}
+}
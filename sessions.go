@@ -0,0 +1,362 @@
+package nb6
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bokwoon95/sq"
+	"golang.org/x/exp/slog"
+)
+
+// defaultSessionIdleTimeout is how long a login session lasts without being
+// used if SessionIdleTimeout is not set.
+const defaultSessionIdleTimeout = 30 * 24 * time.Hour
+
+// defaultSessionMaxAge is how long a login session lasts after logging in if
+// SessionMaxAge is not set.
+const defaultSessionMaxAge = 365 * 24 * time.Hour
+
+// sessionActivityInterval is how often the last active time of a login
+// session is updated, so that not every request has to write to the database.
+const sessionActivityInterval = time.Minute
+
+// sessionIdleTimeout returns the SessionIdleTimeout, or a negative duration
+// if sessions never time out.
+func (nbrew *Notebrew) sessionIdleTimeout() time.Duration {
+	if nbrew.SessionIdleTimeout == 0 {
+		return defaultSessionIdleTimeout
+	}
+	return nbrew.SessionIdleTimeout
+}
+
+// sessionMaxAge returns the SessionMaxAge, or a negative duration if sessions
+// last until they time out.
+func (nbrew *Notebrew) sessionMaxAge() time.Duration {
+	if nbrew.SessionMaxAge == 0 {
+		return defaultSessionMaxAge
+	}
+	return nbrew.SessionMaxAge
+}
+
+// isSessionExpired reports whether the login session with the given
+// authentication token hash and last active time has expired. Sessions
+// created before last active times were recorded are only checked against
+// the SessionMaxAge.
+func (nbrew *Notebrew) isSessionExpired(authenticationTokenHash []byte, lastActiveTime sql.NullTime) bool {
+	if len(authenticationTokenHash) < 8 {
+		return true
+	}
+	now := time.Now()
+	if maxAge := nbrew.sessionMaxAge(); maxAge > 0 {
+		creationTime := time.Unix(int64(binary.BigEndian.Uint64(authenticationTokenHash[:8])), 0)
+		if now.Sub(creationTime) > maxAge {
+			return true
+		}
+	}
+	if idleTimeout := nbrew.sessionIdleTimeout(); idleTimeout > 0 && lastActiveTime.Valid {
+		if now.Sub(lastActiveTime.Time) > idleTimeout {
+			return true
+		}
+	}
+	return false
+}
+
+// touchSession updates the last active time and IP address of a login
+// session, unless it was already updated within the sessionActivityInterval.
+func (nbrew *Notebrew) touchSession(r *http.Request, authenticationTokenHash []byte, lastActiveTime sql.NullTime) error {
+	now := time.Now()
+	if lastActiveTime.Valid && now.Sub(lastActiveTime.Time) < sessionActivityInterval {
+		return nil
+	}
+	ip, _ := getIP(r)
+	_, err := sq.ExecContext(r.Context(), nbrew.DB, sq.CustomQuery{
+		Dialect: nbrew.Dialect,
+		Format: "UPDATE authentication" +
+			" SET last_active_time = {lastActiveTime}, ip_address = {ipAddress}" +
+			" WHERE authentication_token_hash = {authenticationTokenHash}",
+		Values: []any{
+			sq.TimeParam("lastActiveTime", now.UTC()),
+			sq.StringParam("ipAddress", ip),
+			sq.BytesParam("authenticationTokenHash", authenticationTokenHash),
+		},
+	})
+	return err
+}
+
+// revokeSession deletes a login session.
+func (nbrew *Notebrew) revokeSession(ctx context.Context, authenticationTokenHash []byte) error {
+	_, err := sq.ExecContext(ctx, nbrew.DB, sq.CustomQuery{
+		Dialect: nbrew.Dialect,
+		Format:  "DELETE FROM authentication WHERE authentication_token_hash = {authenticationTokenHash}",
+		Values: []any{
+			sq.BytesParam("authenticationTokenHash", authenticationTokenHash),
+		},
+	})
+	return err
+}
+
+// loginSession is a login session of a user as shown on the sessions page.
+type loginSession struct {
+	// ID is the hex-encoded authentication token hash. It identifies the
+	// session without revealing the authentication token.
+	ID             string    `json:"id"`
+	CreationTime   time.Time `json:"creation_time"`
+	LastActiveTime time.Time `json:"last_active_time,omitempty"`
+	UserAgent      string    `json:"user_agent,omitempty"`
+	IPAddress      string    `json:"ip_address,omitempty"`
+	Current        bool      `json:"current,omitempty"`
+}
+
+// sessions lists the login sessions of the user and lets them log out of the
+// other devices. Like the API tokens page, it cannot be used with an API
+// token.
+func (nbrew *Notebrew) sessions(w http.ResponseWriter, r *http.Request, username string) {
+	type Request struct {
+		Action string `json:"action,omitempty"`
+		ID     string `json:"id,omitempty"`
+	}
+	type Response struct {
+		Action  string   `json:"action,omitempty"`
+		ID      string   `json:"id,omitempty"`
+		Errors  []string `json:"errors,omitempty"`
+		Success []string `json:"success,omitempty"`
+	}
+	type TemplateData struct {
+		Sessions []loginSession `json:"sessions"`
+		Alerts   url.Values     `json:"alerts,omitempty"`
+	}
+
+	logger, ok := r.Context().Value(loggerKey).(*slog.Logger)
+	if !ok {
+		logger = slog.Default()
+	}
+
+	if nbrew.DB == nil {
+		notFound(w, r)
+		return
+	}
+	currentTokenHash := getAuthenticationTokenHash(r)
+
+	switch r.Method {
+	case "GET":
+		var templateData TemplateData
+		_, err := nbrew.getSession(r, "flash", &templateData)
+		if err != nil {
+			logger.Error(err.Error())
+		}
+		nbrew.clearSession(w, r, "flash")
+		sessions, err := sq.FetchAllContext(r.Context(), nbrew.DB, sq.CustomQuery{
+			Dialect: nbrew.Dialect,
+			Format: "SELECT {*}" +
+				" FROM authentication" +
+				" JOIN users ON users.user_id = authentication.user_id" +
+				" WHERE users.username = {username}",
+			Values: []any{
+				sq.StringParam("username", username),
+			},
+		}, func(row *sq.Row) (result struct {
+			AuthenticationTokenHash []byte
+			LastActiveTime          sql.NullTime
+			UserAgent               string
+			IPAddress               string
+		}) {
+			result.AuthenticationTokenHash = row.Bytes("authentication.authentication_token_hash")
+			result.LastActiveTime = row.NullTime("authentication.last_active_time")
+			result.UserAgent = row.String("COALESCE(authentication.user_agent, '')")
+			result.IPAddress = row.String("COALESCE(authentication.ip_address, '')")
+			return result
+		})
+		if err != nil {
+			logger.Error(err.Error())
+			internalServerError(w, r, err)
+			return
+		}
+		for _, session := range sessions {
+			if nbrew.isSessionExpired(session.AuthenticationTokenHash, session.LastActiveTime) {
+				continue
+			}
+			loginSession := loginSession{
+				ID:           strings.TrimLeft(hex.EncodeToString(session.AuthenticationTokenHash), "0"),
+				CreationTime: time.Unix(int64(binary.BigEndian.Uint64(session.AuthenticationTokenHash[:8])), 0).UTC(),
+				UserAgent:    session.UserAgent,
+				IPAddress:    session.IPAddress,
+				Current:      bytes.Equal(session.AuthenticationTokenHash, currentTokenHash),
+			}
+			if session.LastActiveTime.Valid {
+				loginSession.LastActiveTime = session.LastActiveTime.Time
+			}
+			templateData.Sessions = append(templateData.Sessions, loginSession)
+		}
+		// Most recently active first.
+		sort.SliceStable(templateData.Sessions, func(i, j int) bool {
+			return templateData.Sessions[i].LastActiveTime.After(templateData.Sessions[j].LastActiveTime)
+		})
+
+		accept, _, _ := mime.ParseMediaType(r.Header.Get("Accept"))
+		if accept == "application/json" {
+			w.Header().Set("Content-Type", "application/json")
+			b, err := json.Marshal(&templateData)
+			if err != nil {
+				logger.Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+			w.Write(b)
+			return
+		}
+
+		funcMap := map[string]any{
+			"safeHTML": func(s string) template.HTML { return template.HTML(s) },
+			"username": func() string { return username },
+		}
+		tmpl, err := template.New("sessions.html").Funcs(funcMap).ParseFS(rootFS, "sessions.html")
+		if err != nil {
+			logger.Error(err.Error())
+			internalServerError(w, r, err)
+			return
+		}
+		buf := bufPool.Get().(*bytes.Buffer)
+		buf.Reset()
+		defer bufPool.Put(buf)
+		err = tmpl.Execute(buf, &templateData)
+		if err != nil {
+			logger.Error(err.Error())
+			internalServerError(w, r, err)
+			return
+		}
+		w.Header().Add("Content-Security-Policy", defaultContentSecurityPolicy)
+		buf.WriteTo(w)
+	case "POST":
+		writeResponse := func(w http.ResponseWriter, r *http.Request, response Response) {
+			accept, _, _ := mime.ParseMediaType(r.Header.Get("Accept"))
+			if accept == "application/json" {
+				w.Header().Set("Content-Type", "application/json")
+				b, err := json.Marshal(&response)
+				if err != nil {
+					logger.Error(err.Error())
+					internalServerError(w, r, err)
+					return
+				}
+				w.Write(b)
+				return
+			}
+			alerts := make(url.Values)
+			for _, msg := range response.Success {
+				alerts.Add("success", msg)
+			}
+			for _, errmsg := range response.Errors {
+				alerts.Add("danger", template.HTMLEscapeString(errmsg))
+			}
+			err := nbrew.setSession(w, r, "flash", map[string]any{
+				"alerts": alerts,
+			})
+			if err != nil {
+				logger.Error(err.Error())
+			}
+			http.Redirect(w, r, nbrew.Scheme+nbrew.AdminDomain+"/admin/sessions/", http.StatusFound)
+		}
+
+		var request Request
+		contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		switch contentType {
+		case "application/json":
+			err := json.NewDecoder(r.Body).Decode(&request)
+			if err != nil {
+				var syntaxErr *json.SyntaxError
+				if errors.As(err, &syntaxErr) {
+					http.Error(w, "400 Bad Request: invalid JSON", http.StatusBadRequest)
+					return
+				}
+				logger.Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+		case "application/x-www-form-urlencoded":
+			err := r.ParseForm()
+			if err != nil {
+				http.Error(w, fmt.Sprintf("400 Bad Request: %s", err), http.StatusBadRequest)
+				return
+			}
+			request.Action = r.Form.Get("action")
+			request.ID = r.Form.Get("id")
+		default:
+			http.Error(w, "415 Unsupported Media Type", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		response := Response{
+			Action: request.Action,
+			ID:     request.ID,
+		}
+		switch response.Action {
+		case "revoke":
+			authenticationTokenHash, err := hex.DecodeString(fmt.Sprintf("%080s", response.ID))
+			if err != nil || len(authenticationTokenHash) != 40 {
+				response.Errors = append(response.Errors, "invalid session id")
+				writeResponse(w, r, response)
+				return
+			}
+			if bytes.Equal(authenticationTokenHash, currentTokenHash) {
+				response.Errors = append(response.Errors, "cannot revoke the current session, log out instead")
+				writeResponse(w, r, response)
+				return
+			}
+			result, err := sq.ExecContext(r.Context(), nbrew.DB, sq.CustomQuery{
+				Dialect: nbrew.Dialect,
+				Format: "DELETE FROM authentication" +
+					" WHERE authentication_token_hash = {authenticationTokenHash}" +
+					" AND user_id = (SELECT user_id FROM users WHERE username = {username})",
+				Values: []any{
+					sq.BytesParam("authenticationTokenHash", authenticationTokenHash),
+					sq.StringParam("username", username),
+				},
+			})
+			if err != nil {
+				logger.Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+			if result.RowsAffected == 0 {
+				response.Errors = append(response.Errors, "no such session")
+				writeResponse(w, r, response)
+				return
+			}
+			response.Success = append(response.Success, "Logged out of the session")
+		case "revoke_others":
+			result, err := sq.ExecContext(r.Context(), nbrew.DB, sq.CustomQuery{
+				Dialect: nbrew.Dialect,
+				Format: "DELETE FROM authentication" +
+					" WHERE authentication_token_hash <> {authenticationTokenHash}" +
+					" AND user_id = (SELECT user_id FROM users WHERE username = {username})",
+				Values: []any{
+					sq.BytesParam("authenticationTokenHash", currentTokenHash),
+					sq.StringParam("username", username),
+				},
+			})
+			if err != nil {
+				logger.Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+			response.Success = append(response.Success, fmt.Sprintf("Logged out of %d other session(s)", result.RowsAffected))
+		default:
+			response.Errors = append(response.Errors, fmt.Sprintf("invalid action %q (must be revoke or revoke_others)", response.Action))
+		}
+		writeResponse(w, r, response)
+	default:
+		http.Error(w, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
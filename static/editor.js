@@ -0,0 +1,82 @@
+import { EditorState } from "/admin/static/lib/prosemirror-state@1.4.2.js";
+import { EditorView } from "/admin/static/lib/prosemirror-view@1.30.1.js";
+import { schema, defaultMarkdownParser, defaultMarkdownSerializer } from "/admin/static/lib/prosemirror-markdown@1.10.1.js";
+import { exampleSetup } from "/admin/static/lib/prosemirror-example-setup@1.2.1.js";
+
+// splitFrontMatter splits the front matter (if any) from the markdown that
+// follows, so that ProseMirror only ever sees the markdown.
+function splitFrontMatter(text) {
+    for (const delimiter of ["---", "+++"]) {
+        if (!text.startsWith(delimiter + "\n") && !text.startsWith(delimiter + "\r\n")) {
+            continue;
+        }
+        const lines = text.split("\n");
+        let offset = lines[0].length + 1;
+        for (let i = 1; i < lines.length; i++) {
+            offset += lines[i].length + 1;
+            if (lines[i].trim() == delimiter) {
+                return [text.slice(0, offset), text.slice(offset)];
+            }
+        }
+        break;
+    }
+    return ["", text];
+}
+
+for (const textarea of document.querySelectorAll("textarea[data-prosemirror]")) {
+    const container = document.createElement("div");
+    container.className = textarea.className.replace("resize-vertical", "") + " bg-white overflow-y-auto";
+    textarea.after(container);
+
+    let frontMatter = "";
+    let view = null;
+    const createState = function() {
+        let markdown;
+        [frontMatter, markdown] = splitFrontMatter(textarea.value);
+        return EditorState.create({
+            doc: defaultMarkdownParser.parse(markdown),
+            plugins: exampleSetup({ schema: schema }),
+        });
+    };
+    view = new EditorView(container, {
+        state: createState(),
+        dispatchTransaction(transaction) {
+            view.updateState(view.state.apply(transaction));
+            // Only write back into the textarea when the document actually
+            // changes, so that opening and saving a file without touching it
+            // never reformats its markdown.
+            if (transaction.docChanged) {
+                textarea.value = frontMatter + defaultMarkdownSerializer.serialize(view.state.doc) + "\n";
+                textarea.dispatchEvent(new Event("input", { bubbles: true }));
+            }
+        },
+    });
+    textarea.hidden = true;
+
+    // Markdown that ProseMirror doesn't understand (tables, raw HTML) can
+    // still be edited as plain text.
+    const toggle = document.createElement("button");
+    toggle.type = "button";
+    toggle.className = "button ba br2 pa2 mh1";
+    toggle.textContent = "Edit as plain text";
+    toggle.addEventListener("click", function() {
+        if (textarea.hidden) {
+            textarea.hidden = false;
+            container.hidden = true;
+            toggle.textContent = "Edit as rich text";
+            textarea.focus();
+            return;
+        }
+        view.updateState(createState());
+        textarea.hidden = true;
+        container.hidden = false;
+        toggle.textContent = "Edit as plain text";
+        view.focus();
+    });
+    const submit = textarea.form.querySelector("button[type=submit]");
+    if (submit) {
+        submit.after(toggle);
+    } else {
+        container.after(toggle);
+    }
+}
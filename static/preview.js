@@ -0,0 +1,15 @@
+// Re-render the preview frame with the contents of the editor whenever the
+// user stops typing for a moment.
+const form = document.querySelector("form[data-preview]");
+const textarea = document.querySelector("textarea[name=content]");
+if (form && textarea) {
+    const input = form.querySelector("input[name=content]");
+    let timeout = null;
+    textarea.addEventListener("input", function() {
+        clearTimeout(timeout);
+        timeout = setTimeout(function() {
+            input.value = textarea.value;
+            form.submit();
+        }, 500);
+    });
+}
@@ -0,0 +1,442 @@
+package nb6
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"golang.org/x/exp/slog"
+)
+
+// normalizeTag converts a tag into the form it is indexed under (which is
+// also the name of its folder in the generated site), or an empty string if
+// the tag is not valid.
+func normalizeTag(tag string) string {
+	return strings.Trim(toSlug(strings.TrimPrefix(strings.TrimSpace(tag), "#")), "-")
+}
+
+// getTags returns the normalized tags of a note or post, which are the tags in
+// its front matter followed by any #hashtags in its markdown.
+func getTags(frontMatter FrontMatter, markdown []byte) []string {
+	var tags []string
+	seen := make(map[string]bool)
+	addTag := func(tag string) {
+		tag = normalizeTag(tag)
+		if tag == "" || seen[tag] {
+			return
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+	}
+	for _, tag := range frontMatter.Tags {
+		addTag(tag)
+	}
+	for _, tag := range extractHashtags(markdown) {
+		addTag(tag)
+	}
+	return tags
+}
+
+// extractHashtags returns the #hashtags found in markdown. A hashtag is a '#'
+// at the start of a word followed by letters, digits, '-' or '_' and at least
+// one letter (so that headings and "#1" are not mistaken for tags). Hashtags
+// inside code blocks and code spans are ignored.
+func extractHashtags(markdown []byte) []string {
+	var hashtags []string
+	inCodeBlock := false
+	for _, line := range strings.Split(string(markdown), "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "```") {
+			inCodeBlock = !inCodeBlock
+			continue
+		}
+		if inCodeBlock {
+			continue
+		}
+		inCodeSpan := false
+		runes := []rune(line)
+		for i := 0; i < len(runes); i++ {
+			if runes[i] == '`' {
+				inCodeSpan = !inCodeSpan
+				continue
+			}
+			if inCodeSpan || runes[i] != '#' || (i > 0 && !unicode.IsSpace(runes[i-1]) && runes[i-1] != '(') {
+				continue
+			}
+			j, hasLetter := i+1, false
+			for ; j < len(runes); j++ {
+				char := runes[j]
+				if unicode.IsLetter(char) {
+					hasLetter = true
+				} else if !unicode.IsDigit(char) && char != '-' && char != '_' {
+					break
+				}
+			}
+			if hasLetter {
+				hashtags = append(hashtags, string(runes[i+1:j]))
+			}
+			i = j - 1
+		}
+	}
+	return hashtags
+}
+
+// walkMarkdownFiles calls fn for every markdown file in the notes and posts
+// folders of a site (including one level of categories), passing in its name
+// relative to the sitePrefix. Walking stops at the first error returned by fn.
+func (nbrew *Notebrew) walkMarkdownFiles(sitePrefix string, fn func(name string, fileInfo fs.FileInfo, text []byte) error) error {
+	for _, folder := range []string{"notes", "posts"} {
+		dirs := []string{folder}
+		dirEntries, err := nbrew.FS.ReadDir(path.Join(sitePrefix, folder))
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			return err
+		}
+		for _, dirEntry := range dirEntries {
+			if dirEntry.IsDir() {
+				dirs = append(dirs, path.Join(folder, dirEntry.Name()))
+			}
+		}
+		for _, dir := range dirs {
+			dirEntries, err := nbrew.FS.ReadDir(path.Join(sitePrefix, dir))
+			if err != nil {
+				return err
+			}
+			for _, dirEntry := range dirEntries {
+				if dirEntry.IsDir() || path.Ext(dirEntry.Name()) != ".md" {
+					continue
+				}
+				fileInfo, err := dirEntry.Info()
+				if err != nil {
+					return err
+				}
+				name := path.Join(dir, dirEntry.Name())
+				text, err := readFile(nbrew.FS, path.Join(sitePrefix, name))
+				if err != nil {
+					return err
+				}
+				err = fn(name, fileInfo, []byte(text))
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// getAllPosts returns the published posts of every category, newest first.
+func (nbrew *Notebrew) getAllPosts(ctx context.Context, sitePrefix string) ([]Post, error) {
+	posts, err := nbrew.getPosts(ctx, sitePrefix, "")
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	dirEntries, err := nbrew.FS.ReadDir(path.Join(sitePrefix, "posts"))
+	if err != nil {
+		return nil, err
+	}
+	for _, dirEntry := range dirEntries {
+		if !dirEntry.IsDir() {
+			continue
+		}
+		categoryPosts, err := nbrew.getPosts(ctx, sitePrefix, dirEntry.Name())
+		if err != nil {
+			return nil, err
+		}
+		posts = append(posts, categoryPosts...)
+	}
+	sortPosts(posts)
+	return posts, nil
+}
+
+// generateTags regenerates the pages of the given tags into
+// site/tags/<tag>/index.html using the site's tag.html template. The posts of
+// each tag are found in the post index of the site (see updatePostIndex) and
+// read with getPosts. Tags that no post has any more have their pages
+// removed.
+func (nbrew *Notebrew) generateTags(sitePrefix string, index map[string]postIndexEntry, tags map[string]bool, getPosts func(names []string) ([]Post, error)) error {
+	namesByTag := make(map[string][]string)
+	for name, entry := range index {
+		for _, tag := range entry.Tags {
+			if tags[tag] {
+				namesByTag[tag] = append(namesByTag[tag], name)
+			}
+		}
+	}
+	tagsDir := path.Join(sitePrefix, "site/tags")
+	var tmpl *template.Template
+	buf := bufPool.Get().(*bytes.Buffer)
+	defer bufPool.Put(buf)
+	for tag := range tags {
+		posts, err := getPosts(namesByTag[tag])
+		if err != nil {
+			return err
+		}
+		if len(posts) == 0 {
+			err = nbrew.removeGeneratedHTML(sitePrefix, path.Join(tagsDir, tag), true)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if tmpl == nil {
+			tmpl, err = nbrew.themeTemplate(sitePrefix, "tag.html")
+			if err != nil {
+				return err
+			}
+		}
+		buf.Reset()
+		err = tmpl.Execute(buf, map[string]any{
+			"Tag":   tag,
+			"Posts": posts,
+		})
+		if err != nil {
+			return err
+		}
+		err = nbrew.writeGeneratedHTML(path.Join(tagsDir, tag), buf.Bytes())
+		if err != nil {
+			return err
+		}
+	}
+	// Removes the tags folder if no tags are left.
+	return nbrew.removeGeneratedHTML(sitePrefix, tagsDir, false)
+}
+
+// tags serves the tag index of a site (/admin/<site>/tags/) and the notes and
+// posts with a particular tag (/admin/<site>/tags/<tag>/).
+func (nbrew *Notebrew) tags(w http.ResponseWriter, r *http.Request, username, sitePrefix, tag string) {
+	type Tag struct {
+		Name  string `json:"name,omitempty"`
+		Count int    `json:"count,omitempty"`
+	}
+	type Entry struct {
+		Path        string     `json:"path,omitempty"`
+		Title       string     `json:"title,omitempty"`
+		Preview     string     `json:"preview,omitempty"`
+		Date        *time.Time `json:"date,omitempty"`
+		Tags        []string   `json:"tags,omitempty"`
+		Draft       bool       `json:"draft,omitempty"`
+		Description string     `json:"description,omitempty"`
+		Size        int64      `json:"size,omitempty"`
+		ModTime     *time.Time `json:"mod_time,omitempty"`
+	}
+	type Response struct {
+		Tag     string  `json:"tag,omitempty"`
+		Tags    []Tag   `json:"tags,omitempty"`
+		Entries []Entry `json:"entries,omitempty"`
+		Sort    string  `json:"sort,omitempty"`
+		Order   string  `json:"order,omitempty"`
+	}
+
+	logger, ok := r.Context().Value(loggerKey).(*slog.Logger)
+	if !ok {
+		logger = slog.Default()
+	}
+
+	if r.Method != "GET" {
+		http.Error(w, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if strings.Contains(tag, "/") || tag != normalizeTag(tag) {
+		notFound(w, r)
+		return
+	}
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("400 Bad Request: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	response := Response{Tag: tag}
+	response.Sort = strings.ToLower(strings.TrimSpace(r.Form.Get("sort")))
+	if response.Sort == "" {
+		cookie, _ := r.Cookie("sort")
+		if cookie != nil {
+			response.Sort = cookie.Value
+		}
+	}
+	if response.Tag == "" {
+		switch response.Sort {
+		case "name", "count":
+			break
+		default:
+			response.Sort = "name"
+		}
+	} else {
+		switch response.Sort {
+		case "created", "edited", "title", "date":
+			break
+		default:
+			response.Sort = "created"
+		}
+	}
+	response.Order = strings.ToLower(strings.TrimSpace(r.Form.Get("order")))
+	if response.Order == "" {
+		cookie, _ := r.Cookie("order")
+		if cookie != nil {
+			response.Order = cookie.Value
+		}
+	}
+	switch response.Order {
+	case "asc", "desc":
+		break
+	default:
+		if response.Sort == "name" || response.Sort == "title" {
+			response.Order = "asc"
+		} else {
+			response.Order = "desc"
+		}
+	}
+
+	counts := make(map[string]int)
+	err = nbrew.walkMarkdownFiles(sitePrefix, func(name string, fileInfo fs.FileInfo, text []byte) error {
+		frontMatter, markdown, err := parseFrontMatter(text)
+		if err != nil {
+			logger.Warn(err.Error(), slog.String("name", name))
+		}
+		tags := getTags(frontMatter, markdown)
+		for _, tag := range tags {
+			counts[tag]++
+		}
+		if response.Tag == "" {
+			return nil
+		}
+		hasTag := false
+		for _, tag := range tags {
+			if tag == response.Tag {
+				hasTag = true
+				break
+			}
+		}
+		if !hasTag {
+			return nil
+		}
+		modTime := fileInfo.ModTime()
+		entry := Entry{
+			Path:        name,
+			Tags:        tags,
+			Draft:       frontMatter.Draft,
+			Description: frontMatter.Description,
+			Size:        fileInfo.Size(),
+			ModTime:     &modTime,
+		}
+		entry.Title, entry.Preview = getTitleAndPreview(io.NopCloser(bytes.NewReader(markdown)))
+		if frontMatter.Title != "" {
+			entry.Title = frontMatter.Title
+		}
+		if frontMatter.Description != "" {
+			entry.Preview = frontMatter.Description
+		}
+		if !frontMatter.Date.IsZero() {
+			entry.Date = &frontMatter.Date
+		}
+		response.Entries = append(response.Entries, entry)
+		return nil
+	})
+	if err != nil {
+		logger.Error(err.Error())
+		internalServerError(w, r, err)
+		return
+	}
+	if response.Tag != "" && counts[response.Tag] == 0 {
+		notFound(w, r)
+		return
+	}
+
+	ascending := response.Order == "asc"
+	if response.Tag == "" {
+		for name, count := range counts {
+			response.Tags = append(response.Tags, Tag{Name: name, Count: count})
+		}
+		sort.Slice(response.Tags, func(i, j int) bool {
+			tag1, tag2 := response.Tags[i], response.Tags[j]
+			if response.Sort == "count" {
+				if tag1.Count != tag2.Count {
+					return (tag1.Count < tag2.Count) == ascending
+				}
+				return tag1.Name < tag2.Name
+			}
+			return (tag1.Name < tag2.Name) == ascending
+		})
+	} else {
+		// Notes and posts are named after the time they were created, so
+		// sorting by name is sorting by date created.
+		entryDate := func(entry Entry) time.Time {
+			if entry.Date != nil {
+				return *entry.Date
+			}
+			return *entry.ModTime
+		}
+		sort.SliceStable(response.Entries, func(i, j int) bool {
+			entry1, entry2 := response.Entries[i], response.Entries[j]
+			switch response.Sort {
+			case "edited":
+				if !entry1.ModTime.Equal(*entry2.ModTime) {
+					return entry1.ModTime.Before(*entry2.ModTime) == ascending
+				}
+			case "title":
+				if entry1.Title != entry2.Title {
+					return (entry1.Title < entry2.Title) == ascending
+				}
+			case "date":
+				if date1, date2 := entryDate(entry1), entryDate(entry2); !date1.Equal(date2) {
+					return date1.Before(date2) == ascending
+				}
+			}
+			return (path.Base(entry1.Path) < path.Base(entry2.Path)) == ascending
+		})
+	}
+
+	accept, _, _ := mime.ParseMediaType(r.Header.Get("Accept"))
+	if accept == "application/json" {
+		w.Header().Set("Content-Type", "application/json")
+		b, err := json.Marshal(&response)
+		if err != nil {
+			logger.Error(err.Error())
+			internalServerError(w, r, err)
+			return
+		}
+		w.Write(b)
+		return
+	}
+	funcMap := map[string]any{
+		"join":       path.Join,
+		"base":       path.Base,
+		"username":   func() string { return username },
+		"referer":    func() string { return r.Referer() },
+		"sitePrefix": func() string { return sitePrefix },
+	}
+	tmpl, err := template.New("tags.html").Funcs(funcMap).ParseFS(rootFS, "tags.html")
+	if err != nil {
+		logger.Error(err.Error())
+		internalServerError(w, r, err)
+		return
+	}
+	buf := bufPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer bufPool.Put(buf)
+	err = tmpl.Execute(buf, &response)
+	if err != nil {
+		logger.Error(err.Error())
+		internalServerError(w, r, err)
+		return
+	}
+	w.Header().Add("Content-Security-Policy", defaultContentSecurityPolicy)
+	buf.WriteTo(w)
+}
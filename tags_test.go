@@ -0,0 +1,74 @@
+package nb6
+
+import (
+	"testing"
+
+	"github.com/bokwoon95/nb6/internal/testutil"
+)
+
+func TestGetTags(t *testing.T) {
+	type TestTable struct {
+		description string
+		frontMatter FrontMatter
+		markdown    string
+		wantTags    []string
+	}
+
+	tests := []TestTable{{
+		description: "no tags",
+		markdown:    "# Hello\n\nworld\n",
+		wantTags:    nil,
+	}, {
+		description: "hashtags",
+		markdown:    "a #go post about #web-dev\n#sqlite",
+		wantTags:    []string{"go", "web-dev", "sqlite"},
+	}, {
+		description: "front matter tags come first",
+		frontMatter: FrontMatter{Tags: []string{"Travel", "#japan"}},
+		markdown:    "#food",
+		wantTags:    []string{"travel", "japan", "food"},
+	}, {
+		description: "duplicates",
+		frontMatter: FrontMatter{Tags: []string{"go"}},
+		markdown:    "#go #Go #go",
+		wantTags:    []string{"go"},
+	}, {
+		description: "headings and numbers",
+		markdown:    "# Heading\n## Subheading\nissue #1 and #2024",
+		wantTags:    nil,
+	}, {
+		description: "middle of a word",
+		markdown:    "a#b c#d http://example.com/#anchor",
+		wantTags:    nil,
+	}, {
+		description: "in parentheses",
+		markdown:    "(#aside)",
+		wantTags:    []string{"aside"},
+	}, {
+		description: "code",
+		markdown:    "```\n#include <stdio.h>\n```\n`#notatag` #tag",
+		wantTags:    []string{"tag"},
+	}, {
+		description: "unicode",
+		markdown:    "#日本 #café",
+		wantTags:    []string{"日本", "café"},
+	}, {
+		description: "punctuation ends the tag",
+		markdown:    "#go, #rust. #zig!",
+		wantTags:    []string{"go", "rust", "zig"},
+	}, {
+		description: "empty front matter tag",
+		frontMatter: FrontMatter{Tags: []string{"", " # "}},
+		wantTags:    nil,
+	}}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.description, func(t *testing.T) {
+			gotTags := getTags(tt.frontMatter, []byte(tt.markdown))
+			if diff := testutil.Diff(gotTags, tt.wantTags); diff != "" {
+				t.Error(testutil.Callers(), diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,461 @@
+package nb6
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"golang.org/x/exp/slog"
+)
+
+// maxUploadRequestSize is the maximum size of an upload request, which may
+// contain many files.
+const maxUploadRequestSize = 100 << 20 // 100 MB
+
+// uploadType describes a type of file that can be uploaded: how large it may
+// be and what its contents must be sniffed as by http.DetectContentType.
+type uploadType struct {
+	MaxSize int64
+	// ContentTypes are the media types (without parameters) that the
+	// contents of the file are allowed to be sniffed as. A content type ending
+	// in "/" matches any media type with that prefix.
+	ContentTypes []string
+}
+
+var (
+	imageUpload = func(contentType string) uploadType {
+		return uploadType{MaxSize: 10 << 20, ContentTypes: []string{contentType}}
+	}
+	fontUpload = func(contentType string) uploadType {
+		return uploadType{MaxSize: 5 << 20, ContentTypes: []string{contentType, "application/octet-stream"}}
+	}
+	textUpload = uploadType{MaxSize: 2 << 20, ContentTypes: []string{"text/"}}
+)
+
+// uploadTypes are the file extensions that can be uploaded into site/themes.
+// Only the image types can be uploaded into site/images.
+var uploadTypes = map[string]uploadType{
+	".jpeg":  imageUpload("image/jpeg"),
+	".jpg":   imageUpload("image/jpeg"),
+	".png":   imageUpload("image/png"),
+	".gif":   imageUpload("image/gif"),
+	".webp":  imageUpload("image/webp"),
+	".ico":   imageUpload("image/x-icon"),
+	".svg":   {MaxSize: 2 << 20, ContentTypes: []string{"text/"}},
+	".ttf":   fontUpload("font/ttf"),
+	".otf":   fontUpload("font/otf"),
+	".woff":  fontUpload("font/woff"),
+	".woff2": fontUpload("font/woff2"),
+	".eot":   fontUpload("application/vnd.ms-fontobject"),
+	".html":  textUpload,
+	".css":   textUpload,
+	".js":    textUpload,
+	".md":    textUpload,
+	".txt":   textUpload,
+	".csv":   textUpload,
+	".tsv":   textUpload,
+	".json":  textUpload,
+	".xml":   textUpload,
+	".toml":  textUpload,
+	".yaml":  textUpload,
+	".yml":   textUpload,
+}
+
+// isImageExt reports whether ext is the extension of an image that can be
+// uploaded into site/images.
+func isImageExt(ext string) bool {
+	switch ext {
+	case ".jpeg", ".jpg", ".png", ".gif", ".webp", ".ico", ".svg":
+		return true
+	}
+	return false
+}
+
+// isActiveUpload reports whether a file uploaded into the site folder is of a
+// type that can run scripts when opened directly in the browser, such as an
+// SVG image or an HTML theme template.
+func isActiveUpload(name string) bool {
+	switch path.Ext(name) {
+	case ".svg", ".html", ".xml", ".js":
+		return true
+	}
+	return false
+}
+
+// isUploadFolder reports whether files can be uploaded into folder (relative
+// to the sitePrefix), which has to be site/images or site/themes or a folder
+// inside them.
+func isUploadFolder(folder string) bool {
+	return folder == "site/images" || strings.HasPrefix(folder, "site/images/") ||
+		folder == "site/themes" || strings.HasPrefix(folder, "site/themes/")
+}
+
+// uploadName turns the name of an uploaded file into a valid file name by
+// lowercasing it and slugifying everything before the extension.
+func uploadName(filename string) string {
+	filename = strings.ToLower(path.Base(strings.ReplaceAll(filename, `\`, "/")))
+	ext := path.Ext(filename)
+	stem := strings.Trim(toSlug(strings.TrimSuffix(filename, ext)), "-")
+	if stem == "" {
+		return ""
+	}
+	return stem + ext
+}
+
+// errFileTooLarge is returned by a maxSizeReader when the file is larger than
+// its maximum size.
+var errFileTooLarge = errors.New("file too large")
+
+// errPreconditionFailed is returned by uploadFile when the If-Match or
+// If-Unmodified-Since header of the request does not hold for the file it
+// would overwrite.
+var errPreconditionFailed = errors.New("precondition failed")
+
+// maxSizeReader is like io.LimitedReader except it returns errFileTooLarge
+// instead of io.EOF if the underlying reader has more than N bytes, so that
+// oversized files fail instead of being silently truncated.
+type maxSizeReader struct {
+	R io.Reader
+	N int64
+}
+
+func (r *maxSizeReader) Read(p []byte) (n int, err error) {
+	if r.N < 0 {
+		return 0, errFileTooLarge
+	}
+	if int64(len(p)) > r.N+1 {
+		p = p[:r.N+1]
+	}
+	n, err = r.R.Read(p)
+	r.N -= int64(n)
+	if r.N < 0 {
+		return n, errFileTooLarge
+	}
+	return n, err
+}
+
+// upload uploads files into site/images or site/themes. Uploads are
+// multipart/form-data requests with a parent_folder and any number of files
+// named "file", each of which is streamed into the FS without being buffered
+// in memory or on disk. Since the request body is read in order, the
+// parent_folder has to come before the files (or be given in the URL query
+// string instead). Files with the same name as an existing file replace it.
+func (nbrew *Notebrew) upload(w http.ResponseWriter, r *http.Request, username, sitePrefix string) {
+	type Response struct {
+		ParentFolder string     `json:"parent_folder,omitempty"`
+		Files        []string   `json:"files,omitempty"`
+		Errors       url.Values `json:"errors,omitempty"`
+	}
+
+	logger, ok := r.Context().Value(loggerKey).(*slog.Logger)
+	if !ok {
+		logger = slog.Default()
+	}
+
+	switch r.Method {
+	case "GET":
+		var response Response
+		ok, err := nbrew.getSession(r, "flash", &response)
+		if err != nil {
+			logger.Error(err.Error())
+		} else if !ok {
+			response.ParentFolder = r.URL.Query().Get("parent_folder")
+		}
+		nbrew.clearSession(w, r, "flash")
+		if response.ParentFolder != "" {
+			response.ParentFolder = strings.Trim(path.Clean(response.ParentFolder), "/")
+		}
+
+		funcMap := map[string]any{
+			"join":       path.Join,
+			"username":   func() string { return username },
+			"referer":    func() string { return r.Referer() },
+			"sitePrefix": func() string { return sitePrefix },
+			"imagesOnly": func() bool {
+				return response.ParentFolder == "site/images" || strings.HasPrefix(response.ParentFolder, "site/images/")
+			},
+		}
+		tmpl, err := template.New("upload.html").Funcs(funcMap).ParseFS(rootFS, "upload.html")
+		if err != nil {
+			logger.Error(err.Error())
+			internalServerError(w, r, err)
+			return
+		}
+		buf := bufPool.Get().(*bytes.Buffer)
+		buf.Reset()
+		defer bufPool.Put(buf)
+		err = tmpl.Execute(buf, &response)
+		if err != nil {
+			logger.Error(err.Error())
+			internalServerError(w, r, err)
+			return
+		}
+		w.Header().Add("Content-Security-Policy", defaultContentSecurityPolicy)
+		buf.WriteTo(w)
+	case "POST":
+		writeResponse := func(w http.ResponseWriter, r *http.Request, response Response) {
+			accept, _, _ := mime.ParseMediaType(r.Header.Get("Accept"))
+			if accept == "application/json" {
+				w.Header().Set("Content-Type", "application/json")
+				b, err := json.Marshal(&response)
+				if err != nil {
+					logger.Error(err.Error())
+					internalServerError(w, r, err)
+					return
+				}
+				w.Write(b)
+				return
+			}
+			if len(response.Files) == 0 {
+				err := nbrew.setSession(w, r, "flash", &response)
+				if err != nil {
+					logger.Error(err.Error())
+					internalServerError(w, r, err)
+					return
+				}
+				http.Redirect(w, r, r.URL.String(), http.StatusFound)
+				return
+			}
+			// Some files may have been uploaded even if others failed, so
+			// the errors are shown alongside the uploaded files.
+			alerts := url.Values{
+				"success": []string{fmt.Sprintf("Uploaded %d file(s): %s", len(response.Files), template.HTMLEscapeString(strings.Join(response.Files, ", ")))},
+			}
+			for _, errmsgs := range response.Errors {
+				for _, errmsg := range errmsgs {
+					alerts.Add("danger", template.HTMLEscapeString(errmsg))
+				}
+			}
+			err := nbrew.setSession(w, r, "flash", map[string]any{
+				"alerts": alerts,
+			})
+			if err != nil {
+				logger.Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+			http.Redirect(w, r, nbrew.Scheme+nbrew.AdminDomain+"/"+path.Join("admin", sitePrefix, response.ParentFolder)+"/", http.StatusFound)
+		}
+
+		contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if contentType != "multipart/form-data" {
+			http.Error(w, "415 Unsupported Media Type", http.StatusUnsupportedMediaType)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxUploadRequestSize)
+		reader, err := r.MultipartReader()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("400 Bad Request: %s", err), http.StatusBadRequest)
+			return
+		}
+
+		response := Response{
+			ParentFolder: r.URL.Query().Get("parent_folder"),
+			Errors:       make(url.Values),
+		}
+		// checkParentFolder validates the parent folder once, right before
+		// the first file is written.
+		parentFolderChecked := false
+		checkParentFolder := func() error {
+			if parentFolderChecked {
+				return nil
+			}
+			parentFolderChecked = true
+			response.ParentFolder = strings.Trim(path.Clean(response.ParentFolder), "/")
+			if !isUploadFolder(response.ParentFolder) {
+				response.Errors.Add("parent_folder", "files can only be uploaded into site/images or site/themes")
+				return nil
+			}
+			fileInfo, err := fs.Stat(nbrew.FS, path.Join(sitePrefix, response.ParentFolder))
+			if err != nil {
+				if errors.Is(err, fs.ErrNotExist) {
+					response.Errors.Add("parent_folder", "folder does not exist")
+					return nil
+				}
+				return err
+			}
+			if !fileInfo.IsDir() {
+				response.Errors.Add("parent_folder", "not a folder")
+			}
+			return nil
+		}
+		// The preconditions are checked for each file right before it is
+		// written, since the files are streamed in one at a time.
+		preconditionFailed := false
+		tooLargeErrmsg := fmt.Sprintf("upload is too large (max %d MB in total)", maxUploadRequestSize>>20)
+	loop:
+		for {
+			part, err := reader.NextPart()
+			if err != nil {
+				if errors.Is(err, io.EOF) {
+					break
+				}
+				var maxBytesErr *http.MaxBytesError
+				if errors.As(err, &maxBytesErr) {
+					response.Errors.Add("", tooLargeErrmsg)
+					break
+				}
+				http.Error(w, fmt.Sprintf("400 Bad Request: %s", err), http.StatusBadRequest)
+				return
+			}
+			switch part.FormName() {
+			case "parent_folder":
+				if parentFolderChecked {
+					break
+				}
+				var b strings.Builder
+				_, err = io.Copy(&b, io.LimitReader(part, 1024))
+				if err != nil {
+					http.Error(w, fmt.Sprintf("400 Bad Request: %s", err), http.StatusBadRequest)
+					return
+				}
+				response.ParentFolder = b.String()
+			case "file":
+				if part.FileName() == "" {
+					break
+				}
+				err = checkParentFolder()
+				if err != nil {
+					logger.Error(err.Error())
+					internalServerError(w, r, err)
+					return
+				}
+				if len(response.Errors["parent_folder"]) > 0 {
+					break
+				}
+				name, errmsg, err := nbrew.uploadFile(r, sitePrefix, response.ParentFolder, part.FileName(), part)
+				if err != nil {
+					if errors.Is(err, errPreconditionFailed) {
+						preconditionFailed = true
+						response.Errors.Add("files", fmt.Sprintf("%s: precondition failed", part.FileName()))
+						break
+					}
+					var maxBytesErr *http.MaxBytesError
+					if errors.As(err, &maxBytesErr) {
+						response.Errors.Add("", tooLargeErrmsg)
+						break loop
+					}
+					logger.Error(err.Error())
+					internalServerError(w, r, err)
+					return
+				}
+				if errmsg != "" {
+					response.Errors.Add("files", errmsg)
+					break
+				}
+				response.Files = append(response.Files, name)
+			}
+			part.Close()
+		}
+		if !parentFolderChecked {
+			err = checkParentFolder()
+			if err != nil {
+				logger.Error(err.Error())
+				internalServerError(w, r, err)
+				return
+			}
+			if len(response.Errors) == 0 {
+				response.Errors.Add("", "no files uploaded")
+			}
+		}
+		if preconditionFailed && len(response.Files) == 0 {
+			http.Error(w, "412 Precondition Failed", http.StatusPreconditionFailed)
+			return
+		}
+		if len(response.Errors) == 0 {
+			response.Errors = nil
+		}
+		if len(response.Files) > 0 {
+			names := make([]string, len(response.Files))
+			for i, name := range response.Files {
+				names[i] = path.Join(response.ParentFolder, name)
+			}
+			err = nbrew.generate(r.Context(), sitePrefix, names...)
+			if err != nil {
+				logger.Error(err.Error())
+			}
+		}
+		writeResponse(w, r, response)
+	default:
+		http.Error(w, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// uploadFile streams a single uploaded file into the parent folder. If the
+// file is rejected, a non-empty errmsg describing why is returned instead of
+// an error. If the preconditions of the request do not hold for the file it
+// would overwrite, errPreconditionFailed is returned.
+func (nbrew *Notebrew) uploadFile(r *http.Request, sitePrefix, parentFolder, filename string, file io.Reader) (name, errmsg string, err error) {
+	name = uploadName(filename)
+	if name == "" {
+		return "", fmt.Sprintf("%s: invalid file name", filename), nil
+	}
+	if errmsgs := validateName(name); len(errmsgs) > 0 {
+		return "", fmt.Sprintf("%s: %s", filename, strings.Join(errmsgs, ", ")), nil
+	}
+	ext := path.Ext(name)
+	typ, ok := uploadTypes[ext]
+	if !ok || (strings.HasPrefix(parentFolder, "site/images") && !isImageExt(ext)) {
+		return "", fmt.Sprintf("%s: file type not allowed", filename), nil
+	}
+
+	// Sniff the first 512 bytes (all that http.DetectContentType looks at)
+	// to make sure the contents match the extension.
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return "", "", err
+	}
+	head = head[:n]
+	detectedType, _, _ := mime.ParseMediaType(http.DetectContentType(head))
+	matched := false
+	for _, contentType := range typ.ContentTypes {
+		if detectedType == contentType || (strings.HasSuffix(contentType, "/") && strings.HasPrefix(detectedType, contentType)) {
+			matched = true
+			break
+		}
+	}
+	if !matched {
+		return "", fmt.Sprintf("%s: contents (%s) do not match the file extension", filename, detectedType), nil
+	}
+
+	filePath := path.Join(sitePrefix, parentFolder, name)
+	ok, err = checkPreconditions(nbrew.FS, r, filePath)
+	if err != nil {
+		return "", "", err
+	}
+	if !ok {
+		return "", "", errPreconditionFailed
+	}
+	_, err = fs.Stat(nbrew.FS, filePath)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return "", "", err
+	}
+	isNewFile := err != nil
+	err = nbrew.writeFile(context.Background(), sitePrefix, path.Join(parentFolder, name), &maxSizeReader{
+		R: io.MultiReader(bytes.NewReader(head), file),
+		N: typ.MaxSize,
+	})
+	if err != nil {
+		// Don't leave a partially written new file behind (LocalFS never
+		// does, but other implementations of FS might).
+		if isNewFile {
+			_ = nbrew.FS.Remove(filePath)
+		}
+		if errors.Is(err, errFileTooLarge) {
+			return "", fmt.Sprintf("%s: file too large (max %d MB)", filename, typ.MaxSize>>20), nil
+		}
+		return "", "", err
+	}
+	return name, "", nil
+}